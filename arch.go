@@ -4,8 +4,13 @@ import (
 	"bytes"
 	"encoding/xml"
 	"fmt"
+	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 type Set struct {
@@ -28,59 +33,391 @@ type ContextData struct {
 	TrackSet TrackedSet `xml:"tracked_set"`
 }
 
+// SpecAddress is an address in a spec file, written as an optional space name
+// followed by a hexadecimal offset, e.g. "INTMEM:20" or "0xfe0a". An empty
+// Space refers to the default code space.
+type SpecAddress struct {
+	Space  string
+	Offset uint64
+}
+
+func (a *SpecAddress) UnmarshalXMLAttr(attr xml.Attr) error {
+	val := attr.Value
+	a.Space = ""
+	if idx := strings.LastIndex(val, ":"); idx != -1 {
+		a.Space = val[:idx]
+		val = val[idx+1:]
+	}
+
+	off, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(val), "0x"), 16, 64)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %v", attr.Value, err)
+	}
+
+	a.Offset = off
+	return nil
+}
+
+// SpecUint is an unsigned number in a spec file, in decimal or hexadecimal.
+type SpecUint uint64
+
+func (u *SpecUint) UnmarshalXMLAttr(attr xml.Attr) error {
+	v, err := strconv.ParseUint(attr.Value, 0, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %q: %v", attr.Value, err)
+	}
+
+	*u = SpecUint(v)
+	return nil
+}
+
+type ProgramCounter struct {
+	Register string `xml:"register,attr"`
+}
+
+type RegisterData struct {
+	Name            string `xml:"name,attr"`
+	Group           string `xml:"group,attr"`
+	Hidden          bool   `xml:"hidden,attr"`
+	VectorLaneSizes string `xml:"vector_lane_sizes,attr"`
+	Rename          string `xml:"rename,attr"`
+	Alias           string `xml:"alias,attr"`
+}
+
+type DefaultSymbol struct {
+	Name     string      `xml:"name,attr"`
+	Address  SpecAddress `xml:"address,attr"`
+	Entry    bool        `xml:"entry,attr"`
+	Type     string      `xml:"type,attr"`
+	Volatile bool        `xml:"volatile,attr"`
+}
+
+type MemoryBlock struct {
+	Name              string       `xml:"name,attr"`
+	StartAddress      SpecAddress  `xml:"start_address,attr"`
+	Length            SpecUint     `xml:"length,attr"`
+	Initialized       bool         `xml:"initialized,attr"`
+	Mode              string       `xml:"mode,attr"`
+	BitMappedAddress  *SpecAddress `xml:"bit_mapped_address,attr"`
+	ByteMappedAddress *SpecAddress `xml:"byte_mapped_address,attr"`
+}
+
 type ProcessorSpec struct {
-	ContextData ContextData `xml:"context_data"`
+	ProgramCounter      ProgramCounter  `xml:"programcounter"`
+	ContextData         ContextData     `xml:"context_data"`
+	RegisterData        []RegisterData  `xml:"register_data>register"`
+	IncidentalCopy      StorageList     `xml:"incidentalcopy"`
+	DefaultSymbols      []DefaultSymbol `xml:"default_symbols>symbol"`
+	DefaultMemoryBlocks []MemoryBlock   `xml:"default_memory_blocks>memory_block"`
+}
+
+// LookupSymbol returns the default symbol placed at the given address. An
+// empty space matches symbols declared without an explicit space.
+func (ps *ProcessorSpec) LookupSymbol(space string, offset uint64) (*DefaultSymbol, bool) {
+	for i := range ps.DefaultSymbols {
+		sym := &ps.DefaultSymbols[i]
+		if sym.Address.Offset == offset && strings.EqualFold(sym.Address.Space, space) {
+			return sym, true
+		}
+	}
+
+	return nil, false
+}
+
+// annotateRegisters fills in the register information declared by the
+// processor spec on registers reported by the SLA.
+func (ps *ProcessorSpec) annotateRegisters(regs []*Register) {
+	data := make(map[string]*RegisterData, len(ps.RegisterData))
+	for i := range ps.RegisterData {
+		data[strings.ToLower(ps.RegisterData[i].Name)] = &ps.RegisterData[i]
+	}
+
+	for _, reg := range regs {
+		reg.IsProgramCounter = strings.EqualFold(reg.Name, ps.ProgramCounter.Register)
+
+		if rd, ok := data[strings.ToLower(reg.Name)]; ok {
+			reg.Group = rd.Group
+			reg.Hidden = rd.Hidden
+			reg.VectorLaneSizes = nil
+			for _, lane := range strings.Split(rd.VectorLaneSizes, ",") {
+				if size, err := strconv.Atoi(strings.TrimSpace(lane)); err == nil {
+					reg.VectorLaneSizes = append(reg.VectorLaneSizes, size)
+				}
+			}
+		}
+	}
+}
+
+type ExternalName struct {
+	Tool string `xml:"tool,attr"`
+	Name string `xml:"name,attr"`
 }
 
 type ArchitectureLanguage struct {
-	Description    string
-	LanguageID     string
+	Description     string
+	LanguageID      string
+	Processor       string
+	Endian          string
+	Size            int
+	Variant         string
+	Version         string
+	ManualIndexFile string
+	Deprecated      bool
+	ExternalNames   []ExternalName
+
+	// ProcessorSpecs, Sla and the Spec of each compiler are only populated
+	// once the language is loaded, see Load.
 	ProcessorSpecs ProcessorSpec
+	Compilers      []Compiler
 	Sla            []byte
+
+	family    *processorFamily
+	pspecFile string
+	slaFile   string
+	loadOnce  sync.Once
+	loadErr   error
+
+	slaOnce sync.Once
+	sla     *slaInfo
+	slaErr  error
+}
+
+// IsBigEndian reports whether the language is big endian.
+func (al *ArchitectureLanguage) IsBigEndian() bool {
+	return al.Endian == "big"
+}
+
+// ExternalNamesFor returns the names the given tool uses for the language.
+func (al *ArchitectureLanguage) ExternalNamesFor(tool string) []string {
+	var names []string
+	for _, en := range al.ExternalNames {
+		if strings.EqualFold(en.Tool, tool) {
+			names = append(names, en.Name)
+		}
+	}
+	return names
 }
 
+// ArchLanguages lists the registered languages, like Languages.
+//
+// Deprecated: use Languages, LookupLanguage or FindLanguages. ArchLanguages is
+// replaced, not modified, when processors register, so reading it while
+// another goroutine registers one is a data race, and it does not list the
+// processors of GOPCODE_PROCESSORS until one of those functions is called.
+var ArchLanguages []*ArchitectureLanguage
+
 var (
-	ArchLanguages []ArchitectureLanguage
+	// languages holds every registered language, guarded by registryMu. Callers
+	// outside the package use Languages, which returns a snapshot.
+	languages []*ArchitectureLanguage
+	// languageIndex maps a language ID to its index in languages, so that a
+	// later registration of the same ID replaces the earlier one.
+	languageIndex = map[string]int{}
+
+	registryMu sync.RWMutex
+	envOnce    sync.Once
+
+	// errors met while registering processors, reported when a language
+	// cannot be found
+	indexErrors []error
 )
 
+type compilerDef struct {
+	Name string `xml:"name,attr"`
+	Spec string `xml:"spec,attr"`
+	ID   string `xml:"id,attr"`
+}
+
 type languageDef struct {
-	Processor   string `xml:"processor,attr"`
-	Endian      string `xml:"endian,attr"`
-	Size        string `xml:"size,attr"`
-	Variant     string `xml:"variant,attr"`
-	Version     string `xml:"version,attr"`
-	SLAFile     string `xml:"slafile,attr"`
-	PSpec       string `xml:"processorspec,attr"`
-	ManualIdx   string `xml:"manualindexfile,attr"`
-	ID          string `xml:"id,attr"`
-	Description string `xml:"description"`
+	Processor     string         `xml:"processor,attr"`
+	Endian        string         `xml:"endian,attr"`
+	Size          string         `xml:"size,attr"`
+	Variant       string         `xml:"variant,attr"`
+	Version       string         `xml:"version,attr"`
+	SLAFile       string         `xml:"slafile,attr"`
+	PSpec         string         `xml:"processorspec,attr"`
+	ManualIdx     string         `xml:"manualindexfile,attr"`
+	ID            string         `xml:"id,attr"`
+	Deprecated    bool           `xml:"deprecated,attr"`
+	Description   string         `xml:"description"`
+	Compilers     []compilerDef  `xml:"compiler"`
+	ExternalNames []ExternalName `xml:"external_name"`
 }
 
 type archLanguages struct {
 	Langs []languageDef `xml:"language"`
 }
 
-func init() {
-	archs, err := ProcessorsFS.ReadDir("processors")
+// processorFamily is a processor directory such as processors/x86. Its files
+// are only read once one of its languages is loaded.
+type processorFamily struct {
+	name string
+	fsys fs.FS
+
+	mu     sync.Mutex
+	cspecs map[string]*CompilerSpec
+
+	opinionsOnce sync.Once
+	opinionList  []*Opinion
+	opinionsErr  error
+}
+
+func (pf *processorFamily) readFile(name string) ([]byte, error) {
+	return fs.ReadFile(pf.fsys, path.Join("data/languages", name))
+}
+
+// compilerSpec parses a cspec once, as they are shared between the languages
+// of a family.
+func (pf *processorFamily) compilerSpec(specFile string) (*CompilerSpec, error) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if cs, ok := pf.cspecs[specFile]; ok {
+		return cs, nil
+	}
+
+	data, err := pf.readFile(specFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", specFile, err)
+	}
+
+	var cs CompilerSpec
+	if err := unmarshalSpec(data, &cs); err != nil {
+		return nil, fmt.Errorf("could not unmarshal %s: %v", specFile, err)
+	}
+
+	pf.cspecs[specFile] = &cs
+	return &cs, nil
+}
+
+// RegisterProcessor adds the languages of a processor family to the registry.
+// The file system must be rooted at the family directory, i.e. contain
+// data/languages with the ldefs, pspec, cspec and sla files. Only the ldefs
+// files are read here; the rest is loaded when a context is created. The
+// families shipped with gopcode register themselves when their package under
+// github.com/dzonerzy/gopcode/processors is imported.
+func RegisterProcessor(name string, fsys fs.FS) error {
+	if err := indexArchitecture(name, fsys); err != nil {
+		registryMu.Lock()
+		indexErrors = append(indexErrors, err)
+		registryMu.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// RegisterProcessorsFS registers every processor family found in the top level
+// directories of fsys, laid out like Ghidra/Processors in a Ghidra install:
+// <family>/data/languages/*.ldefs. Families that fail to register are skipped
+// and the first error is returned.
+func RegisterProcessorsFS(fsys fs.FS) error {
+	entries, err := fs.ReadDir(fsys, ".")
 	if err != nil {
-		panic("could not read processors directory")
+		return fmt.Errorf("could not read processors directory: %v", err)
+	}
+
+	var firstErr error
+	found := false
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		if info, err := fs.Stat(fsys, path.Join(entry.Name(), "data/languages")); err != nil || !info.IsDir() {
+			continue
+		}
+
+		sub, err := fs.Sub(fsys, entry.Name())
+		if err == nil {
+			err = RegisterProcessor(entry.Name(), sub)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		found = true
 	}
 
-	for _, arch := range archs {
-		processArchitecture(arch.Name())
+	if !found {
+		return fmt.Errorf("no processor families found")
 	}
+
+	return firstErr
 }
 
-func processArchitecture(archName string) {
-	files, err := ProcessorsFS.ReadDir(fmt.Sprintf("processors/%s/data/languages", archName))
+// RegisterProcessorsDir registers processor families from a directory on disk.
+// The directory may be a Ghidra install, its Ghidra/Processors directory or a
+// single processor family such as Ghidra/Processors/x86.
+func RegisterProcessorsDir(dir string) error {
+	if info, err := os.Stat(filepath.Join(dir, "Ghidra", "Processors")); err == nil && info.IsDir() {
+		dir = filepath.Join(dir, "Ghidra", "Processors")
+	}
+
+	if info, err := os.Stat(filepath.Join(dir, "data", "languages")); err == nil && info.IsDir() {
+		return RegisterProcessor(filepath.Base(filepath.Clean(dir)), os.DirFS(dir))
+	}
+
+	if err := RegisterProcessorsFS(os.DirFS(dir)); err != nil {
+		return fmt.Errorf("%s: %v", dir, err)
+	}
+
+	return nil
+}
+
+// registerEnvProcessors registers the directories listed in the
+// GOPCODE_PROCESSORS environment variable. It runs the first time the registry
+// is queried, after the processor packages registered themselves, so that the
+// languages found there take precedence over the embedded ones.
+func registerEnvProcessors() {
+	for _, dir := range filepath.SplitList(os.Getenv("GOPCODE_PROCESSORS")) {
+		if dir == "" {
+			continue
+		}
+
+		if err := RegisterProcessorsDir(dir); err != nil {
+			registryMu.Lock()
+			indexErrors = append(indexErrors, err)
+			registryMu.Unlock()
+		}
+	}
+}
+
+// indexArchitecture registers the languages described by the ldefs files of a
+// processor family. Only the ldefs files are read.
+func indexArchitecture(archName string, fsys fs.FS) error {
+	files, err := fs.ReadDir(fsys, "data/languages")
 	if err != nil {
-		panic(fmt.Sprintf("could not read processors/%s/data/languages", archName))
+		return fmt.Errorf("could not read %s/data/languages: %v", archName, err)
+	}
+
+	family := &processorFamily{
+		name:   archName,
+		fsys:   fsys,
+		cspecs: map[string]*CompilerSpec{},
 	}
 
-	ldefs := filterLdefFiles(files)
-	for _, ldef := range ldefs {
-		processLdefFile(archName, ldef)
+	var langs []*ArchitectureLanguage
+	for _, ldef := range filterLdefFiles(files) {
+		l, err := family.processLdefFile(ldef)
+		if err != nil {
+			return err
+		}
+		langs = append(langs, l...)
+	}
+
+	registryMu.Lock()
+	for _, al := range langs {
+		if i, ok := languageIndex[al.LanguageID]; ok {
+			languages[i] = al
+			continue
+		}
+		languageIndex[al.LanguageID] = len(languages)
+		languages = append(languages, al)
 	}
+	ArchLanguages = append([]*ArchitectureLanguage(nil), languages...)
+	registryMu.Unlock()
+
+	return nil
 }
 
 func filterLdefFiles(files []os.DirEntry) []string {
@@ -93,47 +430,178 @@ func filterLdefFiles(files []os.DirEntry) []string {
 	return ldefs
 }
 
-func processLdefFile(archName, ldef string) {
-	langs, err := ProcessorsFS.ReadFile(fmt.Sprintf("processors/%s/data/languages/%s", archName, ldef))
+func (pf *processorFamily) processLdefFile(ldef string) ([]*ArchitectureLanguage, error) {
+	langs, err := pf.readFile(ldef)
 	if err != nil {
-		panic(fmt.Sprintf("could not read %s.ldefs", archName))
-	}
-
-	if bytes.Contains(langs, []byte("version=\"1.1\"")) {
-		langs = bytes.ReplaceAll(langs, []byte("version=\"1.1\""), []byte("version=\"1.0\""))
+		return nil, fmt.Errorf("could not read %s: %v", ldef, err)
 	}
 
 	var l archLanguages
-	if err := xml.Unmarshal(langs, &l); err != nil {
-		panic(fmt.Sprintf("could not unmarshal %s.ldefs: %v", archName, err))
+	if err := unmarshalSpec(langs, &l); err != nil {
+		return nil, fmt.Errorf("could not unmarshal %s: %v", ldef, err)
 	}
 
+	var als []*ArchitectureLanguage
 	for _, lang := range l.Langs {
-		processLanguage(archName, lang)
+		als = append(als, pf.processLanguage(lang))
 	}
+
+	return als, nil
 }
 
-func processLanguage(archName string, lang languageDef) {
-	var al ArchitectureLanguage
+func (pf *processorFamily) processLanguage(lang languageDef) *ArchitectureLanguage {
+	al := &ArchitectureLanguage{
+		family:    pf,
+		pspecFile: lang.PSpec,
+		slaFile:   lang.SLAFile,
+	}
 	al.Description = lang.Description
 	al.LanguageID = strings.ToLower(lang.ID)
+	al.Processor = lang.Processor
+	al.Endian = lang.Endian
+	al.Size, _ = strconv.Atoi(lang.Size)
+	al.Variant = lang.Variant
+	al.Version = lang.Version
+	al.ManualIndexFile = lang.ManualIdx
+	al.Deprecated = lang.Deprecated
+	al.ExternalNames = lang.ExternalNames
+
+	for _, comp := range lang.Compilers {
+		al.Compilers = append(al.Compilers, Compiler{
+			Name:     comp.Name,
+			ID:       comp.ID,
+			SpecFile: comp.Spec,
+		})
+	}
+
+	return al
+}
 
-	pspec, err := ProcessorsFS.ReadFile(fmt.Sprintf("processors/%s/data/languages/%s", archName, lang.PSpec))
+// Load reads the processor spec, compiler specs and SLA of the language. It is
+// called by NewContext and only reads the files the first time.
+func (al *ArchitectureLanguage) Load() error {
+	al.loadOnce.Do(func() {
+		al.loadErr = al.load()
+	})
+	return al.loadErr
+}
+
+func (al *ArchitectureLanguage) load() error {
+	pspec, err := al.family.readFile(al.pspecFile)
 	if err != nil {
-		panic(fmt.Sprintf("could not read %s", lang.PSpec))
+		return fmt.Errorf("could not read %s: %v", al.pspecFile, err)
 	}
 
 	var ps ProcessorSpec
-	if err := xml.Unmarshal(pspec, &ps); err != nil {
-		panic(fmt.Sprintf("could not unmarshal %s", lang.PSpec))
+	if err := unmarshalSpec(pspec, &ps); err != nil {
+		return fmt.Errorf("could not unmarshal %s: %v", al.pspecFile, err)
+	}
+
+	for i := range al.Compilers {
+		cs, err := al.family.compilerSpec(al.Compilers[i].SpecFile)
+		if err != nil {
+			return err
+		}
+		al.Compilers[i].Spec = cs
 	}
 
-	sla, err := ProcessorsFS.ReadFile(fmt.Sprintf("processors/%s/data/languages/%s", archName, lang.SLAFile))
+	sla, err := al.family.readFile(al.slaFile)
 	if err != nil {
-		panic(fmt.Sprintf("could not read %s", lang.SLAFile))
+		return fmt.Errorf("could not read %s: %v", al.slaFile, err)
 	}
 
 	al.ProcessorSpecs = ps
 	al.Sla = sla
-	ArchLanguages = append(ArchLanguages, al)
+	return nil
+}
+
+// Languages returns a snapshot of the registered languages. When several
+// sources register the same language ID, the last registration shadows the
+// earlier ones and only it is returned.
+func Languages() []*ArchitectureLanguage {
+	envOnce.Do(registerEnvProcessors)
+
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	langs := make([]*ArchitectureLanguage, len(languages))
+	copy(langs, languages)
+	return langs
+}
+
+// LookupLanguage returns the registered language with the given ID without
+// loading it. IDs are compared case-insensitively.
+func LookupLanguage(id string) (*ArchitectureLanguage, error) {
+	id = strings.ToLower(id)
+	for _, al := range Languages() {
+		if al.LanguageID == id {
+			return al, nil
+		}
+	}
+
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	if len(indexErrors) != 0 {
+		return nil, fmt.Errorf("language %s not found (%d processor families failed to register, first: %v)", id, len(indexErrors), indexErrors[0])
+	}
+
+	if len(languages) == 0 {
+		return nil, fmt.Errorf("language %s not found: no processor families are registered, import github.com/dzonerzy/gopcode/processors/all or the package of the family", id)
+	}
+
+	return nil, fmt.Errorf("language %s not found (is its processor family imported? see github.com/dzonerzy/gopcode/processors/all)", id)
+}
+
+// FindLanguages returns the languages matching the given processor, endianness
+// and size. Processor names are compared case-insensitively, endianness may be
+// given as "little"/"big" or "LE"/"BE", and empty or zero values match any
+// language.
+func FindLanguages(processor, endian string, size int) []*ArchitectureLanguage {
+	switch strings.ToLower(endian) {
+	case "le":
+		endian = "little"
+	case "be":
+		endian = "big"
+	}
+
+	var langs []*ArchitectureLanguage
+	for _, al := range Languages() {
+		if processor != "" && !strings.EqualFold(al.Processor, processor) {
+			continue
+		}
+		if endian != "" && !strings.EqualFold(al.Endian, endian) {
+			continue
+		}
+		if size != 0 && al.Size != size {
+			continue
+		}
+		langs = append(langs, al)
+	}
+
+	return langs
+}
+
+// LanguageByExternalName returns the first language that the given tool, e.g.
+// "gnu", "IDA-PRO" or "qemu", refers to by name.
+func LanguageByExternalName(tool, name string) (*ArchitectureLanguage, error) {
+	for _, al := range Languages() {
+		for _, en := range al.ExternalNames {
+			if strings.EqualFold(en.Tool, tool) && en.Name == name {
+				return al, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no language known to %s as %s", tool, name)
+}
+
+// unmarshalSpec decodes a spec file, downgrading XML 1.1 declarations which
+// encoding/xml refuses to parse.
+func unmarshalSpec(data []byte, v interface{}) error {
+	if bytes.Contains(data, []byte("version=\"1.1\"")) {
+		data = bytes.ReplaceAll(data, []byte("version=\"1.1\""), []byte("version=\"1.0\""))
+	}
+
+	return xml.Unmarshal(data, v)
 }
@@ -0,0 +1,525 @@
+// Package cfg builds control-flow graphs by recursive descent over the pcode
+// of a gopcode.Context.
+//
+// Starting from entry points, instructions are translated one at a time and
+// the direct targets of their BRANCH, CBRANCH and CALL ops in the code space
+// are followed; relative branches between the ops of an instruction, in the
+// const space, are resolved within the instruction. The instructions are
+// then split into basic blocks:
+//
+//	ctx, _ := gopcode.NewContext("x86:LE:64:default")
+//	g, err := cfg.Build(ctx, prog, prog.Entry)
+//	for _, b := range g.Blocks {
+//		for _, e := range b.Succs {
+//			fmt.Printf("0x%x -> 0x%x %s\n", b.Start, e.To.Start, e.Kind)
+//		}
+//	}
+//
+// A CALL ends its block, which gets a call edge to the callee and a return
+// edge to the instruction following the call: callees are assumed to return.
+// The targets of BRANCHIND and CALLIND ops are unknown unless a Builder's
+// Resolve function provides them; the others are listed in
+// Graph.Unresolved.
+package cfg
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/dzonerzy/gopcode"
+	"github.com/dzonerzy/gopcode/internal/word"
+)
+
+// defaultMaxInstructions bounds the instructions a Builder decodes when
+// MaxInstructions is 0.
+const defaultMaxInstructions = 1 << 20
+
+// defaultValidCode is the number of instructions FindFunctions validates
+// when a pattern does not tell.
+const defaultValidCode = 4
+
+// Source provides the bytes of the code, e.g. a loader.Program.
+type Source interface {
+	// Bytes returns the bytes from addr to the end of the memory holding
+	// it, nil when addr is not loaded.
+	Bytes(addr uint64) []byte
+}
+
+// Buffer is a Source holding code loaded at Base.
+type Buffer struct {
+	Base uint64
+	Data []byte
+}
+
+func (b Buffer) Bytes(addr uint64) []byte {
+	if addr < b.Base || addr-b.Base >= uint64(len(b.Data)) {
+		return nil
+	}
+	return b.Data[addr-b.Base:]
+}
+
+type EdgeKind int
+
+const (
+	// EdgeFallthrough goes to the next instruction.
+	EdgeFallthrough EdgeKind = iota
+	// EdgeBranch is an unconditional branch.
+	EdgeBranch
+	// EdgeConditional is a branch that may not be taken.
+	EdgeConditional
+	// EdgeCall goes from a call to the callee.
+	EdgeCall
+	// EdgeReturn goes from a call to the instruction the callee returns to.
+	EdgeReturn
+	// EdgeIndirect is a target of a BRANCHIND or CALLIND provided by
+	// Builder.Resolve.
+	EdgeIndirect
+)
+
+func (k EdgeKind) String() string {
+	switch k {
+	case EdgeFallthrough:
+		return "fallthrough"
+	case EdgeBranch:
+		return "branch"
+	case EdgeConditional:
+		return "conditional"
+	case EdgeCall:
+		return "call"
+	case EdgeReturn:
+		return "return"
+	case EdgeIndirect:
+		return "indirect"
+	}
+	return fmt.Sprintf("EdgeKind(%d)", int(k))
+}
+
+// Edge is a transfer of control between blocks.
+type Edge struct {
+	From *Block
+	To   *Block
+	Kind EdgeKind
+}
+
+// Block is a basic block, the instructions from Start to End, exclusive.
+type Block struct {
+	Start        uint64
+	End          uint64
+	Instructions []*gopcode.Instruction
+	Succs        []*Edge
+	Preds        []*Edge
+}
+
+// Last returns the last instruction of the block.
+func (b *Block) Last() *gopcode.Instruction {
+	return b.Instructions[len(b.Instructions)-1]
+}
+
+// IndirectSite is a BRANCHIND or CALLIND op, Call telling which.
+type IndirectSite struct {
+	Addr        uint64
+	Instruction *gopcode.Instruction
+	Op          gopcode.PcodeOp
+	Call        bool
+
+	// Targets holds the targets returned by Builder.Resolve.
+	Targets []uint64
+
+	// Block is the block ending with the instruction, set once the graph
+	// is built.
+	Block *Block
+}
+
+// Graph is the control-flow graph of the code reachable from its entries.
+type Graph struct {
+	Blocks    []*Block // sorted by address
+	Functions []uint64 // the entries and the call targets, sorted
+
+	// Names holds the names of the functions the Builder knows, e.g. the
+	// imports PLT stubs jump to.
+	Names map[uint64]string
+
+	// Indirects lists the indirect branches and calls, Unresolved the
+	// ones without targets.
+	Indirects  []*IndirectSite
+	Unresolved []*IndirectSite
+
+	// Errors holds the addresses that could not be decoded, such as
+	// targets out of the Source.
+	Errors map[uint64]error
+}
+
+// Block returns the block starting at addr.
+func (g *Graph) Block(addr uint64) (*Block, bool) {
+	i := sort.Search(len(g.Blocks), func(i int) bool {
+		return g.Blocks[i].Start >= addr
+	})
+	if i < len(g.Blocks) && g.Blocks[i].Start == addr {
+		return g.Blocks[i], true
+	}
+	return nil, false
+}
+
+// BlockAt returns a block containing the instruction at addr.
+func (g *Graph) BlockAt(addr uint64) (*Block, bool) {
+	for _, b := range g.Blocks {
+		for _, instr := range b.Instructions {
+			if instr.Address == addr {
+				return b, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Builder builds control-flow graphs.
+type Builder struct {
+	Context *gopcode.Context
+	Source  Source
+
+	// SkipCalls leaves out the callees, their blocks are not built.
+	SkipCalls bool
+
+	// Resolve, when set, returns the targets of an indirect branch or
+	// call, e.g. read from a jump table.
+	Resolve func(site *IndirectSite) []uint64
+
+	// Name, when set, returns the name of the function at addr, such as
+	// loader.Program.SymbolName, to fill Graph.Names.
+	Name func(addr uint64) (string, bool)
+
+	// MaxInstructions bounds the instructions decoded, 0 means 1<<20.
+	MaxInstructions int
+}
+
+// Build builds the graph of the code of src reachable from entries.
+func Build(ctx *gopcode.Context, src Source, entries ...uint64) (*Graph, error) {
+	b := &Builder{Context: ctx, Source: src}
+	return b.Build(entries...)
+}
+
+// target is an address an instruction transfers control to, call telling
+// whether it is a function.
+type target struct {
+	addr uint64
+	kind EdgeKind
+	call bool
+}
+
+// node is a decoded instruction and where it goes.
+type node struct {
+	instr   *gopcode.Instruction
+	targets []target
+	ends    bool // the instruction ends its block
+	sites   []*IndirectSite
+}
+
+// Build builds the graph of the code reachable from entries.
+func (b *Builder) Build(entries ...uint64) (*Graph, error) {
+	max := b.MaxInstructions
+	if max == 0 {
+		max = defaultMaxInstructions
+	}
+
+	g := &Graph{Names: map[uint64]string{}, Errors: map[uint64]error{}}
+	nodes := map[uint64]*node{}
+	leaders := map[uint64]bool{}
+	functions := map[uint64]bool{}
+
+	var work []uint64
+	push := func(addr uint64, leader bool) {
+		if leader {
+			leaders[addr] = true
+		}
+		work = append(work, addr)
+	}
+	for _, entry := range entries {
+		functions[entry] = true
+		push(entry, true)
+	}
+
+	for len(work) != 0 {
+		addr := work[len(work)-1]
+		work = work[:len(work)-1]
+		if _, ok := nodes[addr]; ok {
+			continue
+		}
+		if _, ok := g.Errors[addr]; ok {
+			continue
+		}
+		if len(nodes) >= max {
+			return nil, fmt.Errorf("more than %d instructions", max)
+		}
+
+		n, err := b.decode(addr)
+		if err != nil {
+			g.Errors[addr] = err
+			continue
+		}
+		nodes[addr] = n
+
+		for _, t := range n.targets {
+			if t.call {
+				functions[t.addr] = true
+				if b.SkipCalls {
+					continue
+				}
+			}
+			push(t.addr, t.kind != EdgeFallthrough || n.ends)
+		}
+	}
+
+	// a block runs from a leader until an instruction ending it or the
+	// next leader
+	blocks := map[uint64]*Block{}
+	for addr := range leaders {
+		n, ok := nodes[addr]
+		if !ok {
+			continue
+		}
+		blk := &Block{Start: addr}
+		for {
+			blk.Instructions = append(blk.Instructions, n.instr)
+			blk.End = n.instr.FallThrough
+			for _, site := range n.sites {
+				site.Block = blk
+			}
+			if n.ends || !n.instr.HasFallThrough || leaders[blk.End] {
+				break
+			}
+			if n, ok = nodes[blk.End]; !ok {
+				break
+			}
+		}
+		blocks[addr] = blk
+		g.Blocks = append(g.Blocks, blk)
+	}
+	sort.Slice(g.Blocks, func(i, j int) bool {
+		return g.Blocks[i].Start < g.Blocks[j].Start
+	})
+
+	for _, blk := range g.Blocks {
+		n := nodes[blk.Last().Address]
+		for _, t := range n.targets {
+			to, ok := blocks[t.addr]
+			if !ok {
+				continue
+			}
+			e := &Edge{From: blk, To: to, Kind: t.kind}
+			blk.Succs = append(blk.Succs, e)
+			to.Preds = append(to.Preds, e)
+		}
+		for _, site := range n.sites {
+			g.Indirects = append(g.Indirects, site)
+			if len(site.Targets) == 0 {
+				g.Unresolved = append(g.Unresolved, site)
+			}
+		}
+	}
+
+	for addr := range functions {
+		g.Functions = append(g.Functions, addr)
+		if b.Name == nil {
+			continue
+		}
+		if name, ok := b.Name(addr); ok {
+			g.Names[addr] = name
+		}
+	}
+	sort.Slice(g.Functions, func(i, j int) bool { return g.Functions[i] < g.Functions[j] })
+	return g, nil
+}
+
+// Validate reports whether the code at addr decodes by recursive descent:
+// the first n instructions reached, callees left out, or all of them when
+// fewer are reachable, decode within the Source.
+func (b *Builder) Validate(addr uint64, n int) bool {
+	_, ok := b.validate(addr, n)
+	return ok
+}
+
+// validate returns the addresses of the instructions validated.
+func (b *Builder) validate(addr uint64, n int) (map[uint64]bool, bool) {
+	seen := map[uint64]bool{}
+	work := []uint64{addr}
+	for len(work) != 0 && len(seen) < n {
+		addr := work[0]
+		work = work[1:]
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+
+		nd, err := b.decode(addr)
+		if err != nil {
+			return nil, false
+		}
+		for _, t := range nd.targets {
+			if !t.call {
+				work = append(work, t.addr)
+			}
+		}
+	}
+	return seen, true
+}
+
+// FindFunctions scans the code from base to the end of its memory for the
+// function starts of patterns, see gopcode.ArchitectureLanguage.Patterns,
+// and returns the ones Validate accepts, sorted. The instructions validated
+// are the validcode of the pattern when it is a number, else
+// defaultValidCode. Candidates within the code validated from a lower one
+// are left out.
+func (b *Builder) FindFunctions(patterns *gopcode.PatternList, base uint64) []uint64 {
+	var starts []uint64
+	covered := map[uint64]bool{}
+	for _, m := range patterns.FunctionStarts(b.Source.Bytes(base), base) {
+		if covered[m.Addr] {
+			continue
+		}
+
+		n, err := strconv.Atoi(m.Pattern.FuncStart.ValidCode)
+		if err != nil || n <= 0 {
+			n = defaultValidCode
+		}
+		code, ok := b.validate(m.Addr, n)
+		if !ok {
+			continue
+		}
+		for addr := range code {
+			covered[addr] = true
+		}
+		starts = append(starts, m.Addr)
+	}
+	return starts
+}
+
+// decode translates the instruction at addr and finds its targets.
+func (b *Builder) decode(addr uint64) (*node, error) {
+	data := b.Source.Bytes(addr)
+	if len(data) == 0 {
+		return nil, fmt.Errorf("address 0x%x is not loaded", addr)
+	}
+
+	it := b.Context.TranslateIter(data, addr)
+	if !it.Next() {
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("no instruction decoded at 0x%x", addr)
+	}
+	n := &node{instr: it.Instruction()}
+
+	// targets in other spaces than the one of the code, e.g. the io space
+	// of the Z80, are not followed
+	space := n.instr.Ops[0].Inputs[0].Space.Name
+	inCode := func(op gopcode.PcodeOp) bool {
+		return op.Inputs[0].Space.Name == space
+	}
+
+	flow := analyze(n.instr.Ops)
+	falls := n.instr.HasFallThrough
+
+	// a branch to the next instruction, such as the exit of a repeated
+	// string instruction, is the fallthrough
+	var branches []gopcode.PcodeOp
+	for _, op := range flow.branches {
+		if !inCode(op) || op.Inputs[0].Offset != n.instr.FallThrough {
+			branches = append(branches, op)
+		}
+	}
+	for _, op := range branches {
+		kind := EdgeBranch
+		if op.Opcode == gopcode.CPUI_CBRANCH || falls || len(branches) > 1 {
+			kind = EdgeConditional
+		}
+		if inCode(op) {
+			n.targets = append(n.targets, target{addr: op.Inputs[0].Offset, kind: kind})
+		}
+	}
+	returns := false
+	for _, op := range flow.calls {
+		returns = true
+		if inCode(op) {
+			n.targets = append(n.targets, target{addr: op.Inputs[0].Offset, kind: EdgeCall, call: true})
+		}
+	}
+	for _, op := range flow.indirects {
+		site := &IndirectSite{Addr: addr, Instruction: n.instr, Op: op, Call: op.Opcode == gopcode.CPUI_CALLIND}
+		returns = returns || site.Call
+		n.sites = append(n.sites, site)
+		if b.Resolve != nil {
+			site.Targets = b.Resolve(site)
+		}
+		for _, t := range site.Targets {
+			n.targets = append(n.targets, target{addr: t, kind: EdgeIndirect, call: site.Call})
+		}
+	}
+
+	n.ends = len(flow.branches) != 0 || len(flow.calls) != 0 || len(n.sites) != 0 || flow.returns || !falls
+	if falls {
+		kind := EdgeFallthrough
+		if returns {
+			kind = EdgeReturn
+		}
+		n.targets = append(n.targets, target{addr: n.instr.FallThrough, kind: kind})
+	}
+	return n, nil
+}
+
+// flow is what the ops of an instruction do to the control flow.
+type flow struct {
+	branches  []gopcode.PcodeOp // BRANCH and CBRANCH out of the instruction
+	calls     []gopcode.PcodeOp
+	indirects []gopcode.PcodeOp // BRANCHIND and CALLIND
+	returns   bool
+}
+
+// analyze walks the ops reachable from the first one, following the
+// relative branches of the const space.
+func analyze(ops []gopcode.PcodeOp) flow {
+	var f flow
+	seen := make([]bool, len(ops))
+	work := []int{0}
+	next := func(i int) {
+		if i >= 0 && i < len(ops) && !seen[i] {
+			work = append(work, i)
+		}
+	}
+
+	for len(work) != 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		if seen[i] {
+			continue
+		}
+		seen[i] = true
+
+		op := ops[i]
+		switch op.Opcode {
+		case gopcode.CPUI_BRANCH, gopcode.CPUI_CBRANCH:
+			if op.Opcode == gopcode.CPUI_CBRANCH {
+				next(i + 1)
+			}
+			dest := op.Inputs[0]
+			if dest.Space.Name == "const" {
+				next(i + int(word.SignExtend(dest.Offset, int(dest.Size))))
+			} else {
+				f.branches = append(f.branches, op)
+			}
+		case gopcode.CPUI_CALL:
+			f.calls = append(f.calls, op)
+			next(i + 1)
+		case gopcode.CPUI_CALLIND:
+			f.indirects = append(f.indirects, op)
+			next(i + 1)
+		case gopcode.CPUI_BRANCHIND:
+			f.indirects = append(f.indirects, op)
+		case gopcode.CPUI_RETURN:
+			f.returns = true
+		default:
+			next(i + 1)
+		}
+	}
+	return f
+}
@@ -0,0 +1,144 @@
+package cfg_test
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/dzonerzy/gopcode"
+	"github.com/dzonerzy/gopcode/cfg"
+	_ "github.com/dzonerzy/gopcode/processors/x86"
+)
+
+var code = cfg.Buffer{Base: 0x1000, Data: []byte{
+	0x55,       // 0x1000: push rbp
+	0x85, 0xff, // 0x1001: test edi, edi
+	0x74, 0x07, // 0x1003: je 0x100c
+	0xe8, 0x06, 0x00, 0x00, 0x00, // 0x1005: call 0x1010
+	0xeb, 0x01, // 0x100a: jmp 0x100d
+	0x90,       // 0x100c: nop
+	0x5d,       // 0x100d: pop rbp
+	0xc3,       // 0x100e: ret
+	0xcc,       // 0x100f: int3
+	0xf3, 0xa4, // 0x1010: rep movsb
+	0xff, 0xe0, // 0x1012: jmp rax
+}}
+
+func newContext(t *testing.T) *gopcode.Context {
+	ctx, err := gopcode.NewContext("x86:LE:64:default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ctx.Destroy)
+	return ctx
+}
+
+// edges lists the edges of g as "from->to kind", sorted.
+func edges(g *cfg.Graph) string {
+	var out []string
+	for _, b := range g.Blocks {
+		for _, e := range b.Succs {
+			out = append(out, fmt.Sprintf("%x->%x %s", e.From.Start, e.To.Start, e.Kind))
+		}
+	}
+	sort.Strings(out)
+	return strings.Join(out, ", ")
+}
+
+func TestBuild(t *testing.T) {
+	g, err := cfg.Build(newContext(t), code, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var starts []string
+	for _, b := range g.Blocks {
+		starts = append(starts, fmt.Sprintf("%x-%x", b.Start, b.End))
+	}
+	if got := strings.Join(starts, " "); got != "1000-1005 1005-100a 100a-100c 100c-100d 100d-100f 1010-1012 1012-1014" {
+		t.Errorf("blocks %s", got)
+	}
+
+	expected := "1000->1005 fallthrough, 1000->100c conditional, 1005->100a return, 1005->1010 call, " +
+		"100a->100d branch, 100c->100d fallthrough, 1010->1010 conditional, 1010->1012 fallthrough"
+	if got := edges(g); got != expected {
+		t.Errorf("edges\n got %s\nwant %s", got, expected)
+	}
+
+	if fmt.Sprintf("%x", g.Functions) != "[1000 1010]" {
+		t.Errorf("functions %x", g.Functions)
+	}
+	if len(g.Unresolved) != 1 || g.Unresolved[0].Addr != 0x1012 || g.Unresolved[0].Call || g.Unresolved[0].Block.Start != 0x1012 {
+		t.Errorf("unresolved %+v", g.Unresolved)
+	}
+	if b, ok := g.BlockAt(0x1001); !ok || b.Start != 0x1000 || len(b.Instructions) != 3 || b.Last().Mnemonic != "JZ" {
+		t.Errorf("block at 0x1001 = %+v", b)
+	}
+}
+
+func TestBuildResolve(t *testing.T) {
+	b := &cfg.Builder{
+		Context:   newContext(t),
+		Source:    code,
+		SkipCalls: true,
+		Resolve: func(site *cfg.IndirectSite) []uint64 {
+			return []uint64{0x100e}
+		},
+	}
+	g, err := b.Build(0x1000, 0x1012)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the indirect target splits the block of pop rbp; ret
+	if _, ok := g.Block(0x1010); ok {
+		t.Error("callee built with SkipCalls")
+	}
+	blk, ok := g.Block(0x100e)
+	if !ok || len(blk.Preds) != 2 {
+		t.Fatalf("block 0x100e = %+v", blk)
+	}
+	if !strings.Contains(edges(g), "1012->100e indirect") || len(g.Unresolved) != 0 {
+		t.Errorf("edges %s, unresolved %v", edges(g), g.Unresolved)
+	}
+	if fmt.Sprintf("%x", g.Functions) != "[1000 1010 1012]" {
+		t.Errorf("functions %x", g.Functions)
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	g, err := cfg.Build(newContext(t), cfg.Buffer{Base: 0x1000, Data: []byte{0xe9, 0xfb, 0x0f, 0x00, 0x00}}, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Blocks) != 1 || len(g.Blocks[0].Succs) != 0 || g.Errors[0x2000] == nil {
+		t.Errorf("blocks %+v, errors %v", g.Blocks, g.Errors)
+	}
+}
+
+func TestFindFunctions(t *testing.T) {
+	ctx := newContext(t)
+	al, err := gopcode.LookupLanguage(ctx.LanguageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patterns, err := al.Patterns("gcc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &cfg.Builder{Context: ctx, Source: cfg.Buffer{Base: 0x1000, Data: []byte{
+		0x31, 0xc0, 0xc3, // 0x1000: xor eax, eax; ret
+		0x0f, 0x1f, 0x40, 0x00, // 0x1003: nop
+		0x55, 0x48, 0x89, 0xe5, 0x48, 0x83, 0xec, 0x10, // 0x1007: push rbp; mov rbp, rsp; sub rsp, 0x10
+		0xc9, 0xc3, // 0x100f: leave; ret
+		0x55, 0x48, 0x89, 0xe5, // 0x1011: push rbp; mov rbp, rsp, then out of the buffer
+	}}}
+	if got := fmt.Sprintf("%x", b.FindFunctions(patterns, 0x1000)); got != "[1007]" {
+		t.Errorf("function starts %s", got)
+	}
+	if b.Validate(0x1011, 4) || !b.Validate(0x1011, 2) {
+		t.Error("code running out of the buffer validated")
+	}
+}
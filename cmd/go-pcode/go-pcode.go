@@ -8,6 +8,7 @@ import (
 	"regexp"
 
 	"github.com/dzonerzy/gopcode"
+	_ "github.com/dzonerzy/gopcode/processors/all"
 )
 
 var (
@@ -66,7 +67,7 @@ func main() {
 
 	if *disasm {
 		disas, err := ctx.Disassemble(b, 0x401000, 1024)
-		if err != nil {
+		if disas == nil {
 			log.Fatalf("failed to disassemble: %v", err)
 		}
 		defer disas.Destroy()
@@ -74,9 +75,12 @@ func main() {
 		for _, instr := range disas.Instructions {
 			fmt.Printf("0x%x: %s %s\n", instr.Address, instr.Mnemonic, instr.Body)
 		}
+		if err != nil {
+			log.Printf("disassembly stopped: %v", err)
+		}
 	} else if *translate {
 		trans, err := ctx.Translate(b, 0x401000, 1024, 0)
-		if err != nil {
+		if trans == nil {
 			log.Fatalf("failed to translate: %v", err)
 		}
 		defer trans.Destroy()
@@ -84,6 +88,9 @@ func main() {
 		for _, op := range trans.Ops {
 			fmt.Println(trans.Format(op))
 		}
+		if err != nil {
+			log.Printf("translation stopped: %v", err)
+		}
 	}
 
 }
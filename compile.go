@@ -0,0 +1,25 @@
+package gopcode
+
+import (
+	"io/fs"
+
+	"github.com/dzonerzy/gopcode/sleigh"
+)
+
+// SleighOptions are the options of CompileSleigh.
+type SleighOptions = sleigh.Options
+
+// CompileSleigh compiles the SLEIGH specification (.slaspec) at path in fsys
+// into the .sla bytes the languages load, so that a modified specification can
+// be used without a Ghidra install. The files the specification includes are
+// read from fsys, relative to the including file, and opts may give the
+// preprocessor defines, as sleigh -D does.
+//
+// The result is the same as the one of Ghidra's compiler. To use it, write it
+// next to the .slaspec as the .sla the ldefs file names and register the
+// processor with RegisterProcessor or RegisterProcessorsDir. Errors of the
+// specification are returned as a sleigh.ErrorList, each with its file and
+// line.
+func CompileSleigh(fsys fs.FS, path string, opts *SleighOptions) ([]byte, error) {
+	return sleigh.Compile(fsys, path, opts)
+}
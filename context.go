@@ -0,0 +1,145 @@
+package gopcode
+
+import (
+	"fmt"
+)
+
+// contextRange holds a context variable value for the addresses [start, end).
+type contextRange struct {
+	name       string
+	value      uint32
+	start, end uint64
+}
+
+// SetContextRange sets a context variable, e.g. ARM TMode, for the addresses
+// from start up to but not including end. Later ranges take precedence over
+// earlier ones where they overlap; outside of all ranges the default set with
+// SetVariableDefault applies. Translate and Disassemble split their input at
+// range boundaries so each instruction is decoded with the values of the range
+// it starts in.
+//
+// Context changes made by the instructions themselves (SLEIGH globalset, such
+// as the switch to Thumb at the target of an ARM blx) are applied as the
+// instructions are decoded, by Translate, TranslateIter and Disassemble alike,
+// and kept by the context for later calls. As in Ghidra, such a change holds
+// from its target up to the next address changed by an instruction, and there
+// it takes precedence over the ranges and defaults. GetContextValue does not
+// report these changes; a new Context starts without them.
+func (c *Context) SetContextRange(name string, value uint32, start, end uint64) error {
+	if start >= end {
+		return fmt.Errorf("invalid context range [0x%x, 0x%x)", start, end)
+	}
+
+	c._ctxRanges = append(c._ctxRanges, contextRange{name: name, value: value, start: start, end: end})
+	return nil
+}
+
+// ClearContextRanges removes every range set with SetContextRange.
+func (c *Context) ClearContextRanges() {
+	c._ctxRanges = nil
+}
+
+// GetContextValue returns the value of a context variable at the given address
+// and whether the variable has been set at all, either with SetContextRange or
+// as a default. Changes made by decoded instructions are not included.
+func (c *Context) GetContextValue(name string, addr uint64) (uint32, bool) {
+	for i := len(c._ctxRanges) - 1; i >= 0; i-- {
+		r := c._ctxRanges[i]
+		if r.name == name && addr >= r.start && addr < r.end {
+			return r.value, true
+		}
+	}
+
+	v, ok := c._ctxDefaults[name]
+	return v, ok
+}
+
+func (c *Context) hasContextRanges() bool {
+	return len(c._ctxRanges) != 0
+}
+
+// nextContextBreak returns the first range boundary after addr, or end.
+func (c *Context) nextContextBreak(addr, end uint64) uint64 {
+	next := end
+	for _, r := range c._ctxRanges {
+		if r.start > addr && r.start < next {
+			next = r.start
+		}
+		if r.end > addr && r.end < next {
+			next = r.end
+		}
+	}
+	return next
+}
+
+// applyContextAt sets every variable with ranges to its value at addr.
+func (c *Context) applyContextAt(addr uint64) {
+	applied := map[string]bool{}
+	for _, r := range c._ctxRanges {
+		if applied[r.name] {
+			continue
+		}
+		applied[r.name] = true
+
+		v, _ := c.GetContextValue(r.name, addr)
+		c.setVariable(r.name, v)
+	}
+}
+
+// restoreContextDefaults undoes applyContextAt.
+func (c *Context) restoreContextDefaults() {
+	for _, r := range c._ctxRanges {
+		c.setVariable(r.name, c._ctxDefaults[r.name])
+	}
+}
+
+// maxInstructionSpan bounds how far past its start address an instruction may
+// read, delay slots included. The native decoder reads at most 16 bytes per
+// instruction.
+const maxInstructionSpan = 64
+
+// segmentBytes returns the part of dat, mapped at base, to decode for the
+// segment [addr, segEnd). It extends past segEnd so that the last instruction
+// of the segment can cross the boundary, without handing the native decoder
+// the rest of the buffer for every segment.
+func segmentBytes(dat []byte, base, addr, segEnd uint64) []byte {
+	end := segEnd - base + maxInstructionSpan
+	if end > uint64(len(dat)) {
+		end = uint64(len(dat))
+	}
+	return dat[addr-base : end]
+}
+
+// walkContextSegments runs decode over the parts of [base, base+size) that
+// share the same context values. decode receives the address to start at, the
+// end of the segment and the number of instructions it may decode (0 meaning
+// no limit); it returns the address following the last instruction it kept,
+// how many instructions it kept and whether decoding is finished.
+func (c *Context) walkContextSegments(base uint64, size int, maxInstructions uint32, decode func(addr, segEnd uint64, max uint32) (uint64, uint32, bool, error)) error {
+	defer c.restoreContextDefaults()
+
+	addr, end := base, base+uint64(size)
+	for addr < end {
+		segEnd := c.nextContextBreak(addr, end)
+		c.applyContextAt(addr)
+
+		next, count, done, err := decode(addr, segEnd, maxInstructions)
+		if err != nil {
+			return err
+		}
+
+		if maxInstructions != 0 {
+			if count >= maxInstructions {
+				return nil
+			}
+			maxInstructions -= count
+		}
+
+		if done || next <= addr {
+			return nil
+		}
+		addr = next
+	}
+
+	return nil
+}
@@ -0,0 +1,229 @@
+package gopcode
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+)
+
+// Storage describes a storage location referenced by a compiler spec. It is
+// either a named register or an address in a space. Locations in the join
+// space are described by the list of registers they are made of.
+type Storage struct {
+	Register string
+	Space    string
+	Offset   int64
+	Size     int
+	Pieces   []string
+}
+
+func (s *Storage) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	*s = Storage{}
+
+	switch start.Name.Local {
+	case "register":
+		for _, attr := range start.Attr {
+			if attr.Name.Local == "name" {
+				s.Register = attr.Value
+			}
+		}
+	case "addr", "varnode":
+		for _, attr := range start.Attr {
+			switch {
+			case attr.Name.Local == "space":
+				s.Space = attr.Value
+			case attr.Name.Local == "offset":
+				off, err := parseOffset(attr.Value)
+				if err != nil {
+					return err
+				}
+				s.Offset = off
+			case attr.Name.Local == "size":
+				size, err := strconv.ParseInt(attr.Value, 0, 32)
+				if err != nil {
+					return fmt.Errorf("invalid size %q: %v", attr.Value, err)
+				}
+				s.Size = int(size)
+			case len(attr.Name.Local) > 5 && attr.Name.Local[:5] == "piece":
+				idx, err := strconv.Atoi(attr.Name.Local[5:])
+				if err != nil || idx < 1 {
+					continue
+				}
+				for len(s.Pieces) < idx {
+					s.Pieces = append(s.Pieces, "")
+				}
+				s.Pieces[idx-1] = attr.Value
+			}
+		}
+	}
+
+	return d.Skip()
+}
+
+// parseOffset accepts the decimal, hexadecimal and negative offsets found in
+// spec files. Large unsigned hex values wrap around to their two's complement.
+func parseOffset(val string) (int64, error) {
+	if v, err := strconv.ParseInt(val, 0, 64); err == nil {
+		return v, nil
+	}
+
+	v, err := strconv.ParseUint(val, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid offset %q: %v", val, err)
+	}
+
+	return int64(v), nil
+}
+
+type SpecValue struct {
+	Value int `xml:"value,attr"`
+}
+
+type SizeAlignment struct {
+	Size      int `xml:"size,attr"`
+	Alignment int `xml:"alignment,attr"`
+}
+
+type DataOrganization struct {
+	AbsoluteMaxAlignment    SpecValue       `xml:"absolute_max_alignment"`
+	MachineAlignment        SpecValue       `xml:"machine_alignment"`
+	DefaultAlignment        SpecValue       `xml:"default_alignment"`
+	DefaultPointerAlignment SpecValue       `xml:"default_pointer_alignment"`
+	PointerSize             SpecValue       `xml:"pointer_size"`
+	PointerShift            SpecValue       `xml:"pointer_shift"`
+	WCharSize               SpecValue       `xml:"wchar_size"`
+	CharSize                SpecValue       `xml:"char_size"`
+	ShortSize               SpecValue       `xml:"short_size"`
+	IntegerSize             SpecValue       `xml:"integer_size"`
+	LongSize                SpecValue       `xml:"long_size"`
+	LongLongSize            SpecValue       `xml:"long_long_size"`
+	FloatSize               SpecValue       `xml:"float_size"`
+	DoubleSize              SpecValue       `xml:"double_size"`
+	LongDoubleSize          SpecValue       `xml:"long_double_size"`
+	SizeAlignmentMap        []SizeAlignment `xml:"size_alignment_map>entry"`
+}
+
+// Alignment returns the alignment of a primitive of the given size according
+// to the size alignment map, falling back to the default alignment.
+func (d DataOrganization) Alignment(size int) int {
+	for _, e := range d.SizeAlignmentMap {
+		if e.Size == size {
+			return e.Alignment
+		}
+	}
+
+	return d.DefaultAlignment.Value
+}
+
+type StackPointer struct {
+	Register       string `xml:"register,attr"`
+	Space          string `xml:"space,attr"`
+	Growth         string `xml:"growth,attr"`
+	ReverseJustify bool   `xml:"reversejustify,attr"`
+}
+
+// GrowsNegative reports whether pushing onto the stack decrements the stack
+// pointer, which is the default when the spec does not say otherwise.
+func (s StackPointer) GrowsNegative() bool {
+	return s.Growth != "positive"
+}
+
+type ParamEntry struct {
+	MinSize   int     `xml:"minsize,attr"`
+	MaxSize   int     `xml:"maxsize,attr"`
+	Align     int     `xml:"align,attr"`
+	MetaType  string  `xml:"metatype,attr"`
+	Extension string  `xml:"extension,attr"`
+	Storage   Storage `xml:",any"`
+}
+
+type ParamGroup struct {
+	Entries []ParamEntry `xml:"pentry"`
+}
+
+type ParamList struct {
+	PointerMax   int          `xml:"pointermax,attr"`
+	KilledByCall bool         `xml:"killedbycall,attr"`
+	Entries      []ParamEntry `xml:"pentry"`
+	Groups       []ParamGroup `xml:"group"`
+}
+
+type StorageList struct {
+	Locations []Storage `xml:",any"`
+}
+
+// ExtraPop is the change of the stack pointer across a call, including the
+// return address. It is UnknownExtraPop when the compiler spec declares it as
+// "unknown"; the value matches the marker used by Ghidra.
+type ExtraPop int
+
+const UnknownExtraPop ExtraPop = 0x8000
+
+func (e *ExtraPop) UnmarshalXMLAttr(attr xml.Attr) error {
+	if attr.Value == "unknown" {
+		*e = UnknownExtraPop
+		return nil
+	}
+
+	v, err := strconv.Atoi(attr.Value)
+	if err != nil {
+		return fmt.Errorf("invalid extrapop %q: %v", attr.Value, err)
+	}
+
+	*e = ExtraPop(v)
+	return nil
+}
+
+type Prototype struct {
+	Name          string       `xml:"name,attr"`
+	ExtraPop      ExtraPop     `xml:"extrapop,attr"`
+	StackShift    int          `xml:"stackshift,attr"`
+	Strategy      string       `xml:"strategy,attr"`
+	Input         ParamList    `xml:"input"`
+	Output        ParamList    `xml:"output"`
+	Unaffected    StorageList  `xml:"unaffected"`
+	KilledByCall  StorageList  `xml:"killedbycall"`
+	LikelyTrash   StorageList  `xml:"likelytrash"`
+	ReturnAddress *StorageList `xml:"returnaddress"`
+}
+
+type CallFixupTarget struct {
+	Name string `xml:"name,attr"`
+}
+
+type CallFixup struct {
+	Name    string            `xml:"name,attr"`
+	Targets []CallFixupTarget `xml:"target"`
+	Body    string            `xml:"pcode>body"`
+}
+
+type CompilerSpec struct {
+	DataOrganization DataOrganization `xml:"data_organization"`
+	StackPointer     StackPointer     `xml:"stackpointer"`
+	ReturnAddress    StorageList      `xml:"returnaddress"`
+	DefaultPrototype Prototype        `xml:"default_proto>prototype"`
+	Prototypes       []Prototype      `xml:"prototype"`
+	CallFixups       []CallFixup      `xml:"callfixup"`
+}
+
+// Prototype returns the named prototype, including the default one.
+func (c *CompilerSpec) Prototype(name string) (*Prototype, bool) {
+	if c.DefaultPrototype.Name == name {
+		return &c.DefaultPrototype, true
+	}
+
+	for i := range c.Prototypes {
+		if c.Prototypes[i].Name == name {
+			return &c.Prototypes[i], true
+		}
+	}
+
+	return nil, false
+}
+
+type Compiler struct {
+	Name     string
+	ID       string
+	SpecFile string
+	Spec     *CompilerSpec
+}
@@ -17,16 +17,98 @@ type DisassemblyInstruction struct {
 }
 
 type PcodeDisassembly struct {
-	_disas       *C.PcodeDisassemblyC
+	_disas       []*C.PcodeDisassemblyC
 	Instructions []DisassemblyInstruction
 }
 
 func (p *PcodeDisassembly) Destroy() {
-	C.pcode_disassembly_free(p._disas)
+	for _, disas := range p._disas {
+		C.pcode_disassembly_free(disas)
+	}
+	p._disas = nil
 }
 
-// PcodeDisassemblyC *pcode_disassemble(PcodeContext *ctx, const char *bytes, unsigned int num_bytes, uint64_t address, unsigned int max_instructions);
 func pcode_disassemble(ctx *Context, dat []byte, baseAddress uint64, maxInstructions uint32) (*PcodeDisassembly, error) {
+	if !ctx.hasContextRanges() {
+		return pcode_disassemble_checked(ctx, dat, baseAddress, maxInstructions, baseAddress+uint64(len(dat)))
+	}
+
+	result := &PcodeDisassembly{}
+
+	err := ctx.walkContextSegments(baseAddress, len(dat), maxInstructions, func(addr, segEnd uint64, max uint32) (uint64, uint32, bool, error) {
+		disas, err := pcode_disassemble_checked(ctx, segmentBytes(dat, baseAddress, addr, segEnd), addr, max, segEnd)
+		if disas == nil {
+			return 0, 0, true, err
+		}
+		result._disas = append(result._disas, disas._disas...)
+
+		// keep the instructions starting inside the segment
+		next, kept := addr, len(disas.Instructions)
+		for i, instr := range disas.Instructions {
+			if instr.Address >= segEnd {
+				kept = i
+				break
+			}
+			next = instr.Address + instr.Length
+		}
+
+		result.Instructions = append(result.Instructions, disas.Instructions[:kept]...)
+
+		// the disassembly stopped on its own before reaching the next segment
+		return next, uint32(kept), err != nil || kept == len(disas.Instructions), err
+	})
+	if err != nil {
+		if _, ok := err.(*DecodeError); ok {
+			return result, err
+		}
+		result.Destroy()
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// pcode_disassemble_checked is the disassembly counterpart of
+// pcode_translate_checked.
+func pcode_disassemble_checked(ctx *Context, dat []byte, baseAddress uint64, maxInstructions uint32, limit uint64) (*PcodeDisassembly, error) {
+	if len(dat) == 0 {
+		return &PcodeDisassembly{}, newDecodeError(dat, baseAddress, DecodeTruncated)
+	}
+
+	commitContext(ctx, dat, baseAddress, maxInstructions)
+
+	// the native decoder reads zeros past the end of the input, so an
+	// instruction ending past it is truncated and any other stop is bad data
+	disas, err := pcode_disassemble_segment(ctx, dat, baseAddress, maxInstructions)
+	if err != nil {
+		return &PcodeDisassembly{}, newDecodeError(dat, baseAddress, DecodeBadData)
+	}
+
+	end := baseAddress + uint64(len(dat))
+	next, count := baseAddress, len(disas.Instructions)
+	if count != 0 {
+		last := disas.Instructions[count-1]
+		next = last.Address + last.Length
+
+		if next > end {
+			disas.Instructions = disas.Instructions[:count-1]
+			if last.Address >= limit {
+				// the caller only decodes up to limit
+				return disas, nil
+			}
+			return disas, newDecodeError(dat[last.Address-baseAddress:], last.Address, DecodeTruncated)
+		}
+	}
+
+	if next >= limit || (maxInstructions != 0 && uint32(count) >= maxInstructions) {
+		return disas, nil
+	}
+
+	return disas, newDecodeError(dat[next-baseAddress:], next, DecodeBadData)
+}
+
+// PcodeDisassemblyC *pcode_disassemble(PcodeContext *ctx, const char *bytes, unsigned int num_bytes, uint64_t address, unsigned int max_instructions);
+func pcode_disassemble_segment(ctx *Context, dat []byte, baseAddress uint64, maxInstructions uint32) (*PcodeDisassembly, error) {
 	data := unsafe.Pointer(&dat[0])
 	var disas *C.PcodeDisassemblyC = C.pcode_disassemble(ctx._ctx, (*C.char)(data), C.uint(len(dat)), C.ulonglong(baseAddress), C.uint(maxInstructions))
 
@@ -35,7 +117,7 @@ func pcode_disassemble(ctx *Context, dat []byte, baseAddress uint64, maxInstruct
 	}
 
 	var pcodeDis = &PcodeDisassembly{}
-	pcodeDis._disas = disas
+	pcodeDis._disas = []*C.PcodeDisassemblyC{disas}
 
 	for i := 0; i < int(disas.num_instructions); i++ {
 		instr := (*C.DisassemblyInstructionC)(unsafe.Pointer(uintptr(unsafe.Pointer(disas.instructions)) + uintptr(i)*unsafe.Sizeof(C.DisassemblyInstructionC{})))
@@ -0,0 +1,588 @@
+// Package emu executes the pcode of a gopcode.Context concretely.
+//
+// An Emulator keeps the contents of every address space the language uses
+// (registers, unique temporaries, ram, ...) and interprets the translated
+// ops one instruction at a time:
+//
+//	ctx, _ := gopcode.NewContext("x86:LE:32:default")
+//	e, _ := emu.New(ctx)
+//	e.Map(0x1000, 0x1000, emu.PermRX)
+//	e.Map(0x7000, 0x1000, emu.PermRW)
+//	e.WriteMemory(0x1000, code)
+//	e.WriteRegister("ESP", 0x8000)
+//	e.SetPC(0x1000)
+//	err := e.Run(0x1010)
+//
+// Varnodes larger than 8 bytes are evaluated with arbitrary precision. Code
+// is fetched from the emulated memory and translated one basic block at a
+// time, cached by address until the memory holding it is written.
+//
+// Hooks extend the emulation: HookUserOp implements CALLOTHER operations such
+// as syscall, HookCode, HookOp and HookMemory observe or alter the execution.
+package emu
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/dzonerzy/gopcode"
+	"github.com/dzonerzy/gopcode/internal/word"
+)
+
+// maxBlockBytes bounds the bytes fetched for the translation of a block.
+const maxBlockBytes = 256
+
+// instruction is a translated instruction and its ops.
+type instruction struct {
+	addr   uint64
+	length uint64
+	ops    []gopcode.PcodeOp
+}
+
+// block is a run of instructions translated together, up to the first
+// branch.
+type block struct {
+	start, end uint64
+	instrs     []*instruction
+}
+
+type Emulator struct {
+	ctx *gopcode.Context
+	pc  uint64
+
+	spaces       map[string]*store
+	memories     map[string]*Memory
+	code         *Memory
+	faultHandler FaultHandler
+	pcReg        *gopcode.Register
+	registers    map[string]*gopcode.Register
+
+	// loadSpaces caches the spaces referenced by the first input of LOAD
+	// and STORE ops
+	loadSpaces map[uint64]*gopcode.AddrSpace
+
+	blocks    map[uint64]*block
+	instrs    map[uint64]*instruction
+	codePages map[uint64][]*block
+
+	userOpHooks map[int][]*Hook
+	codeHooks   map[uint64][]*Hook
+	opHooks     map[gopcode.OpCode][]*Hook
+	memoryHooks []*Hook
+
+	// redirected is set when SetPC is called during an instruction,
+	// stopped when Stop is
+	redirected bool
+	stopped    bool
+
+	trace *Trace
+}
+
+// New returns an emulator for the language of ctx with zeroed registers and
+// no memory mapped. The emulator uses ctx for translation, which must stay
+// alive as long as the emulator is used.
+func New(ctx *gopcode.Context) (*Emulator, error) {
+	e := &Emulator{
+		ctx:        ctx,
+		spaces:     map[string]*store{},
+		memories:   map[string]*Memory{},
+		registers:  map[string]*gopcode.Register{},
+		loadSpaces: map[uint64]*gopcode.AddrSpace{},
+		blocks:     map[uint64]*block{},
+		instrs:     map[uint64]*instruction{},
+		codePages:  map[uint64][]*block{},
+
+		userOpHooks: map[int][]*Hook{},
+		codeHooks:   map[uint64][]*Hook{},
+		opHooks:     map[gopcode.OpCode][]*Hook{},
+	}
+
+	for _, reg := range ctx.GetAllRegisters() {
+		e.registers[reg.Name] = reg
+	}
+	e.pcReg = ctx.GetProgramCounter()
+
+	e.code = e.memory(ctx.DefaultCodeSpace())
+
+	return e, nil
+}
+
+// Context returns the context the emulator translates with.
+func (e *Emulator) Context() *gopcode.Context {
+	return e.ctx
+}
+
+// PC returns the address of the next instruction to execute.
+func (e *Emulator) PC() uint64 {
+	return e.pc
+}
+
+// SetPC sets the address of the next instruction to execute. Called from a
+// hook, it redirects the execution: the rest of the current instruction is
+// skipped.
+func (e *Emulator) SetPC(addr uint64) {
+	e.pc = addr
+	e.redirected = true
+}
+
+// Register returns the register with the given name, which is matched case
+// insensitively if there is no exact match.
+func (e *Emulator) Register(name string) (*gopcode.Register, error) {
+	if reg, ok := e.registers[name]; ok {
+		return reg, nil
+	}
+
+	for n, reg := range e.registers {
+		if strings.EqualFold(n, name) {
+			return reg, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown register %s", name)
+}
+
+// ReadRegister returns the value of a register of up to 8 bytes.
+func (e *Emulator) ReadRegister(name string) (uint64, error) {
+	reg, err := e.Register(name)
+	if err != nil {
+		return 0, err
+	}
+	if reg.Node.Size > 8 {
+		return 0, fmt.Errorf("register %s is %d bytes, use ReadRegisterBig", reg.Name, reg.Node.Size)
+	}
+
+	return e.readUint(reg.Node)
+}
+
+// WriteRegister sets a register, the value is truncated to its size.
+func (e *Emulator) WriteRegister(name string, value uint64) error {
+	reg, err := e.Register(name)
+	if err != nil {
+		return err
+	}
+
+	return e.writeBig(reg.Node, new(big.Int).SetUint64(value))
+}
+
+// ReadRegisterBig returns the value of a register of any size.
+func (e *Emulator) ReadRegisterBig(name string) (*big.Int, error) {
+	reg, err := e.Register(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.readBig(reg.Node)
+}
+
+// WriteRegisterBig sets a register of any size, the value is truncated to its
+// size.
+func (e *Emulator) WriteRegisterBig(name string, value *big.Int) error {
+	reg, err := e.Register(name)
+	if err != nil {
+		return err
+	}
+
+	return e.writeBig(reg.Node, value)
+}
+
+// Memory returns the memory of the default code space, usually ram.
+func (e *Emulator) Memory() *Memory {
+	return e.code
+}
+
+// Map maps size bytes at addr in the default code space, see Memory.Map.
+func (e *Emulator) Map(addr, size uint64, perm Perm) error {
+	return e.code.Map(addr, size, perm)
+}
+
+// ReadMemory reads size bytes of mapped memory at addr in the default code
+// space, regardless of the permissions.
+func (e *Emulator) ReadMemory(addr uint64, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	if err := e.code.Peek(addr, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// WriteMemory writes data to mapped memory at addr in the default code
+// space, regardless of the permissions.
+func (e *Emulator) WriteMemory(addr uint64, data []byte) error {
+	return e.code.Poke(addr, data)
+}
+
+// SetFaultHandler sets the function called on memory faults of every space,
+// nil makes faults fail the access.
+func (e *Emulator) SetFaultHandler(h FaultHandler) {
+	e.faultHandler = h
+}
+
+// Step executes the instruction at the program counter.
+func (e *Emulator) Step() error {
+	e.redirected, e.stopped = false, false
+	e.traceStep(e.pc)
+
+	if err := e.runCodeHooks(e.pc); err != nil {
+		return err
+	}
+	if e.redirected || e.stopped {
+		return nil
+	}
+
+	instr, err := e.fetch(e.pc)
+	if err != nil {
+		return err
+	}
+
+	if e.pcReg != nil {
+		if err := e.writeUint(e.pcReg.Node, instr.addr); err != nil {
+			return err
+		}
+	}
+
+	next, err := e.execute(instr)
+	if err != nil {
+		return err
+	}
+
+	if !e.redirected {
+		e.pc = next
+	}
+	if e.trace != nil {
+		e.trace.pc = e.pc
+	}
+	return nil
+}
+
+// Run executes instructions until the program counter reaches until or a
+// hook calls Stop.
+func (e *Emulator) Run(until uint64) error {
+	for e.pc != until {
+		if err := e.Step(); err != nil {
+			return err
+		}
+		if e.stopped {
+			break
+		}
+	}
+
+	return nil
+}
+
+// fetch returns the instruction at addr, translating the block starting
+// there if it is not cached yet.
+func (e *Emulator) fetch(addr uint64) (*instruction, error) {
+	if instr, ok := e.instrs[addr]; ok {
+		return instr, nil
+	}
+
+	b, err := e.translateBlock(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	e.blocks[addr] = b
+	for _, instr := range b.instrs {
+		if _, ok := e.instrs[instr.addr]; !ok {
+			e.instrs[instr.addr] = instr
+		}
+	}
+
+	first, last := e.code.pageRange(b.start, b.size())
+	for p := first; p <= last; p++ {
+		e.codePages[p] = append(e.codePages[p], b)
+	}
+
+	return b.instrs[0], nil
+}
+
+// size returns the number of bytes of the block, at least one.
+func (b *block) size() uint64 {
+	if b.end > b.start {
+		return b.end - b.start
+	}
+	return 1
+}
+
+// invalidate discards the cached translations of code overlapping size bytes
+// written at addr.
+func (e *Emulator) invalidate(m *Memory, addr, size uint64) {
+	if m != e.code || len(e.codePages) == 0 || size == 0 {
+		return
+	}
+
+	// collect the blocks first, dropBlock rewrites the page lists
+	var stale []*block
+	collect := func(p uint64) {
+		for _, b := range e.codePages[p] {
+			if b.start < addr+size && addr < b.start+b.size() {
+				stale = append(stale, b)
+			}
+		}
+	}
+	first, last := m.pageRange(addr, size)
+	if last-first < uint64(len(e.codePages)) {
+		for p := first; p <= last; p++ {
+			collect(p)
+		}
+	} else {
+		// a large range, such as an unmapped heap, has fewer code pages
+		for p := range e.codePages {
+			if p >= first && p <= last {
+				collect(p)
+			}
+		}
+	}
+	for _, b := range stale {
+		e.dropBlock(b)
+	}
+}
+
+func (e *Emulator) dropBlock(b *block) {
+	if e.blocks[b.start] == b {
+		delete(e.blocks, b.start)
+	}
+	for _, instr := range b.instrs {
+		if e.instrs[instr.addr] == instr {
+			delete(e.instrs, instr.addr)
+		}
+	}
+
+	first, last := e.code.pageRange(b.start, b.size())
+	for p := first; p <= last; p++ {
+		blocks := e.codePages[p][:0]
+		for _, other := range e.codePages[p] {
+			if other != b {
+				blocks = append(blocks, other)
+			}
+		}
+		if len(blocks) == 0 {
+			delete(e.codePages, p)
+		} else {
+			e.codePages[p] = blocks
+		}
+	}
+}
+
+// translateBlock translates the instructions at addr up to the first branch
+// or the end of the executable memory.
+func (e *Emulator) translateBlock(addr uint64) (*block, error) {
+	buf := make([]byte, maxBlockBytes)
+	for {
+		n, err := e.code.Fetch(addr, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := e.decodeBlock(buf[:n], addr)
+		if b != nil || n == len(buf) {
+			return b, err
+		}
+
+		// the instruction continues past the executable memory, fault on
+		// the next byte and try again if the handler mapped it
+		if derr, ok := err.(*gopcode.DecodeError); !ok || derr.Reason != gopcode.DecodeTruncated {
+			return nil, err
+		}
+		if _, err := e.code.Fetch(addr+uint64(n), buf[:1]); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (e *Emulator) decodeBlock(data []byte, addr uint64) (*block, error) {
+	trans, err := e.ctx.Translate(data, addr, 0, gopcode.BbTerminating)
+	if trans == nil {
+		return nil, err
+	}
+
+	// the ops only reference Go memory and outlive the native translation
+	ops := trans.Ops
+	trans.Ops = nil
+	trans.Destroy()
+
+	b := &block{start: addr, end: addr}
+	for i, op := range ops {
+		if op.Opcode != gopcode.CPUI_IMARK {
+			continue
+		}
+
+		instr := &instruction{addr: op.Inputs[0].Offset}
+		for _, in := range op.Inputs {
+			if end := in.Offset + uint64(in.Size); end > instr.addr+instr.length {
+				instr.length = end - instr.addr
+			}
+		}
+
+		j := i + 1
+		for j < len(ops) && ops[j].Opcode != gopcode.CPUI_IMARK {
+			j++
+		}
+		instr.ops = ops[i:j]
+
+		b.instrs = append(b.instrs, instr)
+		b.end = instr.addr + instr.length
+	}
+
+	// a decoding error past the first instruction only ends the block early
+	if len(b.instrs) == 0 {
+		if err == nil {
+			err = fmt.Errorf("no instruction decoded at 0x%x", addr)
+		}
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// execute runs the ops of an instruction and returns the address of the next
+// instruction.
+func (e *Emulator) execute(instr *instruction) (uint64, error) {
+	ops := instr.ops
+	for i := 0; i < len(ops); {
+		op := ops[i]
+
+		if err := e.runOpHooks(op); err != nil {
+			return 0, err
+		}
+		if e.redirected {
+			return e.pc, nil
+		}
+
+		switch op.Opcode {
+		case gopcode.CPUI_IMARK:
+			i++
+		case gopcode.CPUI_BRANCH, gopcode.CPUI_CBRANCH, gopcode.CPUI_CALL:
+			if op.Opcode == gopcode.CPUI_CBRANCH {
+				if err := checkInputs(op, 2); err != nil {
+					return 0, err
+				}
+				cond, err := e.readUint(op.Inputs[1])
+				if err != nil {
+					return 0, err
+				}
+				if cond == 0 {
+					i++
+					continue
+				}
+			}
+
+			target := op.Inputs[0]
+			if target.Space.Name != "const" {
+				return target.Offset, nil
+			}
+
+			// relative branch to another op of the instruction
+			j := i + int(word.SignExtend(target.Offset, int(target.Size)))
+			if j < 0 || j > len(ops) {
+				return 0, fmt.Errorf("relative branch out of instruction at 0x%x", instr.addr)
+			}
+			if j == len(ops) {
+				return instr.addr + instr.length, nil
+			}
+			i = j
+		case gopcode.CPUI_BRANCHIND, gopcode.CPUI_CALLIND, gopcode.CPUI_RETURN:
+			target, err := e.readUint(op.Inputs[0])
+			if err != nil {
+				return 0, err
+			}
+			return target, nil
+		case gopcode.CPUI_CALLOTHER:
+			if err := e.callOther(instr, op); err != nil {
+				return 0, err
+			}
+			if e.redirected {
+				return e.pc, nil
+			}
+			i++
+		case gopcode.CPUI_LOAD:
+			if err := e.load(op); err != nil {
+				return 0, fmt.Errorf("0x%x: %w", instr.addr, err)
+			}
+			i++
+		case gopcode.CPUI_STORE:
+			if err := e.storeOp(op); err != nil {
+				return 0, fmt.Errorf("0x%x: %w", instr.addr, err)
+			}
+			i++
+		default:
+			if err := e.evaluate(op); err != nil {
+				return 0, fmt.Errorf("0x%x: %w", instr.addr, err)
+			}
+			i++
+		}
+	}
+
+	return instr.addr + instr.length, nil
+}
+
+// loadSpace returns the space referenced by the constant first input of a
+// LOAD or STORE.
+func (e *Emulator) loadSpace(vn *gopcode.VarNode) *gopcode.AddrSpace {
+	if space, ok := e.loadSpaces[vn.Offset]; ok {
+		return space
+	}
+
+	space := vn.GetSpaceFromConst()
+	if space == nil {
+		space = e.code.Space()
+	}
+	e.loadSpaces[vn.Offset] = space
+	return space
+}
+
+// pointer returns the space and byte offset a LOAD or STORE accesses.
+func (e *Emulator) pointer(op gopcode.PcodeOp) (*gopcode.AddrSpace, uint64, error) {
+	space := e.loadSpace(op.Inputs[0])
+
+	ptr, err := e.readUint(op.Inputs[1])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if space.WordSize > 1 {
+		ptr *= uint64(space.WordSize)
+	}
+	return space, ptr, nil
+}
+
+func (e *Emulator) load(op gopcode.PcodeOp) error {
+	if err := checkInputs(op, 2); err != nil {
+		return err
+	}
+
+	space, ptr, err := e.pointer(op)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, op.Output.Size)
+	if err := e.readSpace(space, ptr, buf); err != nil {
+		return err
+	}
+	return e.writeBytes(op.Output, buf)
+}
+
+func (e *Emulator) storeOp(op gopcode.PcodeOp) error {
+	if err := checkInputs(op, 3); err != nil {
+		return err
+	}
+
+	space, ptr, err := e.pointer(op)
+	if err != nil {
+		return err
+	}
+
+	value := op.Inputs[2]
+
+	var buf []byte
+	if value.Space.Name == "const" {
+		buf = make([]byte, value.Size)
+		uintToBytes(value.Offset, buf, isBigEndian(space))
+	} else if buf, err = e.readBytes(value); err != nil {
+		return err
+	}
+
+	return e.writeSpace(space, ptr, buf)
+}
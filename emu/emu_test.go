@@ -0,0 +1,579 @@
+package emu_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/dzonerzy/gopcode"
+	"github.com/dzonerzy/gopcode/emu"
+	_ "github.com/dzonerzy/gopcode/processors/68000"
+	_ "github.com/dzonerzy/gopcode/processors/x86"
+)
+
+func newEmulator(t *testing.T, lang string) *emu.Emulator {
+	ctx, err := gopcode.NewContext(lang)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ctx.Destroy)
+
+	e, err := emu.New(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestRunLoop(t *testing.T) {
+	e := newEmulator(t, "x86:LE:32:default")
+
+	code := []byte{
+		0xbe, 0x00, 0x20, 0x00, 0x00, // mov esi, 0x2000
+		0xb9, 0x05, 0x00, 0x00, 0x00, // mov ecx, 5
+		0x80, 0x36, 0x55, // loop: xor byte ptr [esi], 0x55
+		0x46,       // inc esi
+		0x49,       // dec ecx
+		0x75, 0xf9, // jnz loop
+	}
+	secret := []byte("hello")
+	encoded := make([]byte, len(secret))
+	for i, b := range secret {
+		encoded[i] = b ^ 0x55
+	}
+
+	e.Map(0x1000, 0x1000, emu.PermRX)
+	e.Map(0x2000, 0x1000, emu.PermRW)
+	e.WriteMemory(0x1000, code)
+	e.WriteMemory(0x2000, encoded)
+	e.SetPC(0x1000)
+
+	if err := e.Run(0x1000 + uint64(len(code))); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := e.ReadMemory(0x2000, len(secret))
+	if !bytes.Equal(got, secret) {
+		t.Fatalf("expected %q, got %q", secret, got)
+	}
+
+	if esi, _ := e.ReadRegister("ESI"); esi != 0x2005 {
+		t.Fatalf("expected ESI 0x2005, got 0x%x", esi)
+	}
+	if zf, _ := e.ReadRegister("ZF"); zf != 1 {
+		t.Fatalf("expected ZF set, got %d", zf)
+	}
+}
+
+func TestCallReturn(t *testing.T) {
+	e := newEmulator(t, "x86:LE:32:default")
+
+	code := []byte{
+		0xe8, 0x01, 0x00, 0x00, 0x00, // call 0x1006
+		0xf4,                         // hlt
+		0xb8, 0x2a, 0x00, 0x00, 0x00, // mov eax, 42
+		0xc3, // ret
+	}
+	e.Map(0x1000, 0x1000, emu.PermRX)
+	e.Map(0x7000, 0x1000, emu.PermRW)
+	e.WriteMemory(0x1000, code)
+	e.WriteRegister("ESP", 0x8000)
+	e.SetPC(0x1000)
+
+	if err := e.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if e.PC() != 0x1006 {
+		t.Fatalf("expected the call to reach 0x1006, got 0x%x", e.PC())
+	}
+	ret, _ := e.ReadMemory(0x7ffc, 4)
+	if binary.LittleEndian.Uint32(ret) != 0x1005 {
+		t.Fatalf("expected return address 0x1005, got % x", ret)
+	}
+
+	if err := e.Run(0x1005); err != nil {
+		t.Fatal(err)
+	}
+	if eax, _ := e.ReadRegister("EAX"); eax != 42 {
+		t.Fatalf("expected EAX 42, got %d", eax)
+	}
+	if esp, _ := e.ReadRegister("esp"); esp != 0x8000 {
+		t.Fatalf("expected ESP 0x8000, got 0x%x", esp)
+	}
+}
+
+func TestWideAndFloat(t *testing.T) {
+	e := newEmulator(t, "x86:LE:64:default")
+
+	code := []byte{
+		0x66, 0x0f, 0xef, 0xc1, // pxor xmm0, xmm1
+		0xf2, 0x0f, 0x58, 0xd3, // addsd xmm2, xmm3
+	}
+	e.Map(0x1000, 0x1000, emu.PermRX)
+	e.WriteMemory(0x1000, code)
+	e.SetPC(0x1000)
+
+	a, _ := new(big.Int).SetString("0123456789abcdeffedcba9876543210", 16)
+	b, _ := new(big.Int).SetString("ffffffffffffffff0000000000000000", 16)
+	e.WriteRegisterBig("XMM0", a)
+	e.WriteRegisterBig("XMM1", b)
+	e.WriteRegister("XMM2", math.Float64bits(1.5))
+	e.WriteRegister("XMM3", math.Float64bits(2.25))
+
+	if err := e.Run(0x1008); err != nil {
+		t.Fatal(err)
+	}
+
+	xmm0, _ := e.ReadRegisterBig("XMM0")
+	if expected := new(big.Int).Xor(a, b); xmm0.Cmp(expected) != 0 {
+		t.Fatalf("expected XMM0 %x, got %x", expected, xmm0)
+	}
+
+	xmm2, _ := e.ReadRegisterBig("XMM2")
+	if f := math.Float64frombits(xmm2.Uint64()); f != 3.75 {
+		t.Fatalf("expected 3.75, got %v", f)
+	}
+}
+
+func TestExtendedFloat(t *testing.T) {
+	e := newEmulator(t, "x86:LE:32:default")
+
+	code := []byte{
+		0xdd, 0x05, 0x00, 0x20, 0x00, 0x00, // fld qword ptr [0x2000]
+		0xd8, 0xc0, // fadd st0, st0
+		0xdd, 0x1d, 0x08, 0x20, 0x00, 0x00, // fstp qword ptr [0x2008]
+	}
+	in := make([]byte, 8)
+	binary.LittleEndian.PutUint64(in, math.Float64bits(-0.3125))
+
+	e.Map(0x1000, 0x1000, emu.PermRX)
+	e.Map(0x2000, 0x1000, emu.PermRW)
+	e.WriteMemory(0x1000, code)
+	e.WriteMemory(0x2000, in)
+	e.SetPC(0x1000)
+
+	if err := e.Run(0x1000 + uint64(len(code))); err != nil {
+		t.Fatal(err)
+	}
+
+	out, _ := e.ReadMemory(0x2008, 8)
+	if f := math.Float64frombits(binary.LittleEndian.Uint64(out)); f != -0.625 {
+		t.Fatalf("expected -0.625, got %v", f)
+	}
+}
+
+func TestUnhandledCallOther(t *testing.T) {
+	e := newEmulator(t, "x86:LE:32:default")
+
+	e.Map(0x1000, 0x1000, emu.PermRX)
+	e.WriteMemory(0x1000, []byte{0x0f, 0xa2}) // cpuid
+	e.SetPC(0x1000)
+
+	if err := e.Step(); err == nil {
+		t.Fatal("expected an error for CALLOTHER")
+	}
+}
+
+func TestMemoryFaults(t *testing.T) {
+	e := newEmulator(t, "x86:LE:32:default")
+
+	code := []byte{
+		0xa1, 0x00, 0x50, 0x00, 0x00, // mov eax, [0x5000]
+		0xa3, 0x00, 0x10, 0x00, 0x00, // mov [0x1000], eax
+	}
+	e.Map(0x1000, 0x1000, emu.PermRX)
+	e.WriteMemory(0x1000, code)
+	e.SetPC(0x1000)
+
+	var fault *emu.Fault
+	if err := e.Step(); !errors.As(err, &fault) || !fault.Unmapped || fault.Access != emu.AccessRead || fault.Address != 0x5000 {
+		t.Fatalf("expected an unmapped read fault at 0x5000, got %v", err)
+	}
+
+	// map the missing page lazily
+	faults := 0
+	e.SetFaultHandler(func(e *emu.Emulator, f *emu.Fault) bool {
+		faults++
+		if !f.Unmapped {
+			return false
+		}
+		f.Memory.Map(f.Address, 1, emu.PermRW)
+		f.Memory.Poke(f.Address, []byte{0x78, 0x56, 0x34, 0x12})
+		return true
+	})
+	if err := e.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if eax, _ := e.ReadRegister("EAX"); eax != 0x12345678 || faults != 1 {
+		t.Fatalf("expected EAX 0x12345678 after 1 fault, got 0x%x after %d", eax, faults)
+	}
+
+	// the code is not writable
+	if err := e.Step(); !errors.As(err, &fault) || fault.Unmapped || fault.Access != emu.AccessWrite || fault.Address != 0x1000 {
+		t.Fatalf("expected a write permission fault at 0x1000, got %v", err)
+	}
+
+	e.SetFaultHandler(nil)
+	e.SetPC(0x9000)
+	if err := e.Step(); !errors.As(err, &fault) || fault.Access != emu.AccessFetch {
+		t.Fatalf("expected a fetch fault, got %v", err)
+	}
+
+	regions := e.Memory().Regions()
+	if len(regions) != 2 || regions[0].Perm != emu.PermRX || regions[1].Start != 0x5000 || regions[1].Perm != emu.PermRW {
+		t.Fatalf("unexpected regions %v", regions)
+	}
+}
+
+func TestLargeMapping(t *testing.T) {
+	e := newEmulator(t, "x86:LE:64:default")
+	m := e.Memory()
+
+	// 64 GiB, pages are only allocated when written
+	const base, size = 0x100000000, 0x1000000000
+	if err := m.Map(base, size, emu.PermRW); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteUint(base+size-8, 8, 0x1122334455667788); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := m.ReadUint(base+size-8, 8); err != nil || v != 0x1122334455667788 {
+		t.Fatalf("expected the written value, got 0x%x, %v", v, err)
+	}
+	if v, err := m.ReadUint(base+size/2-4, 8); err != nil || v != 0 {
+		t.Fatalf("expected zeros across unwritten pages, got 0x%x, %v", v, err)
+	}
+
+	if err := m.Protect(base+0x1000, 0x1000, emu.PermRead); err != nil {
+		t.Fatal(err)
+	}
+	regions := m.Regions()
+	if len(regions) != 3 || regions[0].Size != 0x1000 || regions[1].Perm != emu.PermRead || regions[2].Start+regions[2].Size != base+size {
+		t.Fatalf("unexpected regions %v", regions)
+	}
+	var fault *emu.Fault
+	if err := m.Write(base+0x1000, []byte{1}); !errors.As(err, &fault) || fault.Unmapped {
+		t.Fatalf("expected a write permission fault, got %v", err)
+	}
+
+	m.Unmap(base, size)
+	if m.IsMapped(base+size-8) || len(m.Regions()) != 0 {
+		t.Fatalf("expected the range unmapped, got %v", m.Regions())
+	}
+	if err := m.Map(base+size-0x1000, 0x1000, emu.PermRW); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m.ReadUint(base+size-8, 8); v != 0 {
+		t.Fatalf("expected a remapped page to be zeroed, got 0x%x", v)
+	}
+}
+
+func TestSelfModifyingCode(t *testing.T) {
+	e := newEmulator(t, "x86:LE:32:default")
+
+	code := []byte{
+		0xc6, 0x05, 0x0b, 0x10, 0x00, 0x00, 0x40, // mov byte ptr [0x100b], 0x40
+		0x90, 0x90, 0x90, 0x90, // nop
+		0x90, // nop, patched to inc eax
+	}
+	e.Map(0x1000, 0x1000, emu.PermRWX)
+	e.WriteMemory(0x1000, code)
+	e.SetPC(0x1000)
+
+	if err := e.Run(0x1000 + uint64(len(code))); err != nil {
+		t.Fatal(err)
+	}
+	if eax, _ := e.ReadRegister("EAX"); eax != 1 {
+		t.Fatalf("expected the patched instruction to run, EAX is %d", eax)
+	}
+}
+
+func TestCodeInvalidation(t *testing.T) {
+	e := newEmulator(t, "x86:LE:32:default")
+
+	// three blocks on the same page
+	code := []byte{
+		0x90, 0xeb, 0x00, // nop; jmp 0x1003
+		0x90, 0xeb, 0x00, // nop; jmp 0x1006
+		0x90, // nop
+	}
+	e.Map(0x1000, 0x1000, emu.PermRWX)
+	e.WriteMemory(0x1000, code)
+	e.SetPC(0x1000)
+	if err := e.Run(0x1000 + uint64(len(code))); err != nil {
+		t.Fatal(err)
+	}
+
+	// a single write patching every block to inc eax
+	e.WriteMemory(0x1000, []byte{0x40, 0xeb, 0x00, 0x40, 0xeb, 0x00, 0x40})
+	e.SetPC(0x1000)
+	if err := e.Run(0x1000 + uint64(len(code))); err != nil {
+		t.Fatal(err)
+	}
+	if eax, _ := e.ReadRegister("EAX"); eax != 3 {
+		t.Fatalf("expected every patched block to run, EAX is %d", eax)
+	}
+
+	// the cached blocks must not run once the page is no longer executable
+	if err := e.Memory().Protect(0x1000, 0x1000, emu.PermRW); err != nil {
+		t.Fatal(err)
+	}
+	e.SetPC(0x1000)
+	var fault *emu.Fault
+	if err := e.Step(); !errors.As(err, &fault) || fault.Access != emu.AccessFetch {
+		t.Fatalf("expected a fetch fault, got %v", err)
+	}
+}
+
+func TestBigEndianMemory(t *testing.T) {
+	e := newEmulator(t, "68000:BE:32:default")
+
+	if !e.Memory().IsBigEndian() {
+		t.Fatal("expected big endian memory")
+	}
+
+	e.Map(0x1000, 0x1000, emu.PermRX)
+	e.Map(0x2000, 0x1000, emu.PermRW)
+	e.WriteMemory(0x1000, []byte{0x20, 0x80}) // move.l d0, (a0)
+	e.WriteRegister("D0", 0x11223344)
+	e.WriteRegister("A0", 0x2000)
+	e.SetPC(0x1000)
+
+	if err := e.Step(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := e.ReadMemory(0x2000, 4)
+	if !bytes.Equal(got, []byte{0x11, 0x22, 0x33, 0x44}) {
+		t.Fatalf("expected big endian bytes, got % x", got)
+	}
+	if v, _ := e.Memory().ReadUint(0x2000, 2); v != 0x1122 {
+		t.Fatalf("expected 0x1122, got 0x%x", v)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	e := newEmulator(t, "x86:LE:32:default")
+
+	code := []byte{
+		0x0f, 0x31, // rdtsc
+		0xe8, 0xf9, 0x3f, 0x00, 0x00, // call 0x5000
+		0xa3, 0x00, 0x20, 0x00, 0x00, // mov [0x2000], eax
+		0xa1, 0x00, 0x20, 0x00, 0x00, // mov eax, [0x2000]
+		0x90, // nop
+	}
+	e.Map(0x1000, 0x1000, emu.PermRX)
+	e.Map(0x2000, 0x1000, emu.PermRW)
+	e.Map(0x7000, 0x1000, emu.PermRW)
+	e.WriteMemory(0x1000, code)
+	e.WriteRegister("ESP", 0x8000)
+	e.SetPC(0x1000)
+
+	if _, err := e.HookUserOp("nosuchop", nil); err == nil {
+		t.Fatal("expected an error for an unknown user operation")
+	}
+	if _, err := e.HookUserOp("rdtsc", func(e *emu.Emulator, op *emu.UserOp) error {
+		if op.Name != "rdtsc" || op.Address != 0x1000 || op.Output == nil {
+			t.Errorf("unexpected user op %+v", op)
+		}
+		return e.WriteVarNode(op.Output, 0x1122334455667788)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// implement the function at 0x5000, which has no code, by returning 7
+	e.HookCode(0x5000, func(e *emu.Emulator, addr uint64) error {
+		esp, _ := e.ReadRegister("ESP")
+		ret, err := e.Memory().ReadUint(esp, 4)
+		if err != nil {
+			return err
+		}
+		e.WriteRegister("EAX", 7)
+		e.WriteRegister("ESP", esp+4)
+		e.SetPC(ret)
+		return nil
+	})
+
+	stores := 0
+	storeHook := e.HookOp(gopcode.CPUI_STORE, func(e *emu.Emulator, op gopcode.PcodeOp) error {
+		stores++
+		return nil
+	})
+
+	e.HookMemory(emu.AccessWrite, 0x2000, 0x2004, func(e *emu.Emulator, access emu.Access, addr uint64, data []byte) error {
+		data[0]++
+		return nil
+	})
+	var read []byte
+	e.HookMemory(emu.AccessRead, 0x2000, 0x2001, func(e *emu.Emulator, access emu.Access, addr uint64, data []byte) error {
+		read = append([]byte(nil), data...)
+		return nil
+	})
+
+	e.HookCode(0x1011, func(e *emu.Emulator, addr uint64) error {
+		e.Stop()
+		return nil
+	})
+
+	if err := e.Run(0x2000); err != nil {
+		t.Fatal(err)
+	}
+	if e.PC() != 0x1011 {
+		t.Fatalf("expected to stop at 0x1011, got 0x%x", e.PC())
+	}
+
+	if edx, _ := e.ReadRegister("EDX"); edx != 0x11223344 {
+		t.Fatalf("expected EDX 0x11223344, got 0x%x", edx)
+	}
+	if eax, _ := e.ReadRegister("EAX"); eax != 8 {
+		t.Fatalf("expected EAX 8, got %d", eax)
+	}
+	if !bytes.Equal(read, []byte{8, 0, 0, 0}) {
+		t.Fatalf("expected the read hook to see 08 00 00 00, got % x", read)
+	}
+	// the call pushes with a STORE, the mov to a constant address copies
+	// to a ram varnode
+	if stores != 1 {
+		t.Fatalf("expected 1 store, got %d", stores)
+	}
+
+	storeHook.Remove()
+	e.SetPC(0x1002)
+	if err := e.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if stores != 1 {
+		t.Fatal("expected the removed hook not to be called")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	e := newEmulator(t, "x86:LE:32:default")
+
+	code := []byte{
+		0xc6, 0x05, 0x07, 0x10, 0x00, 0x00, 0x40, // mov byte ptr [0x1007], 0x40
+		0x90, // nop, patched to inc eax
+	}
+	e.Map(0x1000, 0x1000, emu.PermRWX)
+	e.WriteMemory(0x1000, code)
+	e.SetPC(0x1000)
+
+	// translate the original code before taking the snapshot
+	if err := e.Run(0x1007); err != nil {
+		t.Fatal(err)
+	}
+	e.WriteMemory(0x1000, code)
+	e.SetPC(0x1000)
+
+	s := e.Snapshot()
+
+	for i := 0; i < 2; i++ {
+		if err := e.Run(0x1000 + uint64(len(code))); err != nil {
+			t.Fatal(err)
+		}
+		if eax, _ := e.ReadRegister("EAX"); eax != 1 {
+			t.Fatalf("run %d: expected EAX 1, got %d", i, eax)
+		}
+
+		e.Restore(s)
+		if eax, _ := e.ReadRegister("EAX"); eax != 0 {
+			t.Fatalf("expected EAX restored, got %d", eax)
+		}
+		if pc := e.PC(); pc != 0x1000 {
+			t.Fatalf("expected PC restored, got 0x%x", pc)
+		}
+		if got, _ := e.ReadMemory(0x1007, 1); got[0] != 0x90 {
+			t.Fatalf("expected code restored, got % x", got)
+		}
+	}
+
+	e.Memory().Unmap(0x1000, 0x1000)
+	e.Restore(s)
+	if !e.Memory().IsMapped(0x1000) {
+		t.Fatal("expected mapping restored")
+	}
+
+	// registers are shared between snapshots until either side writes them
+	e.WriteRegister("EBX", 1)
+	s2 := e.Snapshot()
+	e.WriteRegister("EBX", 2)
+	e.Restore(s2)
+	if ebx, _ := e.ReadRegister("EBX"); ebx != 1 {
+		t.Fatalf("expected EBX 1, got %d", ebx)
+	}
+	e.Restore(s)
+	if ebx, _ := e.ReadRegister("EBX"); ebx != 0 {
+		t.Fatalf("expected EBX 0, got %d", ebx)
+	}
+}
+
+func TestTraceReplay(t *testing.T) {
+	e := newEmulator(t, "x86:LE:32:default")
+
+	code := []byte{
+		0xbe, 0x00, 0x20, 0x00, 0x00, // mov esi, 0x2000
+		0xb9, 0x03, 0x00, 0x00, 0x00, // mov ecx, 3
+		0x80, 0x36, 0x55, // loop: xor byte ptr [esi], 0x55
+		0x46,       // inc esi
+		0x49,       // dec ecx
+		0x75, 0xf9, // jnz loop
+	}
+	end := 0x1000 + uint64(len(code))
+	e.Map(0x1000, 0x1000, emu.PermRX)
+	e.WriteMemory(0x1000, code)
+	e.SetPC(0x1000)
+
+	tr := e.StartTrace()
+	e.Map(0x2000, 0x1000, emu.PermRW)
+
+	type state struct {
+		pc       uint64
+		esi, ecx uint64
+		data     []byte
+	}
+	current := func() state {
+		esi, _ := e.ReadRegister("ESI")
+		ecx, _ := e.ReadRegister("ECX")
+		data, _ := e.ReadMemory(0x2000, 3)
+		return state{e.PC(), esi, ecx, data}
+	}
+
+	var states []state
+	for e.PC() != end {
+		states = append(states, current())
+		if err := e.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	states = append(states, current())
+	e.StopTrace()
+
+	if len(tr.Steps) != len(states)-1 {
+		t.Fatalf("expected %d steps, got %d", len(states)-1, len(tr.Steps))
+	}
+
+	for _, step := range []int{len(states) - 1, 0, 7, 3} {
+		if err := tr.Replay(e, step); err != nil {
+			t.Fatal(err)
+		}
+		got, want := current(), states[step]
+		if got.pc != want.pc || got.esi != want.esi || got.ecx != want.ecx || !bytes.Equal(got.data, want.data) {
+			t.Fatalf("step %d: expected %+v, got %+v", step, want, got)
+		}
+	}
+
+	// execution continues from the replayed state
+	if err := e.Run(end); err != nil {
+		t.Fatal(err)
+	}
+	if got := current(); !bytes.Equal(got.data, states[len(states)-1].data) {
+		t.Fatalf("expected % x, got % x", states[len(states)-1].data, got.data)
+	}
+
+	if err := tr.Replay(e, len(tr.Steps)+1); err == nil {
+		t.Fatal("expected an out of range step to fail")
+	}
+}
@@ -0,0 +1,266 @@
+package emu
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/dzonerzy/gopcode"
+	"github.com/dzonerzy/gopcode/internal/word"
+)
+
+// floatFormat describes an IEEE 754 style binary format. Values are computed
+// as float64, so formats wider than 8 bytes lose their extra precision.
+type floatFormat struct {
+	expBits  uint
+	fracBits uint // explicit fraction bits, without the integer bit
+	explicit bool // the integer bit is stored, as in the x87 extended format
+}
+
+var floatFormats = map[int]floatFormat{
+	2:  {expBits: 5, fracBits: 10},
+	4:  {expBits: 8, fracBits: 23},
+	8:  {expBits: 11, fracBits: 52},
+	10: {expBits: 15, fracBits: 63, explicit: true},
+	16: {expBits: 15, fracBits: 112},
+}
+
+func (f floatFormat) bias() int {
+	return 1<<(f.expBits-1) - 1
+}
+
+// fieldBits is the width of the stored significand.
+func (f floatFormat) fieldBits() uint {
+	if f.explicit {
+		return f.fracBits + 1
+	}
+	return f.fracBits
+}
+
+func (f floatFormat) decode(bits *big.Int) float64 {
+	field := f.fieldBits()
+	sign := bits.Bit(int(field+f.expBits)) == 1
+	exp := int(new(big.Int).Rsh(bits, field).Uint64() & (1<<f.expBits - 1))
+	mant := new(big.Int).And(bits, bigBitMask(f.fracBits))
+
+	var v float64
+	switch {
+	case exp == 1<<f.expBits-1:
+		if mant.Sign() == 0 {
+			v = math.Inf(1)
+		} else {
+			v = math.NaN()
+		}
+	case exp == 0:
+		// zero or subnormal
+		m := new(big.Float).SetInt(mant)
+		v, _ = m.SetMantExp(m, 1-f.bias()-int(f.fracBits)).Float64()
+	default:
+		m := new(big.Int).SetBit(mant, int(f.fracBits), 1)
+		bf := new(big.Float).SetInt(m)
+		v, _ = bf.SetMantExp(bf, exp-f.bias()-int(f.fracBits)).Float64()
+	}
+
+	if sign {
+		v = -v
+	}
+	return v
+}
+
+func (f floatFormat) encode(v float64) *big.Int {
+	field := f.fieldBits()
+	expMax := 1<<f.expBits - 1
+	r := new(big.Int)
+
+	var exp int
+	mant := new(big.Int)
+
+	switch {
+	case math.IsNaN(v):
+		exp = expMax
+		mant.SetBit(mant, int(f.fracBits-1), 1)
+	case math.IsInf(v, 0):
+		exp = expMax
+	case v == 0:
+	default:
+		abs := new(big.Float).SetFloat64(math.Abs(v))
+		e := abs.MantExp(nil) - 1
+		exp = e + f.bias()
+
+		var scaled *big.Float
+		if exp <= 0 {
+			exp = 0
+			scaled = new(big.Float).SetMantExp(abs, f.bias()-1+int(f.fracBits))
+		} else {
+			scaled = new(big.Float).SetMantExp(abs, int(f.fracBits)-e)
+		}
+		mant = roundToEven(scaled)
+
+		switch {
+		case exp == 0 && mant.BitLen() > int(f.fracBits):
+			// rounded up to the smallest normal
+			exp = 1
+		case mant.BitLen() > int(f.fracBits)+1:
+			mant.Rsh(mant, 1)
+			exp++
+		}
+
+		if exp >= expMax {
+			exp = expMax
+			mant.SetInt64(0)
+		}
+	}
+
+	if exp != 0 && f.explicit {
+		mant.SetBit(mant, int(f.fracBits), 1)
+	} else {
+		mant.And(mant, bigBitMask(f.fracBits))
+	}
+
+	r.Lsh(big.NewInt(int64(exp)), field)
+	r.Or(r, mant)
+	if math.Signbit(v) {
+		r.SetBit(r, int(field+f.expBits), 1)
+	}
+	return r
+}
+
+func bigBitMask(n uint) *big.Int {
+	m := new(big.Int).Lsh(big.NewInt(1), n)
+	return m.Sub(m, big.NewInt(1))
+}
+
+func roundToEven(v *big.Float) *big.Int {
+	i, _ := v.Int(nil)
+	frac := new(big.Float).Sub(v, new(big.Float).SetInt(i))
+
+	switch frac.Cmp(big.NewFloat(0.5)) {
+	case 1:
+		i.Add(i, big.NewInt(1))
+	case 0:
+		if i.Bit(0) == 1 {
+			i.Add(i, big.NewInt(1))
+		}
+	}
+	return i
+}
+
+func isFloatOp(opcode gopcode.OpCode) bool {
+	return opcode >= gopcode.CPUI_FLOAT_EQUAL && opcode <= gopcode.CPUI_FLOAT_ROUND
+}
+
+func (e *Emulator) readFloat(vn *gopcode.VarNode) (float64, error) {
+	f, ok := floatFormats[int(vn.Size)]
+	if !ok {
+		return 0, fmt.Errorf("unsupported float size %d", vn.Size)
+	}
+
+	v, err := e.readBig(vn)
+	if err != nil {
+		return 0, err
+	}
+	return f.decode(v), nil
+}
+
+func (e *Emulator) writeFloat(vn *gopcode.VarNode, v float64) error {
+	f, ok := floatFormats[int(vn.Size)]
+	if !ok {
+		return fmt.Errorf("unsupported float size %d", vn.Size)
+	}
+
+	// round to the precision of the format first, the arithmetic is done
+	// in double precision
+	if vn.Size == 4 {
+		v = float64(float32(v))
+	}
+	return e.writeBig(vn, f.encode(v))
+}
+
+// floatToInt converts like a saturating cast, NaN converts to zero.
+func floatToInt(v float64) int64 {
+	switch {
+	case math.IsNaN(v):
+		return 0
+	case v >= math.MaxInt64:
+		return math.MaxInt64
+	case v <= math.MinInt64:
+		return math.MinInt64
+	}
+	return int64(v)
+}
+
+func (e *Emulator) evaluateFloat(op gopcode.PcodeOp) error {
+	n := 1
+	switch op.Opcode {
+	case gopcode.CPUI_FLOAT_EQUAL, gopcode.CPUI_FLOAT_NOTEQUAL, gopcode.CPUI_FLOAT_LESS, gopcode.CPUI_FLOAT_LESSEQUAL,
+		gopcode.CPUI_FLOAT_ADD, gopcode.CPUI_FLOAT_DIV, gopcode.CPUI_FLOAT_MULT, gopcode.CPUI_FLOAT_SUB:
+		n = 2
+	}
+	if err := checkInputs(op, n); err != nil {
+		return err
+	}
+
+	if op.Opcode == gopcode.CPUI_FLOAT_INT2FLOAT {
+		if op.Inputs[0].Size > 8 {
+			return fmt.Errorf("%s: unsupported integer size %d", op.Opcode, op.Inputs[0].Size)
+		}
+		v, err := e.readUint(op.Inputs[0])
+		if err != nil {
+			return err
+		}
+		return e.writeFloat(op.Output, float64(word.SignExtend(v, int(op.Inputs[0].Size))))
+	}
+
+	a, err := e.readFloat(op.Inputs[0])
+	if err != nil {
+		return err
+	}
+	var b float64
+	if n > 1 {
+		if b, err = e.readFloat(op.Inputs[1]); err != nil {
+			return err
+		}
+	}
+
+	switch op.Opcode {
+	case gopcode.CPUI_FLOAT_EQUAL:
+		return e.writeUint(op.Output, word.Bool(a == b))
+	case gopcode.CPUI_FLOAT_NOTEQUAL:
+		return e.writeUint(op.Output, word.Bool(a != b))
+	case gopcode.CPUI_FLOAT_LESS:
+		return e.writeUint(op.Output, word.Bool(a < b))
+	case gopcode.CPUI_FLOAT_LESSEQUAL:
+		return e.writeUint(op.Output, word.Bool(a <= b))
+	case gopcode.CPUI_FLOAT_NAN:
+		return e.writeUint(op.Output, word.Bool(math.IsNaN(a)))
+	case gopcode.CPUI_FLOAT_ADD:
+		return e.writeFloat(op.Output, a+b)
+	case gopcode.CPUI_FLOAT_DIV:
+		return e.writeFloat(op.Output, a/b)
+	case gopcode.CPUI_FLOAT_MULT:
+		return e.writeFloat(op.Output, a*b)
+	case gopcode.CPUI_FLOAT_SUB:
+		return e.writeFloat(op.Output, a-b)
+	case gopcode.CPUI_FLOAT_NEG:
+		return e.writeFloat(op.Output, -a)
+	case gopcode.CPUI_FLOAT_ABS:
+		return e.writeFloat(op.Output, math.Abs(a))
+	case gopcode.CPUI_FLOAT_SQRT:
+		return e.writeFloat(op.Output, math.Sqrt(a))
+	case gopcode.CPUI_FLOAT_FLOAT2FLOAT:
+		return e.writeFloat(op.Output, a)
+	case gopcode.CPUI_FLOAT_TRUNC:
+		if op.Output.Size > 8 {
+			return e.writeBig(op.Output, big.NewInt(floatToInt(a)))
+		}
+		return e.writeUint(op.Output, uint64(floatToInt(a)))
+	case gopcode.CPUI_FLOAT_CEIL:
+		return e.writeFloat(op.Output, math.Ceil(a))
+	case gopcode.CPUI_FLOAT_FLOOR:
+		return e.writeFloat(op.Output, math.Floor(a))
+	case gopcode.CPUI_FLOAT_ROUND:
+		return e.writeFloat(op.Output, math.Floor(a+0.5))
+	}
+
+	return fmt.Errorf("unsupported opcode %s", op.Opcode)
+}
@@ -0,0 +1,234 @@
+package emu
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/dzonerzy/gopcode"
+)
+
+// UserOp is a CALLOTHER op passed to a UserOpHook.
+type UserOp struct {
+	Name    string
+	Index   int
+	Address uint64 // address of the instruction
+
+	// Output is nil when the operation returns nothing. Args are the
+	// inputs following the constant index.
+	Output *gopcode.VarNode
+	Args   []*gopcode.VarNode
+}
+
+// UserOpHook implements a user defined operation.
+type UserOpHook func(e *Emulator, op *UserOp) error
+
+// CodeHook is called before the instruction at addr executes.
+type CodeHook func(e *Emulator, addr uint64) error
+
+// OpHook is called before an op executes.
+type OpHook func(e *Emulator, op gopcode.PcodeOp) error
+
+// MemoryHook is called after a read, with the bytes read, and before a write,
+// with the bytes about to be written. It may modify data.
+type MemoryHook func(e *Emulator, access Access, addr uint64, data []byte) error
+
+type hookKind int
+
+const (
+	hookUserOp hookKind = iota
+	hookCode
+	hookOp
+	hookMemory
+)
+
+// Hook is a registered callback, see the Hook methods of Emulator.
+type Hook struct {
+	e    *Emulator
+	kind hookKind
+
+	index      int
+	addr       uint64
+	opcode     gopcode.OpCode
+	access     Access
+	start, end uint64
+
+	userOp UserOpHook
+	code   CodeHook
+	op     OpHook
+	memory MemoryHook
+}
+
+// Remove unregisters the hook.
+func (h *Hook) Remove() {
+	e := h.e
+	switch h.kind {
+	case hookUserOp:
+		e.userOpHooks[h.index] = removeHook(e.userOpHooks[h.index], h)
+	case hookCode:
+		e.codeHooks[h.addr] = removeHook(e.codeHooks[h.addr], h)
+	case hookOp:
+		e.opHooks[h.opcode] = removeHook(e.opHooks[h.opcode], h)
+	case hookMemory:
+		e.memoryHooks = removeHook(e.memoryHooks, h)
+	}
+}
+
+func removeHook(hooks []*Hook, h *Hook) []*Hook {
+	kept := make([]*Hook, 0, len(hooks))
+	for _, other := range hooks {
+		if other != h {
+			kept = append(kept, other)
+		}
+	}
+	return kept
+}
+
+// HookUserOp implements the named user defined operation, e.g. "syscall" or
+// "cpuid". Every CALLOTHER of the operation calls fn instead of failing.
+func (e *Emulator) HookUserOp(name string, fn UserOpHook) (*Hook, error) {
+	for i, n := range e.ctx.GetUserOpNames() {
+		if n == name {
+			h := &Hook{e: e, kind: hookUserOp, index: i, userOp: fn}
+			e.userOpHooks[i] = append(e.userOpHooks[i], h)
+			return h, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown user operation %s", name)
+}
+
+// HookCode calls fn before the instruction at addr executes. The address does
+// not have to be mapped: a hook that redirects the execution with SetPC, or
+// stops it, skips the instruction, which makes it possible to implement
+// functions without code.
+func (e *Emulator) HookCode(addr uint64, fn CodeHook) *Hook {
+	h := &Hook{e: e, kind: hookCode, addr: addr, code: fn}
+	e.codeHooks[addr] = append(e.codeHooks[addr], h)
+	return h
+}
+
+// HookOp calls fn before every op with the given opcode executes. Redirecting
+// the execution with SetPC abandons the rest of the instruction.
+func (e *Emulator) HookOp(opcode gopcode.OpCode, fn OpHook) *Hook {
+	h := &Hook{e: e, kind: hookOp, opcode: opcode, op: fn}
+	e.opHooks[opcode] = append(e.opHooks[opcode], h)
+	return h
+}
+
+// HookMemory calls fn on the reads or writes the program makes to the
+// addresses [start, end) of the default code space. Accesses through
+// ReadMemory, WriteMemory and instruction fetches are not reported.
+func (e *Emulator) HookMemory(access Access, start, end uint64, fn MemoryHook) (*Hook, error) {
+	if access != AccessRead && access != AccessWrite {
+		return nil, fmt.Errorf("cannot hook %s accesses", access)
+	}
+	if start >= end {
+		return nil, fmt.Errorf("invalid range [0x%x, 0x%x)", start, end)
+	}
+
+	h := &Hook{e: e, kind: hookMemory, access: access, start: start, end: end, memory: fn}
+	e.memoryHooks = append(e.memoryHooks, h)
+	return h, nil
+}
+
+// Stop ends Run after the current instruction. Called from a code hook, it
+// also skips the hooked instruction.
+func (e *Emulator) Stop() {
+	e.stopped = true
+}
+
+func (e *Emulator) runCodeHooks(addr uint64) error {
+	for _, h := range e.codeHooks[addr] {
+		if err := h.code(e, addr); err != nil {
+			return err
+		}
+		if e.redirected || e.stopped {
+			break
+		}
+	}
+	return nil
+}
+
+func (e *Emulator) runOpHooks(op gopcode.PcodeOp) error {
+	for _, h := range e.opHooks[op.Opcode] {
+		if err := h.op(e, op); err != nil {
+			return err
+		}
+		if e.redirected {
+			break
+		}
+	}
+	return nil
+}
+
+func (e *Emulator) runMemoryHooks(m *Memory, access Access, addr uint64, data []byte) error {
+	if m != e.code || len(e.memoryHooks) == 0 {
+		return nil
+	}
+
+	end := addr + uint64(len(data))
+	for _, h := range e.memoryHooks {
+		if h.access == access && h.start < end && addr < h.end {
+			if err := h.memory(e, access, addr, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *Emulator) callOther(instr *instruction, op gopcode.PcodeOp) error {
+	index := int(op.Inputs[0].Offset)
+
+	name, _ := e.ctx.UserOpName(uint64(index))
+
+	hooks := e.userOpHooks[index]
+	if len(hooks) == 0 {
+		if name != "" {
+			return fmt.Errorf("unhandled user operation %s at 0x%x", name, instr.addr)
+		}
+		return fmt.Errorf("unhandled CALLOTHER 0x%x at 0x%x", index, instr.addr)
+	}
+
+	uop := &UserOp{
+		Name:    name,
+		Index:   index,
+		Address: instr.addr,
+		Output:  op.Output,
+		Args:    op.Inputs[1:],
+	}
+	for _, h := range hooks {
+		if err := h.userOp(e, uop); err != nil {
+			return err
+		}
+		if e.redirected {
+			break
+		}
+	}
+	return nil
+}
+
+// ReadVarNode returns the value of a varnode of up to 8 bytes, e.g. an
+// argument of a user operation.
+func (e *Emulator) ReadVarNode(vn *gopcode.VarNode) (uint64, error) {
+	if vn.Size > 8 {
+		return 0, fmt.Errorf("varnode is %d bytes, use ReadVarNodeBig", vn.Size)
+	}
+	return e.readUint(vn)
+}
+
+// WriteVarNode sets a varnode, the value is truncated to its size.
+func (e *Emulator) WriteVarNode(vn *gopcode.VarNode, value uint64) error {
+	return e.writeBig(vn, new(big.Int).SetUint64(value))
+}
+
+// ReadVarNodeBig returns the value of a varnode of any size.
+func (e *Emulator) ReadVarNodeBig(vn *gopcode.VarNode) (*big.Int, error) {
+	return e.readBig(vn)
+}
+
+// WriteVarNodeBig sets a varnode of any size, the value is truncated to its
+// size.
+func (e *Emulator) WriteVarNodeBig(vn *gopcode.VarNode, value *big.Int) error {
+	return e.writeBig(vn, value)
+}
@@ -0,0 +1,258 @@
+package linux
+
+import (
+	"fmt"
+	"strings"
+)
+
+// call identifies a system call independently of its number, which differs
+// between architectures.
+type call int
+
+const (
+	callRead call = iota
+	callWrite
+	callOpen
+	callOpenat
+	callClose
+	callLseek
+	callReadv
+	callWritev
+	callUnlink
+	callUnlinkat
+	callBrk
+	callMmap
+	callMmap2
+	callMunmap
+	callMprotect
+	callExit
+	callExitGroup
+	callGetpid
+	callGettid
+	callSetTidAddress
+	callIoctl
+	callUname
+	callArchPrctl
+)
+
+// abi describes how a process of an architecture calls the kernel.
+type abi struct {
+	machine string // reported by uname
+	userOp  string // user defined operation of the syscall instruction
+
+	nr   string
+	args []string
+	ret  string
+	sp   string
+
+	// errFlag is set to 1 on failure and 0 on success, with the positive
+	// error number in ret (MIPS). Otherwise failures return -errno.
+	errFlag string
+
+	// stackArgs is the offset from the stack pointer of the arguments that
+	// do not fit in registers (MIPS o32).
+	stackArgs uint64
+
+	calls map[uint64]call
+
+	oCreat, oExcl, oAppend uint64
+	mapAnon                uint64
+	errnos                 map[Errno]uint64 // numbers differing from the generic ones
+}
+
+var x86_64Calls = map[uint64]call{
+	0:   callRead,
+	1:   callWrite,
+	2:   callOpen,
+	3:   callClose,
+	8:   callLseek,
+	9:   callMmap,
+	10:  callMprotect,
+	11:  callMunmap,
+	12:  callBrk,
+	16:  callIoctl,
+	19:  callReadv,
+	20:  callWritev,
+	39:  callGetpid,
+	60:  callExit,
+	63:  callUname,
+	87:  callUnlink,
+	158: callArchPrctl,
+	186: callGettid,
+	218: callSetTidAddress,
+	231: callExitGroup,
+	257: callOpenat,
+	263: callUnlinkat,
+}
+
+// genericCalls are the numbers of asm-generic/unistd.h, used by AArch64 and
+// RISC-V. 32-bit architectures get mmap2 under the number of mmap.
+func genericCalls(wordSize int) map[uint64]call {
+	mmap := callMmap
+	if wordSize == 4 {
+		mmap = callMmap2
+	}
+
+	return map[uint64]call{
+		29:  callIoctl,
+		35:  callUnlinkat,
+		56:  callOpenat,
+		57:  callClose,
+		62:  callLseek,
+		63:  callRead,
+		64:  callWrite,
+		65:  callReadv,
+		66:  callWritev,
+		93:  callExit,
+		94:  callExitGroup,
+		96:  callSetTidAddress,
+		160: callUname,
+		172: callGetpid,
+		178: callGettid,
+		214: callBrk,
+		215: callMunmap,
+		222: mmap,
+		226: callMprotect,
+	}
+}
+
+var armCalls = map[uint64]call{
+	1:   callExit,
+	3:   callRead,
+	4:   callWrite,
+	5:   callOpen,
+	6:   callClose,
+	10:  callUnlink,
+	19:  callLseek,
+	20:  callGetpid,
+	45:  callBrk,
+	54:  callIoctl,
+	91:  callMunmap,
+	122: callUname,
+	125: callMprotect,
+	145: callReadv,
+	146: callWritev,
+	192: callMmap2,
+	224: callGettid,
+	248: callExitGroup,
+	256: callSetTidAddress,
+	322: callOpenat,
+	328: callUnlinkat,
+}
+
+var mipsO32Calls = map[uint64]call{
+	4001: callExit,
+	4003: callRead,
+	4004: callWrite,
+	4005: callOpen,
+	4006: callClose,
+	4010: callUnlink,
+	4019: callLseek,
+	4020: callGetpid,
+	4045: callBrk,
+	4054: callIoctl,
+	4090: callMmap,
+	4091: callMunmap,
+	4122: callUname,
+	4125: callMprotect,
+	4145: callReadv,
+	4146: callWritev,
+	4210: callMmap2,
+	4222: callGettid,
+	4246: callExitGroup,
+	4252: callSetTidAddress,
+	4288: callOpenat,
+	4294: callUnlinkat,
+}
+
+var mipsN64Calls = map[uint64]call{
+	5000: callRead,
+	5001: callWrite,
+	5002: callOpen,
+	5003: callClose,
+	5008: callLseek,
+	5009: callMmap,
+	5010: callMprotect,
+	5011: callMunmap,
+	5012: callBrk,
+	5015: callIoctl,
+	5018: callReadv,
+	5019: callWritev,
+	5038: callGetpid,
+	5058: callExit,
+	5061: callUname,
+	5085: callUnlink,
+	5178: callGettid,
+	5205: callExitGroup,
+	5212: callSetTidAddress,
+	5247: callOpenat,
+	5253: callUnlinkat,
+}
+
+// lookupABI returns the system call convention of a language ID such as
+// "x86:LE:64:default".
+func lookupABI(languageID string) (*abi, error) {
+	parts := strings.Split(strings.ToLower(languageID), ":")
+	if len(parts) < 3 {
+		return nil, fmt.Errorf("invalid language ID %s", languageID)
+	}
+	processor, size := parts[0], parts[2]
+
+	generic := abi{oCreat: 0x40, oExcl: 0x80, oAppend: 0x400, mapAnon: 0x20}
+
+	switch {
+	case processor == "x86" && size == "64":
+		a := generic
+		a.machine, a.userOp = "x86_64", "syscall"
+		a.nr, a.ret, a.sp = "RAX", "RAX", "RSP"
+		a.args = []string{"RDI", "RSI", "RDX", "R10", "R8", "R9"}
+		a.calls = x86_64Calls
+		return &a, nil
+
+	case processor == "aarch64":
+		a := generic
+		a.machine, a.userOp = "aarch64", "CallSupervisor"
+		a.nr, a.ret, a.sp = "x8", "x0", "sp"
+		a.args = []string{"x0", "x1", "x2", "x3", "x4", "x5"}
+		a.calls = genericCalls(8)
+		return &a, nil
+
+	case processor == "arm":
+		a := generic
+		a.machine, a.userOp = "armv7l", "software_interrupt"
+		a.nr, a.ret, a.sp = "r7", "r0", "sp"
+		a.args = []string{"r0", "r1", "r2", "r3", "r4", "r5"}
+		a.calls = armCalls
+		return &a, nil
+
+	case processor == "mips":
+		a := abi{oCreat: 0x100, oExcl: 0x400, oAppend: 0x8, mapAnon: 0x800}
+		a.userOp = "syscall"
+		a.nr, a.ret, a.sp, a.errFlag = "v0", "v0", "sp", "a3"
+		a.errnos = map[Errno]uint64{ENOSYS: 89}
+		if size == "64" {
+			a.machine = "mips64"
+			a.args = []string{"a0", "a1", "a2", "a3", "t0", "t1"}
+			a.calls = mipsN64Calls
+		} else {
+			a.machine = "mips"
+			a.args = []string{"a0", "a1", "a2", "a3"}
+			a.stackArgs = 16
+			a.calls = mipsO32Calls
+		}
+		return &a, nil
+
+	case processor == "riscv":
+		a := generic
+		a.machine, a.userOp = "riscv"+size, "ecall"
+		a.nr, a.ret, a.sp = "a7", "a0", "sp"
+		a.args = []string{"a0", "a1", "a2", "a3", "a4", "a5"}
+		a.calls = genericCalls(8)
+		if size == "32" {
+			a.calls = genericCalls(4)
+		}
+		return &a, nil
+	}
+
+	return nil, fmt.Errorf("no linux system call convention for %s", languageID)
+}
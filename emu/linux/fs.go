@@ -0,0 +1,179 @@
+package linux
+
+import (
+	"io"
+	"path"
+	"sort"
+)
+
+// FS is an in-memory filesystem of regular files, the only files the
+// emulated program can open. Directories are implicit: a file can be created
+// at any path.
+type FS struct {
+	files map[string]*inode
+}
+
+type inode struct {
+	data []byte
+}
+
+// NewFS returns an empty filesystem.
+func NewFS() *FS {
+	return &FS{files: map[string]*inode{}}
+}
+
+// cleanPath resolves a path against the root, the working directory of the
+// program.
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// WriteFile creates or replaces the file at name.
+func (fs *FS) WriteFile(name string, data []byte) {
+	fs.files[cleanPath(name)] = &inode{data: append([]byte(nil), data...)}
+}
+
+// ReadFile returns a copy of the contents of the file at name.
+func (fs *FS) ReadFile(name string) ([]byte, bool) {
+	n, ok := fs.files[cleanPath(name)]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), n.data...), true
+}
+
+// Remove deletes the file at name. Open descriptors of the file keep working.
+func (fs *FS) Remove(name string) {
+	delete(fs.files, cleanPath(name))
+}
+
+// Files lists the paths of the files, sorted.
+func (fs *FS) Files() []string {
+	names := make([]string, 0, len(fs.files))
+	for name := range fs.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// file is an open file description.
+type file interface {
+	read(p []byte) (int, error)
+	write(p []byte) (int, error)
+	seek(off int64, whence int) (int64, error)
+	// unread gives back the data of the last read when it could not be
+	// delivered, so that the next read returns it again.
+	unread(p []byte)
+}
+
+// stdio is one of the standard descriptors. It uses the fields of the kernel
+// when accessed, so they can be set after New.
+type stdio struct {
+	k       *Kernel
+	fd      int
+	pending []byte // unread input, returned before reading Stdin again
+}
+
+func (f *stdio) read(p []byte) (int, error) {
+	if f.fd != 0 {
+		return 0, EBADF
+	}
+	if len(f.pending) != 0 {
+		n := copy(p, f.pending)
+		f.pending = f.pending[n:]
+		return n, nil
+	}
+	if f.k.Stdin == nil {
+		return 0, nil
+	}
+
+	n, err := f.k.Stdin.Read(p)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *stdio) write(p []byte) (int, error) {
+	w := f.k.Stdout
+	switch f.fd {
+	case 0:
+		return 0, EBADF
+	case 2:
+		w = f.k.Stderr
+	}
+
+	if w == nil {
+		return len(p), nil
+	}
+	return w.Write(p)
+}
+
+func (f *stdio) seek(off int64, whence int) (int64, error) {
+	return 0, ESPIPE
+}
+
+func (f *stdio) unread(p []byte) {
+	f.pending = append(append([]byte(nil), p...), f.pending...)
+}
+
+// memFile is an open file of an FS.
+type memFile struct {
+	node                    *inode
+	pos                     int64
+	readable, writable, app bool
+}
+
+func (f *memFile) read(p []byte) (int, error) {
+	if !f.readable {
+		return 0, EBADF
+	}
+	if f.pos >= int64(len(f.node.data)) {
+		return 0, nil
+	}
+
+	n := copy(p, f.node.data[f.pos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *memFile) write(p []byte) (int, error) {
+	if !f.writable {
+		return 0, EBADF
+	}
+	if f.app {
+		f.pos = int64(len(f.node.data))
+	}
+
+	if end := f.pos + int64(len(p)); end > int64(len(f.node.data)) {
+		grown := make([]byte, end)
+		copy(grown, f.node.data)
+		f.node.data = grown
+	}
+	copy(f.node.data[f.pos:], p)
+	f.pos += int64(len(p))
+	return len(p), nil
+}
+
+func (f *memFile) seek(off int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		off += f.pos
+	case io.SeekEnd:
+		off += int64(len(f.node.data))
+	default:
+		return 0, EINVAL
+	}
+
+	if off < 0 {
+		return 0, EINVAL
+	}
+	f.pos = off
+	return off, nil
+}
+
+func (f *memFile) unread(p []byte) {
+	f.pos -= int64(len(p))
+}
@@ -0,0 +1,267 @@
+// Package linux emulates the system call interface of Linux for programs
+// running in an emu.Emulator, so that statically linked user mode programs
+// run end to end without touching the host.
+//
+// A Kernel implements the syscall instruction of x86-64, AArch64, ARM (EABI),
+// MIPS (o32 and n64) and RISC-V with the calls a simple program needs:
+// reading and writing files, brk and mmap, and exit. Files live in an
+// in-memory FS, standard input and output go to io.Reader and io.Writer of
+// the host:
+//
+//	e, _ := emu.New(ctx)
+//	k, _ := linux.New(e)
+//	k.Stdout = os.Stdout
+//	k.FS.WriteFile("/etc/motd", []byte("hello\n"))
+//	// map and load the program, then
+//	k.SetupStack(0x7fff0000, 0x10000, []string{"prog"}, nil, nil)
+//	k.SetBrk(endOfBss)
+//	e.SetPC(entry)
+//	err := e.Run(0)
+//	code, exited := k.Exited()
+//
+// Unimplemented calls fail with ENOSYS, Handle adds or replaces calls.
+package linux
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dzonerzy/gopcode/emu"
+)
+
+// Errno is a Linux error number returned by a system call. The values are
+// the generic ones; they are translated for the architectures that differ.
+type Errno int
+
+const (
+	EPERM   Errno = 1
+	ENOENT  Errno = 2
+	EBADF   Errno = 9
+	ENOMEM  Errno = 12
+	EACCES  Errno = 13
+	EFAULT  Errno = 14
+	EEXIST  Errno = 17
+	ENOTDIR Errno = 20
+	EISDIR  Errno = 21
+	EINVAL  Errno = 22
+	EMFILE  Errno = 24
+	ENOTTY  Errno = 25
+	ESPIPE  Errno = 29
+	ENOSYS  Errno = 38
+)
+
+var errnoNames = map[Errno]string{
+	EPERM:   "EPERM",
+	ENOENT:  "ENOENT",
+	EBADF:   "EBADF",
+	ENOMEM:  "ENOMEM",
+	EACCES:  "EACCES",
+	EFAULT:  "EFAULT",
+	EEXIST:  "EEXIST",
+	ENOTDIR: "ENOTDIR",
+	EISDIR:  "EISDIR",
+	EINVAL:  "EINVAL",
+	EMFILE:  "EMFILE",
+	ENOTTY:  "ENOTTY",
+	ESPIPE:  "ESPIPE",
+	ENOSYS:  "ENOSYS",
+}
+
+func (e Errno) Error() string {
+	if name, ok := errnoNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("errno %d", int(e))
+}
+
+// Handler implements a system call. It returns the result, or an Errno to
+// fail the call; any other error stops the emulation. args holds the six
+// arguments of the call.
+type Handler func(k *Kernel, args []uint64) (uint64, error)
+
+const (
+	pageSize = 0x1000
+	maxFDs   = 1024
+)
+
+type Kernel struct {
+	emu *emu.Emulator
+	abi *abi
+
+	// FS holds the files the program can open.
+	FS *FS
+
+	// Stdin, Stdout and Stderr back the descriptors 0, 1 and 2. A nil
+	// reader is at end of file, a nil writer discards the output.
+	Stdin          io.Reader
+	Stdout, Stderr io.Writer
+
+	wordSize int
+	files    map[int]file
+	handlers map[uint64]Handler
+
+	brkStart, brk uint64
+	mmapBase      uint64
+
+	exited   bool
+	exitCode int
+}
+
+// New installs a kernel for the language of e, which must be one of the
+// supported architectures.
+func New(e *emu.Emulator) (*Kernel, error) {
+	a, err := lookupABI(e.Context().LanguageID)
+	if err != nil {
+		return nil, err
+	}
+
+	reg, err := e.Register(a.args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	k := &Kernel{
+		emu:      e,
+		abi:      a,
+		FS:       NewFS(),
+		wordSize: int(reg.Node.Size),
+		handlers: map[uint64]Handler{},
+		mmapBase: 0x40000000,
+	}
+	if k.wordSize == 8 {
+		k.mmapBase = 0x7f0000000000
+	}
+
+	k.files = map[int]file{0: &stdio{k: k, fd: 0}, 1: &stdio{k: k, fd: 1}, 2: &stdio{k: k, fd: 2}}
+
+	if _, err := e.HookUserOp(a.userOp, k.syscall); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// Emulator returns the emulator the kernel is installed in.
+func (k *Kernel) Emulator() *emu.Emulator {
+	return k.emu
+}
+
+// Handle implements the system call number nr of the architecture with h,
+// replacing the built-in implementation if any.
+func (k *Kernel) Handle(nr uint64, h Handler) {
+	k.handlers[nr] = h
+}
+
+// SetBrk sets the initial program break, usually the page aligned end of the
+// data segment. Until it is set brk fails and allocators fall back to mmap.
+func (k *Kernel) SetBrk(addr uint64) {
+	addr = pageAlign(addr)
+	k.brkStart, k.brk = addr, addr
+}
+
+// SetMmapBase sets the address from which mmap looks for free memory.
+func (k *Kernel) SetMmapBase(addr uint64) {
+	k.mmapBase = pageAlign(addr)
+}
+
+// Exited returns the exit status once the program called exit, which also
+// stops the emulation.
+func (k *Kernel) Exited() (int, bool) {
+	return k.exitCode, k.exited
+}
+
+func (k *Kernel) syscall(e *emu.Emulator, op *emu.UserOp) error {
+	nr, err := e.ReadRegister(k.abi.nr)
+	if err != nil {
+		return err
+	}
+
+	args, err := k.readArgs()
+	if err != nil {
+		return err
+	}
+
+	h, ok := k.handlers[nr]
+	if !ok {
+		c, ok := k.abi.calls[nr]
+		if !ok {
+			return k.setResult(0, ENOSYS)
+		}
+		h = builtins[c]
+	}
+
+	ret, err := h(k, args)
+	if err != nil {
+		var errno Errno
+		if !errors.As(err, &errno) {
+			return fmt.Errorf("system call %d: %w", nr, err)
+		}
+	}
+	return k.setResult(ret, err)
+}
+
+func (k *Kernel) readArgs() ([]uint64, error) {
+	args := make([]uint64, 6)
+	for i, name := range k.abi.args {
+		v, err := k.emu.ReadRegister(name)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+
+	if n := len(k.abi.args); n < len(args) {
+		sp, err := k.emu.ReadRegister(k.abi.sp)
+		if err != nil {
+			return nil, err
+		}
+		// the arguments on the stack are only there if the call takes
+		// them, ignore the ones that cannot be read
+		for i := n; i < len(args); i++ {
+			addr := sp + k.abi.stackArgs + uint64((i-n)*k.wordSize)
+			args[i], _ = k.emu.Memory().ReadUint(addr, k.wordSize)
+		}
+	}
+
+	return args, nil
+}
+
+func (k *Kernel) setResult(ret uint64, err error) error {
+	a := k.abi
+
+	var errno Errno
+	if !errors.As(err, &errno) {
+		if a.errFlag != "" {
+			if err := k.emu.WriteRegister(a.errFlag, 0); err != nil {
+				return err
+			}
+		}
+		return k.emu.WriteRegister(a.ret, ret)
+	}
+
+	code := uint64(errno)
+	if c, ok := a.errnos[errno]; ok {
+		code = c
+	}
+
+	if a.errFlag != "" {
+		if err := k.emu.WriteRegister(a.errFlag, 1); err != nil {
+			return err
+		}
+		return k.emu.WriteRegister(a.ret, code)
+	}
+	return k.emu.WriteRegister(a.ret, -code)
+}
+
+// signed interprets an argument as a signed C long.
+func (k *Kernel) signed(v uint64) int64 {
+	if k.wordSize == 4 {
+		return int64(int32(v))
+	}
+	return int64(v)
+}
+
+func pageAlign(addr uint64) uint64 {
+	return (addr + pageSize - 1) &^ (pageSize - 1)
+}
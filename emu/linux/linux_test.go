@@ -0,0 +1,386 @@
+package linux_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/dzonerzy/gopcode"
+	"github.com/dzonerzy/gopcode/emu"
+	"github.com/dzonerzy/gopcode/emu/linux"
+	_ "github.com/dzonerzy/gopcode/processors/AARCH64"
+	_ "github.com/dzonerzy/gopcode/processors/ARM"
+	_ "github.com/dzonerzy/gopcode/processors/MIPS"
+	_ "github.com/dzonerzy/gopcode/processors/RISCV"
+	_ "github.com/dzonerzy/gopcode/processors/x86"
+)
+
+const (
+	codeAddr = 0x10000
+	dataAddr = 0x20000
+)
+
+func newKernel(t *testing.T, lang string, code []byte) (*emu.Emulator, *linux.Kernel) {
+	ctx, err := gopcode.NewContext(lang)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ctx.Destroy)
+
+	e, err := emu.New(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := linux.New(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.Map(codeAddr, 0x1000, emu.PermRX)
+	e.Map(dataAddr, 0x1000, emu.PermRW)
+	e.WriteMemory(codeAddr, code)
+	e.SetPC(codeAddr)
+	return e, k
+}
+
+func words(order binary.ByteOrder, ws ...uint32) []byte {
+	buf := make([]byte, 4*len(ws))
+	for i, w := range ws {
+		order.PutUint32(buf[4*i:], w)
+	}
+	return buf
+}
+
+// TestHello runs write(1, "hello\n", 6) and exit(7) on every architecture.
+func TestHello(t *testing.T) {
+	tests := []struct {
+		lang string
+		code []byte
+	}{
+		{"x86:LE:64:default", []byte{
+			0xb8, 0x01, 0x00, 0x00, 0x00, // mov eax, 1
+			0xbf, 0x01, 0x00, 0x00, 0x00, // mov edi, 1
+			0xbe, 0x00, 0x00, 0x02, 0x00, // mov esi, 0x20000
+			0xba, 0x06, 0x00, 0x00, 0x00, // mov edx, 6
+			0x0f, 0x05, // syscall
+			0xb8, 0x3c, 0x00, 0x00, 0x00, // mov eax, 60
+			0xbf, 0x07, 0x00, 0x00, 0x00, // mov edi, 7
+			0x0f, 0x05, // syscall
+		}},
+		{"AARCH64:LE:64:v8A", words(binary.LittleEndian,
+			0xd2800020, // mov x0, #1
+			0xd2a00041, // mov x1, #0x20000
+			0xd28000c2, // mov x2, #6
+			0xd2800808, // mov x8, #64
+			0xd4000001, // svc #0
+			0xd28000e0, // mov x0, #7
+			0xd2800ba8, // mov x8, #93
+			0xd4000001, // svc #0
+		)},
+		{"ARM:LE:32:v8", words(binary.LittleEndian,
+			0xe3a00001, // mov r0, #1
+			0xe3a01802, // mov r1, #0x20000
+			0xe3a02006, // mov r2, #6
+			0xe3a07004, // mov r7, #4
+			0xef000000, // svc #0
+			0xe3a00007, // mov r0, #7
+			0xe3a07001, // mov r7, #1
+			0xef000000, // svc #0
+		)},
+		{"MIPS:BE:32:default", words(binary.BigEndian,
+			0x24040001, // li a0, 1
+			0x3c050002, // lui a1, 0x2
+			0x24060006, // li a2, 6
+			0x24020fa4, // li v0, 4004
+			0x0000000c, // syscall
+			0x24040007, // li a0, 7
+			0x24020fa1, // li v0, 4001
+			0x0000000c, // syscall
+		)},
+		{"RISCV:LE:64:default", words(binary.LittleEndian,
+			0x00100513, // li a0, 1
+			0x000205b7, // lui a1, 0x20
+			0x00600613, // li a2, 6
+			0x04000893, // li a7, 64
+			0x00000073, // ecall
+			0x00700513, // li a0, 7
+			0x05d00893, // li a7, 93
+			0x00000073, // ecall
+		)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.lang, func(t *testing.T) {
+			e, k := newKernel(t, tt.lang, tt.code)
+			e.WriteMemory(dataAddr, []byte("hello\n"))
+
+			var stdout bytes.Buffer
+			k.Stdout = &stdout
+
+			if err := e.Run(0); err != nil {
+				t.Fatal(err)
+			}
+			if stdout.String() != "hello\n" {
+				t.Fatalf("expected hello, got %q", stdout.String())
+			}
+			if code, exited := k.Exited(); !exited || code != 7 {
+				t.Fatalf("expected exit 7, got %d (exited %v)", code, exited)
+			}
+		})
+	}
+}
+
+// syscaller runs single system calls through a syscall instruction.
+type syscaller struct {
+	t *testing.T
+	e *emu.Emulator
+	k *linux.Kernel
+}
+
+func newSyscaller(t *testing.T) *syscaller {
+	e, k := newKernel(t, "x86:LE:64:default", []byte{0x0f, 0x05})
+	return &syscaller{t, e, k}
+}
+
+func (s *syscaller) call(nr uint64, args ...uint64) int64 {
+	regs := []string{"RDI", "RSI", "RDX", "R10", "R8", "R9"}
+	s.e.WriteRegister("RAX", nr)
+	for i, v := range args {
+		s.e.WriteRegister(regs[i], v)
+	}
+
+	s.e.SetPC(codeAddr)
+	if err := s.e.Step(); err != nil {
+		s.t.Fatal(err)
+	}
+
+	rax, _ := s.e.ReadRegister("RAX")
+	return int64(rax)
+}
+
+func (s *syscaller) cstring(addr uint64, str string) uint64 {
+	s.e.WriteMemory(addr, append([]byte(str), 0))
+	return addr
+}
+
+func TestFileSystem(t *testing.T) {
+	s := newSyscaller(t)
+	s.k.FS.WriteFile("/etc/input", []byte("some data"))
+
+	const (
+		read, write, open, close, lseek, unlink = 0, 1, 2, 3, 8, 87
+		oWronly, oCreat, oTrunc                 = 1, 0x40, 0x200
+	)
+	buf := uint64(dataAddr + 0x800)
+
+	fd := s.call(open, s.cstring(dataAddr, "/etc/../etc/input"), 0)
+	if fd != 3 {
+		t.Fatalf("expected fd 3, got %d", fd)
+	}
+	if n := s.call(read, uint64(fd), buf, 4); n != 4 {
+		t.Fatalf("expected 4 bytes, got %d", n)
+	}
+	// a read into unmapped memory does not consume the data
+	if r := s.call(read, uint64(fd), 0xdead0000, 1); r != -int64(linux.EFAULT) {
+		t.Fatalf("expected EFAULT, got %d", r)
+	}
+	if off := s.call(lseek, uint64(fd), 1, 1); off != 5 {
+		t.Fatalf("expected offset 5, got %d", off)
+	}
+	if n := s.call(read, uint64(fd), buf+4, 100); n != 4 {
+		t.Fatalf("expected 4 bytes, got %d", n)
+	}
+	if got, _ := s.e.ReadMemory(buf, 8); string(got) != "somedata" {
+		t.Fatalf("unexpected data %q", got)
+	}
+	if r := s.call(write, uint64(fd), buf, 8); r != -int64(linux.EBADF) {
+		t.Fatalf("expected EBADF writing a read only file, got %d", r)
+	}
+	if r := s.call(close, uint64(fd)); r != 0 {
+		t.Fatalf("close failed with %d", r)
+	}
+	if r := s.call(close, uint64(fd)); r != -int64(linux.EBADF) {
+		t.Fatalf("expected EBADF, got %d", r)
+	}
+
+	out := s.cstring(dataAddr, "tmp/output")
+	fd = s.call(open, out, oWronly|oCreat|oTrunc)
+	if fd != 3 {
+		t.Fatalf("expected fd 3, got %d", fd)
+	}
+	s.call(write, uint64(fd), buf, 8)
+	s.call(close, uint64(fd))
+	if data, ok := s.k.FS.ReadFile("/tmp/output"); !ok || string(data) != "somedata" {
+		t.Fatalf("unexpected output file %q", data)
+	}
+
+	if r := s.call(unlink, out); r != 0 {
+		t.Fatalf("unlink failed with %d", r)
+	}
+	if r := s.call(open, out, 0); r != -int64(linux.ENOENT) {
+		t.Fatalf("expected ENOENT, got %d", r)
+	}
+	if r := s.call(open, 0xdead0000, 0); r != -int64(linux.EFAULT) {
+		t.Fatalf("expected EFAULT, got %d", r)
+	}
+
+	s.k.Stdin = bytes.NewBufferString("input")
+	if r := s.call(read, 0, 0xdead0000, 5); r != -int64(linux.EFAULT) {
+		t.Fatalf("expected EFAULT, got %d", r)
+	}
+	if n := s.call(read, 0, buf, 5); n != 5 {
+		t.Fatalf("expected 5 bytes, got %d", n)
+	}
+	if got, _ := s.e.ReadMemory(buf, 5); string(got) != "input" {
+		t.Fatalf("unexpected stdin data %q", got)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	s := newSyscaller(t)
+	s.k.SetBrk(0x600123)
+
+	const (
+		mmap, mprotect, munmap, brk = 9, 10, 11, 12
+		protRW, mapPrivateAnon      = 3, 0x22
+	)
+
+	if cur := s.call(brk, 0); cur != 0x601000 {
+		t.Fatalf("expected break 0x601000, got 0x%x", cur)
+	}
+	if cur := s.call(brk, 0x603000); cur != 0x603000 {
+		t.Fatalf("expected break 0x603000, got 0x%x", cur)
+	}
+	if err := s.e.WriteMemory(0x602ff8, make([]byte, 8)); err != nil {
+		t.Fatal(err)
+	}
+	if !s.e.Memory().IsMapped(0x602000) || s.e.Memory().IsMapped(0x603000) {
+		t.Fatal("unexpected heap mapping")
+	}
+
+	addr := uint64(s.call(mmap, 0, 0x2000, protRW, mapPrivateAnon, ^uint64(0), 0))
+	if !s.e.Memory().IsMapped(addr) || !s.e.Memory().IsMapped(addr+0x1000) {
+		t.Fatalf("mmap returned unmapped 0x%x", addr)
+	}
+	if other := uint64(s.call(mmap, 0, 0x1000, protRW, mapPrivateAnon, ^uint64(0), 0)); other == addr {
+		t.Fatal("mmap returned the same memory twice")
+	}
+
+	if r := s.call(mprotect, addr, 0x1000, 1); r != 0 {
+		t.Fatalf("mprotect failed with %d", r)
+	}
+	var fault *emu.Fault
+	if err := s.e.Memory().Write(addr, []byte{1}); !errors.As(err, &fault) {
+		t.Fatalf("expected a fault writing read only memory, got %v", err)
+	}
+
+	if r := s.call(munmap, addr, 0x2000); r != 0 {
+		t.Fatalf("munmap failed with %d", r)
+	}
+	if s.e.Memory().IsMapped(addr) {
+		t.Fatal("expected memory unmapped")
+	}
+
+	s.k.FS.WriteFile("/lib", []byte("mapped file"))
+	fd := s.call(2, s.cstring(dataAddr, "/lib"), 0)
+	addr = uint64(s.call(mmap, 0, 11, 1, 2, uint64(fd), 0))
+	if got, _ := s.e.ReadMemory(addr, 11); string(got) != "mapped file" {
+		t.Fatalf("unexpected mapped contents %q", got)
+	}
+}
+
+// TestMIPSErrors checks the error convention of MIPS: a3 is set and v0 holds
+// the positive error number, which differs for ENOSYS.
+func TestMIPSErrors(t *testing.T) {
+	e, _ := newKernel(t, "MIPS:BE:32:default", words(binary.BigEndian, 0x0000000c))
+
+	call := func(nr, a0 uint64) (uint64, uint64) {
+		e.WriteRegister("v0", nr)
+		e.WriteRegister("a0", a0)
+		e.SetPC(codeAddr)
+		if err := e.Step(); err != nil {
+			t.Fatal(err)
+		}
+		v0, _ := e.ReadRegister("v0")
+		a3, _ := e.ReadRegister("a3")
+		return v0, a3
+	}
+
+	if v0, a3 := call(4006, 42); v0 != uint64(linux.EBADF) || a3 != 1 {
+		t.Fatalf("expected EBADF, got v0 %d a3 %d", v0, a3)
+	}
+	if v0, a3 := call(4999, 0); v0 != 89 || a3 != 1 {
+		t.Fatalf("expected ENOSYS, got v0 %d a3 %d", v0, a3)
+	}
+	if v0, a3 := call(4020, 0); v0 != 1 || a3 != 0 {
+		t.Fatalf("expected pid 1, got v0 %d a3 %d", v0, a3)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	s := newSyscaller(t)
+
+	s.k.Handle(39, func(k *linux.Kernel, args []uint64) (uint64, error) {
+		return 1234, nil
+	})
+	s.k.Handle(500, func(k *linux.Kernel, args []uint64) (uint64, error) {
+		return 0, linux.EPERM
+	})
+
+	if pid := s.call(39); pid != 1234 {
+		t.Fatalf("expected the handler to run, got %d", pid)
+	}
+	if r := s.call(500); r != -int64(linux.EPERM) {
+		t.Fatalf("expected EPERM, got %d", r)
+	}
+	if r := s.call(501); r != -int64(linux.ENOSYS) {
+		t.Fatalf("expected ENOSYS, got %d", r)
+	}
+}
+
+func TestSetupStack(t *testing.T) {
+	s := newSyscaller(t)
+
+	err := s.k.SetupStack(0x7fff0000, 0x10000, []string{"prog", "-v"}, []string{"HOME=/"},
+		[]linux.Aux{{Type: linux.AuxEntry, Value: codeAddr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sp, _ := s.e.ReadRegister("RSP")
+	if sp%16 != 0 {
+		t.Fatalf("misaligned stack pointer 0x%x", sp)
+	}
+
+	word := func(i uint64) uint64 {
+		v, err := s.e.Memory().ReadUint(sp+8*i, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	str := func(addr uint64) string {
+		var b []byte
+		for {
+			c, _ := s.e.ReadMemory(addr+uint64(len(b)), 1)
+			if c[0] == 0 {
+				return string(b)
+			}
+			b = append(b, c[0])
+		}
+	}
+
+	if argc := word(0); argc != 2 {
+		t.Fatalf("expected argc 2, got %d", argc)
+	}
+	if a, b := str(word(1)), str(word(2)); a != "prog" || b != "-v" || word(3) != 0 {
+		t.Fatalf("unexpected argv %q %q", a, b)
+	}
+	if env := str(word(4)); env != "HOME=/" || word(5) != 0 {
+		t.Fatalf("unexpected envp %q", env)
+	}
+	if word(6) != linux.AuxEntry || word(7) != codeAddr {
+		t.Fatalf("unexpected auxv entry %d=0x%x", word(6), word(7))
+	}
+}
@@ -0,0 +1,95 @@
+package linux
+
+import (
+	"github.com/dzonerzy/gopcode/emu"
+)
+
+// Aux is an entry of the auxiliary vector passed to a program on its stack.
+type Aux struct {
+	Type, Value uint64
+}
+
+// Types of auxiliary vector entries. Loaders provide the program headers and
+// entry point, SetupStack adds the page size and random bytes.
+const (
+	AuxNull   = 0
+	AuxPhdr   = 3
+	AuxPhent  = 4
+	AuxPhnum  = 5
+	AuxPagesz = 6
+	AuxBase   = 7
+	AuxEntry  = 9
+	AuxRandom = 25
+)
+
+// SetupStack maps size bytes of stack below top and lays out the arguments,
+// the environment and the auxiliary vector the way the kernel does for a new
+// program, then points the stack pointer at the argument count.
+func (k *Kernel) SetupStack(top, size uint64, argv, envp []string, auxv []Aux) error {
+	top &^= pageSize - 1
+	if err := k.emu.Map(top-size, size, emu.PermRW); err != nil {
+		return err
+	}
+
+	m := k.emu.Memory()
+	word := uint64(k.wordSize)
+
+	// the strings and random bytes go at the top of the stack
+	sp := top
+	push := func(data []byte) (uint64, error) {
+		sp -= uint64(len(data))
+		return sp, m.Poke(sp, data)
+	}
+
+	random, err := push([]byte("gopcode-random16"))
+	if err != nil {
+		return err
+	}
+
+	pushStrings := func(strs []string) ([]uint64, error) {
+		ptrs := make([]uint64, len(strs))
+		for i, s := range strs {
+			addr, err := push(append([]byte(s), 0))
+			if err != nil {
+				return nil, err
+			}
+			ptrs[i] = addr
+		}
+		return ptrs, nil
+	}
+
+	argPtrs, err := pushStrings(argv)
+	if err != nil {
+		return err
+	}
+	envPtrs, err := pushStrings(envp)
+	if err != nil {
+		return err
+	}
+
+	auxv = append(append([]Aux(nil), auxv...),
+		Aux{AuxPagesz, pageSize},
+		Aux{AuxRandom, random},
+		Aux{AuxNull, 0},
+	)
+
+	var vector []uint64
+	vector = append(vector, uint64(len(argv)))
+	vector = append(append(vector, argPtrs...), 0)
+	vector = append(append(vector, envPtrs...), 0)
+	for _, a := range auxv {
+		vector = append(vector, a.Type, a.Value)
+	}
+
+	sp = (sp - uint64(len(vector))*word) &^ 15
+	if sp < top-size {
+		return EFAULT
+	}
+	for i, v := range vector {
+		if err := m.WriteUint(sp+uint64(i)*word, k.wordSize, v); err != nil {
+			return err
+		}
+	}
+
+	return k.emu.WriteRegister(k.abi.sp, sp)
+}
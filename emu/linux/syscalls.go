@@ -0,0 +1,515 @@
+package linux
+
+import (
+	"errors"
+
+	"github.com/dzonerzy/gopcode/emu"
+)
+
+var builtins = map[call]Handler{
+	callRead:          (*Kernel).sysRead,
+	callWrite:         (*Kernel).sysWrite,
+	callOpen:          (*Kernel).sysOpen,
+	callOpenat:        (*Kernel).sysOpenat,
+	callClose:         (*Kernel).sysClose,
+	callLseek:         (*Kernel).sysLseek,
+	callReadv:         (*Kernel).sysReadv,
+	callWritev:        (*Kernel).sysWritev,
+	callUnlink:        (*Kernel).sysUnlink,
+	callUnlinkat:      (*Kernel).sysUnlinkat,
+	callBrk:           (*Kernel).sysBrk,
+	callMmap:          (*Kernel).sysMmap,
+	callMmap2:         (*Kernel).sysMmap2,
+	callMunmap:        (*Kernel).sysMunmap,
+	callMprotect:      (*Kernel).sysMprotect,
+	callExit:          (*Kernel).sysExit,
+	callExitGroup:     (*Kernel).sysExit,
+	callGetpid:        (*Kernel).sysGetpid,
+	callGettid:        (*Kernel).sysGetpid,
+	callSetTidAddress: (*Kernel).sysGetpid,
+	callIoctl:         (*Kernel).sysIoctl,
+	callUname:         (*Kernel).sysUname,
+	callArchPrctl:     (*Kernel).sysArchPrctl,
+}
+
+const (
+	atFDCWD = -100
+
+	oAccMode = 0x3
+	oRDONLY  = 0x0
+	oWRONLY  = 0x1
+	oRDWR    = 0x2
+	oTrunc   = 0x200
+
+	protRead  = 0x1
+	protWrite = 0x2
+	protExec  = 0x4
+	mapFixed  = 0x10
+
+	// maxIO bounds the bytes moved by a read or write, which may be short
+	maxIO   = 1 << 20
+	maxPath = 4096
+)
+
+// memoryError turns a fault on the memory of the program into EFAULT.
+func memoryError(err error) error {
+	var fault *emu.Fault
+	if errors.As(err, &fault) {
+		return EFAULT
+	}
+	return err
+}
+
+func (k *Kernel) readMemory(addr, size uint64) ([]byte, error) {
+	buf := make([]byte, size)
+	if err := k.emu.Memory().Read(addr, buf); err != nil {
+		return nil, memoryError(err)
+	}
+	return buf, nil
+}
+
+func (k *Kernel) writeMemory(addr uint64, data []byte) error {
+	return memoryError(k.emu.Memory().Write(addr, data))
+}
+
+func (k *Kernel) readWord(addr uint64) (uint64, error) {
+	v, err := k.emu.Memory().ReadUint(addr, k.wordSize)
+	return v, memoryError(err)
+}
+
+func (k *Kernel) readString(addr uint64) (string, error) {
+	var s []byte
+	b := make([]byte, 1)
+	for len(s) < maxPath {
+		if err := k.emu.Memory().Read(addr+uint64(len(s)), b); err != nil {
+			return "", memoryError(err)
+		}
+		if b[0] == 0 {
+			return string(s), nil
+		}
+		s = append(s, b[0])
+	}
+	return "", EINVAL
+}
+
+func (k *Kernel) file(fd uint64) (file, error) {
+	f, ok := k.files[int(int32(fd))]
+	if !ok {
+		return nil, EBADF
+	}
+	return f, nil
+}
+
+func (k *Kernel) sysRead(args []uint64) (uint64, error) {
+	f, err := k.file(args[0])
+	if err != nil {
+		return 0, err
+	}
+
+	size := args[2]
+	if size > maxIO {
+		size = maxIO
+	}
+
+	buf := make([]byte, size)
+	n, err := f.read(buf)
+	if err != nil {
+		return 0, err
+	}
+	if err := k.writeMemory(args[1], buf[:n]); err != nil {
+		// the data did not reach the guest, keep it for the next read
+		f.unread(buf[:n])
+		return 0, err
+	}
+	return uint64(n), nil
+}
+
+func (k *Kernel) sysWrite(args []uint64) (uint64, error) {
+	f, err := k.file(args[0])
+	if err != nil {
+		return 0, err
+	}
+
+	size := args[2]
+	if size > maxIO {
+		size = maxIO
+	}
+
+	buf, err := k.readMemory(args[1], size)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := f.write(buf)
+	return uint64(n), err
+}
+
+// iovecs reads an array of struct iovec.
+func (k *Kernel) iovecs(addr, count uint64) ([][2]uint64, error) {
+	if count > 1024 {
+		return nil, EINVAL
+	}
+
+	vecs := make([][2]uint64, count)
+	word := uint64(k.wordSize)
+	for i := range vecs {
+		base, err := k.readWord(addr + uint64(i)*2*word)
+		if err != nil {
+			return nil, err
+		}
+		size, err := k.readWord(addr + uint64(i)*2*word + word)
+		if err != nil {
+			return nil, err
+		}
+		vecs[i] = [2]uint64{base, size}
+	}
+	return vecs, nil
+}
+
+func (k *Kernel) sysReadv(args []uint64) (uint64, error) {
+	vecs, err := k.iovecs(args[1], args[2])
+	if err != nil {
+		return 0, err
+	}
+
+	var total uint64
+	for _, v := range vecs {
+		n, err := k.sysRead([]uint64{args[0], v[0], v[1]})
+		if err != nil {
+			if total != 0 {
+				break
+			}
+			return 0, err
+		}
+		total += n
+		if n < v[1] {
+			break
+		}
+	}
+	return total, nil
+}
+
+func (k *Kernel) sysWritev(args []uint64) (uint64, error) {
+	vecs, err := k.iovecs(args[1], args[2])
+	if err != nil {
+		return 0, err
+	}
+
+	var total uint64
+	for _, v := range vecs {
+		n, err := k.sysWrite([]uint64{args[0], v[0], v[1]})
+		if err != nil {
+			if total != 0 {
+				break
+			}
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func (k *Kernel) sysOpen(args []uint64) (uint64, error) {
+	return k.open(atFDCWD, args[0], args[1])
+}
+
+func (k *Kernel) sysOpenat(args []uint64) (uint64, error) {
+	return k.open(int32(args[0]), args[1], args[2])
+}
+
+// path reads the path argument of a *at call. Only absolute paths and paths
+// relative to the working directory, the root, are supported.
+func (k *Kernel) path(dirfd int32, addr uint64) (string, error) {
+	name, err := k.readString(addr)
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		return "", ENOENT
+	}
+	if name[0] != '/' && dirfd != atFDCWD {
+		return "", ENOTDIR
+	}
+	return cleanPath(name), nil
+}
+
+func (k *Kernel) open(dirfd int32, pathname, flags uint64) (uint64, error) {
+	name, err := k.path(dirfd, pathname)
+	if err != nil {
+		return 0, err
+	}
+
+	node, ok := k.FS.files[name]
+	switch {
+	case !ok && flags&k.abi.oCreat == 0:
+		return 0, ENOENT
+	case !ok:
+		node = &inode{}
+		k.FS.files[name] = node
+	case flags&k.abi.oCreat != 0 && flags&k.abi.oExcl != 0:
+		return 0, EEXIST
+	}
+
+	f := &memFile{node: node, app: flags&k.abi.oAppend != 0}
+	switch flags & oAccMode {
+	case oRDONLY:
+		f.readable = true
+	case oWRONLY:
+		f.writable = true
+	case oRDWR:
+		f.readable, f.writable = true, true
+	default:
+		return 0, EINVAL
+	}
+	if flags&oTrunc != 0 && f.writable {
+		node.data = nil
+	}
+
+	for fd := 0; fd < maxFDs; fd++ {
+		if _, used := k.files[fd]; !used {
+			k.files[fd] = f
+			return uint64(fd), nil
+		}
+	}
+	return 0, EMFILE
+}
+
+func (k *Kernel) sysClose(args []uint64) (uint64, error) {
+	if _, err := k.file(args[0]); err != nil {
+		return 0, err
+	}
+	delete(k.files, int(int32(args[0])))
+	return 0, nil
+}
+
+func (k *Kernel) sysLseek(args []uint64) (uint64, error) {
+	f, err := k.file(args[0])
+	if err != nil {
+		return 0, err
+	}
+
+	off, err := f.seek(k.signed(args[1]), int(args[2]))
+	return uint64(off), err
+}
+
+func (k *Kernel) sysUnlink(args []uint64) (uint64, error) {
+	return k.unlink(atFDCWD, args[0])
+}
+
+func (k *Kernel) sysUnlinkat(args []uint64) (uint64, error) {
+	return k.unlink(int32(args[0]), args[1])
+}
+
+func (k *Kernel) unlink(dirfd int32, pathname uint64) (uint64, error) {
+	name, err := k.path(dirfd, pathname)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := k.FS.files[name]; !ok {
+		return 0, ENOENT
+	}
+
+	delete(k.FS.files, name)
+	return 0, nil
+}
+
+// sysBrk moves the program break. Like the kernel it returns the current
+// break when the request cannot be satisfied.
+func (k *Kernel) sysBrk(args []uint64) (uint64, error) {
+	addr := args[0]
+	if k.brkStart == 0 || addr < k.brkStart {
+		return k.brk, nil
+	}
+
+	m := k.emu.Memory()
+	old, end := pageAlign(k.brk), pageAlign(addr)
+	switch {
+	case end > old:
+		for p := old; p < end; p += pageSize {
+			if m.IsMapped(p) {
+				return k.brk, nil
+			}
+		}
+		if err := m.Map(old, end-old, emu.PermRW); err != nil {
+			return k.brk, nil
+		}
+	case end < old:
+		m.Unmap(end, old-end)
+	}
+
+	k.brk = addr
+	return addr, nil
+}
+
+func (k *Kernel) sysMmap2(args []uint64) (uint64, error) {
+	return k.sysMmap([]uint64{args[0], args[1], args[2], args[3], args[4], args[5] * pageSize})
+}
+
+func (k *Kernel) sysMmap(args []uint64) (uint64, error) {
+	addr, length, prot, flags, fd, offset := args[0], args[1], args[2], args[3], args[4], args[5]
+	if length == 0 || addr%pageSize != 0 || offset%pageSize != 0 {
+		return 0, EINVAL
+	}
+	size := pageAlign(length)
+
+	var src *memFile
+	if flags&k.abi.mapAnon == 0 {
+		f, err := k.file(fd)
+		if err != nil {
+			return 0, err
+		}
+		mf, ok := f.(*memFile)
+		if !ok || !mf.readable {
+			return 0, EACCES
+		}
+		src = mf
+	}
+
+	m := k.emu.Memory()
+	switch {
+	case flags&mapFixed != 0:
+		m.Unmap(addr, size)
+	case addr == 0 || !k.isFree(addr, size):
+		addr = k.findFree(size)
+		if addr == 0 {
+			return 0, ENOMEM
+		}
+		k.mmapBase = addr + size
+	}
+
+	if err := m.Map(addr, size, protPerm(prot)); err != nil {
+		return 0, ENOMEM
+	}
+
+	if src != nil && offset < uint64(len(src.node.data)) {
+		data := src.node.data[offset:]
+		if uint64(len(data)) > length {
+			data = data[:length]
+		}
+		if err := m.Poke(addr, data); err != nil {
+			return 0, err
+		}
+	}
+
+	return addr, nil
+}
+
+func (k *Kernel) isFree(addr, size uint64) bool {
+	m := k.emu.Memory()
+	for p := addr; p < addr+size; p += pageSize {
+		if p < addr || m.IsMapped(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// findFree returns the first free range of size bytes from the mmap base, or
+// 0 if there is none.
+func (k *Kernel) findFree(size uint64) uint64 {
+	m := k.emu.Memory()
+	for addr := k.mmapBase; addr+size > addr; {
+		p := addr
+		for ; p < addr+size && !m.IsMapped(p); p += pageSize {
+		}
+		if p >= addr+size {
+			return addr
+		}
+		addr = p + pageSize
+	}
+	return 0
+}
+
+func protPerm(prot uint64) emu.Perm {
+	var perm emu.Perm
+	if prot&protRead != 0 {
+		perm |= emu.PermRead
+	}
+	if prot&protWrite != 0 {
+		perm |= emu.PermWrite
+	}
+	if prot&protExec != 0 {
+		perm |= emu.PermExec
+	}
+	return perm
+}
+
+func (k *Kernel) sysMunmap(args []uint64) (uint64, error) {
+	if args[0]%pageSize != 0 || args[1] == 0 {
+		return 0, EINVAL
+	}
+	k.emu.Memory().Unmap(args[0], pageAlign(args[1]))
+	return 0, nil
+}
+
+func (k *Kernel) sysMprotect(args []uint64) (uint64, error) {
+	if args[0]%pageSize != 0 {
+		return 0, EINVAL
+	}
+	if args[1] == 0 {
+		return 0, nil
+	}
+	if err := k.emu.Memory().Protect(args[0], pageAlign(args[1]), protPerm(args[2])); err != nil {
+		return 0, ENOMEM
+	}
+	return 0, nil
+}
+
+func (k *Kernel) sysExit(args []uint64) (uint64, error) {
+	k.exited, k.exitCode = true, int(args[0]&0xff)
+	k.emu.Stop()
+	return 0, nil
+}
+
+// sysGetpid also implements gettid and set_tid_address: the program is the
+// only process and thread.
+func (k *Kernel) sysGetpid(args []uint64) (uint64, error) {
+	return 1, nil
+}
+
+// sysIoctl reports that no descriptor is a terminal.
+func (k *Kernel) sysIoctl(args []uint64) (uint64, error) {
+	if _, err := k.file(args[0]); err != nil {
+		return 0, err
+	}
+	return 0, ENOTTY
+}
+
+func (k *Kernel) sysUname(args []uint64) (uint64, error) {
+	// struct utsname is six 65 byte strings on every architecture
+	fields := []string{"Linux", "gopcode", "5.15.0", "#1", k.abi.machine, ""}
+	buf := make([]byte, 65*len(fields))
+	for i, f := range fields {
+		copy(buf[i*65:], f)
+	}
+	return 0, k.writeMemory(args[0], buf)
+}
+
+func (k *Kernel) sysArchPrctl(args []uint64) (uint64, error) {
+	const (
+		setGS = 0x1001
+		setFS = 0x1002
+		getFS = 0x1003
+		getGS = 0x1004
+	)
+
+	var reg string
+	switch args[0] {
+	case setFS, getFS:
+		reg = "FS_OFFSET"
+	case setGS, getGS:
+		reg = "GS_OFFSET"
+	default:
+		return 0, EINVAL
+	}
+
+	if args[0] == setFS || args[0] == setGS {
+		return 0, k.emu.WriteRegister(reg, args[1])
+	}
+
+	v, err := k.emu.ReadRegister(reg)
+	if err != nil {
+		return 0, err
+	}
+	return 0, memoryError(k.emu.Memory().WriteUint(args[1], k.wordSize, v))
+}
@@ -0,0 +1,450 @@
+package emu
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/dzonerzy/gopcode"
+)
+
+// Perm is a set of access permissions of mapped memory.
+type Perm uint8
+
+const (
+	PermRead Perm = 1 << iota
+	PermWrite
+	PermExec
+
+	PermRW  = PermRead | PermWrite
+	PermRX  = PermRead | PermExec
+	PermRWX = PermRead | PermWrite | PermExec
+)
+
+func (p Perm) String() string {
+	s := []byte("---")
+	if p&PermRead != 0 {
+		s[0] = 'r'
+	}
+	if p&PermWrite != 0 {
+		s[1] = 'w'
+	}
+	if p&PermExec != 0 {
+		s[2] = 'x'
+	}
+	return string(s)
+}
+
+// Access is the kind of a memory access.
+type Access int
+
+const (
+	AccessRead Access = iota
+	AccessWrite
+	AccessFetch
+)
+
+func (a Access) String() string {
+	switch a {
+	case AccessRead:
+		return "read"
+	case AccessWrite:
+		return "write"
+	case AccessFetch:
+		return "fetch"
+	}
+	return fmt.Sprintf("access %d", int(a))
+}
+
+func (a Access) perm() Perm {
+	switch a {
+	case AccessWrite:
+		return PermWrite
+	case AccessFetch:
+		return PermExec
+	}
+	return PermRead
+}
+
+// Fault describes an access to unmapped memory or one the permissions of the
+// memory do not allow. It is returned as the error of the access when no
+// fault handler resolves it.
+type Fault struct {
+	Memory   *Memory
+	Access   Access
+	Address  uint64 // address of the first faulting byte
+	Size     int
+	Unmapped bool
+}
+
+func (f *Fault) Error() string {
+	reason := "permission denied"
+	if f.Unmapped {
+		reason = "unmapped memory"
+	}
+	return fmt.Sprintf("%s fault at %s:0x%x (%d bytes): %s", f.Access, f.Memory.Space().Name, f.Address, f.Size, reason)
+}
+
+// FaultHandler is called on a memory fault. It can map or change the
+// permissions of the memory, e.g. with f.Memory.Map, and returns true to
+// retry the access or false to fail it with the fault.
+type FaultHandler func(e *Emulator, f *Fault) bool
+
+// Region is a run of mapped memory with the same permissions.
+type Region struct {
+	Start uint64
+	Size  uint64
+	Perm  Perm
+}
+
+// page is a page of memory. Pages captured by a snapshot are frozen and
+// copied before they are modified.
+type page struct {
+	data   [pageSize]byte
+	frozen bool
+}
+
+// writablePage returns the page p, allocating it on first write and copying
+// it first if it is frozen.
+func (m *Memory) writablePage(p uint64) *page {
+	pg, ok := m.pages[p]
+	if !ok {
+		pg = &page{}
+		m.pages[p] = pg
+	} else if pg.frozen {
+		cp := *pg
+		cp.frozen = false
+		pg = &cp
+		m.pages[p] = pg
+	}
+	return pg
+}
+
+// mapping is a run of mapped pages, first to last included, with the same
+// permissions.
+type mapping struct {
+	first, last uint64
+	perm        Perm
+}
+
+// Memory is the sparse, paged contents of an address space such as ram.
+// Addresses are byte offsets, like the offsets of varnodes; the pointers of
+// LOAD and STORE ops are scaled by the word size of the space before they
+// reach the memory.
+//
+// Mapping memory only records the range and its permissions: pages are
+// allocated on first write and read as zeros until then, so mapping a large
+// range costs nothing up front.
+type Memory struct {
+	emu       *Emulator
+	space     *gopcode.AddrSpace
+	wordSize  uint64
+	bigEndian bool
+	maps      []mapping // sorted, never modified in place
+	pages     map[uint64]*page
+}
+
+func newMemory(e *Emulator, space *gopcode.AddrSpace) *Memory {
+	wordSize := uint64(space.WordSize)
+	if wordSize == 0 {
+		wordSize = 1
+	}
+
+	return &Memory{
+		emu:       e,
+		space:     space,
+		wordSize:  wordSize,
+		bigEndian: space.Flags&gopcode.BigEndian != 0,
+		pages:     map[uint64]*page{},
+	}
+}
+
+// Space returns the address space of the memory.
+func (m *Memory) Space() *gopcode.AddrSpace {
+	return m.space
+}
+
+// WordSize returns the number of bytes addressed by one unit of a pointer
+// into the space.
+func (m *Memory) WordSize() uint64 {
+	return m.wordSize
+}
+
+// IsBigEndian reports whether multi-byte values are stored big endian.
+func (m *Memory) IsBigEndian() bool {
+	return m.bigEndian
+}
+
+// pageRange returns the pages covering size bytes at addr.
+func (m *Memory) pageRange(addr, size uint64) (first, last uint64) {
+	return addr / pageSize, (addr + size - 1) / pageSize
+}
+
+// mapping returns the mapping of page p.
+func (m *Memory) mapping(p uint64) (mapping, bool) {
+	i := sort.Search(len(m.maps), func(i int) bool { return m.maps[i].last >= p })
+	if i < len(m.maps) && m.maps[i].first <= p {
+		return m.maps[i], true
+	}
+	return mapping{}, false
+}
+
+// remap sets the permissions of the pages first to last, or unmaps them,
+// merging the mappings left with the same permissions.
+func (m *Memory) remap(first, last uint64, perm Perm, mapped bool) {
+	var maps []mapping
+	for _, r := range m.maps {
+		if r.last < first || r.first > last {
+			maps = append(maps, r)
+			continue
+		}
+		if r.first < first {
+			maps = append(maps, mapping{r.first, first - 1, r.perm})
+		}
+		if r.last > last {
+			maps = append(maps, mapping{last + 1, r.last, r.perm})
+		}
+	}
+	if mapped {
+		maps = append(maps, mapping{first, last, perm})
+	}
+	sort.Slice(maps, func(i, j int) bool { return maps[i].first < maps[j].first })
+
+	merged := maps[:0]
+	for _, r := range maps {
+		if n := len(merged); n != 0 && merged[n-1].perm == r.perm && merged[n-1].last+1 == r.first {
+			merged[n-1].last = r.last
+			continue
+		}
+		merged = append(merged, r)
+	}
+	m.maps = merged
+}
+
+// Map maps size bytes at addr with the given permissions, extended to whole
+// pages. New pages read as zeros, pages already mapped keep their contents
+// and take the new permissions.
+func (m *Memory) Map(addr, size uint64, perm Perm) error {
+	if size == 0 {
+		return fmt.Errorf("cannot map an empty range")
+	}
+
+	first, last := m.pageRange(addr, size)
+	if last < first {
+		return fmt.Errorf("range at 0x%x wraps around", addr)
+	}
+	m.remap(first, last, perm, true)
+
+	m.emu.traceEvent(TraceEvent{Kind: TraceMap, Space: m.space.Name, Address: addr, Size: size, Perm: perm})
+	return nil
+}
+
+// Unmap removes the pages covering size bytes at addr.
+func (m *Memory) Unmap(addr, size uint64) {
+	if size == 0 {
+		return
+	}
+
+	first, last := m.pageRange(addr, size)
+	m.remap(first, last, 0, false)
+	if last-first < uint64(len(m.pages)) {
+		for p := first; ; p++ {
+			delete(m.pages, p)
+			if p == last {
+				break
+			}
+		}
+	} else {
+		for p := range m.pages {
+			if p >= first && p <= last {
+				delete(m.pages, p)
+			}
+		}
+	}
+	m.emu.invalidate(m, addr, size)
+	m.emu.traceEvent(TraceEvent{Kind: TraceUnmap, Space: m.space.Name, Address: addr, Size: size})
+}
+
+// Protect changes the permissions of the mapped pages covering size bytes at
+// addr.
+func (m *Memory) Protect(addr, size uint64, perm Perm) error {
+	if size == 0 {
+		return nil
+	}
+
+	first, last := m.pageRange(addr, size)
+	for p := first; ; {
+		r, ok := m.mapping(p)
+		if !ok {
+			return &Fault{Memory: m, Access: AccessWrite, Address: p * pageSize, Size: pageSize, Unmapped: true}
+		}
+		if r.last >= last {
+			break
+		}
+		p = r.last + 1
+	}
+	m.remap(first, last, perm, true)
+	if perm&PermExec == 0 {
+		// the cached translations would otherwise still run
+		m.emu.invalidate(m, addr, size)
+	}
+
+	m.emu.traceEvent(TraceEvent{Kind: TraceMap, Space: m.space.Name, Address: addr, Size: size, Perm: perm})
+	return nil
+}
+
+// IsMapped reports whether addr is mapped.
+func (m *Memory) IsMapped(addr uint64) bool {
+	_, ok := m.mapping(addr / pageSize)
+	return ok
+}
+
+// Regions returns the mapped memory sorted by address, with adjacent pages of
+// the same permissions merged.
+func (m *Memory) Regions() []Region {
+	regions := make([]Region, 0, len(m.maps))
+	for _, r := range m.maps {
+		regions = append(regions, Region{Start: r.first * pageSize, Size: (r.last - r.first + 1) * pageSize, Perm: r.perm})
+	}
+	return regions
+}
+
+// check finds the first byte of an access that is unmapped or not allowed,
+// and returns the number of bytes accessible before it.
+func (m *Memory) check(addr uint64, size int, access Access, checkPerm bool) (int, *Fault) {
+	for n := 0; n < size; {
+		off := addr + uint64(n)
+		r, ok := m.mapping(off / pageSize)
+		if !ok || (checkPerm && r.perm&access.perm() == 0) {
+			return n, &Fault{Memory: m, Access: access, Address: off, Size: size - n, Unmapped: !ok}
+		}
+
+		// the end of the mapping is 0 at the top of the space
+		end := (r.last + 1) * pageSize
+		if end == 0 || end-off >= uint64(size-n) {
+			break
+		}
+		n += int(end - off)
+	}
+	return size, nil
+}
+
+// access checks an access and gives the fault handler a chance to resolve a
+// fault before failing it.
+func (m *Memory) access(addr uint64, size int, access Access, checkPerm bool) error {
+	for {
+		_, fault := m.check(addr, size, access, checkPerm)
+		if fault == nil {
+			return nil
+		}
+
+		h := m.emu.faultHandler
+		if h == nil || !h(m.emu, fault) {
+			return fault
+		}
+	}
+}
+
+func (m *Memory) copyOut(addr uint64, buf []byte) {
+	for n := 0; n < len(buf); {
+		off := addr + uint64(n)
+		chunk := buf[n:]
+		if len(chunk) > int(pageSize-off%pageSize) {
+			chunk = chunk[:pageSize-off%pageSize]
+		}
+
+		if pg, ok := m.pages[off/pageSize]; ok {
+			copy(chunk, pg.data[off%pageSize:])
+		} else {
+			for i := range chunk {
+				chunk[i] = 0
+			}
+		}
+		n += len(chunk)
+	}
+}
+
+func (m *Memory) copyIn(addr uint64, data []byte) {
+	for n := 0; n < len(data); {
+		off := addr + uint64(n)
+		pg := m.writablePage(off / pageSize)
+		n += copy(pg.data[off%pageSize:], data[n:])
+	}
+	m.emu.invalidate(m, addr, uint64(len(data)))
+	m.emu.traceEvent(TraceEvent{Kind: TraceWrite, Space: m.space.Name, Address: addr, Data: data})
+}
+
+// Read reads len(buf) bytes at addr, as the LOAD of a program would.
+func (m *Memory) Read(addr uint64, buf []byte) error {
+	if err := m.access(addr, len(buf), AccessRead, true); err != nil {
+		return err
+	}
+	m.copyOut(addr, buf)
+	return m.emu.runMemoryHooks(m, AccessRead, addr, buf)
+}
+
+// Write writes data at addr, as the STORE of a program would. Cached
+// translations of the written bytes are discarded, so self-modifying code
+// executes its new instructions.
+func (m *Memory) Write(addr uint64, data []byte) error {
+	if err := m.access(addr, len(data), AccessWrite, true); err != nil {
+		return err
+	}
+	if err := m.emu.runMemoryHooks(m, AccessWrite, addr, data); err != nil {
+		return err
+	}
+	m.copyIn(addr, data)
+	return nil
+}
+
+// Peek reads mapped memory regardless of its permissions.
+func (m *Memory) Peek(addr uint64, buf []byte) error {
+	if err := m.access(addr, len(buf), AccessRead, false); err != nil {
+		return err
+	}
+	m.copyOut(addr, buf)
+	return nil
+}
+
+// Poke writes mapped memory regardless of its permissions, e.g. to load
+// code into read-only pages.
+func (m *Memory) Poke(addr uint64, data []byte) error {
+	if err := m.access(addr, len(data), AccessWrite, false); err != nil {
+		return err
+	}
+	m.copyIn(addr, data)
+	return nil
+}
+
+// Fetch reads up to len(buf) bytes of executable memory at addr for decoding.
+// It stops at the first byte that is not executable and faults only if there
+// is none at addr.
+func (m *Memory) Fetch(addr uint64, buf []byte) (int, error) {
+	for {
+		n, fault := m.check(addr, len(buf), AccessFetch, true)
+		if n != 0 || fault == nil {
+			m.copyOut(addr, buf[:n])
+			return n, nil
+		}
+
+		h := m.emu.faultHandler
+		if h == nil || !h(m.emu, fault) {
+			return 0, fault
+		}
+	}
+}
+
+// ReadUint reads a value of up to 8 bytes in the byte order of the memory.
+func (m *Memory) ReadUint(addr uint64, size int) (uint64, error) {
+	buf := make([]byte, size)
+	if err := m.Read(addr, buf); err != nil {
+		return 0, err
+	}
+	return bytesToUint(buf, m.bigEndian), nil
+}
+
+// WriteUint writes the low size bytes of v in the byte order of the memory.
+func (m *Memory) WriteUint(addr uint64, size int, v uint64) error {
+	buf := make([]byte, size)
+	uintToBytes(v, buf, m.bigEndian)
+	return m.Write(addr, buf)
+}
@@ -0,0 +1,226 @@
+package emu
+
+import (
+	"fmt"
+	"math/big"
+	"math/bits"
+
+	"github.com/dzonerzy/gopcode"
+	"github.com/dzonerzy/gopcode/internal/word"
+)
+
+func bigMask(size int) *big.Int {
+	m := new(big.Int).Lsh(big.NewInt(1), uint(size)*8)
+	return m.Sub(m, big.NewInt(1))
+}
+
+// bigSigned interprets a value of size bytes as two's complement.
+func bigSigned(v *big.Int, size int) *big.Int {
+	v = new(big.Int).And(v, bigMask(size))
+	if v.Bit(size*8-1) == 1 {
+		v.Sub(v, new(big.Int).Lsh(big.NewInt(1), uint(size)*8))
+	}
+	return v
+}
+
+// isWide reports whether an op involves a varnode larger than 8 bytes and has
+// to be evaluated with arbitrary precision.
+func isWide(op gopcode.PcodeOp) bool {
+	if op.Output != nil && op.Output.Size > 8 {
+		return true
+	}
+	for _, in := range op.Inputs {
+		if in.Size > 8 {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate executes an op that only reads its inputs and writes its output.
+func (e *Emulator) evaluate(op gopcode.PcodeOp) error {
+	if op.Output == nil {
+		return fmt.Errorf("%s has no output", op.Opcode)
+	}
+
+	if isFloatOp(op.Opcode) {
+		return e.evaluateFloat(op)
+	}
+
+	if isWide(op) {
+		in := make([]*big.Int, len(op.Inputs))
+		for i, vn := range op.Inputs {
+			v, err := e.readBig(vn)
+			if err != nil {
+				return err
+			}
+			in[i] = v
+		}
+
+		out, err := evalBig(op, in)
+		if err != nil {
+			return err
+		}
+		return e.writeBig(op.Output, out)
+	}
+
+	in := make([]uint64, len(op.Inputs))
+	for i, vn := range op.Inputs {
+		v, err := e.readUint(vn)
+		if err != nil {
+			return err
+		}
+		in[i] = v
+	}
+
+	out, err := gopcode.EvaluateUint(op, in)
+	if err != nil {
+		return err
+	}
+	return e.writeUint(op.Output, out)
+}
+
+func checkInputs(op gopcode.PcodeOp, n int) error {
+	if len(op.Inputs) < n {
+		return fmt.Errorf("%s expects %d inputs, got %d", op.Opcode, n, len(op.Inputs))
+	}
+	return nil
+}
+
+// evalBig evaluates an op with arbitrary precision. The result is truncated
+// to the output size when written.
+func evalBig(op gopcode.PcodeOp, in []*big.Int) (*big.Int, error) {
+	n, ok := op.Opcode.Arity()
+	if !ok {
+		return nil, fmt.Errorf("unsupported opcode %s", op.Opcode)
+	}
+	if err := checkInputs(op, n); err != nil {
+		return nil, err
+	}
+
+	size := int(op.Inputs[0].Size)
+	outSize := int(op.Output.Size)
+	a := in[0]
+	var b *big.Int
+	if n > 1 {
+		b = in[1]
+	}
+	r := new(big.Int)
+
+	switch op.Opcode {
+	case gopcode.CPUI_COPY, gopcode.CPUI_INT_ZEXT, gopcode.CPUI_CAST, gopcode.CPUI_INDIRECT:
+		return a, nil
+	case gopcode.CPUI_INT_EQUAL:
+		return big.NewInt(int64(word.Bool(a.Cmp(b) == 0))), nil
+	case gopcode.CPUI_INT_NOTEQUAL:
+		return big.NewInt(int64(word.Bool(a.Cmp(b) != 0))), nil
+	case gopcode.CPUI_INT_SLESS:
+		return big.NewInt(int64(word.Bool(bigSigned(a, size).Cmp(bigSigned(b, size)) < 0))), nil
+	case gopcode.CPUI_INT_SLESSEQUAL:
+		return big.NewInt(int64(word.Bool(bigSigned(a, size).Cmp(bigSigned(b, size)) <= 0))), nil
+	case gopcode.CPUI_INT_LESS:
+		return big.NewInt(int64(word.Bool(a.Cmp(b) < 0))), nil
+	case gopcode.CPUI_INT_LESSEQUAL:
+		return big.NewInt(int64(word.Bool(a.Cmp(b) <= 0))), nil
+	case gopcode.CPUI_INT_SEXT:
+		return bigSigned(a, size), nil
+	case gopcode.CPUI_INT_ADD:
+		return r.Add(a, b), nil
+	case gopcode.CPUI_INT_SUB:
+		return r.Sub(a, b), nil
+	case gopcode.CPUI_INT_CARRY:
+		return big.NewInt(int64(word.Bool(r.Add(a, b).Cmp(bigMask(size)) > 0))), nil
+	case gopcode.CPUI_INT_SCARRY, gopcode.CPUI_INT_SBORROW:
+		sa, sb := bigSigned(a, size), bigSigned(b, size)
+		if op.Opcode == gopcode.CPUI_INT_SCARRY {
+			r.Add(sa, sb)
+		} else {
+			r.Sub(sa, sb)
+		}
+		return big.NewInt(int64(word.Bool(bigSigned(r, size).Cmp(r) != 0))), nil
+	case gopcode.CPUI_INT_2COMP:
+		return r.Neg(a), nil
+	case gopcode.CPUI_INT_NEGATE:
+		return r.Not(a), nil
+	case gopcode.CPUI_INT_XOR:
+		return r.Xor(a, b), nil
+	case gopcode.CPUI_INT_AND:
+		return r.And(a, b), nil
+	case gopcode.CPUI_INT_OR:
+		return r.Or(a, b), nil
+	case gopcode.CPUI_INT_LEFT:
+		if !b.IsUint64() || b.Uint64() >= uint64(outSize)*8 {
+			return r, nil
+		}
+		return r.Lsh(a, uint(b.Uint64())), nil
+	case gopcode.CPUI_INT_RIGHT:
+		if !b.IsUint64() || b.Uint64() >= uint64(size)*8 {
+			return r, nil
+		}
+		return r.Rsh(a, uint(b.Uint64())), nil
+	case gopcode.CPUI_INT_SRIGHT:
+		shift := uint64(size)*8 - 1
+		if b.IsUint64() && b.Uint64() < shift {
+			shift = b.Uint64()
+		}
+		return r.Rsh(bigSigned(a, size), uint(shift)), nil
+	case gopcode.CPUI_INT_MULT:
+		return r.Mul(a, b), nil
+	case gopcode.CPUI_INT_DIV, gopcode.CPUI_INT_REM:
+		if b.Sign() == 0 {
+			return nil, fmt.Errorf("%s: division by zero", op.Opcode)
+		}
+		if op.Opcode == gopcode.CPUI_INT_DIV {
+			return r.Quo(a, b), nil
+		}
+		return r.Rem(a, b), nil
+	case gopcode.CPUI_INT_SDIV, gopcode.CPUI_INT_SREM:
+		if b.Sign() == 0 {
+			return nil, fmt.Errorf("%s: division by zero", op.Opcode)
+		}
+		if op.Opcode == gopcode.CPUI_INT_SDIV {
+			return r.Quo(bigSigned(a, size), bigSigned(b, size)), nil
+		}
+		return r.Rem(bigSigned(a, size), bigSigned(b, size)), nil
+	case gopcode.CPUI_BOOL_NEGATE:
+		return big.NewInt(int64(word.Bool(a.Sign() == 0))), nil
+	case gopcode.CPUI_BOOL_XOR:
+		return big.NewInt(int64(word.Bool((a.Sign() != 0) != (b.Sign() != 0)))), nil
+	case gopcode.CPUI_BOOL_AND:
+		return big.NewInt(int64(word.Bool(a.Sign() != 0 && b.Sign() != 0))), nil
+	case gopcode.CPUI_BOOL_OR:
+		return big.NewInt(int64(word.Bool(a.Sign() != 0 || b.Sign() != 0))), nil
+	case gopcode.CPUI_PIECE:
+		return r.Or(r.Lsh(a, uint(op.Inputs[1].Size)*8), b), nil
+	case gopcode.CPUI_SUBPIECE:
+		if !b.IsUint64() || b.Uint64() >= uint64(size) {
+			return r, nil
+		}
+		return r.Rsh(a, uint(b.Uint64())*8), nil
+	case gopcode.CPUI_PTRADD:
+		return r.Add(a, r.Mul(b, in[2])), nil
+	case gopcode.CPUI_PTRSUB:
+		return r.Add(a, b), nil
+	case gopcode.CPUI_INSERT:
+		pos, width := uint(in[2].Uint64()), uint(in[3].Uint64())
+		m := new(big.Int).Lsh(big.NewInt(1), width)
+		m.Sub(m, big.NewInt(1))
+		r.AndNot(a, new(big.Int).Lsh(m, pos))
+		return r.Or(r, new(big.Int).Lsh(new(big.Int).And(b, m), pos)), nil
+	case gopcode.CPUI_EXTRACT:
+		pos, width := uint(b.Uint64()), uint(in[2].Uint64())
+		m := new(big.Int).Lsh(big.NewInt(1), width)
+		m.Sub(m, big.NewInt(1))
+		return r.And(r.Rsh(a, pos), m), nil
+	case gopcode.CPUI_POPCOUNT:
+		count := 0
+		for _, w := range new(big.Int).And(a, bigMask(size)).Bits() {
+			count += bits.OnesCount(uint(w))
+		}
+		return big.NewInt(int64(count)), nil
+	case gopcode.CPUI_LZCOUNT:
+		return big.NewInt(int64(size*8 - new(big.Int).And(a, bigMask(size)).BitLen())), nil
+	}
+
+	return nil, fmt.Errorf("unsupported opcode %s", op.Opcode)
+}
@@ -0,0 +1,97 @@
+package emu
+
+// Snapshot is a saved state of an emulator: the program counter, the
+// registers and the mapped memory with its permissions. Register and memory
+// pages are shared with the emulator and only copied when either side
+// modifies them, so taking a snapshot is cheap even with a lot of memory
+// mapped.
+type Snapshot struct {
+	pc       uint64
+	stores   map[string]map[uint64]*page
+	memories map[string]map[uint64]*page
+	maps     map[string][]mapping
+}
+
+// Snapshot saves the current state, see Restore.
+func (e *Emulator) Snapshot() *Snapshot {
+	s := &Snapshot{
+		pc:       e.pc,
+		stores:   make(map[string]map[uint64]*page, len(e.spaces)),
+		memories: make(map[string]map[uint64]*page, len(e.memories)),
+		maps:     make(map[string][]mapping, len(e.memories)),
+	}
+
+	for name, st := range e.spaces {
+		s.stores[name] = freezePages(st.pages)
+	}
+
+	for name, m := range e.memories {
+		s.memories[name] = freezePages(m.pages)
+		s.maps[name] = m.maps
+	}
+
+	return s
+}
+
+// Restore returns the emulator to the state saved by Snapshot. A snapshot can
+// be restored any number of times, but only by the emulator that took it.
+// Hooks are not part of the state and stay registered.
+func (e *Emulator) Restore(s *Snapshot) {
+	e.pc = s.pc
+
+	for name, st := range e.spaces {
+		st.pages = copyPages(s.stores[name])
+	}
+
+	for name, m := range e.memories {
+		saved := s.memories[name]
+
+		// discard the translations of the pages that differ
+		for p, pg := range m.pages {
+			if saved[p] != pg {
+				e.invalidate(m, p*pageSize, pageSize)
+			}
+		}
+		for p := range saved {
+			if _, ok := m.pages[p]; !ok {
+				e.invalidate(m, p*pageSize, pageSize)
+			}
+		}
+
+		// and of the mappings whose permissions differ
+		for _, r := range m.maps {
+			if !containsMapping(s.maps[name], r) {
+				e.invalidate(m, r.first*pageSize, (r.last-r.first+1)*pageSize)
+			}
+		}
+
+		m.pages = copyPages(saved)
+		m.maps = s.maps[name]
+	}
+}
+
+// freezePages returns a copy of the page map sharing the pages, which are
+// frozen so that they are copied before they are modified.
+func freezePages(pages map[uint64]*page) map[uint64]*page {
+	for _, pg := range pages {
+		pg.frozen = true
+	}
+	return copyPages(pages)
+}
+
+func copyPages(pages map[uint64]*page) map[uint64]*page {
+	cp := make(map[uint64]*page, len(pages))
+	for p, pg := range pages {
+		cp[p] = pg
+	}
+	return cp
+}
+
+func containsMapping(maps []mapping, r mapping) bool {
+	for _, o := range maps {
+		if o == r {
+			return true
+		}
+	}
+	return false
+}
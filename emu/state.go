@@ -0,0 +1,223 @@
+package emu
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"github.com/dzonerzy/gopcode"
+	"github.com/dzonerzy/gopcode/internal/word"
+)
+
+const pageSize = 0x1000
+
+// store is a sparse byte store backing the register and unique spaces.
+// Pages are allocated on first write and read as zeros until then. Like the
+// pages of a Memory, pages captured by a snapshot are frozen and copied before
+// they are modified.
+type store struct {
+	pages map[uint64]*page
+}
+
+func newStore() *store {
+	return &store{pages: map[uint64]*page{}}
+}
+
+func (s *store) read(offset uint64, buf []byte) {
+	for n := 0; n < len(buf); {
+		p, off := (offset+uint64(n))/pageSize, (offset+uint64(n))%pageSize
+		chunk := buf[n:]
+		if len(chunk) > int(pageSize-off) {
+			chunk = chunk[:pageSize-off]
+		}
+
+		if pg, ok := s.pages[p]; ok {
+			copy(chunk, pg.data[off:])
+		} else {
+			for i := range chunk {
+				chunk[i] = 0
+			}
+		}
+		n += len(chunk)
+	}
+}
+
+func (s *store) write(offset uint64, data []byte) {
+	for n := 0; n < len(data); {
+		p, off := (offset+uint64(n))/pageSize, (offset+uint64(n))%pageSize
+
+		pg, ok := s.pages[p]
+		if !ok {
+			pg = &page{}
+			s.pages[p] = pg
+		} else if pg.frozen {
+			cp := *pg
+			cp.frozen = false
+			pg = &cp
+			s.pages[p] = pg
+		}
+		n += copy(pg.data[off:], data[n:])
+	}
+}
+
+// bytesToUint decodes up to 8 bytes in the given byte order.
+func bytesToUint(buf []byte, bigEndian bool) uint64 {
+	var tmp [8]byte
+	if bigEndian {
+		copy(tmp[8-len(buf):], buf)
+		return binary.BigEndian.Uint64(tmp[:])
+	}
+	copy(tmp[:], buf)
+	return binary.LittleEndian.Uint64(tmp[:])
+}
+
+// uintToBytes encodes the low len(buf) bytes of v in the given byte order.
+func uintToBytes(v uint64, buf []byte, bigEndian bool) {
+	var tmp [8]byte
+	if bigEndian {
+		binary.BigEndian.PutUint64(tmp[:], v)
+		copy(buf, tmp[8-len(buf):])
+		return
+	}
+	binary.LittleEndian.PutUint64(tmp[:], v)
+	copy(buf, tmp[:])
+}
+
+func bytesToBig(buf []byte, bigEndian bool) *big.Int {
+	if bigEndian {
+		return new(big.Int).SetBytes(buf)
+	}
+
+	rev := make([]byte, len(buf))
+	for i, b := range buf {
+		rev[len(buf)-1-i] = b
+	}
+	return new(big.Int).SetBytes(rev)
+}
+
+// bigToBytes encodes v, truncated to len(buf) bytes, in the given byte order.
+func bigToBytes(v *big.Int, buf []byte, bigEndian bool) {
+	v = new(big.Int).And(v, bigMask(len(buf)))
+	v.FillBytes(buf)
+
+	if !bigEndian {
+		for i, j := 0, len(buf)-1; i < j; i, j = i+1, j-1 {
+			buf[i], buf[j] = buf[j], buf[i]
+		}
+	}
+}
+
+// isMemory reports whether a space is backed by a Memory, with mapped regions
+// and permissions, rather than a plain store.
+func isMemory(space *gopcode.AddrSpace) bool {
+	switch space.Name {
+	case "register", "unique", "const":
+		return false
+	}
+	return true
+}
+
+func isBigEndian(space *gopcode.AddrSpace) bool {
+	return space.Flags&gopcode.BigEndian != 0
+}
+
+// spaceStore returns the store of the named space, creating it on first use.
+func (e *Emulator) spaceStore(space *gopcode.AddrSpace) *store {
+	s, ok := e.spaces[space.Name]
+	if !ok {
+		s = newStore()
+		e.spaces[space.Name] = s
+	}
+	return s
+}
+
+// memory returns the memory of a space, creating it on first use.
+func (e *Emulator) memory(space *gopcode.AddrSpace) *Memory {
+	m, ok := e.memories[space.Name]
+	if !ok {
+		m = newMemory(e, space)
+		e.memories[space.Name] = m
+	}
+	return m
+}
+
+// readSpace reads len(buf) bytes at offset in a space, checking the
+// permissions of memory spaces.
+func (e *Emulator) readSpace(space *gopcode.AddrSpace, offset uint64, buf []byte) error {
+	if isMemory(space) {
+		return e.memory(space).Read(offset, buf)
+	}
+
+	e.spaceStore(space).read(offset, buf)
+	return nil
+}
+
+func (e *Emulator) writeSpace(space *gopcode.AddrSpace, offset uint64, data []byte) error {
+	if isMemory(space) {
+		return e.memory(space).Write(offset, data)
+	}
+
+	e.spaceStore(space).write(offset, data)
+	if space.Name != "unique" {
+		e.traceEvent(TraceEvent{Kind: TraceWrite, Space: space.Name, Address: offset, Data: data})
+	}
+	return nil
+}
+
+func (e *Emulator) readBytes(vn *gopcode.VarNode) ([]byte, error) {
+	if vn.Space.Name == "const" {
+		return nil, fmt.Errorf("cannot read the bytes of a constant")
+	}
+
+	buf := make([]byte, vn.Size)
+	if err := e.readSpace(vn.Space, vn.Offset, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (e *Emulator) writeBytes(vn *gopcode.VarNode, data []byte) error {
+	if vn.Space.Name == "const" {
+		return fmt.Errorf("cannot write to a constant")
+	}
+
+	return e.writeSpace(vn.Space, vn.Offset, data)
+}
+
+// readUint reads a varnode of up to 8 bytes.
+func (e *Emulator) readUint(vn *gopcode.VarNode) (uint64, error) {
+	if vn.Space.Name == "const" {
+		return vn.Offset & word.Mask(int(vn.Size)), nil
+	}
+
+	buf, err := e.readBytes(vn)
+	if err != nil {
+		return 0, err
+	}
+	return bytesToUint(buf, isBigEndian(vn.Space)), nil
+}
+
+func (e *Emulator) writeUint(vn *gopcode.VarNode, v uint64) error {
+	buf := make([]byte, vn.Size)
+	uintToBytes(v, buf, isBigEndian(vn.Space))
+	return e.writeBytes(vn, buf)
+}
+
+// readBig reads a varnode of any size.
+func (e *Emulator) readBig(vn *gopcode.VarNode) (*big.Int, error) {
+	if vn.Space.Name == "const" {
+		return new(big.Int).SetUint64(vn.Offset), nil
+	}
+
+	buf, err := e.readBytes(vn)
+	if err != nil {
+		return nil, err
+	}
+	return bytesToBig(buf, isBigEndian(vn.Space)), nil
+}
+
+func (e *Emulator) writeBig(vn *gopcode.VarNode, v *big.Int) error {
+	buf := make([]byte, vn.Size)
+	bigToBytes(v, buf, isBigEndian(vn.Space))
+	return e.writeBytes(vn, buf)
+}
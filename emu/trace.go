@@ -0,0 +1,143 @@
+package emu
+
+import (
+	"fmt"
+)
+
+// TraceEventKind is the kind of a state change recorded by a Trace.
+type TraceEventKind int
+
+const (
+	TraceWrite TraceEventKind = iota
+	TraceMap
+	TraceUnmap
+)
+
+// TraceEvent is a change of the state: a write of Data to a register or to
+// memory, or a change of the memory mapping of Size bytes with Perm.
+type TraceEvent struct {
+	Kind    TraceEventKind
+	Space   string
+	Address uint64
+	Data    []byte
+	Size    uint64
+	Perm    Perm
+}
+
+// TraceStep is an executed instruction and the changes made from its start to
+// the start of the next step, including those made by hooks or between steps.
+type TraceStep struct {
+	Address uint64
+	Events  []TraceEvent
+}
+
+// Trace records the execution of an emulator, see StartTrace.
+type Trace struct {
+	Steps []TraceStep
+
+	start  *Snapshot
+	before []TraceEvent
+	pc     uint64 // program counter after the last step
+}
+
+// StartTrace snapshots the current state and records every executed address
+// and state change until StopTrace. Writes to the unique space, which only
+// holds temporaries of an instruction, are not recorded.
+func (e *Emulator) StartTrace() *Trace {
+	t := &Trace{start: e.Snapshot(), pc: e.pc}
+	e.trace = t
+	return t
+}
+
+// StopTrace stops recording.
+func (e *Emulator) StopTrace() {
+	if e.trace != nil {
+		e.trace.pc = e.pc
+	}
+	e.trace = nil
+}
+
+func (e *Emulator) traceStep(addr uint64) {
+	if e.trace != nil {
+		e.trace.Steps = append(e.trace.Steps, TraceStep{Address: addr})
+	}
+}
+
+func (e *Emulator) traceEvent(ev TraceEvent) {
+	t := e.trace
+	if t == nil {
+		return
+	}
+
+	if ev.Data != nil {
+		ev.Data = append([]byte(nil), ev.Data...)
+	}
+
+	if n := len(t.Steps); n != 0 {
+		t.Steps[n-1].Events = append(t.Steps[n-1].Events, ev)
+	} else {
+		t.before = append(t.before, ev)
+	}
+}
+
+// Replay puts the emulator in the state it was in before the step-th
+// recorded instruction executed, or after the last one when step is the
+// number of steps. The state is rebuilt from the recorded changes rather than
+// by executing again, so the result does not depend on hooks.
+func (t *Trace) Replay(e *Emulator, step int) error {
+	if step < 0 || step > len(t.Steps) {
+		return fmt.Errorf("step %d out of range [0, %d]", step, len(t.Steps))
+	}
+
+	// do not record the replay itself
+	recording := e.trace
+	e.trace = nil
+	defer func() { e.trace = recording }()
+
+	e.Restore(t.start)
+
+	if err := e.applyEvents(t.before); err != nil {
+		return err
+	}
+	for _, s := range t.Steps[:step] {
+		if err := e.applyEvents(s.Events); err != nil {
+			return err
+		}
+	}
+
+	if step < len(t.Steps) {
+		e.pc = t.Steps[step].Address
+	} else {
+		e.pc = t.pc
+	}
+	return nil
+}
+
+func (e *Emulator) applyEvents(events []TraceEvent) error {
+	for _, ev := range events {
+		m, ok := e.memories[ev.Space]
+		if !ok {
+			st, ok := e.spaces[ev.Space]
+			if !ok || ev.Kind != TraceWrite {
+				return fmt.Errorf("unexpected event in space %s", ev.Space)
+			}
+			st.write(ev.Address, ev.Data)
+			continue
+		}
+
+		switch ev.Kind {
+		case TraceWrite:
+			if err := m.Poke(ev.Address, ev.Data); err != nil {
+				return err
+			}
+		case TraceMap:
+			if err := m.Map(ev.Address, ev.Size, ev.Perm); err != nil {
+				return err
+			}
+		case TraceUnmap:
+			m.Unmap(ev.Address, ev.Size)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package gopcode
+
+import (
+	"fmt"
+)
+
+type DecodeErrorReason int
+
+const (
+	// DecodeBadData means the bytes do not decode to any instruction.
+	DecodeBadData DecodeErrorReason = iota
+	// DecodeUnimplemented means the instruction decodes but its semantics
+	// are not implemented by the language, so it has no pcode.
+	DecodeUnimplemented
+	// DecodeTruncated means the input ends in the middle of an instruction.
+	DecodeTruncated
+)
+
+func (r DecodeErrorReason) String() string {
+	switch r {
+	case DecodeBadData:
+		return "bad data"
+	case DecodeUnimplemented:
+		return "unimplemented instruction"
+	case DecodeTruncated:
+		return "truncated input"
+	}
+
+	return fmt.Sprintf("unknown reason %d", int(r))
+}
+
+// DecodeError reports where and why Translate or Disassemble stopped before
+// the end of the input. Both return it together with the instructions decoded
+// before the failure, which still have to be destroyed.
+type DecodeError struct {
+	Address uint64
+	Bytes   []byte // the input at Address, at most 16 bytes
+	Reason  DecodeErrorReason
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decoding failed at 0x%x (% x): %s", e.Address, e.Bytes, e.Reason)
+}
+
+const decodeErrorBytes = 16
+
+// newDecodeError returns the error of a failure to decode the instruction at
+// the start of data, mapped at addr.
+func newDecodeError(data []byte, addr uint64, reason DecodeErrorReason) *DecodeError {
+	n := len(data)
+	if n > decodeErrorBytes {
+		n = decodeErrorBytes
+	}
+	return &DecodeError{Address: addr, Bytes: append([]byte(nil), data[:n]...), Reason: reason}
+}
+
+// translateError returns the error of a translation stopping at the start of
+// data. The native library drops the exception that stopped it, and only
+// disassembly, which does not need the semantics of the instruction, tells
+// an unimplemented instruction from bad data.
+func (c *Context) translateError(data []byte, addr uint64) *DecodeError {
+	if len(data) == 0 {
+		return newDecodeError(data, addr, DecodeTruncated)
+	}
+
+	disas, err := pcode_disassemble_segment(c, data, addr, 1)
+	if err != nil {
+		return newDecodeError(data, addr, DecodeBadData)
+	}
+	defer disas.Destroy()
+
+	switch {
+	case len(disas.Instructions) != 1:
+		return newDecodeError(data, addr, DecodeBadData)
+	case disas.Instructions[0].Length > uint64(len(data)):
+		return newDecodeError(data, addr, DecodeTruncated)
+	}
+	return newDecodeError(data, addr, DecodeUnimplemented)
+}
+
+// endsBlock reports whether the ops of an instruction contain control flow,
+// which is where a BbTerminating translation legitimately stops.
+func endsBlock(ops []PcodeOp) bool {
+	for _, op := range ops {
+		switch op.Opcode {
+		case CPUI_BRANCH, CPUI_CBRANCH, CPUI_BRANCHIND, CPUI_CALL, CPUI_CALLIND, CPUI_RETURN:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+package gopcode
+
+import (
+	"fmt"
+	"math/bits"
+
+	"github.com/dzonerzy/gopcode/internal/word"
+)
+
+// arity is the number of inputs each evaluated opcode reads.
+var arity = map[OpCode]int{
+	CPUI_COPY:           1,
+	CPUI_INT_EQUAL:      2,
+	CPUI_INT_NOTEQUAL:   2,
+	CPUI_INT_SLESS:      2,
+	CPUI_INT_SLESSEQUAL: 2,
+	CPUI_INT_LESS:       2,
+	CPUI_INT_LESSEQUAL:  2,
+	CPUI_INT_ZEXT:       1,
+	CPUI_INT_SEXT:       1,
+	CPUI_INT_ADD:        2,
+	CPUI_INT_SUB:        2,
+	CPUI_INT_CARRY:      2,
+	CPUI_INT_SCARRY:     2,
+	CPUI_INT_SBORROW:    2,
+	CPUI_INT_2COMP:      1,
+	CPUI_INT_NEGATE:     1,
+	CPUI_INT_XOR:        2,
+	CPUI_INT_AND:        2,
+	CPUI_INT_OR:         2,
+	CPUI_INT_LEFT:       2,
+	CPUI_INT_RIGHT:      2,
+	CPUI_INT_SRIGHT:     2,
+	CPUI_INT_MULT:       2,
+	CPUI_INT_DIV:        2,
+	CPUI_INT_SDIV:       2,
+	CPUI_INT_REM:        2,
+	CPUI_INT_SREM:       2,
+	CPUI_BOOL_NEGATE:    1,
+	CPUI_BOOL_XOR:       2,
+	CPUI_BOOL_AND:       2,
+	CPUI_BOOL_OR:        2,
+	CPUI_INDIRECT:       1,
+	CPUI_PIECE:          2,
+	CPUI_SUBPIECE:       2,
+	CPUI_CAST:           1,
+	CPUI_PTRADD:         3,
+	CPUI_PTRSUB:         2,
+	CPUI_INSERT:         4,
+	CPUI_EXTRACT:        3,
+	CPUI_POPCOUNT:       1,
+	CPUI_LZCOUNT:        1,
+}
+
+// Arity returns the number of inputs of an opcode evaluated by EvaluateUint,
+// and false for the other opcodes.
+func (o OpCode) Arity() (int, bool) {
+	n, ok := arity[o]
+	return n, ok
+}
+
+// EvaluateUint evaluates an integer or boolean op, whose varnodes all fit in
+// 64 bits, given the values of its inputs. The result is masked to the
+// output size. Float ops, the ops with side effects and a division by zero
+// are errors.
+func EvaluateUint(op PcodeOp, in []uint64) (uint64, error) {
+	if op.Output == nil {
+		return 0, fmt.Errorf("%s has no output", op.Opcode)
+	}
+	n, ok := arity[op.Opcode]
+	if !ok {
+		return 0, fmt.Errorf("unsupported opcode %s", op.Opcode)
+	}
+	if len(op.Inputs) < n || len(in) < n {
+		return 0, fmt.Errorf("%s expects %d inputs, got %d", op.Opcode, n, len(in))
+	}
+	if op.Output.Size > 8 {
+		return 0, fmt.Errorf("%s output of %d bytes", op.Opcode, op.Output.Size)
+	}
+	for _, vn := range op.Inputs {
+		if vn.Size > 8 {
+			return 0, fmt.Errorf("%s input of %d bytes", op.Opcode, vn.Size)
+		}
+	}
+
+	out, err := evalUint(op, in, n)
+	if err != nil {
+		return 0, err
+	}
+	return out & word.Mask(int(op.Output.Size)), nil
+}
+
+// evalUint evaluates an op of n inputs, which were checked by EvaluateUint.
+func evalUint(op PcodeOp, in []uint64, n int) (uint64, error) {
+	size := int(op.Inputs[0].Size)
+	outSize := int(op.Output.Size)
+	a := in[0]
+	var b uint64
+	if n > 1 {
+		b = in[1]
+	}
+
+	switch op.Opcode {
+	case CPUI_COPY, CPUI_INT_ZEXT, CPUI_CAST, CPUI_INDIRECT:
+		return a, nil
+	case CPUI_INT_EQUAL:
+		return word.Bool(a == b), nil
+	case CPUI_INT_NOTEQUAL:
+		return word.Bool(a != b), nil
+	case CPUI_INT_SLESS:
+		return word.Bool(word.SignExtend(a, size) < word.SignExtend(b, size)), nil
+	case CPUI_INT_SLESSEQUAL:
+		return word.Bool(word.SignExtend(a, size) <= word.SignExtend(b, size)), nil
+	case CPUI_INT_LESS:
+		return word.Bool(a < b), nil
+	case CPUI_INT_LESSEQUAL:
+		return word.Bool(a <= b), nil
+	case CPUI_INT_SEXT:
+		return uint64(word.SignExtend(a, size)), nil
+	case CPUI_INT_ADD:
+		return a + b, nil
+	case CPUI_INT_SUB:
+		return a - b, nil
+	case CPUI_INT_CARRY:
+		return word.Bool((a+b)&word.Mask(size) < a), nil
+	case CPUI_INT_SCARRY:
+		sa, sb := word.SignExtend(a, size), word.SignExtend(b, size)
+		r := word.SignExtend((a+b)&word.Mask(size), size)
+		return word.Bool((sa < 0) == (sb < 0) && (r < 0) != (sa < 0)), nil
+	case CPUI_INT_SBORROW:
+		sa, sb := word.SignExtend(a, size), word.SignExtend(b, size)
+		r := word.SignExtend((a-b)&word.Mask(size), size)
+		return word.Bool((sa < 0) != (sb < 0) && (r < 0) != (sa < 0)), nil
+	case CPUI_INT_2COMP:
+		return -a, nil
+	case CPUI_INT_NEGATE:
+		return ^a, nil
+	case CPUI_INT_XOR:
+		return a ^ b, nil
+	case CPUI_INT_AND:
+		return a & b, nil
+	case CPUI_INT_OR:
+		return a | b, nil
+	case CPUI_INT_LEFT:
+		if b >= uint64(outSize)*8 {
+			return 0, nil
+		}
+		return a << b, nil
+	case CPUI_INT_RIGHT:
+		if b >= uint64(size)*8 {
+			return 0, nil
+		}
+		return a >> b, nil
+	case CPUI_INT_SRIGHT:
+		if b >= uint64(size)*8 {
+			b = uint64(size)*8 - 1
+		}
+		return uint64(word.SignExtend(a, size) >> b), nil
+	case CPUI_INT_MULT:
+		return a * b, nil
+	case CPUI_INT_DIV, CPUI_INT_REM:
+		if b == 0 {
+			return 0, fmt.Errorf("%s: division by zero", op.Opcode)
+		}
+		if op.Opcode == CPUI_INT_DIV {
+			return a / b, nil
+		}
+		return a % b, nil
+	case CPUI_INT_SDIV, CPUI_INT_SREM:
+		if b == 0 {
+			return 0, fmt.Errorf("%s: division by zero", op.Opcode)
+		}
+		sa, sb := word.SignExtend(a, size), word.SignExtend(b, size)
+		if op.Opcode == CPUI_INT_SDIV {
+			return uint64(sa / sb), nil
+		}
+		return uint64(sa % sb), nil
+	case CPUI_BOOL_NEGATE:
+		return word.Bool(a == 0), nil
+	case CPUI_BOOL_XOR:
+		return word.Bool((a != 0) != (b != 0)), nil
+	case CPUI_BOOL_AND:
+		return word.Bool(a != 0 && b != 0), nil
+	case CPUI_BOOL_OR:
+		return word.Bool(a != 0 || b != 0), nil
+	case CPUI_PIECE:
+		return a<<(uint(op.Inputs[1].Size)*8) | b, nil
+	case CPUI_SUBPIECE:
+		if b >= 8 {
+			return 0, nil
+		}
+		return a >> (b * 8), nil
+	case CPUI_PTRADD:
+		return a + b*in[2], nil
+	case CPUI_PTRSUB:
+		return a + b, nil
+	case CPUI_INSERT:
+		pos, width := in[2], in[3]
+		m := word.Mask(8)
+		if width < 64 {
+			m = 1<<width - 1
+		}
+		return a&^(m<<pos) | (b&m)<<pos, nil
+	case CPUI_EXTRACT:
+		pos, width := b, in[2]
+		m := word.Mask(8)
+		if width < 64 {
+			m = 1<<width - 1
+		}
+		return (a >> pos) & m, nil
+	case CPUI_POPCOUNT:
+		return uint64(bits.OnesCount64(a & word.Mask(size))), nil
+	case CPUI_LZCOUNT:
+		return uint64(bits.LeadingZeros64(a&word.Mask(size)) - (64 - size*8)), nil
+	}
+
+	return 0, fmt.Errorf("unsupported opcode %s", op.Opcode)
+}
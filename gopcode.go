@@ -215,21 +215,27 @@ var (
 )
 
 func NewContext(LanguageID string) (*Context, error) {
-	for _, al := range ArchLanguages {
-		if al.LanguageID == LanguageID {
-			ctx := pcode_context_create(al.Sla)
+	al, err := LookupLanguage(LanguageID)
+	if err != nil {
+		return nil, err
+	}
 
-			for _, set := range al.ProcessorSpecs.ContextData.CtxSet.Set {
-				v, _ := strconv.ParseUint(set.Val, 10, 32)
-				ctx.SetVariableDefault(set.Name, uint32(v))
-			}
+	if err := al.Load(); err != nil {
+		return nil, fmt.Errorf("could not load language %s: %v", al.LanguageID, err)
+	}
 
-			// populate registers
-			_ = ctx.GetAllRegisters()
+	ctx := pcode_context_create(al.Sla)
+	ctx.LanguageID = al.LanguageID
+	ctx._lang = al
+	ctx._pspec = &al.ProcessorSpecs
 
-			return ctx, nil
-		}
+	for _, set := range al.ProcessorSpecs.ContextData.CtxSet.Set {
+		v, _ := strconv.ParseUint(set.Val, 10, 32)
+		ctx.SetVariableDefault(set.Name, uint32(v))
 	}
 
-	return nil, fmt.Errorf("language %s not found", LanguageID)
+	// populate registers
+	_ = ctx.GetAllRegisters()
+
+	return ctx, nil
 }
@@ -49,6 +49,11 @@ func (v *VarNode) GetSpaceFromConst() *AddrSpace {
 	var sp *AddrSpace = nil
 
 	if v.Space.Name == "const" {
+		// the offset is the native space, prefer the copy of its context
+		if cached, ok := nativeSpaces.Load(uintptr(v.Offset)); ok {
+			return cached.(*AddrSpace)
+		}
+
 		var res *C.AddrSpaceC = C.pcode_varnode_get_space_from_const(C.ulonglong(v.Offset))
 		sp = &AddrSpace{
 			Name:               C.GoString(res.name),
@@ -70,21 +75,36 @@ func (v *VarNode) GetSpaceFromConst() *AddrSpace {
 }
 
 type Register struct {
-	Node *VarNode
-	Name string
+	Node             *VarNode
+	Name             string
+	Group            string
+	Hidden           bool
+	VectorLaneSizes  []int
+	IsProgramCounter bool
 }
 
 type Context struct {
-	_ctx       *C.PcodeContext
-	LanguageID string
-	_registers []*Register
+	_ctx         *C.PcodeContext
+	_lang        *ArchitectureLanguage
+	_pspec       *ProcessorSpec
+	LanguageID   string
+	_registers   []*Register
+	_spaces      map[*C.NativeAddrSpace]*AddrSpace
+	_ctxDefaults map[string]uint32
+	_ctxRanges   []contextRange
 }
 
 func (c *Context) Destroy() {
+	c.releaseSpaces()
 	C.pcode_context_free(c._ctx)
 }
 
 func (c *Context) SetVariableDefault(name string, value uint32) {
+	c._ctxDefaults[name] = value
+	c.setVariable(name, value)
+}
+
+func (c *Context) setVariable(name string, value uint32) {
 	cname := C.CString(name)
 	C.pcode_context_set_variable_default(c._ctx, cname, C.uint32_t(value))
 	C.free(unsafe.Pointer(cname))
@@ -103,17 +123,7 @@ func (c *Context) GetAllRegisters() []*Register {
 		regs = append(regs, &Register{
 			Name: C.GoString(reg.name),
 			Node: &VarNode{
-				Space: &AddrSpace{
-					Name:               C.GoString(reg.varnode.space.name),
-					Index:              uint32(reg.varnode.space.index),
-					AddressSize:        uint32(reg.varnode.space.address_size),
-					WordSize:           uint32(reg.varnode.space.word_size),
-					Flags:              AddrSpaceFlags(reg.varnode.space.flags),
-					Highest:            uint64(reg.varnode.space.highest),
-					PointerLowerBound:  uint64(reg.varnode.space.pointer_lower_bound),
-					PointerUpperBound:  uint64(reg.varnode.space.pointer_upper_bound),
-					NativeAddrSpacePtr: reg.varnode.space.n_space,
-				},
+				Space:  c.getOrCreateAddrSpace(reg.varnode.space),
 				Offset: uint64(reg.varnode.offset),
 				Size:   int32(reg.varnode.size),
 			},
@@ -127,6 +137,10 @@ func (c *Context) GetAllRegisters() []*Register {
 	C.free(unsafe.Pointer(reglist.registers))
 	C.free(unsafe.Pointer(reglist))
 
+	if c._pspec != nil {
+		c._pspec.annotateRegisters(regs)
+	}
+
 	if c._registers == nil {
 		c._registers = regs
 	}
@@ -134,6 +148,23 @@ func (c *Context) GetAllRegisters() []*Register {
 	return regs
 }
 
+// GetProgramCounter returns the register the processor spec declares as the
+// program counter, or nil if there is none.
+func (c *Context) GetProgramCounter() *Register {
+	for _, reg := range c.GetAllRegisters() {
+		if reg.IsProgramCounter {
+			return reg
+		}
+	}
+
+	return nil
+}
+
+// GetProcessorSpec returns the processor spec the context was created from.
+func (c *Context) GetProcessorSpec() *ProcessorSpec {
+	return c._pspec
+}
+
 func (c *Context) GetRegisterName(space *AddrSpace, offset uint64, size int32) string {
 	cname := C.pcode_context_get_register_name(c._ctx, space.NativeAddrSpacePtr, C.ulonglong(offset), C.int32_t(size))
 	cname_gostr := C.GoString(cname)
@@ -156,5 +187,9 @@ func pcode_context_create(sla []byte) *Context {
 	var csla = C.CString(string(sla))
 	ctx := C.pcode_context_create((*C.uchar)(unsafe.Pointer(&sla[0])), C.size_t(len(sla)))
 	C.free(unsafe.Pointer(csla))
-	return &Context{_ctx: ctx}
+	return &Context{
+		_ctx:         ctx,
+		_spaces:      map[*C.NativeAddrSpace]*AddrSpace{},
+		_ctxDefaults: map[string]uint32{},
+	}
 }
@@ -1,10 +1,20 @@
 package gopcode_test
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/fstest"
 
 	"github.com/dzonerzy/gopcode"
+	mos6502 "github.com/dzonerzy/gopcode/processors/6502"
+	_ "github.com/dzonerzy/gopcode/processors/all"
+	"github.com/dzonerzy/gopcode/sleigh"
 )
 
 func TestContext(t *testing.T) {
@@ -34,6 +44,125 @@ func TestGetAllRegisters(t *testing.T) {
 	}
 }
 
+func TestProcessorSpec(t *testing.T) {
+	ctx, err := gopcode.NewContext("x86:le:64:default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Destroy()
+
+	pc := ctx.GetProgramCounter()
+	if pc == nil || pc.Name != "RIP" {
+		t.Fatalf("expected RIP as program counter, got %v", pc)
+	}
+
+	for _, reg := range ctx.GetAllRegisters() {
+		if reg.Name == "DR0" && reg.Group != "DEBUG" {
+			t.Fatalf("expected DR0 in group DEBUG, got %q", reg.Group)
+		}
+	}
+
+	hcs08, err := gopcode.NewContext("hcs08:be:16:default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hcs08.Destroy()
+
+	sym, ok := hcs08.GetProcessorSpec().LookupSymbol("", 0xfffe)
+	if !ok || sym.Name != "VECTOR_Reset" || !sym.Entry {
+		t.Fatalf("expected VECTOR_Reset at 0xfffe, got %v", sym)
+	}
+}
+
+func TestAddrSpaces(t *testing.T) {
+	for _, tc := range []struct {
+		lang string
+		code []byte
+		big  bool
+	}{
+		{"x86:LE:32:default", []byte{0x8b, 0x00}, false},  // mov eax, [eax]
+		{"68000:BE:32:default", []byte{0x20, 0x10}, true}, // move.l (a0), d0
+	} {
+		ctx, err := gopcode.NewContext(tc.lang)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ctx.Destroy()
+
+		trans, err := ctx.Translate(tc.code, 0x1000, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer trans.Destroy()
+
+		// registers and ops share the spaces of the context, whose byte
+		// order is the one of the language
+		spaces := map[string]*gopcode.AddrSpace{}
+		for _, reg := range ctx.GetAllRegisters() {
+			spaces[reg.Node.Space.Name] = reg.Node.Space
+		}
+		for _, op := range trans.Ops {
+			vns := op.Inputs
+			if op.Output != nil {
+				vns = append(vns, op.Output)
+			}
+			for _, vn := range vns {
+				if s, ok := spaces[vn.Space.Name]; ok && s != vn.Space {
+					t.Fatalf("%s: %s space differs between registers and ops", tc.lang, vn.Space.Name)
+				}
+				spaces[vn.Space.Name] = vn.Space
+			}
+			if op.Opcode == gopcode.CPUI_LOAD && op.Inputs[0].GetSpaceFromConst() != spaces["ram"] {
+				t.Fatalf("%s: LOAD space differs from the ram space", tc.lang)
+			}
+		}
+
+		for _, name := range []string{"register", "ram"} {
+			if big := spaces[name].Flags&gopcode.BigEndian != 0; big != tc.big {
+				t.Errorf("%s: %s space big endian %v", tc.lang, name, big)
+			}
+		}
+		if ctx.DefaultCodeSpace() != spaces["ram"] {
+			t.Errorf("%s: default code space is not the ram space", tc.lang)
+		}
+	}
+}
+
+func TestDefaultCodeSpace(t *testing.T) {
+	ctx, err := gopcode.NewContext("eBPF:LE:64:default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Destroy()
+
+	if space := ctx.DefaultCodeSpace(); space == nil || space.Name != "ram" || space.Flags&gopcode.BigEndian != 0 {
+		t.Errorf("default code space %+v", space)
+	}
+}
+
+func TestEvaluateUint(t *testing.T) {
+	vn := func(size int32) *gopcode.VarNode { return &gopcode.VarNode{Size: size} }
+	for _, tc := range []struct {
+		op   gopcode.PcodeOp
+		in   []uint64
+		want uint64
+		err  bool
+	}{
+		{gopcode.PcodeOp{Opcode: gopcode.CPUI_INT_ADD, Output: vn(1), Inputs: []*gopcode.VarNode{vn(1), vn(1)}}, []uint64{0xff, 2}, 1, false},
+		{gopcode.PcodeOp{Opcode: gopcode.CPUI_INT_SEXT, Output: vn(8), Inputs: []*gopcode.VarNode{vn(2)}}, []uint64{0x8000}, 0xffffffffffff8000, false},
+		{gopcode.PcodeOp{Opcode: gopcode.CPUI_INT_SLESS, Output: vn(1), Inputs: []*gopcode.VarNode{vn(4), vn(4)}}, []uint64{0xffffffff, 0}, 1, false},
+		{gopcode.PcodeOp{Opcode: gopcode.CPUI_PIECE, Output: vn(4), Inputs: []*gopcode.VarNode{vn(2), vn(2)}}, []uint64{0x1234, 0x5678}, 0x12345678, false},
+		{gopcode.PcodeOp{Opcode: gopcode.CPUI_INT_DIV, Output: vn(4), Inputs: []*gopcode.VarNode{vn(4), vn(4)}}, []uint64{1, 0}, 0, true},
+		{gopcode.PcodeOp{Opcode: gopcode.CPUI_INT_ZEXT, Output: vn(16), Inputs: []*gopcode.VarNode{vn(8)}}, []uint64{1}, 0, true},
+		{gopcode.PcodeOp{Opcode: gopcode.CPUI_LOAD, Output: vn(4), Inputs: []*gopcode.VarNode{vn(8), vn(8)}}, []uint64{0, 0}, 0, true},
+	} {
+		got, err := gopcode.EvaluateUint(tc.op, tc.in)
+		if (err != nil) != tc.err || got != tc.want {
+			t.Errorf("%s %x = 0x%x, %v", tc.op.Opcode, tc.in, got, err)
+		}
+	}
+}
+
 func TestDisassemble(t *testing.T) {
 	ctx, err := gopcode.NewContext("x86:le:32:default")
 	if err != nil {
@@ -119,6 +248,439 @@ func TestTranslate(t *testing.T) {
 	}
 }
 
+func TestTranslateRepeated(t *testing.T) {
+	ctx, err := gopcode.NewContext("x86:le:32:default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Destroy()
+
+	data := []byte{0x55, 0x8b, 0xec, 0xc3}
+
+	for i := 0; i < 3; i++ {
+		trans, err := ctx.Translate(data, 0x1000, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := trans.Format(trans.Ops[3]); got != "*[ram]ESP = unique[b780:4]" {
+			t.Fatalf("unexpected formatting %q in round %d", got, i)
+		}
+		trans.Destroy()
+	}
+}
+
+func TestContextRange(t *testing.T) {
+	ctx, err := gopcode.NewContext("ARM:LE:32:v8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Destroy()
+
+	data := []byte{
+		0x1e, 0xff, 0x2f, 0xe1, // bx lr
+		0x00, 0xbf, // nop (thumb)
+		0x70, 0x47, // bx lr (thumb)
+	}
+
+	if err := ctx.SetContextRange("TMode", 1, 0x1004, 0x1008); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, ok := ctx.GetContextValue("TMode", 0x1000); !ok || v != 0 {
+		t.Fatalf("expected TMode 0 at 0x1000, got %d", v)
+	}
+	if v, _ := ctx.GetContextValue("TMode", 0x1006); v != 1 {
+		t.Fatalf("expected TMode 1 at 0x1006, got %d", v)
+	}
+
+	disas, err := ctx.Disassemble(data, 0x1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disas.Destroy()
+
+	expected := []uint64{0x1000, 0x1004, 0x1006}
+	if len(disas.Instructions) != len(expected) {
+		t.Fatalf("expected %d instructions, got %+v", len(expected), disas.Instructions)
+	}
+	for i, instr := range disas.Instructions {
+		if instr.Address != expected[i] {
+			t.Fatalf("expected instruction at 0x%x, got 0x%x", expected[i], instr.Address)
+		}
+	}
+
+	trans, err := ctx.Translate(data, 0x1000, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trans.Destroy()
+
+	var marks []uint64
+	for _, op := range trans.Ops {
+		if op.Opcode == gopcode.CPUI_IMARK {
+			marks = append(marks, op.Inputs[0].Offset)
+		}
+	}
+	if fmt.Sprint(marks) != fmt.Sprint(expected) {
+		t.Fatalf("expected instructions at %v, got %v", expected, marks)
+	}
+
+	// without the range the thumb code decodes as a single ARM instruction
+	ctx.ClearContextRanges()
+	disas2, err := ctx.Disassemble(data, 0x1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disas2.Destroy()
+
+	if len(disas2.Instructions) != 2 {
+		t.Fatalf("expected 2 ARM instructions, got %+v", disas2.Instructions)
+	}
+}
+
+func TestContextGlobalSet(t *testing.T) {
+	data := []byte{
+		0x02, 0x00, 0x00, 0xfa, // blx 0x1010
+		0x00, 0x00, 0xa0, 0xe1, // nop
+		0x00, 0x00, 0xa0, 0xe1, // nop
+		0x00, 0x00, 0xa0, 0xe1, // nop
+		0x01, 0x20, // movs r0, #1 (thumb)
+		0x70, 0x47, // bx lr (thumb)
+	}
+	expected := "[0x1000 0x1004 0x1008 0x100c 0x1010 0x1012]"
+
+	newContext := func() *gopcode.Context {
+		ctx, err := gopcode.NewContext("ARM:LE:32:v8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(ctx.Destroy)
+		return ctx
+	}
+
+	// the blx switches its target to thumb
+	ctx := newContext()
+	disas, err := ctx.Disassemble(data, 0x1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disas.Destroy()
+	var addrs []string
+	for _, instr := range disas.Instructions {
+		addrs = append(addrs, fmt.Sprintf("0x%x", instr.Address))
+	}
+	if fmt.Sprint(addrs) != expected || disas.Instructions[4].Mnemonic != "movs" {
+		t.Fatalf("expected thumb code at 0x1010, got %+v", disas.Instructions)
+	}
+
+	ctx = newContext()
+	trans, err := ctx.Translate(data, 0x1000, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trans.Destroy()
+	addrs = nil
+	for _, op := range trans.Ops {
+		if op.Opcode == gopcode.CPUI_IMARK {
+			addrs = append(addrs, fmt.Sprintf("0x%x", op.Inputs[0].Offset))
+		}
+	}
+	if fmt.Sprint(addrs) != expected {
+		t.Fatalf("expected instructions at %s, got %v", expected, addrs)
+	}
+
+	// the change is kept by the context for later calls
+	ctx = newContext()
+	it := ctx.TranslateIter(data, 0x1000)
+	if !it.Next() || it.Instruction().Mnemonic != "blx" {
+		t.Fatalf("expected blx, got %v", it.Err())
+	}
+	if err := it.Seek(0x1010); err != nil {
+		t.Fatal(err)
+	}
+	if !it.Next() || it.Instruction().String() != "movs r0,#0x1" {
+		t.Fatalf("expected thumb code at 0x1010, got %v %v", it.Instruction(), it.Err())
+	}
+}
+
+func TestContextRangeSegments(t *testing.T) {
+	ctx, err := gopcode.NewContext("ARM:LE:32:v8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Destroy()
+
+	// ARM nops around two thumb nops, each segment only decodes its own
+	// instructions and those crossing into the next one
+	var data []byte
+	for i := 0; i < 64; i++ {
+		if i == 32 {
+			data = append(data, 0x00, 0xbf, 0x00, 0xbf)
+			continue
+		}
+		data = append(data, 0x00, 0xf0, 0x20, 0xe3)
+	}
+	if err := ctx.SetContextRange("TMode", 1, 0x1080, 0x1084); err != nil {
+		t.Fatal(err)
+	}
+
+	disas, err := ctx.Disassemble(data, 0x1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disas.Destroy()
+
+	if n := len(disas.Instructions); n != 65 || disas.Instructions[33].Address != 0x1082 || disas.Instructions[64].Address != 0x10fc {
+		t.Fatalf("unexpected disassembly of %d instructions", n)
+	}
+
+	trans, err := ctx.Translate(data, 0x1000, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trans.Destroy()
+
+	marks := 0
+	for _, op := range trans.Ops {
+		if op.Opcode == gopcode.CPUI_IMARK {
+			marks++
+		}
+	}
+	if marks != 65 {
+		t.Fatalf("expected 65 instructions, got %d", marks)
+	}
+}
+
+func TestTranslateIter(t *testing.T) {
+	ctx, err := gopcode.NewContext("x86:le:32:default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Destroy()
+
+	data := []byte{
+		0x55,       // push ebp
+		0x8b, 0xec, // mov ebp, esp
+		0x74, 0x01, // jz +1
+		0xc3, // ret
+		0x90, // nop
+	}
+
+	type step struct {
+		addr     uint64
+		mnemonic string
+		falls    bool
+	}
+	expected := []step{
+		{0x1000, "PUSH", true},
+		{0x1001, "MOV", true},
+		{0x1003, "JZ", true},
+		{0x1005, "RET", false},
+		{0x1006, "NOP", true},
+	}
+
+	it := ctx.TranslateIter(data, 0x1000)
+	var got []step
+	for it.Next() {
+		instr := it.Instruction()
+		if instr.Ops[0].Opcode != gopcode.CPUI_IMARK {
+			t.Fatalf("expected an IMARK first, got %s", instr.Ops[0].Opcode)
+		}
+		got = append(got, step{instr.Address, instr.Mnemonic, instr.HasFallThrough})
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	if err := it.Seek(0x1006); err != nil {
+		t.Fatal(err)
+	}
+	if !it.Next() || it.Instruction().String() != "NOP" || it.Next() {
+		t.Fatal("expected a single NOP after seeking")
+	}
+}
+
+func TestTranslateIterConditionalReturn(t *testing.T) {
+	ctx, err := gopcode.NewContext("ARM:LE:32:v8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Destroy()
+
+	data := []byte{
+		0x1e, 0xff, 0x2f, 0x01, // bxeq lr
+		0x1e, 0xff, 0x2f, 0xe1, // bx lr
+	}
+
+	// bxeq lr branches to the next instruction when the condition does not
+	// hold, before its return
+	var got []bool
+	it := ctx.TranslateIter(data, 0x1000)
+	for it.Next() {
+		got = append(got, it.Instruction().HasFallThrough)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != "[true false]" {
+		t.Fatalf("expected [true false], got %v", got)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	ctx, err := gopcode.NewContext("x86:le:32:default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Destroy()
+
+	tests := []struct {
+		data   []byte
+		addr   uint64
+		reason gopcode.DecodeErrorReason
+	}{
+		{[]byte{0x90, 0x0f}, 0x1001, gopcode.DecodeTruncated},
+		{[]byte{0x90, 0xe8, 0x00, 0x00}, 0x1001, gopcode.DecodeTruncated},
+		{[]byte{0x90, 0xff, 0xff}, 0x1001, gopcode.DecodeBadData},
+	}
+
+	for _, tt := range tests {
+		trans, err := ctx.Translate(tt.data, 0x1000, 0, 0)
+		var derr *gopcode.DecodeError
+		if !errors.As(err, &derr) {
+			t.Fatalf("% x: expected a DecodeError, got %v", tt.data, err)
+		}
+		if derr.Address != tt.addr || derr.Reason != tt.reason {
+			t.Fatalf("% x: unexpected error %v", tt.data, derr)
+		}
+		if len(trans.Ops) != 1 || trans.Ops[0].Opcode != gopcode.CPUI_IMARK {
+			t.Fatalf("% x: expected the NOP before the failure, got %d ops", tt.data, len(trans.Ops))
+		}
+		trans.Destroy()
+
+		disas, err := ctx.Disassemble(tt.data, 0x1000, 0)
+		if !errors.As(err, &derr) || derr.Address != tt.addr || derr.Reason != tt.reason {
+			t.Fatalf("% x: unexpected disassembly error %v", tt.data, err)
+		}
+		if len(disas.Instructions) != 1 {
+			t.Fatalf("% x: expected 1 instruction, got %d", tt.data, len(disas.Instructions))
+		}
+		disas.Destroy()
+	}
+
+	m68k, err := gopcode.NewContext("68000:BE:32:default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m68k.Destroy()
+
+	// nop; illegal; nop
+	data := []byte{0x4e, 0x71, 0x4a, 0xfc, 0x4e, 0x71}
+	trans, err := m68k.Translate(data, 0x1000, 0, 0)
+	var derr *gopcode.DecodeError
+	if !errors.As(err, &derr) || derr.Address != 0x1002 || derr.Reason != gopcode.DecodeUnimplemented {
+		t.Fatalf("expected an unimplemented instruction at 0x1002, got %v", err)
+	}
+	trans.Destroy()
+
+	disas, err := m68k.Disassemble(data, 0x1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(disas.Instructions) != 3 {
+		t.Fatalf("expected 3 instructions, got %d", len(disas.Instructions))
+	}
+	disas.Destroy()
+}
+
+func TestUserOpNames(t *testing.T) {
+	ctx, err := gopcode.NewContext("x86:LE:64:default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Destroy()
+
+	names := ctx.GetUserOpNames()
+	cpuid := userOpIndex(names, "cpuid")
+	if userOpIndex(names, "syscall") < 0 || cpuid < 0 {
+		t.Fatalf("unexpected user operations %v", names)
+	}
+
+	// the index of the CALLOTHER of syscall names it
+	trans, err := ctx.Translate([]byte{0x0f, 0x05}, 0x1000, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trans.Destroy()
+
+	found := false
+	for _, op := range trans.Ops {
+		if op.Opcode == gopcode.CPUI_CALLOTHER {
+			found = names[op.Inputs[0].Offset] == "syscall"
+			if f := trans.Format(op); f != "syscall()" {
+				t.Fatalf("expected syscall(), got %s", f)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("expected a CALLOTHER of syscall")
+	}
+
+	// the lookup by index round-trips with the names
+	for i, want := range names {
+		if name, ok := ctx.UserOpName(uint64(i)); !ok || name != want {
+			t.Fatalf("expected %s at %d, got %q", want, i, name)
+		}
+	}
+	if name, ok := ctx.UserOpName(uint64(cpuid)); !ok || name != "cpuid" {
+		t.Fatalf("expected cpuid, got %q", name)
+	}
+	if _, ok := ctx.UserOpName(uint64(len(names))); ok {
+		t.Fatal("expected no name past the last user operation")
+	}
+
+	// rdtsc returns a value
+	rdtsc, err := ctx.Translate([]byte{0x0f, 0x31}, 0x1000, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdtsc.Destroy()
+
+	for _, op := range rdtsc.Ops {
+		if op.Opcode == gopcode.CPUI_CALLOTHER {
+			if f := rdtsc.Format(op); f != fmt.Sprintf("unique[%x:8] = rdtsc()", op.Output.Offset) {
+				t.Fatalf("unexpected format %s", f)
+			}
+		}
+	}
+
+	arm, err := gopcode.LookupLanguage("ARM:LE:32:v8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	armNames, err := arm.UserOpNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userOpIndex(armNames, "coprocessor_moveto") < 0 {
+		t.Fatalf("expected coprocessor_moveto, got %v", armNames)
+	}
+}
+
+func userOpIndex(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
 func TestListArchitectures(t *testing.T) {
 	if len(gopcode.ArchLanguages) == 0 {
 		t.Fatal("no architecture languages found")
@@ -129,6 +691,418 @@ func TestListArchitectures(t *testing.T) {
 	}
 }
 
+func TestLazyLoading(t *testing.T) {
+	lang, err := gopcode.LookupLanguage("6502:le:16:default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lang.Sla != nil {
+		t.Fatal("expected the SLA to be loaded on demand")
+	}
+
+	ctx, err := gopcode.NewContext("6502:LE:16:default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Destroy()
+
+	if lang.Sla == nil || lang.ProcessorSpecs.ProgramCounter.Register != "PC" {
+		t.Fatal("expected the language to be loaded by NewContext")
+	}
+
+	if _, err := gopcode.NewContext("nosuch:le:32:default"); err == nil || !strings.Contains(err.Error(), "processors/all") {
+		t.Fatalf("expected an error naming processors/all for an unknown language, got %v", err)
+	}
+}
+
+func TestRegisterProcessor(t *testing.T) {
+	fsys := fstest.MapFS{
+		"data/languages/test.ldefs": &fstest.MapFile{Data: []byte(`<language_definitions>
+  <language processor="TestProc" endian="little" size="32" variant="default" version="1.0"
+            slafile="test.sla" processorspec="test.pspec" id="TestProc:LE:32:default">
+    <description>Test processor</description>
+  </language>
+</language_definitions>`)},
+	}
+
+	if err := gopcode.RegisterProcessor("TestProc", fsys); err != nil {
+		t.Fatal(err)
+	}
+
+	if langs := gopcode.FindLanguages("testproc", "little", 32); len(langs) != 1 {
+		t.Fatalf("expected 1 registered language, got %d", len(langs))
+	}
+
+	// the pspec and sla are missing, which is only noticed when loading
+	if _, err := gopcode.NewContext("testproc:le:32:default"); err == nil {
+		t.Fatal("expected an error loading an incomplete language")
+	}
+
+	if err := gopcode.RegisterProcessor("Broken", fstest.MapFS{}); err == nil {
+		t.Fatal("expected an error registering a family without languages")
+	}
+}
+
+func TestCompileSleigh(t *testing.T) {
+	spec := []byte(`define endian=little;
+define alignment=1;
+
+define space ram type=ram_space size=2 default;
+define space register type=register_space size=1;
+
+define register offset=0x00 size=1 [ A X ];
+define register offset=0x10 size=2 [ PC ];
+
+define token opbyte (8) op = (0,7);
+define token data8 (8) imm8 = (0,7);
+
+:LDA "#"imm8 is op=0xa9; imm8 { A = imm8; }
+@ifdef WITH_INX
+:INX is op=0xe8 { X = X + 1; }
+@endif
+`)
+
+	src := fstest.MapFS{"mini.slaspec": &fstest.MapFile{Data: spec}}
+	sla, err := gopcode.CompileSleigh(src, "mini.slaspec", &gopcode.SleighOptions{
+		Defines: map[string]string{"WITH_INX": ""},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := fstest.MapFS{
+		"data/languages/mini.ldefs": &fstest.MapFile{Data: []byte(`<language_definitions>
+  <language processor="Mini" endian="little" size="16" variant="default" version="1.0"
+            slafile="mini.sla" processorspec="mini.pspec" id="Mini:LE:16:default">
+    <description>Mini processor</description>
+  </language>
+</language_definitions>`)},
+		"data/languages/mini.pspec": &fstest.MapFile{Data: []byte(`<processor_spec>
+  <programcounter register="PC"/>
+</processor_spec>`)},
+		"data/languages/mini.sla": &fstest.MapFile{Data: sla},
+	}
+	if err := gopcode.RegisterProcessor("Mini", fsys); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := gopcode.NewContext("mini:le:16:default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Destroy()
+
+	data := []byte{0xa9, 0x05, 0xe8}
+
+	disas, err := ctx.Disassemble(data, 0x1000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disas.Destroy()
+
+	if len(disas.Instructions) != 2 || disas.Instructions[0].Mnemonic != "LDA" || disas.Instructions[1].Mnemonic != "INX" {
+		t.Fatalf("unexpected disassembly %+v", disas.Instructions)
+	}
+
+	trans, err := ctx.Translate(data, 0x1000, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trans.Destroy()
+
+	expected := []gopcode.OpCode{
+		gopcode.CPUI_IMARK,
+		gopcode.CPUI_COPY,
+		gopcode.CPUI_IMARK,
+		gopcode.CPUI_INT_ADD,
+	}
+	if len(trans.Ops) != len(expected) {
+		t.Fatalf("expected %d ops, got %d", len(expected), len(trans.Ops))
+	}
+	for i, op := range trans.Ops {
+		if op.Opcode != expected[i] {
+			t.Fatalf("expected %s, got %s at %d", expected[i], op.Opcode, i)
+		}
+	}
+
+	// errors of the specification come with their file and line
+	src["mini.slaspec"] = &fstest.MapFile{Data: append(spec, ":TAX is op=0xaa { X = Y; }\n"...)}
+	_, err = gopcode.CompileSleigh(src, "mini.slaspec", nil)
+	var list sleigh.ErrorList
+	if !errors.As(err, &list) || list[0].File != "mini.slaspec" || list[0].Line != 17 {
+		t.Fatalf("expected an error at mini.slaspec:17, got %v", err)
+	}
+}
+
+func TestRegisterProcessorsDir(t *testing.T) {
+	// lay out a copy of the 6502 family like a Ghidra install, with a patched
+	// description for the 65C02 language
+	dir := t.TempDir()
+	err := fs.WalkDir(mos6502.FS, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		data, err := fs.ReadFile(mos6502.FS, name)
+		if err != nil {
+			return err
+		}
+		data = bytes.ReplaceAll(data, []byte("65C02 Microcontroller Family"), []byte("Patched 65C02"))
+
+		dst := filepath.Join(dir, "Ghidra", "Processors", "6502", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		return os.WriteFile(dst, data, 0o644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gopcode.RegisterProcessorsDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	// register the embedded family again once done, so that the languages of
+	// the removed directory do not shadow it in the other tests
+	t.Cleanup(func() {
+		if err := gopcode.RegisterProcessor("6502", mos6502.FS); err != nil {
+			t.Error(err)
+		}
+	})
+
+	lang, err := gopcode.LookupLanguage("65c02:le:16:default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lang.Description != "Patched 65C02" {
+		t.Fatalf("expected the on-disk language to shadow the embedded one, got %q", lang.Description)
+	}
+
+	n := 0
+	for _, al := range gopcode.Languages() {
+		if al.LanguageID == "65c02:le:16:default" {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Fatalf("expected the shadowed language to be listed once, got %d", n)
+	}
+
+	ctx, err := gopcode.NewContext("65c02:le:16:default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Destroy()
+
+	disas, err := ctx.Disassemble([]byte{0xea, 0x60}, 0x1000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disas.Destroy()
+
+	if len(disas.Instructions) != 2 || disas.Instructions[1].Mnemonic != "RTS" {
+		t.Fatalf("unexpected disassembly %+v", disas.Instructions)
+	}
+
+	if err := gopcode.RegisterProcessorsDir(t.TempDir()); err == nil {
+		t.Fatal("expected an error for a directory without processors")
+	}
+}
+
+func TestCompilerSpecs(t *testing.T) {
+	lang, err := gopcode.LookupLanguage("x86:LE:32:default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lang.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	var gcc *gopcode.CompilerSpec
+	for _, c := range lang.Compilers {
+		if c.ID == "gcc" {
+			gcc = c.Spec
+		}
+	}
+	if gcc == nil {
+		t.Fatal("gcc compiler spec not found")
+	}
+
+	if gcc.StackPointer.Register != "ESP" {
+		t.Fatalf("expected ESP, got %s", gcc.StackPointer.Register)
+	}
+
+	if gcc.DataOrganization.PointerSize.Value != 4 || gcc.DataOrganization.Alignment(8) != 4 {
+		t.Fatalf("unexpected data organization %+v", gcc.DataOrganization)
+	}
+
+	if gcc.DefaultPrototype.Name != "__cdecl" || gcc.DefaultPrototype.ExtraPop != 4 {
+		t.Fatalf("unexpected default prototype %s", gcc.DefaultPrototype.Name)
+	}
+
+	out := gcc.DefaultPrototype.Output.Entries
+	if len(out) != 3 || out[1].Storage.Register != "EAX" || len(out[2].Storage.Pieces) != 2 {
+		t.Fatalf("unexpected output entries %+v", out)
+	}
+
+	if in := gcc.DefaultPrototype.Input.Entries; len(in) != 1 || in[0].Storage.Space != "stack" || in[0].Storage.Offset != 4 {
+		t.Fatalf("unexpected input entries %+v", in)
+	}
+
+	proto, ok := gcc.Prototype("syscall")
+	if !ok || len(proto.Input.Entries) != 6 || proto.KilledByCall.Locations[0].Register != "EAX" {
+		t.Fatal("unexpected syscall prototype")
+	}
+
+	if len(gcc.CallFixups) == 0 || gcc.CallFixups[0].Targets[0].Name != "__i686.get_pc_thunk.ax" {
+		t.Fatal("unexpected call fixups")
+	}
+}
+
+func TestLanguageQueries(t *testing.T) {
+	langs := gopcode.FindLanguages("x86", "LE", 64)
+	if len(langs) == 0 {
+		t.Fatal("no x86 64-bit languages found")
+	}
+
+	for _, al := range langs {
+		if al.Processor != "x86" || al.IsBigEndian() || al.Size != 64 {
+			t.Fatalf("unexpected language %s", al.LanguageID)
+		}
+	}
+
+	al, err := gopcode.LanguageByExternalName("qemu", "qemu-i386")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if al.LanguageID != "x86:le:32:default" || al.Variant != "default" {
+		t.Fatalf("expected x86:le:32:default, got %s", al.LanguageID)
+	}
+
+	if names := al.ExternalNamesFor("gnu"); len(names) != 1 || names[0] != "i386:intel" {
+		t.Fatalf("unexpected gnu names %v", names)
+	}
+
+	if _, err := gopcode.LanguageByExternalName("qemu", "qemu-none"); err == nil {
+		t.Fatal("expected an error for an unknown external name")
+	}
+}
+
+func TestQueryOpinions(t *testing.T) {
+	tests := []struct {
+		loader, primary, secondary string
+		language, compiler         string
+	}{
+		{gopcode.LoaderELF, "62", "0", "x86:le:64:default", "gcc"},
+		{gopcode.LoaderPE, "34404", "", "x86:le:64:default", "windows"},
+		// MIPS32 R2 o32 with microMIPS, matched bit by bit on e_flags
+		{gopcode.LoaderELF, "8", "1912606720", "mips:be:32:micro", "default"},
+	}
+
+	for _, tt := range tests {
+		specs, err := gopcode.QueryOpinions(tt.loader, tt.primary, tt.secondary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(specs) == 0 {
+			t.Fatalf("no opinion for %s %s", tt.loader, tt.primary)
+		}
+
+		found := false
+		for _, s := range specs {
+			if s.Language.LanguageID == tt.language && s.CompilerID == tt.compiler {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("%s %s: %s/%s not suggested", tt.loader, tt.primary, tt.language, tt.compiler)
+		}
+		if tt.secondary != "" && specs[0].Language.Variant != strings.Split(tt.language, ":")[3] {
+			t.Fatalf("%s %s: expected variant of %s first, got %s", tt.loader, tt.primary, tt.language, specs[0].Language.LanguageID)
+		}
+	}
+
+	if specs, _ := gopcode.QueryOpinions(gopcode.LoaderELF, "65535", ""); len(specs) != 0 {
+		t.Fatalf("unexpected opinions for an unknown machine: %v", specs)
+	}
+}
+
+func TestParseBitPattern(t *testing.T) {
+	p, err := gopcode.ParseBitPattern("0x90 * 0x5589e5 01010...0x..83ec # comment\n 0x5.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p.Value, []byte{0x90, 0x55, 0x89, 0xe5, 0x50, 0x00, 0x83, 0xec, 0x50}) ||
+		!bytes.Equal(p.Mask, []byte{0xff, 0xff, 0xff, 0xff, 0xf8, 0x00, 0xff, 0xff, 0xf0}) || p.Mark != 1 {
+		t.Fatalf("value %x, mask %x, mark %d", p.Value, p.Mask, p.Mark)
+	}
+	if p.Bits() != 4*8+5+2*8+4 {
+		t.Fatalf("expected 57 bits, got %d", p.Bits())
+	}
+	if !p.Match([]byte{0x90, 0x55, 0x89, 0xe5, 0x53, 0x12, 0x83, 0xec, 0x57, 0xff}) || p.Match([]byte{0x90, 0x55, 0x89, 0xe5, 0x58}) {
+		t.Fatal("unexpected match result")
+	}
+
+	for _, bad := range []string{"", "0x5", "0101", "0xzz"} {
+		if _, err := gopcode.ParseBitPattern(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestPatterns(t *testing.T) {
+	// every pattern file of the registered families parses
+	for _, al := range gopcode.Languages() {
+		for _, c := range al.Compilers {
+			if _, err := al.Patterns(c.ID); err != nil {
+				t.Fatalf("%s %s: %v", al.LanguageID, c.ID, err)
+			}
+		}
+	}
+
+	al, err := gopcode.LookupLanguage("x86:LE:64:default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	patterns, err := al.Patterns("gcc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patterns.Patterns) == 0 {
+		t.Fatal("no x86-64 gcc patterns")
+	}
+
+	data := []byte{
+		0x31, 0xc0, 0xc3, // xor eax, eax; ret
+		0x0f, 0x1f, 0x40, 0x00, // nop
+		0x55, 0x48, 0x89, 0xe5, 0x48, 0x83, 0xec, 0x10, // push rbp; mov rbp, rsp; sub rsp, 0x10
+		0xc9, 0xc3, // leave; ret
+	}
+	starts := patterns.FunctionStarts(data, 0x1000)
+	found := false
+	for _, m := range starts {
+		if m.Addr == 0x1007 && m.Pattern.Pre != nil {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("pattern pair not matched: %v", starts)
+	}
+
+	// the pair needs a pre pattern right before the function
+	data[6] = 0xcc
+	for _, m := range patterns.FunctionStarts(data, 0x1000) {
+		if m.Addr == 0x1007 && m.Pattern.Pre != nil {
+			t.Fatalf("pair matched without pre pattern at 0x%x", m.Addr)
+		}
+	}
+}
+
 func BenchmarkTranslate(b *testing.B) {
 	ctx, err := gopcode.NewContext("x86:le:32:default")
 	if err != nil {
@@ -0,0 +1,28 @@
+// Package word holds the integer helpers shared by the packages evaluating
+// pcode on values of up to 8 bytes.
+package word
+
+// Mask returns the mask of a value of size bytes, up to 8.
+func Mask(size int) uint64 {
+	if size >= 8 {
+		return ^uint64(0)
+	}
+	return 1<<(uint(size)*8) - 1
+}
+
+// SignExtend sign extends a value of size bytes to 64 bits.
+func SignExtend(v uint64, size int) int64 {
+	if size <= 0 || size >= 8 {
+		return int64(v)
+	}
+	shift := 64 - uint(size)*8
+	return int64(v<<shift) >> shift
+}
+
+// Bool returns 1 for true and 0 for false.
+func Bool(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
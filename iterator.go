@@ -0,0 +1,208 @@
+package gopcode
+
+import (
+	"fmt"
+
+	"github.com/dzonerzy/gopcode/internal/word"
+)
+
+// Instruction is a single decoded instruction together with its pcode.
+type Instruction struct {
+	_formatter prettyPrinter
+
+	Address  uint64
+	Length   uint64
+	Mnemonic string
+	Body     string
+	Ops      []PcodeOp
+
+	// FallThrough is the address following the instruction, including any
+	// delay slot. HasFallThrough reports whether execution may continue
+	// there: it is false when every path through the ops ends with a branch
+	// elsewhere or a return, and true for a conditional branch or return.
+	FallThrough    uint64
+	HasFallThrough bool
+}
+
+func (i *Instruction) String() string {
+	if i.Body == "" {
+		return i.Mnemonic
+	}
+	return fmt.Sprintf("%s %s", i.Mnemonic, i.Body)
+}
+
+func (i *Instruction) Format(pco PcodeOp) string {
+	return i._formatter.formatPcodeOp(pco)
+}
+
+// InstructionIterator decodes a buffer one instruction at a time, see
+// Context.TranslateIter.
+type InstructionIterator struct {
+	ctx  *Context
+	data []byte
+	base uint64
+	next uint64
+	cur  *Instruction
+	err  error
+}
+
+// TranslateIter returns an iterator translating data, mapped at baseAddress,
+// one instruction at a time starting at baseAddress:
+//
+//	it := ctx.TranslateIter(data, 0x401000)
+//	for it.Next() {
+//		instr := it.Instruction()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// The iterator follows the fall-through of each instruction; use Seek to
+// continue at another address such as a branch target. The returned
+// instructions own their ops and stay valid after the iterator advances.
+func (c *Context) TranslateIter(data []byte, baseAddress uint64) *InstructionIterator {
+	return &InstructionIterator{
+		ctx:  c,
+		data: data,
+		base: baseAddress,
+		next: baseAddress,
+	}
+}
+
+// Seek sets the address of the next instruction to decode.
+func (it *InstructionIterator) Seek(addr uint64) error {
+	if addr < it.base || addr >= it.base+uint64(len(it.data)) {
+		return fmt.Errorf("address 0x%x is outside of the buffer", addr)
+	}
+
+	it.next = addr
+	it.err = nil
+	return nil
+}
+
+// Next decodes the next instruction. It returns false at the end of the
+// buffer or on error, see Err.
+func (it *InstructionIterator) Next() bool {
+	it.cur = nil
+	if it.err != nil || it.next < it.base || it.next >= it.base+uint64(len(it.data)) {
+		return false
+	}
+
+	instr, err := it.ctx.decodeInstruction(segmentBytes(it.data, it.base, it.next, it.next), it.next)
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	it.cur = instr
+	it.next = instr.FallThrough
+	return true
+}
+
+// Instruction returns the instruction decoded by the last call to Next.
+func (it *InstructionIterator) Instruction() *Instruction {
+	return it.cur
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *InstructionIterator) Err() error {
+	return it.err
+}
+
+// decodeInstruction translates and disassembles the instruction at the start
+// of data.
+func (c *Context) decodeInstruction(data []byte, addr uint64) (*Instruction, error) {
+	trans, err := pcode_translate(c, data, addr, 1, 0)
+	if err != nil {
+		if trans != nil {
+			trans.Destroy()
+		}
+		return nil, err
+	}
+
+	// the ops only reference Go memory, so the native translation can be
+	// released right away and the instruction keeps the ops
+	ops := trans.Ops
+	trans.Ops = nil
+	trans.Destroy()
+
+	disas, err := pcode_disassemble(c, data, addr, 1)
+	if disas != nil {
+		defer disas.Destroy()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(disas.Instructions) == 0 {
+		return nil, fmt.Errorf("disassembly failed")
+	}
+
+	instr := &Instruction{
+		_formatter: c.formatter(),
+		Address:    addr,
+		Length:     disas.Instructions[0].Length,
+		Mnemonic:   disas.Instructions[0].Mnemonic,
+		Body:       disas.Instructions[0].Body,
+		Ops:        ops,
+	}
+
+	for _, op := range ops {
+		if op.Opcode == CPUI_IMARK {
+			if end := instructionEnd(op); end > addr+instr.Length {
+				instr.Length = end - addr
+			}
+		}
+	}
+	instr.FallThrough = addr + instr.Length
+
+	instr.HasFallThrough = fallsThrough(ops, instr.FallThrough)
+
+	return instr, nil
+}
+
+// fallsThrough reports whether execution may continue at the fall-through
+// address after the ops of an instruction: whether the end of the ops is
+// reachable from the first one, following the relative branches of the const
+// space, or one of them branches to fallThrough, like the not taken path of
+// an ARM conditional return.
+func fallsThrough(ops []PcodeOp, fallThrough uint64) bool {
+	if len(ops) == 0 {
+		return true
+	}
+
+	space := ops[0].Inputs[0].Space.Name
+	seen := make([]bool, len(ops))
+	work := []int{0}
+	for len(work) != 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		if i >= len(ops) {
+			return true
+		}
+		if i < 0 || seen[i] {
+			continue
+		}
+		seen[i] = true
+
+		op := ops[i]
+		switch op.Opcode {
+		case CPUI_BRANCH, CPUI_CBRANCH:
+			if op.Opcode == CPUI_CBRANCH {
+				work = append(work, i+1)
+			}
+			dest := op.Inputs[0]
+			switch {
+			case dest.Space.Name == "const":
+				work = append(work, i+int(word.SignExtend(dest.Offset, int(dest.Size))))
+			case dest.Space.Name == space && dest.Offset == fallThrough:
+				return true
+			}
+		case CPUI_BRANCHIND, CPUI_RETURN:
+		default:
+			work = append(work, i+1)
+		}
+	}
+	return false
+}
@@ -0,0 +1,324 @@
+package loader
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dzonerzy/gopcode"
+	"github.com/dzonerzy/gopcode/emu"
+)
+
+// relocatableBase is where the sections of relocatable objects, which have
+// no addresses, are laid out.
+const relocatableBase = 0x10000
+
+func loadELF(data []byte) (*Program, error) {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Program{
+		Format:      "ELF",
+		Entry:       f.Entry,
+		BigEndian:   f.ByteOrder == binary.BigEndian,
+		AddressSize: 32,
+	}
+	if f.Class == elf.ELFCLASS64 {
+		p.AddressSize = 64
+	}
+
+	// debug/elf does not expose e_flags, the secondary key of the opinions
+	flagsOff := 0x24
+	if f.Class == elf.ELFCLASS64 {
+		flagsOff = 0x30
+	}
+	if len(data) < flagsOff+4 {
+		return nil, fmt.Errorf("truncated ELF header")
+	}
+	flags := f.ByteOrder.Uint32(data[flagsOff:])
+
+	specs, err := gopcode.QueryOpinions(gopcode.LoaderELF, strconv.Itoa(int(f.Machine)), strconv.FormatUint(uint64(flags), 10))
+	if err != nil && len(specs) == 0 {
+		return nil, err
+	}
+	p.setLoadSpecs(specs)
+
+	// section addresses, assigned for relocatable objects
+	addrs := make([]uint64, len(f.Sections))
+	if f.Type == elf.ET_REL {
+		p.Entry = 0
+		layoutSections(f, addrs)
+	} else {
+		for i, s := range f.Sections {
+			addrs[i] = s.Addr
+		}
+	}
+
+	if err := p.loadELFSegments(f, data, addrs); err != nil {
+		return nil, err
+	}
+
+	for i, s := range f.Sections {
+		if s.Flags&elf.SHF_ALLOC == 0 || s.Name == "" {
+			continue
+		}
+		p.Sections = append(p.Sections, &Section{
+			Name: s.Name,
+			Addr: addrs[i],
+			Size: s.Size,
+			Perm: elfSectionPerm(s.Flags),
+		})
+	}
+
+	symbols, _ := f.Symbols()
+	dynamic, _ := f.DynamicSymbols()
+	p.loadELFSymbols(f, addrs, symbols, dynamic)
+
+	if err := p.loadELFRelocations(f, addrs, symbols, dynamic); err != nil {
+		return nil, err
+	}
+	p.loadELFImports(f, dynamic)
+
+	return p, nil
+}
+
+// layoutSections gives addresses to the allocated sections of a relocatable
+// object, one after the other.
+func layoutSections(f *elf.File, addrs []uint64) {
+	next := uint64(relocatableBase)
+	for i, s := range f.Sections {
+		if s.Flags&elf.SHF_ALLOC == 0 || s.Size == 0 {
+			continue
+		}
+		if align := s.Addralign; align > 1 {
+			next = (next + align - 1) &^ (align - 1)
+		}
+		addrs[i] = next
+		next += s.Size
+	}
+}
+
+func elfSectionPerm(flags elf.SectionFlag) emu.Perm {
+	perm := emu.PermRead
+	if flags&elf.SHF_WRITE != 0 {
+		perm |= emu.PermWrite
+	}
+	if flags&elf.SHF_EXECINSTR != 0 {
+		perm |= emu.PermExec
+	}
+	return perm
+}
+
+func (p *Program) loadELFSegments(f *elf.File, data []byte, addrs []uint64) error {
+	for i, prog := range f.Progs {
+		if prog.Type != elf.PT_LOAD {
+			continue
+		}
+		if prog.Off+prog.Filesz > uint64(len(data)) || prog.Filesz > prog.Memsz {
+			return fmt.Errorf("segment %d is out of the file", i)
+		}
+
+		var perm emu.Perm
+		if prog.Flags&elf.PF_R != 0 {
+			perm |= emu.PermRead
+		}
+		if prog.Flags&elf.PF_W != 0 {
+			perm |= emu.PermWrite
+		}
+		if prog.Flags&elf.PF_X != 0 {
+			perm |= emu.PermExec
+		}
+
+		p.Segments = append(p.Segments, &Segment{
+			Name: fmt.Sprintf("segment_%d", i),
+			Addr: prog.Vaddr,
+			Size: prog.Memsz,
+			Perm: perm,
+			Data: data[prog.Off : prog.Off+prog.Filesz],
+		})
+	}
+
+	// relocatable objects have no program headers, their sections are
+	// the segments
+	if len(f.Progs) == 0 {
+		for i, s := range f.Sections {
+			if s.Flags&elf.SHF_ALLOC == 0 || s.Size == 0 {
+				continue
+			}
+
+			seg := &Segment{Name: s.Name, Addr: addrs[i], Size: s.Size, Perm: elfSectionPerm(s.Flags)}
+			if s.Type != elf.SHT_NOBITS {
+				d, err := s.Data()
+				if err != nil {
+					return fmt.Errorf("section %s: %v", s.Name, err)
+				}
+				seg.Data = d
+			}
+			p.Segments = append(p.Segments, seg)
+		}
+	}
+
+	p.sortSegments()
+	return nil
+}
+
+func (p *Program) loadELFSymbols(f *elf.File, addrs []uint64, symbols, dynamic []elf.Symbol) {
+	type key struct {
+		name string
+		addr uint64
+	}
+	seen := map[key]bool{}
+
+	add := func(sym elf.Symbol, export bool) {
+		typ := elf.ST_TYPE(sym.Info)
+		if sym.Name == "" || sym.Section == elf.SHN_UNDEF || typ == elf.STT_FILE || typ == elf.STT_SECTION {
+			return
+		}
+
+		s := &Symbol{Name: sym.Name, Addr: sym.Value, Size: sym.Size}
+		if f.Type == elf.ET_REL && sym.Section < elf.SHN_LORESERVE && int(sym.Section) < len(addrs) {
+			s.Addr += addrs[sym.Section]
+		}
+		switch typ {
+		case elf.STT_FUNC:
+			s.Kind = SymbolFunction
+		case elf.STT_OBJECT, elf.STT_TLS:
+			s.Kind = SymbolObject
+		}
+		bind := elf.ST_BIND(sym.Info)
+		s.Global = bind == elf.STB_GLOBAL || bind == elf.STB_WEAK
+
+		if export && s.Global {
+			p.Exports = append(p.Exports, s)
+		}
+		if k := (key{s.Name, s.Addr}); !seen[k] {
+			seen[k] = true
+			p.Symbols = append(p.Symbols, s)
+		}
+	}
+
+	for _, sym := range symbols {
+		add(sym, false)
+	}
+	for _, sym := range dynamic {
+		add(sym, true)
+	}
+}
+
+// relocationSections returns the REL and RELA sections, the ones patching
+// the PLT first.
+func relocationSections(f *elf.File) []*elf.Section {
+	var plt, other []*elf.Section
+	for _, s := range f.Sections {
+		if s.Type != elf.SHT_REL && s.Type != elf.SHT_RELA {
+			continue
+		}
+		if strings.HasSuffix(s.Name, ".plt") {
+			plt = append(plt, s)
+		} else {
+			other = append(other, s)
+		}
+	}
+	return append(plt, other...)
+}
+
+func (p *Program) loadELFRelocations(f *elf.File, addrs []uint64, symbols, dynamic []elf.Symbol) error {
+	for _, s := range relocationSections(f) {
+		data, err := s.Data()
+		if err != nil {
+			return fmt.Errorf("section %s: %v", s.Name, err)
+		}
+
+		var syms []elf.Symbol
+		if int(s.Link) < len(f.Sections) {
+			switch f.Sections[s.Link].Type {
+			case elf.SHT_SYMTAB:
+				syms = symbols
+			case elf.SHT_DYNSYM:
+				syms = dynamic
+			}
+		}
+
+		// offsets of relocatable objects are relative to the patched
+		// section
+		var base uint64
+		if f.Type == elf.ET_REL && int(s.Info) < len(addrs) {
+			base = addrs[s.Info]
+		}
+
+		rela := s.Type == elf.SHT_RELA
+		word := 4
+		if f.Class == elf.ELFCLASS64 {
+			word = 8
+		}
+		size := 2 * word
+		if rela {
+			size += word
+		}
+
+		order := f.ByteOrder
+		for off := 0; off+size <= len(data); off += size {
+			entry := data[off : off+size]
+
+			var r Relocation
+			var sym uint64
+			if f.Class == elf.ELFCLASS64 {
+				info := order.Uint64(entry[8:])
+				r.Addr = order.Uint64(entry) + base
+				r.Type, sym = uint32(info), info>>32
+				if rela {
+					r.Addend = int64(order.Uint64(entry[16:]))
+				}
+			} else {
+				info := order.Uint32(entry[4:])
+				r.Addr = uint64(order.Uint32(entry)) + base
+				r.Type, sym = info&0xff, uint64(info>>8)
+				if rela {
+					r.Addend = int64(int32(order.Uint32(entry[8:])))
+				}
+			}
+
+			// debug/elf drops the null symbol at index 0
+			if sym != 0 && sym <= uint64(len(syms)) {
+				r.Symbol = syms[sym-1].Name
+			}
+			p.Relocations = append(p.Relocations, &r)
+		}
+	}
+
+	return nil
+}
+
+// loadELFImports lists the undefined dynamic symbols, with the slot of their
+// first relocation.
+func (p *Program) loadELFImports(f *elf.File, dynamic []elf.Symbol) {
+	libraries := map[string]string{}
+	if imported, err := f.ImportedSymbols(); err == nil {
+		for _, imp := range imported {
+			libraries[imp.Name] = imp.Library
+		}
+	}
+
+	slots := map[string]uint64{}
+	for _, r := range p.Relocations {
+		if _, ok := slots[r.Symbol]; !ok && r.Symbol != "" {
+			slots[r.Symbol] = r.Addr
+		}
+	}
+
+	for _, sym := range dynamic {
+		if sym.Section != elf.SHN_UNDEF || sym.Name == "" {
+			continue
+		}
+		p.Imports = append(p.Imports, &Import{
+			Name:    sym.Name,
+			Library: libraries[sym.Name],
+			Addr:    slots[sym.Name],
+		})
+	}
+}
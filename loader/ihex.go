@@ -0,0 +1,88 @@
+package loader
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+)
+
+// Intel HEX record types.
+const (
+	ihexData              = 0x00
+	ihexEOF               = 0x01
+	ihexExtSegmentAddress = 0x02
+	ihexStartSegment      = 0x03
+	ihexExtLinearAddress  = 0x04
+	ihexStartLinear       = 0x05
+)
+
+// loadIHex reads an Intel HEX file. The extended segment and linear address
+// records set the upper bits of the following data records, the start
+// records the entry point.
+func loadIHex(data []byte) (*Program, error) {
+	p := &Program{Format: "Intel HEX"}
+
+	var records []*Segment
+	var base uint64
+	for n, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != ':' {
+			return nil, fmt.Errorf("line %d: missing start code", n+1)
+		}
+
+		rec := make([]byte, hex.DecodedLen(len(line)-1))
+		if _, err := hex.Decode(rec, line[1:]); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n+1, err)
+		}
+		if len(rec) < 5 || len(rec) != int(rec[0])+5 {
+			return nil, fmt.Errorf("line %d: invalid record length", n+1)
+		}
+		var sum byte
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0 {
+			return nil, fmt.Errorf("line %d: checksum mismatch", n+1)
+		}
+
+		addr := uint64(rec[1])<<8 | uint64(rec[2])
+		payload := rec[4 : len(rec)-1]
+		switch rec[3] {
+		case ihexData:
+			if len(payload) != 0 {
+				records = append(records, &Segment{Addr: base + addr, Size: uint64(len(payload)), Data: payload})
+			}
+		case ihexEOF:
+			p.addRecords(records)
+			return p, nil
+		case ihexExtSegmentAddress, ihexExtLinearAddress:
+			if len(payload) != 2 {
+				return nil, fmt.Errorf("line %d: invalid address record", n+1)
+			}
+			base = uint64(payload[0])<<8 | uint64(payload[1])
+			if rec[3] == ihexExtSegmentAddress {
+				base <<= 4
+			} else {
+				base <<= 16
+			}
+		case ihexStartSegment, ihexStartLinear:
+			if len(payload) != 4 {
+				return nil, fmt.Errorf("line %d: invalid start record", n+1)
+			}
+			if rec[3] == ihexStartSegment {
+				cs := uint64(payload[0])<<8 | uint64(payload[1])
+				ip := uint64(payload[2])<<8 | uint64(payload[3])
+				p.Entry = cs<<4 + ip
+			} else {
+				p.Entry = uint64(payload[0])<<24 | uint64(payload[1])<<16 | uint64(payload[2])<<8 | uint64(payload[3])
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unknown record type %d", n+1, rec[3])
+		}
+	}
+
+	return nil, fmt.Errorf("missing end of file record")
+}
@@ -0,0 +1,402 @@
+// Package loader reads ELF, PE and Mach-O executable files into a Program:
+// the memory image described by their segments, their sections, symbols,
+// imports and relocations, and the gopcode language they are written for,
+// chosen with the .opinion files of the registered processors.
+//
+// Firmware images, Intel HEX and Motorola S-record files or raw binaries
+// placed by a MemoryMap, do not record their language, see
+// Program.SetLanguage.
+//
+//	prog, _ := loader.Open("/bin/true")
+//	ctx, _ := prog.NewContext()
+//	trans, _ := prog.Translate(ctx, prog.Entry, 10, gopcode.BbTerminating)
+//
+// Files are only read, nothing is executed or linked: relocations and imports
+// are reported, not applied.
+package loader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/dzonerzy/gopcode"
+	"github.com/dzonerzy/gopcode/emu"
+)
+
+const pageSize = 0x1000
+
+// Segment is a range of the memory image. Data holds its initialized bytes
+// and may be shorter than Size, the rest is zero.
+type Segment struct {
+	Name string
+	Addr uint64
+	Size uint64
+	Perm emu.Perm
+	Data []byte
+}
+
+// Section is a named range of the memory image, within a segment. Space is
+// empty unless the section is in another address space than the memory
+// image, e.g. the SFR space of the 8051.
+type Section struct {
+	Name  string
+	Addr  uint64
+	Size  uint64
+	Perm  emu.Perm
+	Space string
+}
+
+type SymbolKind int
+
+const (
+	SymbolUnknown SymbolKind = iota
+	SymbolFunction
+	SymbolObject
+)
+
+func (k SymbolKind) String() string {
+	switch k {
+	case SymbolFunction:
+		return "function"
+	case SymbolObject:
+		return "object"
+	}
+	return "unknown"
+}
+
+// Symbol is a named address defined by the file. Space is empty unless the
+// address is in another address space than the memory image.
+type Symbol struct {
+	Name   string
+	Addr   uint64
+	Size   uint64
+	Kind   SymbolKind
+	Global bool
+	Space  string
+}
+
+// Import is a symbol the file expects from a library. Addr is the slot the
+// dynamic linker fills with its address, e.g. a GOT entry, or 0 when the
+// import has none.
+type Import struct {
+	Name    string
+	Library string
+	Addr    uint64
+}
+
+// Relocation is a location of the memory image that the linker patches.
+// Type is specific to the format and the architecture.
+type Relocation struct {
+	Addr   uint64
+	Type   uint32
+	Symbol string
+	Addend int64
+}
+
+// Program is a loaded executable file.
+type Program struct {
+	Format string // "ELF", "PE", "Mach-O", "Intel HEX", "S-record" or "raw"
+
+	// Language is the most likely language of the code and CompilerID its
+	// compiler spec. LoadSpecs lists every candidate, best first. Language
+	// is nil when no registered processor claims the file.
+	Language   *gopcode.ArchitectureLanguage
+	CompilerID string
+	LoadSpecs  []gopcode.LoadSpec
+
+	Entry       uint64
+	BigEndian   bool
+	AddressSize int // in bits
+
+	Segments    []*Segment // sorted by address
+	Sections    []*Section
+	Symbols     []*Symbol
+	Exports     []*Symbol
+	Imports     []*Import
+	Relocations []*Relocation
+
+	// FunctionStarts holds the function entry points the file records
+	// besides its symbols, e.g. the .pdata entries of x64 PE files or
+	// LC_FUNCTION_STARTS of Mach-O files.
+	FunctionStarts []uint64
+}
+
+// Open loads the file at name.
+func Open(name string) (*Program, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return Load(data)
+}
+
+// Load loads a file from its contents, recognized by its magic number. Of
+// the slices of a fat Mach-O file, arm64 is preferred, then x86_64; see
+// LoadSlice to pick another.
+func Load(data []byte) (*Program, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x7fELF")):
+		return loadELF(data)
+	case bytes.HasPrefix(data, []byte("MZ")):
+		return loadPE(data)
+	case isFat(data):
+		return loadFat(data)
+	case isMachO(data):
+		return loadMachO(data)
+	case bytes.HasPrefix(data, []byte(":")):
+		return loadIHex(data)
+	case len(data) > 1 && data[0] == 'S' && data[1] >= '0' && data[1] <= '9':
+		return loadSRec(data)
+	}
+
+	return nil, fmt.Errorf("unknown file format")
+}
+
+// setLoadSpecs records the candidate languages, preferring the ones of the
+// address size and endianness of the file.
+func (p *Program) setLoadSpecs(specs []gopcode.LoadSpec) {
+	endian := "little"
+	if p.BigEndian {
+		endian = "big"
+	}
+
+	rank := func(s gopcode.LoadSpec) int {
+		r := 0
+		if s.Language.Size != p.AddressSize {
+			r += 2
+		}
+		if s.Language.Endian != endian {
+			r++
+		}
+		return r
+	}
+	sort.SliceStable(specs, func(i, j int) bool {
+		return rank(specs[i]) < rank(specs[j])
+	})
+
+	p.LoadSpecs = specs
+	if len(specs) != 0 {
+		p.Language, p.CompilerID = specs[0].Language, specs[0].CompilerID
+	}
+}
+
+func (p *Program) sortSegments() {
+	sort.SliceStable(p.Segments, func(i, j int) bool {
+		return p.Segments[i].Addr < p.Segments[j].Addr
+	})
+}
+
+// addRecords builds the segments of a firmware image from its data records,
+// in file order. Contiguous records are merged and where records overlap the
+// last one wins.
+func (p *Program) addRecords(records []*Segment) {
+	sorted := append([]*Segment(nil), records...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Addr < sorted[j].Addr
+	})
+
+	var cur *Segment
+	for _, r := range sorted {
+		if cur != nil && r.Addr <= cur.Addr+cur.Size {
+			if end := r.Addr + r.Size; end > cur.Addr+cur.Size {
+				cur.Size = end - cur.Addr
+			}
+			continue
+		}
+		cur = &Segment{
+			Name: fmt.Sprintf("segment_%d", len(p.Segments)),
+			Addr: r.Addr,
+			Size: r.Size,
+			Perm: emu.PermRX,
+		}
+		p.Segments = append(p.Segments, cur)
+	}
+
+	p.sortSegments()
+	for _, seg := range p.Segments {
+		if seg.Data == nil {
+			seg.Data = make([]byte, seg.Size)
+		}
+	}
+	for _, r := range records {
+		seg, _ := p.Segment(r.Addr)
+		copy(seg.Data[r.Addr-seg.Addr:], r.Data)
+	}
+}
+
+// NewContext creates a context for the language of the program.
+func (p *Program) NewContext() (*gopcode.Context, error) {
+	if p.Language == nil {
+		return nil, fmt.Errorf("unknown language")
+	}
+	return gopcode.NewContext(p.Language.LanguageID)
+}
+
+// Segment returns the segment containing addr.
+func (p *Program) Segment(addr uint64) (*Segment, bool) {
+	i := sort.Search(len(p.Segments), func(i int) bool {
+		return p.Segments[i].Addr+p.Segments[i].Size > addr
+	})
+	if i < len(p.Segments) && p.Segments[i].Addr <= addr {
+		return p.Segments[i], true
+	}
+	return nil, false
+}
+
+// Section returns the section with the given name.
+func (p *Program) Section(name string) (*Section, bool) {
+	for _, s := range p.Sections {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// Symbol returns the symbol with the given name.
+func (p *Program) Symbol(name string) (*Symbol, bool) {
+	for _, s := range p.Symbols {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// SymbolAt returns a symbol defined at addr of the memory image, preferring
+// functions.
+func (p *Program) SymbolAt(addr uint64) (*Symbol, bool) {
+	var found *Symbol
+	for _, s := range p.Symbols {
+		if s.Addr == addr && s.Space == "" && (found == nil || found.Kind != SymbolFunction && s.Kind == SymbolFunction) {
+			found = s
+		}
+	}
+	return found, found != nil
+}
+
+// Bytes returns the initialized bytes from addr to the end of its segment,
+// the input of Translate and Disassemble, or nil if there are none.
+func (p *Program) Bytes(addr uint64) []byte {
+	seg, ok := p.Segment(addr)
+	if !ok || addr-seg.Addr >= uint64(len(seg.Data)) {
+		return nil
+	}
+	return seg.Data[addr-seg.Addr:]
+}
+
+// Read returns size bytes of the memory image at addr, which may span
+// adjacent segments.
+func (p *Program) Read(addr uint64, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	for n := 0; n < size; {
+		at := addr + uint64(n)
+		seg, ok := p.Segment(at)
+		if !ok {
+			return nil, fmt.Errorf("address 0x%x is not loaded", at)
+		}
+
+		off := at - seg.Addr
+		chunk := seg.Size - off
+		if rest := uint64(size - n); chunk > rest {
+			chunk = rest
+		}
+		if off < uint64(len(seg.Data)) {
+			copy(buf[n:n+int(chunk)], seg.Data[off:])
+		}
+		n += int(chunk)
+	}
+	return buf, nil
+}
+
+// Bounds returns the lowest and the end of the highest address loaded.
+func (p *Program) Bounds() (lo, hi uint64) {
+	if len(p.Segments) == 0 {
+		return 0, 0
+	}
+
+	lo = p.Segments[0].Addr
+	for _, seg := range p.Segments {
+		if end := seg.Addr + seg.Size; end > hi {
+			hi = end
+		}
+	}
+	return lo, hi
+}
+
+func (p *Program) byteOrder() binary.ByteOrder {
+	if p.BigEndian {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// cString reads the NUL terminated string at addr.
+func (p *Program) cString(addr uint64) (string, error) {
+	b := p.Bytes(addr)
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return string(b[:i]), nil
+	}
+	return "", fmt.Errorf("unterminated string at 0x%x", addr)
+}
+
+func (p *Program) readUint(addr uint64, size int) (uint64, error) {
+	b, err := p.Read(addr, size)
+	if err != nil {
+		return 0, err
+	}
+	order := p.byteOrder()
+	switch size {
+	case 2:
+		return uint64(order.Uint16(b)), nil
+	case 4:
+		return uint64(order.Uint32(b)), nil
+	}
+	return order.Uint64(b), nil
+}
+
+// Translate translates the code at addr, see gopcode.Context.Translate.
+func (p *Program) Translate(ctx *gopcode.Context, addr uint64, maxInstructions uint32, flags gopcode.TranslateFlags) (*gopcode.PcodeTranslation, error) {
+	return ctx.Translate(p.Bytes(addr), addr, maxInstructions, flags)
+}
+
+// Disassemble disassembles the code at addr, see gopcode.Context.Disassemble.
+func (p *Program) Disassemble(ctx *gopcode.Context, addr uint64, maxInstructions uint32) (*gopcode.PcodeDisassembly, error) {
+	return ctx.Disassemble(p.Bytes(addr), addr, maxInstructions)
+}
+
+// Map maps the segments in the memory of an emulator. Pages shared by
+// segments get the permissions of all of them.
+func (p *Program) Map(e *emu.Emulator) error {
+	perms := map[uint64]emu.Perm{}
+	for _, seg := range p.Segments {
+		if seg.Size == 0 {
+			continue
+		}
+		for pg := seg.Addr &^ (pageSize - 1); pg < seg.Addr+seg.Size; pg += pageSize {
+			perms[pg] |= seg.Perm
+		}
+	}
+
+	pages := make([]uint64, 0, len(perms))
+	for pg := range perms {
+		pages = append(pages, pg)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i] < pages[j] })
+
+	for _, pg := range pages {
+		if err := e.Map(pg, pageSize, perms[pg]); err != nil {
+			return err
+		}
+	}
+
+	for _, seg := range p.Segments {
+		if err := e.Memory().Poke(seg.Addr, seg.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
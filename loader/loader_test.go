@@ -0,0 +1,619 @@
+package loader_test
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/dzonerzy/gopcode"
+	"github.com/dzonerzy/gopcode/cfg"
+	"github.com/dzonerzy/gopcode/emu"
+	"github.com/dzonerzy/gopcode/emu/linux"
+	"github.com/dzonerzy/gopcode/loader"
+	_ "github.com/dzonerzy/gopcode/processors/6502"
+	_ "github.com/dzonerzy/gopcode/processors/8051"
+	_ "github.com/dzonerzy/gopcode/processors/AARCH64"
+	_ "github.com/dzonerzy/gopcode/processors/HCS08"
+	_ "github.com/dzonerzy/gopcode/processors/x86"
+)
+
+const (
+	rX86_64PC32     = 2
+	rX86_64Relative = 8
+)
+
+func open(t *testing.T, name string) *loader.Program {
+	p, err := loader.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestELFExecutable(t *testing.T) {
+	p := open(t, "hello-x86_64")
+
+	if p.Format != "ELF" || p.AddressSize != 64 || p.BigEndian {
+		t.Fatalf("unexpected header %s %d %v", p.Format, p.AddressSize, p.BigEndian)
+	}
+	if p.Language == nil || p.Language.LanguageID != "x86:le:64:default" || p.CompilerID != "gcc" {
+		t.Fatalf("unexpected language %v %s", p.Language, p.CompilerID)
+	}
+
+	for _, name := range []string{"_start", "add", "counter", "message"} {
+		if _, ok := p.Symbol(name); !ok {
+			t.Fatalf("missing symbol %s", name)
+		}
+	}
+	start, _ := p.Symbol("_start")
+	if start.Addr != p.Entry || start.Kind != loader.SymbolFunction {
+		t.Fatalf("unexpected _start %+v, entry 0x%x", start, p.Entry)
+	}
+	if sym, ok := p.SymbolAt(p.Entry); !ok || sym.Name != "_start" {
+		t.Fatalf("no symbol at the entry point")
+	}
+
+	ctx, err := p.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Destroy()
+
+	trans, err := p.Translate(ctx, p.Entry, 1, gopcode.BbTerminating)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trans.Ops) == 0 || trans.Ops[0].Opcode != gopcode.CPUI_IMARK || trans.Ops[0].Inputs[0].Offset != p.Entry {
+		t.Fatalf("could not translate the entry point")
+	}
+}
+
+func TestELFRun(t *testing.T) {
+	p := open(t, "hello-x86_64")
+
+	ctx, err := p.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Destroy()
+
+	e, err := emu.New(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Map(e); err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := linux.New(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	k.Stdout = &out
+	if err := k.SetupStack(0x7fff0000, 0x10000, []string{"hello"}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	e.SetPC(p.Entry)
+	if err := e.Run(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, ok := k.Exited(); !ok || code != 42 {
+		t.Fatalf("expected exit 42, got %d %v", code, ok)
+	}
+	if out.String() != "hello from elf\n" {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+}
+
+func TestELFDynamic(t *testing.T) {
+	p := open(t, "dynamic-x86_64")
+
+	if p.Entry != 0x1070 {
+		t.Fatalf("unexpected entry 0x%x", p.Entry)
+	}
+
+	imports := map[string]*loader.Import{}
+	for _, imp := range p.Imports {
+		imports[imp.Name] = imp
+	}
+	for name, slot := range map[string]uint64{"strcpy": 0x3fc0, "puts": 0x3fc8, "printf": 0x3fd0} {
+		imp, ok := imports[name]
+		if !ok {
+			t.Fatalf("missing import %s", name)
+		}
+		if imp.Addr != slot || imp.Library != "libc.so.6" {
+			t.Fatalf("unexpected import %+v", imp)
+		}
+	}
+
+	relative := false
+	for _, r := range p.Relocations {
+		if r.Type == rX86_64Relative {
+			relative = true
+		}
+	}
+	if !relative {
+		t.Fatal("missing R_X86_64_RELATIVE relocations")
+	}
+
+	if lo, hi := p.Bounds(); lo != 0 || hi != 0x4080 {
+		t.Fatalf("unexpected bounds 0x%x-0x%x", lo, hi)
+	}
+	seg, ok := p.Segment(p.Entry)
+	if !ok || seg.Perm != emu.PermRX {
+		t.Fatalf("unexpected segment of the entry point %+v", seg)
+	}
+
+	// the .bss is past the initialized data and reads as zero
+	buffer, ok := p.Symbol("buffer")
+	if !ok {
+		t.Fatal("missing symbol buffer")
+	}
+	data, err := p.Read(buffer.Addr, int(buffer.Size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, make([]byte, 64)) {
+		t.Fatalf("unexpected .bss contents %x", data)
+	}
+}
+
+func TestELFRelocatable(t *testing.T) {
+	p := open(t, "hello-x86_64.o")
+
+	text, ok := p.Section(".text")
+	if !ok || text.Addr == 0 || text.Perm != emu.PermRX {
+		t.Fatalf("unexpected .text %+v", text)
+	}
+
+	start, ok := p.Symbol("_start")
+	if !ok || start.Addr < text.Addr || start.Addr >= text.Addr+text.Size {
+		t.Fatalf("_start is not in .text: %+v", start)
+	}
+
+	targets := map[string]bool{}
+	for _, r := range p.Relocations {
+		if r.Type != rX86_64PC32 || r.Addr < text.Addr || r.Addr >= text.Addr+text.Size {
+			t.Fatalf("unexpected relocation %+v", r)
+		}
+		targets[r.Symbol] = true
+	}
+	if !targets["counter"] || !targets["message"] {
+		t.Fatalf("unexpected relocation targets %v", targets)
+	}
+}
+
+func TestPE(t *testing.T) {
+	p := open(t, "hello-x86_64.exe")
+
+	if p.Format != "PE" || p.AddressSize != 64 || p.Entry != 0x140001000 {
+		t.Fatalf("unexpected header %s %d 0x%x", p.Format, p.AddressSize, p.Entry)
+	}
+	if p.Language == nil || p.Language.LanguageID != "x86:le:64:default" || p.CompilerID != "windows" {
+		t.Fatalf("unexpected language %v %s", p.Language, p.CompilerID)
+	}
+
+	want := []loader.Import{
+		{Name: "ExitProcess", Library: "KERNEL32.dll", Addr: 0x140003000},
+		{Name: "puts", Library: "msvcrt.dll", Addr: 0x140003010},
+		{Name: "Ordinal_115", Library: "WS2_32.dll", Addr: 0x140003020},
+	}
+	if len(p.Imports) != len(want) {
+		t.Fatalf("expected %d imports, got %d", len(want), len(p.Imports))
+	}
+	for i, imp := range p.Imports {
+		if *imp != want[i] {
+			t.Fatalf("expected import %+v, got %+v", want[i], *imp)
+		}
+	}
+
+	exports := map[string]uint64{}
+	for _, s := range p.Exports {
+		exports[s.Name] = s.Addr
+	}
+	if len(exports) != 2 || exports["add"] != 0x140001030 || exports["Ordinal_2"] != 0x140001000 {
+		t.Fatalf("unexpected exports %v", exports)
+	}
+
+	if len(p.Relocations) != 1 || p.Relocations[0].Addr != 0x140003030 || p.Relocations[0].Type != 10 {
+		t.Fatalf("unexpected relocations %+v", p.Relocations)
+	}
+
+	// the chained entry at 0x140001020 is a part of main
+	if len(p.FunctionStarts) != 2 || p.FunctionStarts[0] != 0x140001000 || p.FunctionStarts[1] != 0x140001030 {
+		t.Fatalf("unexpected function starts %x", p.FunctionStarts)
+	}
+
+	if text, ok := p.Section(".text"); !ok || text.Addr != 0x140001000 || text.Perm != emu.PermRX {
+		t.Fatalf("unexpected .text %+v", text)
+	}
+	if msg, _ := p.Read(0x140002000, 13); string(msg) != "hello from pe" {
+		t.Fatalf("unexpected string %q", msg)
+	}
+	if lo, _ := p.Bounds(); lo != 0x140000000 {
+		t.Fatalf("headers are not loaded at the image base: 0x%x", lo)
+	}
+
+	ctx, err := p.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Destroy()
+
+	dis, err := p.Disassemble(ctx, p.Entry, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dis.Instructions) != 5 || dis.Instructions[4].Mnemonic != "CALL" {
+		t.Fatalf("unexpected disassembly of main")
+	}
+}
+
+func TestPE32(t *testing.T) {
+	p := open(t, "hello-i386.dll")
+
+	if p.AddressSize != 32 || p.Entry != 0x10001020 {
+		t.Fatalf("unexpected header %d 0x%x", p.AddressSize, p.Entry)
+	}
+	if p.Language == nil || p.Language.LanguageID != "x86:le:32:default" || p.CompilerID != "windows" {
+		t.Fatalf("unexpected language %v %s", p.Language, p.CompilerID)
+	}
+
+	// quit forwards to KERNEL32.ExitProcess and has no address
+	if len(p.Exports) != 2 || p.Exports[0].Name != "add" || p.Exports[1].Name != "get" || p.Exports[1].Addr != 0x10001010 {
+		t.Fatalf("unexpected exports %+v", p.Exports)
+	}
+	if len(p.Relocations) != 1 || p.Relocations[0].Addr != 0x10001011 || p.Relocations[0].Type != 3 {
+		t.Fatalf("unexpected relocations %+v", p.Relocations)
+	}
+	if len(p.Imports) != 0 || len(p.FunctionStarts) != 0 {
+		t.Fatalf("unexpected imports %v or function starts %v", p.Imports, p.FunctionStarts)
+	}
+}
+
+func TestMachO(t *testing.T) {
+	p := open(t, "hello-arm64")
+
+	if p.Format != "Mach-O" || p.AddressSize != 64 || p.Entry != 0x100001000 {
+		t.Fatalf("unexpected header %s %d 0x%x", p.Format, p.AddressSize, p.Entry)
+	}
+	if p.Language == nil || p.Language.LanguageID != "aarch64:le:64:applesilicon" || p.CompilerID != "default" {
+		t.Fatalf("unexpected language %v %s", p.Language, p.CompilerID)
+	}
+
+	// __PAGEZERO is not loaded
+	if lo, _ := p.Bounds(); lo != 0x100000000 {
+		t.Fatalf("unexpected lowest address 0x%x", lo)
+	}
+	if text, ok := p.Section("__TEXT,__text"); !ok || text.Addr != 0x100001000 || text.Perm != emu.PermRX {
+		t.Fatalf("unexpected __text %+v", text)
+	}
+
+	for name, addr := range map[string]uint64{"_main": 0x100001000, "_add": 0x100001020} {
+		if s, ok := p.Symbol(name); !ok || s.Addr != addr || s.Kind != loader.SymbolFunction {
+			t.Fatalf("unexpected symbol %s %+v", name, s)
+		}
+	}
+
+	want := []loader.Import{
+		{Name: "_puts", Library: "/usr/lib/libSystem.B.dylib", Addr: 0x100004000},
+		{Name: "_exit", Library: "/usr/lib/libSystem.B.dylib", Addr: 0x100004008},
+	}
+	if len(p.Imports) != len(want) {
+		t.Fatalf("expected %d imports, got %+v", len(want), p.Imports)
+	}
+	for i, imp := range p.Imports {
+		if *imp != want[i] {
+			t.Fatalf("expected import %+v, got %+v", want[i], *imp)
+		}
+	}
+
+	// the pointer to _add in __const is rebased by the same chain
+	if len(p.Relocations) != 3 {
+		t.Fatalf("expected 3 fixups, got %d", len(p.Relocations))
+	}
+	if r := p.Relocations[2]; r.Addr != 0x100004010 || r.Symbol != "" || r.Addend != 0x100001020 {
+		t.Fatalf("unexpected rebase %+v", r)
+	}
+
+	if len(p.FunctionStarts) != 2 || p.FunctionStarts[0] != 0x100001000 || p.FunctionStarts[1] != 0x100001020 {
+		t.Fatalf("unexpected function starts %x", p.FunctionStarts)
+	}
+}
+
+func TestFat(t *testing.T) {
+	data, err := os.ReadFile("testdata/hello-fat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arches, err := loader.Slices(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(arches) != 2 || arches[0] != "x86_64" || arches[1] != "arm64" {
+		t.Fatalf("unexpected slices %v", arches)
+	}
+
+	p, err := loader.Load(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Language.Processor != "AARCH64" {
+		t.Fatalf("expected the arm64 slice, got %s", p.Language.LanguageID)
+	}
+
+	p, err = loader.LoadSlice(data, "x86_64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Language.LanguageID != "x86:le:64:default" || p.CompilerID != "gcc" {
+		t.Fatalf("unexpected language %s %s", p.Language.LanguageID, p.CompilerID)
+	}
+	if len(p.Imports) != 2 || p.Imports[1].Name != "_exit" || p.Imports[1].Addr != 0x100004008 {
+		t.Fatalf("unexpected imports %+v", p.Imports)
+	}
+	if r := p.Relocations[2]; r.Addend != 0x100001020 {
+		t.Fatalf("unexpected rebase %+v", r)
+	}
+
+	ctx, err := p.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Destroy()
+
+	dis, err := p.Disassemble(ctx, p.Entry, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dis.Instructions) != 3 || dis.Instructions[2].Mnemonic != "CALL" {
+		t.Fatalf("unexpected disassembly of _main")
+	}
+
+	if _, err := loader.LoadSlice(data, "ppc"); err == nil {
+		t.Fatal("expected an error for a missing slice")
+	}
+}
+
+func mnemonics(t *testing.T, p *loader.Program, addr uint64, n uint32) []string {
+	ctx, err := p.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Destroy()
+
+	dis, err := p.Disassemble(ctx, addr, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, ins := range dis.Instructions {
+		out = append(out, ins.Mnemonic)
+	}
+	return out
+}
+
+func TestIHex(t *testing.T) {
+	p, err := loader.Load([]byte(`:020000040000FA
+:04F00000A605B700AA
+:02F0040020FAF0
+:02FFFE00F00011
+:00000001FF
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Format != "Intel HEX" || p.Language != nil {
+		t.Fatalf("format %q, language %v", p.Format, p.Language)
+	}
+	if len(p.Segments) != 2 || p.Segments[0].Addr != 0xf000 || p.Segments[0].Size != 6 {
+		t.Fatalf("records are not merged: %+v", p.Segments)
+	}
+
+	if err := p.SetLanguage("HCS08:BE:16:MC9S08GB60"); err != nil {
+		t.Fatal(err)
+	}
+	if !p.BigEndian || p.AddressSize != 16 || p.CompilerID != "default" {
+		t.Errorf("big endian %v, address size %d, compiler %q", p.BigEndian, p.AddressSize, p.CompilerID)
+	}
+	if s, ok := p.Symbol("PTAD"); !ok || s.Addr != 0 || s.Space != "" {
+		t.Errorf("PTAD = %+v", s)
+	}
+	if seg, ok := p.Segment(0x80); !ok || seg.Name != "LOW_RAM" {
+		t.Errorf("segment at 0x80 = %+v", seg)
+	}
+	if seg, ok := p.Segment(0xf000); !ok || seg.Name != "segment_0" {
+		t.Errorf("memory blocks replace the records: %+v", seg)
+	}
+
+	found := false
+	for _, addr := range p.FunctionStarts {
+		found = found || addr == 0xf000
+	}
+	if !found {
+		t.Errorf("reset vector target missing from %x", p.FunctionStarts)
+	}
+
+	if got := mnemonics(t, p, 0xf000, 3); len(got) != 3 || got[0] != "LDA" || got[1] != "STA" || got[2] != "BRA" {
+		t.Errorf("disassembly = %v", got)
+	}
+}
+
+func TestSRec(t *testing.T) {
+	p, err := loader.Load([]byte("S008000068656C6C6FE3\r\nS1088000A9018D00023E\r\nS10680054C0080A8\r\nS105FFFC00807F\r\nS5030003F9\r\nS90380007C\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Format != "S-record" || p.Entry != 0x8000 {
+		t.Fatalf("format %q, entry 0x%x", p.Format, p.Entry)
+	}
+	if err := p.SetLanguage("6502:LE:16:default"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.Section("ZERO_PAGE"); !ok {
+		t.Error("ZERO_PAGE memory block missing")
+	}
+	if len(p.FunctionStarts) != 1 || p.FunctionStarts[0] != 0x8000 {
+		t.Errorf("function starts %x", p.FunctionStarts)
+	}
+	if got := mnemonics(t, p, 0x8000, 3); len(got) != 3 || got[2] != "JMP" {
+		t.Errorf("disassembly = %v", got)
+	}
+
+	if _, err := loader.Load([]byte("S1088000A9018D00023F\n")); err == nil {
+		t.Error("bad checksum accepted")
+	}
+}
+
+func TestLoadRaw(t *testing.T) {
+	m, err := loader.ParseMemoryMap([]byte(`{
+		"language": "8051:BE:16:default",
+		"regions": [
+			{"name": "CODE", "address": 0, "perm": "rx", "offset": "0x0"},
+			{"name": "XDATA", "address": "0x8000", "size": "0x100", "perm": "rw"}
+		],
+		"symbols": [{"name": "main", "address": "0x0", "kind": "function"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := loader.LoadRaw([]byte{0x75, 0x90, 0xff, 0x80, 0xfe}, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(p.Segments) != 2 || p.Segments[0].Size != 5 || p.Segments[1].Perm != emu.PermRW {
+		t.Fatalf("segments %+v", p.Segments)
+	}
+	if s, ok := p.Symbol("P1"); !ok || s.Space != "SFR" || s.Addr != 0x90 {
+		t.Errorf("P1 = %+v", s)
+	}
+	if s, ok := p.Section("SFR"); !ok || s.Space != "SFR" {
+		t.Errorf("SFR = %+v", s)
+	}
+	if s, ok := p.SymbolAt(0); !ok || s.Name != "main" {
+		t.Errorf("symbol at 0 = %+v", s)
+	}
+	if got := mnemonics(t, p, 0, 2); len(got) != 2 || got[0] != "MOV" || got[1] != "SJMP" {
+		t.Errorf("disassembly = %v", got)
+	}
+}
+
+func findThunks(t *testing.T, p *loader.Program) (*gopcode.Context, map[uint64]string) {
+	ctx, err := p.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ctx.Destroy)
+
+	thunks, err := p.FindThunks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[uint64]string{}
+	for _, th := range thunks {
+		names[th.Addr] = th.Name
+	}
+	return ctx, names
+}
+
+func TestThunks(t *testing.T) {
+	p := open(t, "dynamic-x86_64")
+	ctx, names := findThunks(t, p)
+
+	want := map[uint64]string{0x1030: "strcpy", 0x1040: "puts", 0x1050: "printf", 0x1060: "__cxa_finalize"}
+	for addr, name := range want {
+		if names[addr] != name {
+			t.Errorf("thunk at 0x%x = %q, want %q", addr, names[addr], name)
+		}
+	}
+	if name, ok := names[0x1020]; ok {
+		t.Errorf("PLT0 labeled %s", name)
+	}
+	if name, ok := p.SymbolName(0x1040); !ok || name != "puts" {
+		t.Errorf("symbol at 0x1040 = %q", name)
+	}
+
+	main, _ := p.Symbol("main")
+	b := &cfg.Builder{Context: ctx, Source: p, SkipCalls: true, Name: p.SymbolName}
+	g, err := b.Build(main.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []uint64{0x1030, 0x1040, 0x1050} {
+		if g.Names[addr] != want[addr] {
+			t.Errorf("callee 0x%x = %q, want %q", addr, g.Names[addr], want[addr])
+		}
+	}
+}
+
+func TestThunksAArch64(t *testing.T) {
+	m, err := loader.ParseMemoryMap([]byte(`{
+		"language": "AARCH64:LE:64:v8A",
+		"regions": [
+			{"name": "text", "address": "0x10000", "perm": "rx", "offset": 0},
+			{"name": "got", "address": "0x20000", "size": "0x100", "perm": "rw"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := []byte{
+		0x90, 0x00, 0x00, 0x90, // adrp x16, 0x20000
+		0x11, 0x0a, 0x40, 0xf9, // ldr x17, [x16, #0x10]
+		0x10, 0x42, 0x00, 0x91, // add x16, x16, #0x10
+		0x20, 0x02, 0x1f, 0xd6, // br x17
+		0xfc, 0xff, 0xff, 0x97, // bl 0x10000
+		0xc0, 0x03, 0x5f, 0xd6, // ret
+	}
+	p, err := loader.LoadRaw(code, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Relocations = append(p.Relocations, &loader.Relocation{Addr: 0x20010, Symbol: "memcpy"})
+
+	_, names := findThunks(t, p)
+	if len(names) != 1 || names[0x10000] != "memcpy" {
+		t.Fatalf("thunks = %v", names)
+	}
+	if name, ok := p.SymbolName(0x10000); !ok || name != "memcpy" {
+		t.Errorf("symbol at 0x10000 = %q", name)
+	}
+}
+
+func TestThunksPartialWrite(t *testing.T) {
+	m, err := loader.ParseMemoryMap([]byte(`{
+		"language": "x86:LE:64:default",
+		"regions": [
+			{"name": ".plt", "address": "0x10000", "perm": "rx", "offset": 0},
+			{"name": "got", "address": "0x20000", "size": "0x100", "perm": "rw"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := []byte{
+		0x48, 0x8b, 0x05, 0xf9, 0xff, 0x00, 0x00, // 0x10000: mov rax, [rip+0xfff9]
+		0xb0, 0x00, // 0x10007: mov al, 0
+		0xff, 0xe0, // 0x10009: jmp rax
+		0x48, 0x8b, 0x05, 0xf6, 0xff, 0x00, 0x00, // 0x1000b: mov rax, [rip+0xfff6]
+		0xff, 0xe0, // 0x10012: jmp rax
+	}
+	p, err := loader.LoadRaw(code, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Relocations = append(p.Relocations,
+		&loader.Relocation{Addr: 0x20000, Symbol: "memcpy"},
+		&loader.Relocation{Addr: 0x20008, Symbol: "memset"})
+
+	// writing AL changes the target loaded into RAX
+	_, names := findThunks(t, p)
+	if len(names) != 1 || names[0x1000b] != "memset" {
+		t.Fatalf("thunks = %v", names)
+	}
+}
@@ -0,0 +1,642 @@
+package loader
+
+import (
+	"bytes"
+	"debug/macho"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dzonerzy/gopcode"
+	"github.com/dzonerzy/gopcode/emu"
+)
+
+const (
+	fatMagic = 0xcafebabe
+
+	// Java class files share the magic of fat files, they are told apart by
+	// the number of architectures which is their version there
+	maxFatArches = 0x20
+
+	cpuArm64_32 = 0x0200000c
+
+	lcUnixThread        = 0x5
+	lcFunctionStarts    = 0x26
+	lcMain              = 0x80000028
+	lcDyldChainedFixups = 0x80000034
+
+	nStab = 0xe0
+	nType = 0x0e
+	nExt  = 0x01
+	nPExt = 0x10
+	nUndf = 0x0
+	nSect = 0xe
+
+	sAttrPureInstructions = 0x80000000
+	sAttrSomeInstructions = 0x400
+
+	chainedPtrArm64e           = 1
+	chainedPtr64               = 2
+	chainedPtr32               = 3
+	chainedPtr64Offset         = 6
+	chainedPtrArm64eUserland   = 9
+	chainedPtrArm64eUserland24 = 12
+
+	chainedPtrStartNone  = 0xffff
+	chainedPtrStartMulti = 0x8000
+)
+
+// machoArches names the CPU types of slices, the names Slices returns and
+// LoadSlice takes.
+var machoArches = map[macho.Cpu]string{
+	macho.Cpu386:   "i386",
+	macho.CpuAmd64: "x86_64",
+	macho.CpuArm:   "arm",
+	macho.CpuArm64: "arm64",
+	cpuArm64_32:    "arm64_32",
+	macho.CpuPpc:   "ppc",
+	macho.CpuPpc64: "ppc64",
+}
+
+// preferredSlices is the order in which Load picks the slice of a fat file.
+var preferredSlices = []string{"arm64", "x86_64", "arm64_32", "arm", "i386"}
+
+func archName(cpu macho.Cpu) string {
+	if name, ok := machoArches[cpu]; ok {
+		return name
+	}
+	return fmt.Sprintf("cpu%d", uint32(cpu))
+}
+
+func isFat(data []byte) bool {
+	return len(data) >= 8 && binary.BigEndian.Uint32(data) == fatMagic &&
+		binary.BigEndian.Uint32(data[4:]) < maxFatArches
+}
+
+func isMachO(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(data) {
+	case macho.Magic32, macho.Magic64:
+		return true
+	}
+	switch binary.BigEndian.Uint32(data) {
+	case macho.Magic32, macho.Magic64:
+		return true
+	}
+	return false
+}
+
+type fatSlice struct {
+	arch string
+	data []byte
+}
+
+func fatSlices(data []byte) ([]fatSlice, error) {
+	n := binary.BigEndian.Uint32(data[4:])
+	if uint64(len(data)) < 8+20*uint64(n) {
+		return nil, fmt.Errorf("truncated fat header")
+	}
+
+	slices := make([]fatSlice, 0, n)
+	for i := uint32(0); i < n; i++ {
+		h := data[8+20*i:]
+		cpu := macho.Cpu(binary.BigEndian.Uint32(h))
+		off := uint64(binary.BigEndian.Uint32(h[8:]))
+		size := uint64(binary.BigEndian.Uint32(h[12:]))
+		if off+size > uint64(len(data)) {
+			return nil, fmt.Errorf("slice %s is out of the file", archName(cpu))
+		}
+		slices = append(slices, fatSlice{archName(cpu), data[off : off+size]})
+	}
+	return slices, nil
+}
+
+// Slices returns the architectures of a Mach-O file, "arm64", "x86_64", ...,
+// one per slice of a fat file.
+func Slices(data []byte) ([]string, error) {
+	switch {
+	case isFat(data):
+		slices, err := fatSlices(data)
+		if err != nil {
+			return nil, err
+		}
+		arches := make([]string, len(slices))
+		for i, s := range slices {
+			arches[i] = s.arch
+		}
+		return arches, nil
+
+	case isMachO(data):
+		f, err := macho.NewFile(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return []string{archName(f.Cpu)}, nil
+	}
+
+	return nil, fmt.Errorf("not a Mach-O file")
+}
+
+// LoadSlice loads the slice of a Mach-O file for the given architecture, see
+// Slices.
+func LoadSlice(data []byte, arch string) (*Program, error) {
+	if !isFat(data) {
+		arches, err := Slices(data)
+		if err != nil {
+			return nil, err
+		}
+		if arches[0] != arch {
+			return nil, fmt.Errorf("no %s slice", arch)
+		}
+		return loadMachO(data)
+	}
+
+	slices, err := fatSlices(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range slices {
+		if s.arch == arch {
+			return loadMachO(s.data)
+		}
+	}
+	return nil, fmt.Errorf("no %s slice", arch)
+}
+
+// loadFat loads the preferred slice of a fat file.
+func loadFat(data []byte) (*Program, error) {
+	slices, err := fatSlices(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(slices) == 0 {
+		return nil, fmt.Errorf("empty fat file")
+	}
+
+	for _, arch := range preferredSlices {
+		for _, s := range slices {
+			if s.arch == arch {
+				return loadMachO(s.data)
+			}
+		}
+	}
+	return loadMachO(slices[0].data)
+}
+
+func loadMachO(data []byte) (*Program, error) {
+	f, err := macho.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Program{
+		Format:      "Mach-O",
+		BigEndian:   f.ByteOrder == binary.BigEndian,
+		AddressSize: 32,
+	}
+	if f.Magic == macho.Magic64 {
+		p.AddressSize = 64
+	}
+
+	var secondary string
+	switch {
+	case bytes.Contains(data, goBuildInfo):
+		secondary = "golang"
+	case hasSwiftSections(f):
+		secondary = "swift"
+	}
+	specs, err := gopcode.QueryOpinions(gopcode.LoaderMachO, strconv.FormatUint(uint64(f.Cpu), 10), secondary)
+	if err != nil && len(specs) == 0 {
+		return nil, err
+	}
+	p.setLoadSpecs(specs)
+
+	// addresses in the load commands are relative to the segment mapping
+	// the start of the file
+	var base uint64
+	var libraries []string
+	for _, l := range f.Loads {
+		switch l := l.(type) {
+		case *macho.Segment:
+			if l.Offset == 0 && l.Filesz != 0 {
+				base = l.Addr
+			}
+		case *macho.Dylib:
+			libraries = append(libraries, l.Name)
+		}
+	}
+
+	if err := p.loadMachOSegments(f, data); err != nil {
+		return nil, err
+	}
+	p.loadMachOSymbols(f, libraries)
+
+	for _, l := range f.Loads {
+		raw := l.Raw()
+		if len(raw) < 8 {
+			continue
+		}
+		cmd := f.ByteOrder.Uint32(raw)
+
+		switch cmd {
+		case lcMain:
+			if len(raw) >= 16 {
+				p.Entry = base + f.ByteOrder.Uint64(raw[8:])
+			}
+		case lcUnixThread:
+			if p.Entry == 0 {
+				p.Entry = threadPC(f, raw)
+			}
+		case lcFunctionStarts:
+			off, size, err := linkeditData(f, raw, data)
+			if err != nil {
+				return nil, fmt.Errorf("function starts: %v", err)
+			}
+			p.loadFunctionStarts(base, data[off:off+size])
+		case lcDyldChainedFixups:
+			off, size, err := linkeditData(f, raw, data)
+			if err != nil {
+				return nil, fmt.Errorf("chained fixups: %v", err)
+			}
+			if err := p.loadChainedFixups(base, data[off:off+size], libraries); err != nil {
+				return nil, fmt.Errorf("chained fixups: %v", err)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+func hasSwiftSections(f *macho.File) bool {
+	for _, s := range f.Sections {
+		if strings.HasPrefix(s.Name, "__swift5") {
+			return true
+		}
+	}
+	return false
+}
+
+// linkeditData returns the range of the file described by a
+// linkedit_data_command.
+func linkeditData(f *macho.File, raw, data []byte) (uint32, uint32, error) {
+	if len(raw) < 16 {
+		return 0, 0, fmt.Errorf("truncated load command")
+	}
+	off, size := f.ByteOrder.Uint32(raw[8:]), f.ByteOrder.Uint32(raw[12:])
+	if uint64(off)+uint64(size) > uint64(len(data)) {
+		return 0, 0, fmt.Errorf("data is out of the file")
+	}
+	return off, size, nil
+}
+
+// threadPC returns the program counter of the thread state of an
+// LC_UNIXTHREAD command, the entry point of binaries without LC_MAIN.
+func threadPC(f *macho.File, raw []byte) uint64 {
+	var word, index int
+	switch f.Cpu {
+	case macho.Cpu386:
+		word, index = 4, 10 // eip
+	case macho.CpuArm:
+		word, index = 4, 15 // pc
+	case macho.CpuAmd64:
+		word, index = 8, 16 // rip
+	case macho.CpuArm64:
+		word, index = 8, 32 // pc
+	default:
+		return 0
+	}
+
+	// cmd, cmdsize, flavor and count precede the state
+	off := 16 + word*index
+	if len(raw) < off+word {
+		return 0
+	}
+	if word == 4 {
+		return uint64(f.ByteOrder.Uint32(raw[off:]))
+	}
+	return f.ByteOrder.Uint64(raw[off:])
+}
+
+func (p *Program) loadMachOSegments(f *macho.File, data []byte) error {
+	for _, l := range f.Loads {
+		seg, ok := l.(*macho.Segment)
+		if !ok {
+			continue
+		}
+		// __PAGEZERO reserves the low addresses and has no access
+		if seg.Prot == 0 && seg.Filesz == 0 {
+			continue
+		}
+		if seg.Offset+seg.Filesz > uint64(len(data)) || seg.Filesz > seg.Memsz {
+			return fmt.Errorf("segment %s is out of the file", seg.Name)
+		}
+
+		var perm emu.Perm
+		if seg.Prot&1 != 0 {
+			perm |= emu.PermRead
+		}
+		if seg.Prot&2 != 0 {
+			perm |= emu.PermWrite
+		}
+		if seg.Prot&4 != 0 {
+			perm |= emu.PermExec
+		}
+
+		p.Segments = append(p.Segments, &Segment{
+			Name: seg.Name,
+			Addr: seg.Addr,
+			Size: seg.Memsz,
+			Perm: perm,
+			Data: data[seg.Offset : seg.Offset+seg.Filesz],
+		})
+
+		// sections are named after Apple's "segment,section" notation,
+		// section names alone are not unique
+		for _, s := range f.Sections {
+			if s.Seg == seg.Name {
+				p.Sections = append(p.Sections, &Section{
+					Name: s.Seg + "," + s.Name,
+					Addr: s.Addr,
+					Size: s.Size,
+					Perm: perm,
+				})
+			}
+		}
+	}
+
+	p.sortSegments()
+	return nil
+}
+
+// loadMachOSymbols reads LC_SYMTAB. Undefined symbols are imports, of the
+// library given by their two-level namespace ordinal; their addresses come
+// from the chained fixups, if any.
+func (p *Program) loadMachOSymbols(f *macho.File, libraries []string) {
+	if f.Symtab == nil {
+		return
+	}
+
+	for _, sym := range f.Symtab.Syms {
+		if sym.Type&nStab != 0 || sym.Name == "" {
+			continue
+		}
+
+		switch sym.Type & nType {
+		case nUndf:
+			imp := &Import{Name: sym.Name}
+			if ord := int(sym.Desc >> 8); ord > 0 && ord <= len(libraries) {
+				imp.Library = libraries[ord-1]
+			}
+			p.Imports = append(p.Imports, imp)
+
+		case nSect:
+			s := &Symbol{
+				Name:   sym.Name,
+				Addr:   sym.Value,
+				Kind:   SymbolObject,
+				Global: sym.Type&nExt != 0 && sym.Type&nPExt == 0,
+			}
+			if i := int(sym.Sect) - 1; i >= 0 && i < len(f.Sections) &&
+				f.Sections[i].Flags&(sAttrPureInstructions|sAttrSomeInstructions) != 0 {
+				s.Kind = SymbolFunction
+			}
+			if s.Global {
+				p.Exports = append(p.Exports, s)
+			}
+			p.Symbols = append(p.Symbols, s)
+		}
+	}
+}
+
+// loadFunctionStarts decodes LC_FUNCTION_STARTS, ULEB128 deltas from the
+// start of the image.
+func (p *Program) loadFunctionStarts(base uint64, data []byte) {
+	addr := base
+	for len(data) != 0 {
+		delta, n := binary.Uvarint(data)
+		if n <= 0 || delta == 0 {
+			return
+		}
+		data = data[n:]
+		addr += delta
+		p.FunctionStarts = append(p.FunctionStarts, addr)
+	}
+}
+
+type chainedImport struct {
+	name, library string
+	addend        int64
+}
+
+// loadChainedFixups reads LC_DYLD_CHAINED_FIXUPS: the imports it binds and
+// the chains of pointers to fix, which start in each page of the data
+// segments. Bound pointers become imports and relocations naming their symbol,
+// rebased pointers relocations whose Addend is their target. The Type of the
+// relocations is the DYLD_CHAINED_PTR_* format of the chain.
+func (p *Program) loadChainedFixups(base uint64, blob []byte, libraries []string) error {
+	if len(blob) < 28 {
+		return fmt.Errorf("truncated header")
+	}
+	le := binary.LittleEndian
+	startsOff := le.Uint32(blob[4:])
+	importsOff := le.Uint32(blob[8:])
+	symbolsOff := le.Uint32(blob[12:])
+	count := le.Uint32(blob[16:])
+	format := le.Uint32(blob[20:])
+	if le.Uint32(blob[24:]) != 0 {
+		return fmt.Errorf("compressed symbol names are not supported")
+	}
+
+	imports, err := chainedImports(blob, importsOff, symbolsOff, count, format, libraries)
+	if err != nil {
+		return err
+	}
+
+	if uint64(startsOff)+4 > uint64(len(blob)) {
+		return fmt.Errorf("truncated starts")
+	}
+	starts := blob[startsOff:]
+	segCount := le.Uint32(starts)
+	if 4+4*uint64(segCount) > uint64(len(starts)) {
+		return fmt.Errorf("truncated starts")
+	}
+
+	for i := uint32(0); i < segCount; i++ {
+		off := le.Uint32(starts[4+4*i:])
+		if off == 0 {
+			continue
+		}
+		if uint64(off)+22 > uint64(len(starts)) {
+			return fmt.Errorf("truncated segment starts")
+		}
+		seg := starts[off:]
+		segPageSize := uint64(le.Uint16(seg[4:]))
+		ptrFormat := le.Uint16(seg[6:])
+		segOffset := le.Uint64(seg[8:])
+		pageCount := int(le.Uint16(seg[20:]))
+		if 22+2*pageCount > len(seg) {
+			return fmt.Errorf("truncated segment starts")
+		}
+
+		for pg := 0; pg < pageCount; pg++ {
+			start := le.Uint16(seg[22+2*pg:])
+			// pages with several chains only occur in 32-bit firmware
+			if start == chainedPtrStartNone || start&chainedPtrStartMulti != 0 {
+				continue
+			}
+			addr := base + segOffset + uint64(pg)*segPageSize + uint64(start)
+			if err := p.walkChain(base, addr, ptrFormat, imports); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func chainedImports(blob []byte, off, symbols, count, format uint32, libraries []string) ([]chainedImport, error) {
+	size := map[uint32]uint32{1: 4, 2: 8, 3: 16}[format]
+	if size == 0 {
+		return nil, fmt.Errorf("unknown imports format %d", format)
+	}
+	if uint64(off)+uint64(count)*uint64(size) > uint64(len(blob)) || uint64(symbols) > uint64(len(blob)) {
+		return nil, fmt.Errorf("truncated imports")
+	}
+
+	le := binary.LittleEndian
+	imports := make([]chainedImport, count)
+	for i := range imports {
+		entry := blob[off+uint32(i)*size:]
+
+		var ordinal int
+		var name uint64
+		switch format {
+		case 1, 2:
+			v := le.Uint32(entry)
+			ordinal, name = int(int8(v)), uint64(v>>9)
+			if format == 2 {
+				imports[i].addend = int64(int32(le.Uint32(entry[4:])))
+			}
+		case 3:
+			v := le.Uint64(entry)
+			ordinal, name = int(int16(v)), v>>32
+			imports[i].addend = int64(le.Uint64(entry[8:]))
+		}
+
+		strs := blob[symbols:]
+		if name >= uint64(len(strs)) {
+			return nil, fmt.Errorf("import %d name is out of the symbols", i)
+		}
+		if end := bytes.IndexByte(strs[name:], 0); end >= 0 {
+			imports[i].name = string(strs[name : name+uint64(end)])
+		}
+		// 0 is the image itself, negative ordinals the main executable, a
+		// flat namespace lookup or a weak lookup
+		if ordinal > 0 && ordinal <= len(libraries) {
+			imports[i].library = libraries[ordinal-1]
+		}
+	}
+	return imports, nil
+}
+
+// walkChain follows a chain of fixups from addr.
+func (p *Program) walkChain(base, addr uint64, format uint16, imports []chainedImport) error {
+	for {
+		var raw uint64
+		var err error
+		if format == chainedPtr32 {
+			raw, err = p.readUint(addr, 4)
+		} else {
+			raw, err = p.readUint(addr, 8)
+		}
+		if err != nil {
+			return err
+		}
+
+		var next, stride uint64
+		var bind bool
+		var ordinal uint64
+		var addend int64
+		var target uint64
+
+		switch format {
+		case chainedPtr64, chainedPtr64Offset:
+			next, stride = raw>>51&0xfff, 4
+			if bind = raw>>63 != 0; bind {
+				ordinal, addend = raw&0xffffff, int64(raw>>24&0xff)
+			} else {
+				target = raw&0xfffffffff | (raw>>36&0xff)<<56
+				if format == chainedPtr64Offset {
+					target += base
+				}
+			}
+
+		case chainedPtrArm64e, chainedPtrArm64eUserland, chainedPtrArm64eUserland24:
+			next, stride = raw>>51&0x7ff, 8
+			auth := raw>>63 != 0
+			if bind = raw>>62&1 != 0; bind {
+				ordinal = raw & 0xffff
+				if format == chainedPtrArm64eUserland24 {
+					ordinal = raw & 0xffffff
+				}
+				if !auth {
+					// 19 bits, sign extended
+					addend = int64(raw>>32&0x7ffff) << 45 >> 45
+				}
+			} else if auth {
+				target = raw&0xffffffff + base
+			} else {
+				target = raw&0x7ffffffffff | (raw>>43&0xff)<<56
+				if format != chainedPtrArm64e {
+					target += base
+				}
+			}
+
+		case chainedPtr32:
+			next, stride = raw>>26&0x1f, 4
+			if bind = raw>>31 != 0; bind {
+				ordinal, addend = raw&0xfffff, int64(raw>>20&0x3f)
+			} else {
+				target = raw & 0x3ffffff
+			}
+
+		default:
+			return fmt.Errorf("unsupported pointer format %d", format)
+		}
+
+		r := &Relocation{Addr: addr, Type: uint32(format)}
+		if bind {
+			if ordinal >= uint64(len(imports)) {
+				return fmt.Errorf("import %d out of range at 0x%x", ordinal, addr)
+			}
+			imp := imports[ordinal]
+			r.Symbol, r.Addend = imp.name, imp.addend+addend
+			p.addImport(&Import{Name: imp.name, Library: imp.library, Addr: addr})
+		} else {
+			r.Addend = int64(target)
+		}
+		p.Relocations = append(p.Relocations, r)
+
+		if next == 0 {
+			return nil
+		}
+		addr += next * stride
+	}
+}
+
+// addImport records an import, filling the address of the one read from
+// the symbol table.
+func (p *Program) addImport(imp *Import) {
+	for _, known := range p.Imports {
+		if known.Name == imp.Name && known.Addr == 0 {
+			known.Addr = imp.Addr
+			if known.Library == "" {
+				known.Library = imp.Library
+			}
+			return
+		}
+	}
+	p.Imports = append(p.Imports, imp)
+}
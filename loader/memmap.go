@@ -0,0 +1,254 @@
+package loader
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dzonerzy/gopcode"
+	"github.com/dzonerzy/gopcode/emu"
+)
+
+// MapUint is a number of a memory map, written as a JSON number or a string
+// such as "0x8000".
+type MapUint uint64
+
+func (u *MapUint) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+
+	v, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %s: %v", b, err)
+	}
+	*u = MapUint(v)
+	return nil
+}
+
+// Region is a range of memory of a MemoryMap. The bytes of the blob at
+// Offset fill it, when Offset is given; Size defaults to the rest of the
+// blob. Without Offset the region is zero. Perm is a combination of "r",
+// "w" and "x", "rwx" when empty.
+type Region struct {
+	Name    string   `json:"name"`
+	Address MapUint  `json:"address"`
+	Size    MapUint  `json:"size"`
+	Perm    string   `json:"perm"`
+	Offset  *MapUint `json:"offset"`
+}
+
+// MapSymbol names an address of a MemoryMap. Kind is "function", "object"
+// or empty.
+type MapSymbol struct {
+	Name    string  `json:"name"`
+	Address MapUint `json:"address"`
+	Kind    string  `json:"kind"`
+}
+
+// MemoryMap describes how a raw binary, e.g. a flash dump, is placed in
+// memory:
+//
+//	{
+//		"language": "HCS08:BE:16:MC9S08GB60",
+//		"entry": "0xf000",
+//		"regions": [
+//			{"name": "FLASH", "address": "0xf000", "size": "0x1000", "perm": "rx", "offset": 0}
+//		],
+//		"symbols": [{"name": "reset", "address": "0xf000", "kind": "function"}]
+//	}
+//
+// Compiler defaults to the first compiler spec of the language.
+type MemoryMap struct {
+	Language string      `json:"language"`
+	Compiler string      `json:"compiler"`
+	Entry    MapUint     `json:"entry"`
+	Regions  []Region    `json:"regions"`
+	Symbols  []MapSymbol `json:"symbols"`
+}
+
+// ParseMemoryMap parses a JSON memory map.
+func ParseMemoryMap(data []byte) (*MemoryMap, error) {
+	m := &MemoryMap{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// LoadRaw places a raw binary in memory as described by m. The memory blocks
+// and symbols of the processor spec of the language are added, see
+// SetLanguage.
+func LoadRaw(blob []byte, m *MemoryMap) (*Program, error) {
+	p := &Program{Format: "raw", Entry: uint64(m.Entry)}
+
+	for _, r := range m.Regions {
+		perm, err := parsePerm(r.Perm)
+		if err != nil {
+			return nil, fmt.Errorf("region %s: %v", r.Name, err)
+		}
+
+		seg := &Segment{Name: r.Name, Addr: uint64(r.Address), Size: uint64(r.Size), Perm: perm}
+		if r.Offset != nil {
+			off := uint64(*r.Offset)
+			if off > uint64(len(blob)) {
+				return nil, fmt.Errorf("region %s: offset 0x%x is out of the blob", r.Name, off)
+			}
+			seg.Data = blob[off:]
+			if seg.Size == 0 {
+				seg.Size = uint64(len(seg.Data))
+			}
+			if uint64(len(seg.Data)) > seg.Size {
+				seg.Data = seg.Data[:seg.Size]
+			}
+		}
+		if seg.Size == 0 {
+			return nil, fmt.Errorf("region %s is empty", r.Name)
+		}
+		if p.overlaps(seg.Addr, seg.Size) {
+			return nil, fmt.Errorf("region %s overlaps another region", r.Name)
+		}
+
+		p.Segments = append(p.Segments, seg)
+		p.Sections = append(p.Sections, &Section{Name: r.Name, Addr: seg.Addr, Size: seg.Size, Perm: perm})
+		p.sortSegments()
+	}
+
+	for _, s := range m.Symbols {
+		sym := &Symbol{Name: s.Name, Addr: uint64(s.Address), Global: true}
+		switch s.Kind {
+		case "function":
+			sym.Kind = SymbolFunction
+		case "object":
+			sym.Kind = SymbolObject
+		case "":
+		default:
+			return nil, fmt.Errorf("symbol %s: unknown kind %q", s.Name, s.Kind)
+		}
+		p.Symbols = append(p.Symbols, sym)
+	}
+
+	if m.Language != "" {
+		if err := p.SetLanguage(m.Language); err != nil {
+			return nil, err
+		}
+	}
+	if m.Compiler != "" {
+		p.CompilerID = m.Compiler
+	}
+	return p, nil
+}
+
+func parsePerm(s string) (emu.Perm, error) {
+	if s == "" {
+		return emu.PermRWX, nil
+	}
+
+	var perm emu.Perm
+	for _, c := range s {
+		switch c {
+		case 'r':
+			perm |= emu.PermRead
+		case 'w':
+			perm |= emu.PermWrite
+		case 'x':
+			perm |= emu.PermExec
+		case '-', 'v': // volatile, as in the memory blocks of processor specs
+		default:
+			return 0, fmt.Errorf("invalid permissions %q", s)
+		}
+	}
+	return perm, nil
+}
+
+func (p *Program) overlaps(addr, size uint64) bool {
+	for _, seg := range p.Segments {
+		if addr < seg.Addr+seg.Size && seg.Addr < addr+size {
+			return true
+		}
+	}
+	return false
+}
+
+// SetLanguage sets the language of a program whose file does not record it,
+// such as a firmware image, and merges its processor spec: the default
+// memory blocks become sections, and zero segments where nothing is loaded,
+// the default symbols name IO registers and interrupt vectors. Blocks and
+// symbols of other address spaces than the one of the code, e.g. the SFR
+// space of the 8051, have their Space set and no segment.
+func (p *Program) SetLanguage(id string) error {
+	al, err := gopcode.LookupLanguage(id)
+	if err != nil {
+		return err
+	}
+	if err := al.Load(); err != nil {
+		return err
+	}
+
+	p.Language = al
+	p.CompilerID = ""
+	if len(al.Compilers) != 0 {
+		p.CompilerID = al.Compilers[0].ID
+	}
+	p.BigEndian = al.IsBigEndian()
+	p.AddressSize = al.Size
+
+	ctx, err := p.NewContext()
+	if err != nil {
+		return err
+	}
+	defer ctx.Destroy()
+	space := ctx.DefaultCodeSpace().Name
+
+	// a space of the spec is the one of the code when it is not given
+	other := func(s string) string {
+		if s == "" || strings.EqualFold(s, space) {
+			return ""
+		}
+		return s
+	}
+
+	for _, b := range al.ProcessorSpecs.DefaultMemoryBlocks {
+		addr, size := b.StartAddress.Offset, uint64(b.Length)
+		perm := emu.PermRW
+		if b.Mode != "" {
+			if perm, err = parsePerm(b.Mode); err != nil {
+				return fmt.Errorf("memory block %s: %v", b.Name, err)
+			}
+		}
+
+		s := &Section{Name: b.Name, Addr: addr, Size: size, Perm: perm, Space: other(b.StartAddress.Space)}
+		p.Sections = append(p.Sections, s)
+
+		// mapped blocks are views of other memory
+		mapped := b.BitMappedAddress != nil || b.ByteMappedAddress != nil
+		if s.Space == "" && !mapped && size != 0 && !p.overlaps(addr, size) {
+			p.Segments = append(p.Segments, &Segment{Name: b.Name, Addr: addr, Size: size, Perm: perm})
+		}
+	}
+	p.sortSegments()
+
+	for _, d := range al.ProcessorSpecs.DefaultSymbols {
+		s := &Symbol{Name: d.Name, Addr: d.Address.Offset, Kind: SymbolObject, Global: true, Space: other(d.Address.Space)}
+		p.Symbols = append(p.Symbols, s)
+		if !d.Entry || s.Space != "" {
+			continue
+		}
+
+		// code_ptr entries are interrupt vectors holding the address of
+		// the handler
+		if d.Type != "code_ptr" {
+			s.Kind = SymbolFunction
+			p.FunctionStarts = append(p.FunctionStarts, s.Addr)
+			continue
+		}
+		if word := al.Size / 8; word == 2 || word == 4 || word == 8 {
+			if target, err := p.readUint(s.Addr, word); err == nil && target != 0 {
+				p.FunctionStarts = append(p.FunctionStarts, target)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,366 @@
+package loader
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/dzonerzy/gopcode"
+	"github.com/dzonerzy/gopcode/emu"
+)
+
+// goBuildInfo starts the build information of Go binaries, which the x86
+// opinions tell apart with the "golang" secondary key.
+var goBuildInfo = []byte("\xff Go buildinf:")
+
+const (
+	symClassExternal = 2
+	symClassStatic   = 3
+	symClassLabel    = 6
+	symTypeFunction  = 0x20
+
+	relBasedAbsolute = 0
+
+	unwFlagChainInfo = 0x4
+
+	ordinalFlag32 = 1 << 31
+	ordinalFlag64 = 1 << 63
+)
+
+func loadPE(data []byte) (*Program, error) {
+	f, err := pe.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Program{Format: "PE"}
+
+	var base uint64
+	var entry, sizeOfHeaders uint32
+	var dirs [16]pe.DataDirectory
+	var numDirs uint32
+	switch oh := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		p.AddressSize = 32
+		base, entry, sizeOfHeaders = uint64(oh.ImageBase), oh.AddressOfEntryPoint, oh.SizeOfHeaders
+		dirs, numDirs = oh.DataDirectory, oh.NumberOfRvaAndSizes
+	case *pe.OptionalHeader64:
+		p.AddressSize = 64
+		base, entry, sizeOfHeaders = oh.ImageBase, oh.AddressOfEntryPoint, oh.SizeOfHeaders
+		dirs, numDirs = oh.DataDirectory, oh.NumberOfRvaAndSizes
+	default:
+		return nil, fmt.Errorf("missing optional header")
+	}
+	if entry != 0 {
+		p.Entry = base + uint64(entry)
+	}
+
+	var secondary string
+	if bytes.Contains(data, goBuildInfo) {
+		secondary = "golang"
+	}
+	specs, err := gopcode.QueryOpinions(gopcode.LoaderPE, strconv.Itoa(int(f.Machine)), secondary)
+	if err != nil && len(specs) == 0 {
+		return nil, err
+	}
+	p.setLoadSpecs(specs)
+
+	if err := p.loadPESections(f, data, base, sizeOfHeaders); err != nil {
+		return nil, err
+	}
+	p.loadCOFFSymbols(f, base)
+
+	dir := func(i int) pe.DataDirectory {
+		if uint32(i) < numDirs {
+			return dirs[i]
+		}
+		return pe.DataDirectory{}
+	}
+	if err := p.loadPEImports(base, dir(pe.IMAGE_DIRECTORY_ENTRY_IMPORT)); err != nil {
+		return nil, fmt.Errorf("imports: %v", err)
+	}
+	if err := p.loadPEExports(base, dir(pe.IMAGE_DIRECTORY_ENTRY_EXPORT)); err != nil {
+		return nil, fmt.Errorf("exports: %v", err)
+	}
+	if err := p.loadPERelocations(base, dir(pe.IMAGE_DIRECTORY_ENTRY_BASERELOC)); err != nil {
+		return nil, fmt.Errorf("relocations: %v", err)
+	}
+	if f.Machine == pe.IMAGE_FILE_MACHINE_AMD64 {
+		if err := p.loadPData(base, dir(pe.IMAGE_DIRECTORY_ENTRY_EXCEPTION)); err != nil {
+			return nil, fmt.Errorf("exceptions: %v", err)
+		}
+	}
+
+	return p, nil
+}
+
+func (p *Program) loadPESections(f *pe.File, data []byte, base uint64, sizeOfHeaders uint32) error {
+	if int(sizeOfHeaders) > len(data) {
+		return fmt.Errorf("headers are out of the file")
+	}
+	p.Segments = append(p.Segments, &Segment{
+		Name: "Headers",
+		Addr: base,
+		Size: uint64(sizeOfHeaders),
+		Perm: emu.PermRead,
+		Data: data[:sizeOfHeaders],
+	})
+
+	for _, s := range f.Sections {
+		size := s.VirtualSize
+		if size == 0 {
+			size = s.Size
+		}
+
+		var perm emu.Perm
+		if s.Characteristics&pe.IMAGE_SCN_MEM_READ != 0 {
+			perm |= emu.PermRead
+		}
+		if s.Characteristics&pe.IMAGE_SCN_MEM_WRITE != 0 {
+			perm |= emu.PermWrite
+		}
+		if s.Characteristics&pe.IMAGE_SCN_MEM_EXECUTE != 0 {
+			perm |= emu.PermExec
+		}
+
+		// the raw data is padded to the file alignment, the rest of the
+		// virtual size is zero
+		raw := s.Size
+		if raw > size {
+			raw = size
+		}
+		if s.Characteristics&pe.IMAGE_SCN_CNT_UNINITIALIZED_DATA != 0 {
+			raw = 0
+		}
+		if uint64(s.Offset)+uint64(raw) > uint64(len(data)) {
+			return fmt.Errorf("section %s is out of the file", s.Name)
+		}
+
+		addr := base + uint64(s.VirtualAddress)
+		p.Segments = append(p.Segments, &Segment{
+			Name: s.Name,
+			Addr: addr,
+			Size: uint64(size),
+			Perm: perm,
+			Data: data[s.Offset : s.Offset+raw],
+		})
+		p.Sections = append(p.Sections, &Section{Name: s.Name, Addr: addr, Size: uint64(size), Perm: perm})
+	}
+
+	p.sortSegments()
+	return nil
+}
+
+// loadCOFFSymbols reads the COFF symbol table, which only binaries built by
+// GNU toolchains usually keep.
+func (p *Program) loadCOFFSymbols(f *pe.File, base uint64) {
+	for _, sym := range f.Symbols {
+		if sym.SectionNumber <= 0 || int(sym.SectionNumber) > len(f.Sections) || sym.Name == "" || sym.Name[0] == '.' {
+			continue
+		}
+		// external, static and label symbols name addresses, the other
+		// classes are debug information
+		switch sym.StorageClass {
+		case symClassExternal, symClassStatic, symClassLabel:
+		default:
+			continue
+		}
+
+		sec := f.Sections[sym.SectionNumber-1]
+		s := &Symbol{
+			Name:   sym.Name,
+			Addr:   base + uint64(sec.VirtualAddress) + uint64(sym.Value),
+			Global: sym.StorageClass == symClassExternal,
+		}
+		switch {
+		case sym.Type&0xf0 == symTypeFunction:
+			s.Kind = SymbolFunction
+		case sec.Characteristics&pe.IMAGE_SCN_MEM_EXECUTE == 0:
+			s.Kind = SymbolObject
+		}
+		p.Symbols = append(p.Symbols, s)
+	}
+}
+
+// loadPEImports walks the import descriptors. Each import is named after its
+// lookup table entry, "Ordinal_N" when imported by ordinal, and its address is
+// its slot in the import address table.
+func (p *Program) loadPEImports(base uint64, dir pe.DataDirectory) error {
+	if dir.VirtualAddress == 0 {
+		return nil
+	}
+
+	word := p.AddressSize / 8
+	ordinalFlag := uint64(ordinalFlag32)
+	if word == 8 {
+		ordinalFlag = ordinalFlag64
+	}
+
+	for desc := base + uint64(dir.VirtualAddress); ; desc += 20 {
+		b, err := p.Read(desc, 20)
+		if err != nil {
+			return err
+		}
+		lookup := binary.LittleEndian.Uint32(b[0:])
+		name := binary.LittleEndian.Uint32(b[12:])
+		iat := binary.LittleEndian.Uint32(b[16:])
+		if name == 0 && iat == 0 {
+			return nil
+		}
+
+		library, err := p.cString(base + uint64(name))
+		if err != nil {
+			return err
+		}
+		// old linkers only emit the address table, which the loader
+		// overwrites
+		if lookup == 0 {
+			lookup = iat
+		}
+
+		for i := uint64(0); ; i++ {
+			entry, err := p.readUint(base+uint64(lookup)+i*uint64(word), word)
+			if err != nil {
+				return err
+			}
+			if entry == 0 {
+				break
+			}
+
+			imp := &Import{Library: library, Addr: base + uint64(iat) + i*uint64(word)}
+			if entry&ordinalFlag != 0 {
+				imp.Name = fmt.Sprintf("Ordinal_%d", entry&0xffff)
+			} else if imp.Name, err = p.cString(base + entry&0x7fffffff + 2); err != nil {
+				return err
+			}
+			p.Imports = append(p.Imports, imp)
+		}
+	}
+}
+
+// loadPEExports reads the export directory. Exports without a name are named
+// "Ordinal_N"; forwarders to other libraries have no address and are left
+// out.
+func (p *Program) loadPEExports(base uint64, dir pe.DataDirectory) error {
+	if dir.VirtualAddress == 0 {
+		return nil
+	}
+
+	start := base + uint64(dir.VirtualAddress)
+	b, err := p.Read(start, 40)
+	if err != nil {
+		return err
+	}
+	ordinalBase := binary.LittleEndian.Uint32(b[16:])
+	numFunctions := binary.LittleEndian.Uint32(b[20:])
+	numNames := binary.LittleEndian.Uint32(b[24:])
+	functions := base + uint64(binary.LittleEndian.Uint32(b[28:]))
+	names := base + uint64(binary.LittleEndian.Uint32(b[32:]))
+	ordinals := base + uint64(binary.LittleEndian.Uint32(b[36:]))
+
+	named := map[uint32]string{}
+	for i := uint64(0); i < uint64(numNames); i++ {
+		ord, err := p.readUint(ordinals+2*i, 2)
+		if err != nil {
+			return err
+		}
+		rva, err := p.readUint(names+4*i, 4)
+		if err != nil {
+			return err
+		}
+		if named[uint32(ord)], err = p.cString(base + rva); err != nil {
+			return err
+		}
+	}
+
+	for i := uint32(0); i < numFunctions; i++ {
+		rva, err := p.readUint(functions+4*uint64(i), 4)
+		if err != nil {
+			return err
+		}
+		addr := base + rva
+		if rva == 0 || addr >= start && addr < start+uint64(dir.Size) {
+			continue
+		}
+
+		name, ok := named[i]
+		if !ok {
+			name = fmt.Sprintf("Ordinal_%d", ordinalBase+i)
+		}
+		s := &Symbol{Name: name, Addr: addr, Global: true}
+		if seg, ok := p.Segment(addr); ok && seg.Perm&emu.PermExec != 0 {
+			s.Kind = SymbolFunction
+		} else {
+			s.Kind = SymbolObject
+		}
+		p.Exports = append(p.Exports, s)
+		p.Symbols = append(p.Symbols, s)
+	}
+	return nil
+}
+
+// loadPERelocations reads the base relocations, applied by the loader when
+// the image is not loaded at its preferred base. Type is the
+// IMAGE_REL_BASED_* kind of the fixup.
+func (p *Program) loadPERelocations(base uint64, dir pe.DataDirectory) error {
+	if dir.VirtualAddress == 0 {
+		return nil
+	}
+
+	b, err := p.Read(base+uint64(dir.VirtualAddress), int(dir.Size))
+	if err != nil {
+		return err
+	}
+	for len(b) >= 8 {
+		page := binary.LittleEndian.Uint32(b)
+		size := binary.LittleEndian.Uint32(b[4:])
+		if size < 8 || int(size) > len(b) {
+			return fmt.Errorf("invalid block size %d", size)
+		}
+
+		for off := 8; off+2 <= int(size); off += 2 {
+			entry := binary.LittleEndian.Uint16(b[off:])
+			if typ := uint32(entry >> 12); typ != relBasedAbsolute {
+				p.Relocations = append(p.Relocations, &Relocation{
+					Addr: base + uint64(page) + uint64(entry&0xfff),
+					Type: typ,
+				})
+			}
+		}
+		b = b[size:]
+	}
+	return nil
+}
+
+// loadPData reads the function starts from the x64 exception directory.
+// Entries whose unwind information chains to another entry describe a part
+// of a function, not its start.
+func (p *Program) loadPData(base uint64, dir pe.DataDirectory) error {
+	if dir.VirtualAddress == 0 {
+		return nil
+	}
+
+	b, err := p.Read(base+uint64(dir.VirtualAddress), int(dir.Size))
+	if err != nil {
+		return err
+	}
+	for off := 0; off+12 <= len(b); off += 12 {
+		begin := binary.LittleEndian.Uint32(b[off:])
+		unwind := binary.LittleEndian.Uint32(b[off+8:])
+		if begin == 0 {
+			continue
+		}
+
+		info, err := p.Read(base+uint64(unwind), 1)
+		if err != nil {
+			return err
+		}
+		if info[0]>>3&unwFlagChainInfo != 0 {
+			continue
+		}
+		p.FunctionStarts = append(p.FunctionStarts, base+uint64(begin))
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package loader
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+)
+
+// loadSRec reads a Motorola S-record file. S1, S2 and S3 records hold data
+// with 16, 24 and 32 bit addresses, S7, S8 and S9 the entry point; the
+// header and count records are skipped.
+func loadSRec(data []byte) (*Program, error) {
+	p := &Program{Format: "S-record"}
+
+	var records []*Segment
+	for n, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if len(line) < 4 || line[0] != 'S' {
+			return nil, fmt.Errorf("line %d: invalid record", n+1)
+		}
+
+		rec := make([]byte, hex.DecodedLen(len(line)-2))
+		if _, err := hex.Decode(rec, line[2:]); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n+1, err)
+		}
+		if len(rec) != int(rec[0])+1 {
+			return nil, fmt.Errorf("line %d: invalid record length", n+1)
+		}
+		var sum byte
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0xff {
+			return nil, fmt.Errorf("line %d: checksum mismatch", n+1)
+		}
+
+		var addrSize int
+		switch line[1] {
+		case '0', '1', '5', '9':
+			addrSize = 2
+		case '2', '6', '8':
+			addrSize = 3
+		case '3', '7':
+			addrSize = 4
+		default:
+			return nil, fmt.Errorf("line %d: unknown record type S%c", n+1, line[1])
+		}
+		if len(rec) < addrSize+2 {
+			return nil, fmt.Errorf("line %d: invalid record length", n+1)
+		}
+
+		var addr uint64
+		for _, b := range rec[1 : 1+addrSize] {
+			addr = addr<<8 | uint64(b)
+		}
+		payload := rec[1+addrSize : len(rec)-1]
+		switch line[1] {
+		case '1', '2', '3':
+			if len(payload) != 0 {
+				records = append(records, &Segment{Addr: addr, Size: uint64(len(payload)), Data: payload})
+			}
+		case '7', '8', '9':
+			p.Entry = addr
+		}
+	}
+
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no data records")
+	}
+	p.addRecords(records)
+	return p, nil
+}
@@ -0,0 +1,15 @@
+// Built with:
+//
+//	gcc -O1 -fpie -pie -fno-asynchronous-unwind-tables -Wl,--build-id=none -Wl,-z,now -o dynamic-x86_64 dynamic.c
+
+#include <stdio.h>
+#include <string.h>
+
+char buffer[64];
+
+int main(int argc, char **argv) {
+	strcpy(buffer, argv[0]);
+	puts(buffer);
+	printf("%d\n", argc);
+	return 0;
+}
@@ -0,0 +1,23 @@
+// Built with:
+//
+//	gcc -Os -static -nostdlib -fno-pie -no-pie -fno-asynchronous-unwind-tables -Wl,--build-id=none -o hello-x86_64 hello.c
+//	gcc -Os -c -fno-asynchronous-unwind-tables -o hello-x86_64.o hello.c
+
+static long sys(long nr, long a, long b, long c) {
+	long ret;
+	__asm__ volatile("syscall" : "=a"(ret) : "a"(nr), "D"(a), "S"(b), "d"(c) : "rcx", "r11", "memory");
+	return ret;
+}
+
+const char message[] = "hello from elf\n";
+int counter = 41;
+
+int add(int a, int b) {
+	return a + b;
+}
+
+void _start(void) {
+	counter = add(counter, 1);
+	sys(1, 1, (long)message, sizeof(message) - 1);
+	sys(60, counter, 0, 0);
+}
@@ -0,0 +1,302 @@
+//go:build ignore
+
+// mkmacho writes the Mach-O test files, there is no Apple toolchain to build
+// them from source. Run it from the testdata directory:
+//
+//	go run mkmacho.go
+//
+// Both slices have a main calling puts and exit through __got, bound with
+// chained fixups, an add function, a pointer to add in __const rebased by the
+// same chain, LC_MAIN, LC_FUNCTION_STARTS and a symbol table. The arm64 slice
+// uses DYLD_CHAINED_PTR_64_OFFSET pointers and the x86_64 one
+// DYLD_CHAINED_PTR_64.
+//
+// hello-arm64 is the arm64 slice alone, hello-fat holds both.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+)
+
+const (
+	base     = 0x100000000
+	pageSize = 0x4000
+
+	textOff     = 0x1000 // _main
+	addOff      = 0x1020 // _add
+	cstringOff  = 0x1100
+	dataOff     = 0x4000 // __got, then __const
+	linkeditOff = 0x8000
+
+	cpuX86_64 = 0x01000007
+	cpuArm64  = 0x0100000c
+
+	lcSymtab          = 0x2
+	lcLoadDylib       = 0xc
+	lcSegment64       = 0x19
+	lcFunctionStarts  = 0x26
+	lcMain            = 0x80000028
+	lcDyldChainedFixs = 0x80000034
+
+	ptr64       = 2
+	ptr64Offset = 6
+)
+
+var le = binary.LittleEndian
+
+type buffer struct{ bytes.Buffer }
+
+func (b *buffer) u8(v uint8)   { b.WriteByte(v) }
+func (b *buffer) u16(v uint16) { binary.Write(b, le, v) }
+func (b *buffer) u32(v uint32) { binary.Write(b, le, v) }
+func (b *buffer) u64(v uint64) { binary.Write(b, le, v) }
+func (b *buffer) name(s string) {
+	var n [16]byte
+	copy(n[:], s)
+	b.Write(n[:])
+}
+func (b *buffer) pad(align int) {
+	for b.Len()%align != 0 {
+		b.WriteByte(0)
+	}
+}
+
+type section struct {
+	name   string
+	addr   uint64
+	size   uint64
+	offset uint32
+	flags  uint32
+}
+
+func (b *buffer) segment(name string, addr, size, off, filesize uint64, prot uint32, secs []section) {
+	b.u32(lcSegment64)
+	b.u32(uint32(72 + 80*len(secs)))
+	b.name(name)
+	b.u64(addr)
+	b.u64(size)
+	b.u64(off)
+	b.u64(filesize)
+	b.u32(prot)
+	b.u32(prot)
+	b.u32(uint32(len(secs)))
+	b.u32(0)
+	for _, s := range secs {
+		b.name(s.name)
+		b.name(name)
+		b.u64(s.addr)
+		b.u64(s.size)
+		b.u32(s.offset)
+		b.u32(2)
+		b.u32(0)
+		b.u32(0)
+		b.u32(s.flags)
+		b.u32(0)
+		b.u32(0)
+		b.u32(0)
+	}
+}
+
+func code(cpu uint32) []byte {
+	var b buffer
+	if cpu == cpuArm64 {
+		for _, w := range []uint32{
+			0xa9bf7bfd, // stp x29, x30, [sp, #-16]!
+			0x100007e0, // adr x0, message
+			0x58017fd0, // ldr x16, _puts@got
+			0xd63f0200, // blr x16
+			0x52800000, // mov w0, #0
+			0x58017fb0, // ldr x16, _exit@got
+			0xd63f0200, // blr x16
+			0xd4200000, // brk #0
+			0x0b010000, // _add: add w0, w0, w1
+			0xd65f03c0, // ret
+		} {
+			b.u32(w)
+		}
+		return b.Bytes()
+	}
+
+	b.Write([]byte{
+		0x55,                                     // push rbp
+		0x48, 0x8d, 0x3d, 0xf8, 0x00, 0x00, 0x00, // lea rdi, [rip+message]
+		0xff, 0x15, 0xf2, 0x2f, 0x00, 0x00, // call [rip+_puts@got]
+		0x31, 0xff, // xor edi, edi
+		0xff, 0x15, 0xf2, 0x2f, 0x00, 0x00, // call [rip+_exit@got]
+		0x0f, 0x0b, // ud2
+	})
+	for b.Len() < addOff-textOff {
+		b.u8(0xcc)
+	}
+	b.Write([]byte{0x8d, 0x04, 0x37, 0xc3}) // _add: lea eax, [rdi+rsi]; ret
+	return b.Bytes()
+}
+
+func slice(cpu uint32) []byte {
+	format := uint16(ptr64)
+	rebase := uint64(base + addOff)
+	if cpu == cpuArm64 {
+		format = ptr64Offset
+		rebase = addOff
+	}
+
+	// __got binds _puts and _exit, __const holds a pointer to _add
+	var data buffer
+	data.u64(1<<63 | 2<<51 | 0) // bind import 0, next in 8 bytes
+	data.u64(1<<63 | 2<<51 | 1) // bind import 1
+	data.u64(rebase)            // rebase, end of the chain
+
+	var link buffer
+	fixups := link.Len()
+	link.u32(0)  // fixups_version
+	link.u32(32) // starts_offset
+	link.u32(80) // imports_offset
+	link.u32(88) // symbols_offset
+	link.u32(2)  // imports_count
+	link.u32(1)  // DYLD_CHAINED_IMPORT
+	link.u32(0)  // uncompressed symbols
+	link.pad(8)
+	link.u32(4) // starts_in_image: seg_count
+	link.u32(0)
+	link.u32(0)
+	link.u32(24) // __DATA_CONST
+	link.u32(0)
+	link.pad(8)
+	link.u32(24) // starts_in_segment: size
+	link.u16(pageSize)
+	link.u16(format)
+	link.u64(dataOff)
+	link.u32(0)
+	link.u16(1)
+	link.u16(0)
+	link.u32(1 | 0<<9) // libSystem, _puts
+	link.u32(1 | 6<<9) // libSystem, _exit
+	link.WriteString("_puts\x00_exit\x00")
+	link.pad(8)
+	fixupsSize := link.Len() - fixups
+
+	starts := link.Len()
+	link.Write([]byte{0x80, 0x20, 0x20, 0x00}) // uleb128 0x1000, 0x20, end
+	link.pad(8)
+	startsSize := link.Len() - starts
+
+	symoff := link.Len()
+	strtab := "\x00__mh_execute_header\x00_main\x00_add\x00_puts\x00_exit\x00"
+	for _, s := range []struct {
+		strx  uint32
+		typ   uint8
+		sect  uint8
+		desc  uint16
+		value uint64
+	}{
+		{1, 0x0f, 1, 0x10, base},
+		{21, 0x0f, 1, 0, base + textOff},
+		{27, 0x0f, 1, 0, base + addOff},
+		{32, 0x01, 0, 1 << 8, 0},
+		{38, 0x01, 0, 1 << 8, 0},
+	} {
+		link.u32(s.strx)
+		link.u8(s.typ)
+		link.u8(s.sect)
+		link.u16(s.desc)
+		link.u64(s.value)
+	}
+	stroff := link.Len()
+	link.WriteString(strtab)
+	link.pad(8)
+
+	var cmds buffer
+	cmds.segment("__PAGEZERO", 0, base, 0, 0, 0, nil)
+	cmds.segment("__TEXT", base, pageSize, 0, pageSize, 5, []section{
+		{"__text", base + textOff, uint64(len(code(cpu))), textOff, 0x80000400},
+		{"__cstring", base + cstringOff, 17, cstringOff, 2},
+	})
+	cmds.segment("__DATA_CONST", base+dataOff, pageSize, dataOff, pageSize, 3, []section{
+		{"__got", base + dataOff, 16, dataOff, 6},
+		{"__const", base + dataOff + 16, 8, dataOff + 16, 0},
+	})
+	cmds.segment("__LINKEDIT", base+linkeditOff, pageSize, linkeditOff, uint64(link.Len()), 1, nil)
+	cmds.u32(lcDyldChainedFixs)
+	cmds.u32(16)
+	cmds.u32(uint32(linkeditOff + fixups))
+	cmds.u32(uint32(fixupsSize))
+	cmds.u32(lcFunctionStarts)
+	cmds.u32(16)
+	cmds.u32(uint32(linkeditOff + starts))
+	cmds.u32(uint32(startsSize))
+	cmds.u32(lcSymtab)
+	cmds.u32(24)
+	cmds.u32(uint32(linkeditOff + symoff))
+	cmds.u32(5)
+	cmds.u32(uint32(linkeditOff + stroff))
+	cmds.u32(uint32(len(strtab)))
+	dylib := "/usr/lib/libSystem.B.dylib\x00"
+	cmds.u32(lcLoadDylib)
+	cmds.u32(uint32(24 + (len(dylib)+7)&^7))
+	cmds.u32(24)
+	cmds.u32(2)
+	cmds.u32(0x05276403)
+	cmds.u32(0x00010000)
+	cmds.WriteString(dylib)
+	cmds.pad(8)
+	cmds.u32(lcMain)
+	cmds.u32(24)
+	cmds.u64(textOff)
+	cmds.u64(0)
+
+	var b buffer
+	b.u32(0xfeedfacf)
+	b.u32(cpu)
+	if cpu == cpuX86_64 {
+		b.u32(3)
+	} else {
+		b.u32(0)
+	}
+	b.u32(2) // MH_EXECUTE
+	b.u32(9)
+	b.u32(uint32(cmds.Len()))
+	b.u32(0x200085)
+	b.u32(0)
+	b.Write(cmds.Bytes())
+
+	out := make([]byte, linkeditOff+link.Len())
+	copy(out, b.Bytes())
+	copy(out[textOff:], code(cpu))
+	copy(out[cstringOff:], "hello from macho\x00")
+	copy(out[dataOff:], data.Bytes())
+	copy(out[linkeditOff:], link.Bytes())
+	return out
+}
+
+func fat(slices ...[]byte) []byte {
+	var b bytes.Buffer
+	be := binary.BigEndian
+	binary.Write(&b, be, uint32(0xcafebabe))
+	binary.Write(&b, be, uint32(len(slices)))
+
+	off := uint32(pageSize)
+	for _, s := range slices {
+		cpu := le.Uint32(s[4:])
+		binary.Write(&b, be, []uint32{cpu, le.Uint32(s[8:]), off, uint32(len(s)), 14})
+		off += (uint32(len(s)) + pageSize - 1) &^ (pageSize - 1)
+	}
+	for _, s := range slices {
+		for b.Len()%pageSize != 0 {
+			b.WriteByte(0)
+		}
+		b.Write(s)
+	}
+	return b.Bytes()
+}
+
+func main() {
+	arm64 := slice(cpuArm64)
+	if err := os.WriteFile("hello-arm64", arm64, 0o644); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile("hello-fat", fat(slice(cpuX86_64), arm64), 0o644); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,349 @@
+//go:build ignore
+
+// mkpe writes the PE test files, there is no Windows toolchain to build them
+// from source. Run it from the testdata directory:
+//
+//	go run mkpe.go
+//
+// hello-x86_64.exe calls puts and ExitProcess, imports WS2_32.dll by ordinal,
+// exports add by name and main by ordinal, has a pointer to add in .data
+// (with its base relocation) and .pdata entries for main, a chained fragment
+// of main and add.
+//
+// hello-i386.dll exports add and get, a forwarder to KERNEL32.ExitProcess,
+// and get reads a global through an absolute address.
+package main
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"os"
+)
+
+const (
+	fileAlign = 0x200
+	sectAlign = 0x1000
+
+	scnCode  = pe.IMAGE_SCN_CNT_CODE | pe.IMAGE_SCN_MEM_EXECUTE | pe.IMAGE_SCN_MEM_READ
+	scnRData = pe.IMAGE_SCN_CNT_INITIALIZED_DATA | pe.IMAGE_SCN_MEM_READ
+	scnData  = pe.IMAGE_SCN_CNT_INITIALIZED_DATA | pe.IMAGE_SCN_MEM_READ | pe.IMAGE_SCN_MEM_WRITE
+	scnReloc = pe.IMAGE_SCN_CNT_INITIALIZED_DATA | pe.IMAGE_SCN_MEM_READ | pe.IMAGE_SCN_MEM_DISCARDABLE
+)
+
+type section struct {
+	name  string
+	rva   uint32
+	data  []byte
+	chars uint32
+}
+
+// image is the contents of a section, written at RVAs.
+type image struct {
+	rva  uint32
+	data []byte
+}
+
+func (im *image) at(rva uint32, size int) []byte {
+	off := int(rva - im.rva)
+	for len(im.data) < off+size {
+		im.data = append(im.data, 0)
+	}
+	return im.data[off : off+size]
+}
+
+func (im *image) bytes(rva uint32, b ...byte) { copy(im.at(rva, len(b)), b) }
+func (im *image) str(rva uint32, s string)    { copy(im.at(rva, len(s)+1), s) }
+func (im *image) u16(rva uint32, v uint16)    { binary.LittleEndian.PutUint16(im.at(rva, 2), v) }
+func (im *image) u32(rva uint32, v uint32)    { binary.LittleEndian.PutUint32(im.at(rva, 4), v) }
+func (im *image) u64(rva uint32, v uint64)    { binary.LittleEndian.PutUint64(im.at(rva, 8), v) }
+
+func align(v, a uint32) uint32 { return (v + a - 1) &^ (a - 1) }
+
+func build(machine uint16, base uint64, entry uint32, chars uint16, secs []section, dirs [16]pe.DataDirectory) []byte {
+	pe64 := machine == pe.IMAGE_FILE_MACHINE_AMD64
+
+	var buf bytes.Buffer
+	dos := make([]byte, 0x40)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], 0x40)
+	buf.Write(dos)
+	buf.WriteString("PE\x00\x00")
+
+	optSize := 224
+	if pe64 {
+		optSize = 240
+	}
+	binary.Write(&buf, binary.LittleEndian, pe.FileHeader{
+		Machine:              machine,
+		NumberOfSections:     uint16(len(secs)),
+		SizeOfOptionalHeader: uint16(optSize),
+		Characteristics:      chars,
+	})
+
+	last := secs[len(secs)-1]
+	sizeOfImage := align(last.rva+uint32(len(last.data)), sectAlign)
+	const sizeOfHeaders = 0x400
+
+	if pe64 {
+		binary.Write(&buf, binary.LittleEndian, pe.OptionalHeader64{
+			Magic:                       0x20b,
+			MajorLinkerVersion:          2,
+			AddressOfEntryPoint:         entry,
+			BaseOfCode:                  secs[0].rva,
+			ImageBase:                   base,
+			SectionAlignment:            sectAlign,
+			FileAlignment:               fileAlign,
+			MajorOperatingSystemVersion: 6,
+			MajorSubsystemVersion:       6,
+			SizeOfImage:                 sizeOfImage,
+			SizeOfHeaders:               sizeOfHeaders,
+			Subsystem:                   pe.IMAGE_SUBSYSTEM_WINDOWS_CUI,
+			DllCharacteristics:          0x160,
+			SizeOfStackReserve:          0x200000,
+			SizeOfStackCommit:           0x1000,
+			SizeOfHeapReserve:           0x100000,
+			SizeOfHeapCommit:            0x1000,
+			NumberOfRvaAndSizes:         16,
+			DataDirectory:               dirs,
+		})
+	} else {
+		binary.Write(&buf, binary.LittleEndian, pe.OptionalHeader32{
+			Magic:                       0x10b,
+			MajorLinkerVersion:          2,
+			AddressOfEntryPoint:         entry,
+			BaseOfCode:                  secs[0].rva,
+			ImageBase:                   uint32(base),
+			SectionAlignment:            sectAlign,
+			FileAlignment:               fileAlign,
+			MajorOperatingSystemVersion: 4,
+			MajorSubsystemVersion:       4,
+			SizeOfImage:                 sizeOfImage,
+			SizeOfHeaders:               sizeOfHeaders,
+			Subsystem:                   pe.IMAGE_SUBSYSTEM_WINDOWS_CUI,
+			DllCharacteristics:          0x140,
+			SizeOfStackReserve:          0x200000,
+			SizeOfStackCommit:           0x1000,
+			SizeOfHeapReserve:           0x100000,
+			SizeOfHeapCommit:            0x1000,
+			NumberOfRvaAndSizes:         16,
+			DataDirectory:               dirs,
+		})
+	}
+
+	off := uint32(sizeOfHeaders)
+	for _, s := range secs {
+		var name [8]uint8
+		copy(name[:], s.name)
+		raw := align(uint32(len(s.data)), fileAlign)
+		binary.Write(&buf, binary.LittleEndian, pe.SectionHeader32{
+			Name:             name,
+			VirtualSize:      uint32(len(s.data)),
+			VirtualAddress:   s.rva,
+			SizeOfRawData:    raw,
+			PointerToRawData: off,
+			Characteristics:  s.chars,
+		})
+		off += raw
+	}
+
+	buf.Write(make([]byte, sizeOfHeaders-buf.Len()))
+	for _, s := range secs {
+		buf.Write(s.data)
+		buf.Write(make([]byte, align(uint32(buf.Len()), fileAlign)-uint32(buf.Len())))
+	}
+	return buf.Bytes()
+}
+
+func x86_64() []byte {
+	text := &image{rva: 0x1000}
+	rdata := &image{rva: 0x2000}
+	data := &image{rva: 0x3000}
+	pdata := &image{rva: 0x4000}
+	reloc := &image{rva: 0x5000}
+
+	const (
+		msg       = 0x2000
+		iatExit   = 0x3000
+		iatPuts   = 0x3010
+		iatWS2    = 0x3020
+		addPtr    = 0x3030
+		mainStart = 0x1000
+		fragStart = 0x1020
+		addStart  = 0x1030
+	)
+
+	// main
+	text.bytes(0x1000, 0x48, 0x83, 0xec, 0x28) // sub rsp, 0x28
+	text.bytes(0x1004, 0x48, 0x8d, 0x0d)       // lea rcx, [rip+msg]
+	text.u32(0x1007, msg-0x100b)
+	text.bytes(0x100b, 0xff, 0x15) // call [rip+puts]
+	text.u32(0x100d, iatPuts-0x1011)
+	text.bytes(0x1011, 0x31, 0xc9) // xor ecx, ecx
+	text.bytes(0x1013, 0xff, 0x15) // call [rip+ExitProcess]
+	text.u32(0x1015, iatExit-0x1019)
+	text.bytes(0x1019, 0xcc, 0xcc, 0xcc, 0xcc, 0xcc, 0xcc, 0xcc)
+	// fragment of main
+	text.bytes(0x1020, 0x48, 0x83, 0xc4, 0x28, 0xc3) // add rsp, 0x28; ret
+	text.bytes(0x1025, 0xcc, 0xcc, 0xcc, 0xcc, 0xcc, 0xcc, 0xcc, 0xcc, 0xcc, 0xcc, 0xcc)
+	// add
+	text.bytes(0x1030, 0x8d, 0x04, 0x11, 0xc3) // lea eax, [rcx+rdx]; ret
+
+	rdata.str(msg, "hello from pe")
+
+	// unwind info of main, its fragment (chained to main) and add
+	rdata.bytes(0x2010, 0x01, 0x04, 0x01, 0x00, 0x04, 0x42, 0x00, 0x00)
+	rdata.bytes(0x2018, 0x21, 0x00, 0x00, 0x00)
+	rdata.u32(0x201c, mainStart)
+	rdata.u32(0x2020, fragStart)
+	rdata.u32(0x2024, 0x2010)
+	rdata.bytes(0x2028, 0x01, 0x00, 0x00, 0x00)
+
+	// import descriptors, lookup tables, hint/names and DLL names
+	const (
+		iltExit = 0x2080
+		iltPuts = 0x2090
+		iltWS2  = 0x20a0
+		hnExit  = 0x20b0
+		hnPuts  = 0x20c0
+		dllK32  = 0x20c8
+		dllCRT  = 0x20d8
+		dllWS2  = 0x20e4
+	)
+	for i, d := range []struct{ ilt, name, iat uint32 }{
+		{iltExit, dllK32, iatExit},
+		{iltPuts, dllCRT, iatPuts},
+		{iltWS2, dllWS2, iatWS2},
+	} {
+		desc := uint32(0x2030 + 20*i)
+		rdata.u32(desc, d.ilt)
+		rdata.u32(desc+12, d.name)
+		rdata.u32(desc+16, d.iat)
+	}
+	rdata.u64(iltExit, hnExit)
+	rdata.u64(iltPuts, hnPuts)
+	rdata.u64(iltWS2, 1<<63|115)
+	rdata.u16(hnExit, 0x167)
+	rdata.str(hnExit+2, "ExitProcess")
+	rdata.u16(hnPuts, 0x4a8)
+	rdata.str(hnPuts+2, "puts")
+	rdata.str(dllK32, "KERNEL32.dll")
+	rdata.str(dllCRT, "msvcrt.dll")
+	rdata.str(dllWS2, "WS2_32.dll")
+
+	data.u64(iatExit, hnExit)
+	data.u64(iatPuts, hnPuts)
+	data.u64(iatWS2, 1<<63|115)
+	data.u64(addPtr, 0x140000000+addStart)
+
+	// export directory: add by name, main by ordinal
+	rdata.u32(0x20f0+12, 0x212c) // Name
+	rdata.u32(0x20f0+16, 1)      // Base
+	rdata.u32(0x20f0+20, 2)      // NumberOfFunctions
+	rdata.u32(0x20f0+24, 1)      // NumberOfNames
+	rdata.u32(0x20f0+28, 0x2118) // AddressOfFunctions
+	rdata.u32(0x20f0+32, 0x2120) // AddressOfNames
+	rdata.u32(0x20f0+36, 0x2124) // AddressOfNameOrdinals
+	rdata.u32(0x2118, addStart)
+	rdata.u32(0x211c, mainStart)
+	rdata.u32(0x2120, 0x2128)
+	rdata.u16(0x2124, 0)
+	rdata.str(0x2128, "add")
+	rdata.str(0x212c, "hello.exe")
+
+	for i, f := range [][3]uint32{
+		{mainStart, fragStart, 0x2010},
+		{fragStart, addStart, 0x2018},
+		{addStart, 0x1034, 0x2028},
+	} {
+		pdata.u32(0x4000+12*uint32(i), f[0])
+		pdata.u32(0x4004+12*uint32(i), f[1])
+		pdata.u32(0x4008+12*uint32(i), f[2])
+	}
+
+	reloc.u32(0x5000, 0x3000)
+	reloc.u32(0x5004, 12)
+	reloc.u16(0x5008, 10<<12|0x30) // IMAGE_REL_BASED_DIR64
+	reloc.u16(0x500a, 0)
+
+	var dirs [16]pe.DataDirectory
+	dirs[pe.IMAGE_DIRECTORY_ENTRY_EXPORT] = pe.DataDirectory{VirtualAddress: 0x20f0, Size: 0x2136 - 0x20f0}
+	dirs[pe.IMAGE_DIRECTORY_ENTRY_IMPORT] = pe.DataDirectory{VirtualAddress: 0x2030, Size: 80}
+	dirs[pe.IMAGE_DIRECTORY_ENTRY_EXCEPTION] = pe.DataDirectory{VirtualAddress: 0x4000, Size: 36}
+	dirs[pe.IMAGE_DIRECTORY_ENTRY_BASERELOC] = pe.DataDirectory{VirtualAddress: 0x5000, Size: 12}
+	dirs[pe.IMAGE_DIRECTORY_ENTRY_IAT] = pe.DataDirectory{VirtualAddress: 0x3000, Size: 0x30}
+
+	return build(pe.IMAGE_FILE_MACHINE_AMD64, 0x140000000, mainStart,
+		pe.IMAGE_FILE_EXECUTABLE_IMAGE|pe.IMAGE_FILE_LARGE_ADDRESS_AWARE, []section{
+			{".text", text.rva, text.data, scnCode},
+			{".rdata", rdata.rva, rdata.data, scnRData},
+			{".data", data.rva, data.data, scnData},
+			{".pdata", pdata.rva, pdata.data, scnRData},
+			{".reloc", reloc.rva, reloc.data, scnReloc},
+		}, dirs)
+}
+
+func i386() []byte {
+	text := &image{rva: 0x1000}
+	rdata := &image{rva: 0x2000}
+	data := &image{rva: 0x3000}
+	reloc := &image{rva: 0x4000}
+
+	const base = 0x10000000
+
+	text.bytes(0x1000, 0x8b, 0x44, 0x24, 0x04, 0x03, 0x44, 0x24, 0x08, 0xc3) // add
+	text.bytes(0x1010, 0xa1)                                                 // get: mov eax, [counter]
+	text.u32(0x1011, base+0x3000)
+	text.bytes(0x1015, 0xc3)
+	text.bytes(0x1020, 0xb8, 0x01, 0x00, 0x00, 0x00, 0xc2, 0x0c, 0x00) // DllMain
+
+	rdata.u32(0x2000+12, 0x2048) // Name
+	rdata.u32(0x2000+16, 1)      // Base
+	rdata.u32(0x2000+20, 3)      // NumberOfFunctions
+	rdata.u32(0x2000+24, 3)      // NumberOfNames
+	rdata.u32(0x2000+28, 0x2028) // AddressOfFunctions
+	rdata.u32(0x2000+32, 0x2034) // AddressOfNames
+	rdata.u32(0x2000+36, 0x2040) // AddressOfNameOrdinals
+	rdata.u32(0x2028, 0x1000)
+	rdata.u32(0x202c, 0x1010)
+	rdata.u32(0x2030, 0x2064) // forwarder, within the directory
+	rdata.u32(0x2034, 0x2054)
+	rdata.u32(0x2038, 0x2058)
+	rdata.u32(0x203c, 0x205c)
+	rdata.u16(0x2040, 0)
+	rdata.u16(0x2042, 1)
+	rdata.u16(0x2044, 2)
+	rdata.str(0x2048, "hello.dll")
+	rdata.str(0x2054, "add")
+	rdata.str(0x2058, "get")
+	rdata.str(0x205c, "quit")
+	rdata.str(0x2064, "KERNEL32.ExitProcess")
+
+	data.u32(0x3000, 41)
+
+	reloc.u32(0x4000, 0x1000)
+	reloc.u32(0x4004, 12)
+	reloc.u16(0x4008, 3<<12|0x11) // IMAGE_REL_BASED_HIGHLOW
+	reloc.u16(0x400a, 0)
+
+	var dirs [16]pe.DataDirectory
+	dirs[pe.IMAGE_DIRECTORY_ENTRY_EXPORT] = pe.DataDirectory{VirtualAddress: 0x2000, Size: 0x2079 - 0x2000}
+	dirs[pe.IMAGE_DIRECTORY_ENTRY_BASERELOC] = pe.DataDirectory{VirtualAddress: 0x4000, Size: 12}
+
+	return build(pe.IMAGE_FILE_MACHINE_I386, base, 0x1020,
+		pe.IMAGE_FILE_EXECUTABLE_IMAGE|pe.IMAGE_FILE_32BIT_MACHINE|pe.IMAGE_FILE_DLL, []section{
+			{".text", text.rva, text.data, scnCode},
+			{".rdata", rdata.rva, rdata.data, scnRData},
+			{".data", data.rva, data.data, scnData},
+			{".reloc", reloc.rva, reloc.data, scnReloc},
+		}, dirs)
+}
+
+func main() {
+	if err := os.WriteFile("hello-x86_64.exe", x86_64(), 0o644); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile("hello-i386.dll", i386(), 0o644); err != nil {
+		panic(err)
+	}
+}
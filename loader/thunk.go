@@ -0,0 +1,222 @@
+package loader
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/dzonerzy/gopcode"
+	"github.com/dzonerzy/gopcode/emu"
+)
+
+// maxThunkInstructions bounds the instructions of a stub.
+const maxThunkInstructions = 8
+
+// thunkSections are the sections made of stubs, every instruction of them
+// is tried.
+var thunkSections = []string{".plt", ".plt.sec", ".plt.got", "__TEXT,__stubs", "__TEXT,__auth_stubs"}
+
+// Thunk is a stub jumping to an imported function through the slot the
+// dynamic linker fills, e.g. an ELF PLT entry or a Mach-O stub.
+type Thunk struct {
+	Addr   uint64
+	Size   uint64
+	Slot   uint64
+	Name   string
+	Import *Import // nil when the slot is relocated against a symbol that is not imported
+}
+
+// FindThunks finds the stubs of the program and labels them with a function
+// symbol named after the import they jump to, so that calls to the stub
+// resolve to names such as memcpy, see SymbolName.
+//
+// The candidates are the instructions of the stub sections, such as .plt,
+// and the matches of the thunk patterns of the language in the executable
+// segments, see gopcode.ArchitectureLanguage.ThunkPatterns. The pcode of a
+// candidate is evaluated up to its indirect branch, whose target must be
+// loaded from a slot relocated against a symbol or holding an import.
+func (p *Program) FindThunks(ctx *gopcode.Context) ([]*Thunk, error) {
+	if p.Language == nil {
+		return nil, fmt.Errorf("unknown language")
+	}
+
+	candidates := map[uint64]bool{}
+	for _, name := range thunkSections {
+		sec, ok := p.Section(name)
+		if !ok {
+			continue
+		}
+		it := ctx.TranslateIter(p.Bytes(sec.Addr), sec.Addr)
+		for it.Next() && it.Instruction().Address < sec.Addr+sec.Size {
+			candidates[it.Instruction().Address] = true
+		}
+	}
+
+	patterns, err := p.Language.ThunkPatterns()
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range p.Segments {
+		if seg.Perm&emu.PermExec == 0 {
+			continue
+		}
+		for _, m := range patterns.Scan(seg.Data, seg.Addr) {
+			candidates[m.Addr] = true
+		}
+	}
+
+	targets := map[uint64]string{}
+	for _, r := range p.Relocations {
+		if _, ok := targets[r.Addr]; !ok && r.Symbol != "" {
+			targets[r.Addr] = r.Symbol
+		}
+	}
+	imports := map[string]*Import{}
+	for _, imp := range p.Imports {
+		imports[imp.Name] = imp
+		if _, ok := targets[imp.Addr]; !ok && imp.Addr != 0 {
+			targets[imp.Addr] = imp.Name
+		}
+	}
+
+	addrs := make([]uint64, 0, len(candidates))
+	for addr := range candidates {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+
+	var thunks []*Thunk
+	for _, addr := range addrs {
+		slot, end, ok := thunkSlot(ctx, p, addr)
+		if !ok {
+			continue
+		}
+		name, ok := targets[slot]
+		if !ok {
+			continue
+		}
+
+		t := &Thunk{Addr: addr, Size: end - addr, Slot: slot, Name: name, Import: imports[name]}
+		thunks = append(thunks, t)
+		if s, ok := p.SymbolAt(addr); !ok || s.Name != name {
+			p.Symbols = append(p.Symbols, &Symbol{Name: name, Addr: addr, Size: t.Size, Kind: SymbolFunction})
+		}
+	}
+	return thunks, nil
+}
+
+// SymbolName returns the name of the symbol at addr, preferring functions,
+// e.g. to name the callees of a cfg.Builder.
+func (p *Program) SymbolName(addr uint64) (string, bool) {
+	s, ok := p.SymbolAt(addr)
+	if !ok {
+		return "", false
+	}
+	return s.Name, true
+}
+
+// thunkSlot evaluates the pcode of the instructions at addr, following their
+// fallthrough, and returns the slot the first indirect branch reads its
+// target from and the end of its instruction.
+func thunkSlot(ctx *gopcode.Context, p *Program, addr uint64) (slot, end uint64, ok bool) {
+	// values of the varnodes computed from constants, and the slots of the
+	// varnodes loaded from a constant address
+	values := map[varKey]uint64{}
+	loaded := map[varKey]uint64{}
+
+	value := func(vn *gopcode.VarNode) (uint64, bool) {
+		if vn.Space.Name == "const" {
+			return vn.Offset, true
+		}
+		v, ok := values[keyOf(vn)]
+		return v, ok
+	}
+
+	for i := 0; i < maxThunkInstructions; i++ {
+		it := ctx.TranslateIter(p.Bytes(addr), addr)
+		if !it.Next() {
+			return 0, 0, false
+		}
+		instr := it.Instruction()
+
+		for _, op := range instr.Ops {
+			switch op.Opcode {
+			case gopcode.CPUI_IMARK:
+				continue
+			case gopcode.CPUI_BRANCHIND, gopcode.CPUI_CALLIND:
+				in := op.Inputs[0]
+				if s, ok := loaded[keyOf(in)]; ok {
+					return s, instr.FallThrough, true
+				}
+				if in.Space.Name == instrSpace(instr) {
+					return in.Offset, instr.FallThrough, true
+				}
+				return 0, 0, false
+			case gopcode.CPUI_BRANCH, gopcode.CPUI_CBRANCH, gopcode.CPUI_CALL, gopcode.CPUI_RETURN:
+				return 0, 0, false
+			}
+			if op.Output == nil {
+				continue
+			}
+
+			out := keyOf(op.Output)
+			forget(values, out)
+			forget(loaded, out)
+			if op.Opcode == gopcode.CPUI_LOAD {
+				if a, ok := value(op.Inputs[1]); ok {
+					loaded[out] = a
+				}
+				continue
+			}
+			if op.Opcode == gopcode.CPUI_COPY {
+				in := op.Inputs[0]
+				if s, ok := loaded[keyOf(in)]; ok {
+					loaded[out] = s
+					continue
+				}
+				if in.Space.Name == instrSpace(instr) {
+					loaded[out] = in.Offset
+					continue
+				}
+			}
+			var in []uint64
+			for _, vn := range op.Inputs {
+				if v, ok := value(vn); ok {
+					in = append(in, v)
+				}
+			}
+			if len(in) != len(op.Inputs) {
+				continue
+			}
+			if v, err := gopcode.EvaluateUint(op, in); err == nil {
+				values[out] = v
+			}
+		}
+		addr = instr.FallThrough
+	}
+	return 0, 0, false
+}
+
+// varKey identifies a varnode independently of the AddrSpace values.
+type varKey struct {
+	space  string
+	offset uint64
+	size   int32
+}
+
+func keyOf(vn *gopcode.VarNode) varKey {
+	return varKey{vn.Space.Name, vn.Offset, vn.Size}
+}
+
+// instrSpace returns the address space of the instruction.
+func instrSpace(instr *gopcode.Instruction) string {
+	return instr.Ops[0].Inputs[0].Space.Name
+}
+
+// forget removes the varnodes overlapping k, e.g. X17 when W17 is written.
+func forget(m map[varKey]uint64, k varKey) {
+	for o := range m {
+		if o.space == k.space && o.offset < k.offset+uint64(k.size) && k.offset < o.offset+uint64(o.size) {
+			delete(m, o)
+		}
+	}
+}
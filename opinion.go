@@ -0,0 +1,276 @@
+package gopcode
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Loader names used by the .opinion files of the processor families.
+const (
+	LoaderELF   = "Executable and Linking Format (ELF)"
+	LoaderPE    = "Portable Executable (PE)"
+	LoaderMachO = "Mac OS X Mach-O"
+	LoaderCOFF  = "MS Common Object File Format (COFF)"
+)
+
+// Opinion is a leaf constraint of a .opinion file: binaries of Loader whose
+// primary key (e.g. the ELF e_machine) is one of Primary and whose secondary
+// key (e.g. the ELF e_flags) matches Secondary are of the given processor
+// and compiler spec. Empty fields match anything.
+type Opinion struct {
+	Loader     string
+	Primary    []string
+	Secondary  string
+	Processor  string
+	Endian     string
+	Size       int
+	Variant    string
+	CompilerID string
+}
+
+// LoadSpec is a language and compiler spec suggested for a binary.
+type LoadSpec struct {
+	Language   *ArchitectureLanguage
+	CompilerID string
+}
+
+type opinionConstraint struct {
+	Attrs       []xml.Attr          `xml:",any,attr"`
+	Constraints []opinionConstraint `xml:"constraint"`
+}
+
+type opinionFile struct {
+	Constraints []opinionConstraint `xml:"constraint"`
+}
+
+// flatten returns the leaf constraints, which inherit the attributes of their
+// parents.
+func (c *opinionConstraint) flatten(parent Opinion, out []*Opinion) ([]*Opinion, error) {
+	o := parent
+	for _, attr := range c.Attrs {
+		switch attr.Name.Local {
+		case "loader":
+			o.Loader = attr.Value
+		case "primary":
+			o.Primary = nil
+			for _, p := range strings.Split(attr.Value, ",") {
+				o.Primary = append(o.Primary, strings.TrimSpace(p))
+			}
+		case "secondary":
+			o.Secondary = strings.TrimSpace(attr.Value)
+		case "processor":
+			o.Processor = attr.Value
+		case "endian":
+			o.Endian = attr.Value
+		case "size":
+			size, err := strconv.Atoi(attr.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size %q: %v", attr.Value, err)
+			}
+			o.Size = size
+		case "variant":
+			o.Variant = attr.Value
+		case "compilerSpecID":
+			o.CompilerID = attr.Value
+		}
+	}
+
+	if len(c.Constraints) == 0 {
+		return append(out, &o), nil
+	}
+
+	var err error
+	for i := range c.Constraints {
+		if out, err = c.Constraints[i].flatten(o, out); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func parseOpinions(data []byte) ([]*Opinion, error) {
+	var f opinionFile
+	if err := unmarshalSpec(data, &f); err != nil {
+		return nil, err
+	}
+
+	var opinions []*Opinion
+	var err error
+	for i := range f.Constraints {
+		if opinions, err = f.Constraints[i].flatten(Opinion{}, opinions); err != nil {
+			return nil, err
+		}
+	}
+	return opinions, nil
+}
+
+// opinions parses the .opinion files of the family once.
+func (pf *processorFamily) opinions() ([]*Opinion, error) {
+	pf.opinionsOnce.Do(func() {
+		files, err := fs.Glob(pf.fsys, path.Join("data/languages", "*.opinion"))
+		if err != nil {
+			pf.opinionsErr = err
+			return
+		}
+
+		for _, file := range files {
+			data, err := fs.ReadFile(pf.fsys, file)
+			if err != nil {
+				pf.opinionsErr = fmt.Errorf("could not read %s: %v", file, err)
+				return
+			}
+
+			ops, err := parseOpinions(data)
+			if err != nil {
+				pf.opinionsErr = fmt.Errorf("could not unmarshal %s: %v", file, err)
+				return
+			}
+			pf.opinionList = append(pf.opinionList, ops...)
+		}
+	})
+	return pf.opinionList, pf.opinionsErr
+}
+
+// Opinions returns the constraints of the .opinion files of the registered
+// processor families. Families whose files cannot be parsed are skipped and
+// the first error is returned.
+func Opinions() ([]*Opinion, error) {
+	seen := map[*processorFamily]bool{}
+	var opinions []*Opinion
+	var firstErr error
+	for _, al := range Languages() {
+		if seen[al.family] {
+			continue
+		}
+		seen[al.family] = true
+
+		ops, err := al.family.opinions()
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %v", al.family.name, err)
+		}
+		opinions = append(opinions, ops...)
+	}
+
+	return opinions, firstErr
+}
+
+// Matches reports whether the opinion applies to a binary of the loader with
+// the given keys. A secondary constraint written "0b..." is matched bit by bit
+// against the key, with "." matching any bit, and one written "0x..." is
+// compared as a number.
+func (o *Opinion) Matches(loader, primary, secondary string) bool {
+	if o.Loader != loader {
+		return false
+	}
+
+	found := false
+	for _, p := range o.Primary {
+		if p == primary {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+
+	return o.Secondary == "" || matchSecondary(o.Secondary, secondary)
+}
+
+func matchSecondary(constraint, key string) bool {
+	lower := strings.ToLower(constraint)
+	switch {
+	case strings.HasPrefix(lower, "0b"):
+		value, err := strconv.ParseUint(key, 0, 64)
+		if err != nil {
+			return false
+		}
+
+		bits := strings.NewReplacer(" ", "", "_", "").Replace(lower[2:])
+		for i := 0; i < len(bits); i++ {
+			bit := value >> uint(len(bits)-1-i) & 1
+			switch bits[i] {
+			case '0':
+				if bit != 0 {
+					return false
+				}
+			case '1':
+				if bit != 1 {
+					return false
+				}
+			}
+		}
+		return true
+
+	case strings.HasPrefix(lower, "0x"):
+		want, err1 := strconv.ParseUint(lower[2:], 16, 64)
+		value, err2 := strconv.ParseUint(key, 0, 64)
+		return err1 == nil && err2 == nil && want == value
+	}
+
+	return strings.EqualFold(constraint, key)
+}
+
+// Languages returns the registered languages designated by the opinion that
+// have its compiler spec.
+func (o *Opinion) Languages() []*ArchitectureLanguage {
+	var langs []*ArchitectureLanguage
+	for _, al := range FindLanguages(o.Processor, o.Endian, o.Size) {
+		if o.Variant != "" && !strings.EqualFold(al.Variant, o.Variant) {
+			continue
+		}
+		for _, c := range al.Compilers {
+			if o.CompilerID == "" || c.ID == o.CompilerID {
+				langs = append(langs, al)
+				break
+			}
+		}
+	}
+	return langs
+}
+
+// QueryOpinions returns the languages and compiler specs the .opinion files
+// suggest for a binary of the loader with the given primary and secondary
+// keys, e.g. LoaderELF with the decimal e_machine and e_flags. Constraints
+// on the secondary key are more specific and their results come first. The
+// result may hold languages of several sizes or endiannesses when the
+// constraints do not pin them; loaders narrow it down with what they know of
+// the binary.
+func QueryOpinions(loader, primary, secondary string) ([]LoadSpec, error) {
+	opinions, err := Opinions()
+
+	var matched []*Opinion
+	for _, o := range opinions {
+		if o.Matches(loader, primary, secondary) && o.Secondary != "" {
+			matched = append(matched, o)
+		}
+	}
+	for _, o := range opinions {
+		if o.Matches(loader, primary, secondary) && o.Secondary == "" {
+			matched = append(matched, o)
+		}
+	}
+
+	var specs []LoadSpec
+	seen := map[LoadSpec]bool{}
+	for _, o := range matched {
+		for _, al := range o.Languages() {
+			id := o.CompilerID
+			if id == "" {
+				id = al.Compilers[0].ID
+			}
+
+			spec := LoadSpec{Language: al, CompilerID: id}
+			if !seen[spec] {
+				seen[spec] = true
+				specs = append(specs, spec)
+			}
+		}
+	}
+
+	return specs, err
+}
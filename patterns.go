@@ -0,0 +1,455 @@
+package gopcode
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// BitPattern is a byte sequence where only the bits set in Mask are
+// significant, the <data> of a pattern file. Mark is the offset of the
+// address the pattern designates, such as a function start following
+// padding.
+type BitPattern struct {
+	Value []byte
+	Mask  []byte
+	Mark  int
+}
+
+// ParseBitPattern parses the <data> syntax of the pattern files: hexadecimal
+// digits following "0x" and bytes of eight binary digits, where "." matches
+// any digit. A "*" token sets the mark, "#" starts a comment running to the
+// end of the line.
+//
+//	0x90 * 0x5589e5 01010... 0x..83ec
+func ParseBitPattern(s string) (*BitPattern, error) {
+	// spell every bit as '0', '1' or '.'
+	var bits strings.Builder
+	mark := 0
+	for _, line := range strings.Split(s, "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		// a token is a run of binary bytes, possibly followed by "0x" and
+		// hexadecimal digits, as in "01.01...0x.."
+		for _, tok := range strings.Fields(line) {
+			if tok == "*" {
+				mark = bits.Len() / 8
+				continue
+			}
+			for rest := tok; rest != ""; {
+				if strings.HasPrefix(strings.ToLower(rest), "0x") {
+					digits := rest[2:]
+					if len(digits) == 0 || len(digits)%2 != 0 {
+						return nil, fmt.Errorf("invalid hexadecimal token %q", tok)
+					}
+					for _, c := range digits {
+						if c == '.' {
+							bits.WriteString("....")
+							continue
+						}
+						d := strings.IndexRune("0123456789abcdef", c|0x20)
+						if d < 0 {
+							return nil, fmt.Errorf("invalid hexadecimal token %q", tok)
+						}
+						fmt.Fprintf(&bits, "%04b", d)
+					}
+					break
+				}
+
+				if len(rest) < 8 || strings.Trim(rest[:8], "01.") != "" {
+					return nil, fmt.Errorf("invalid binary token %q", tok)
+				}
+				bits.WriteString(rest[:8])
+				rest = rest[8:]
+			}
+		}
+	}
+
+	spelled := bits.String()
+	if spelled == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+
+	p := &BitPattern{Mark: mark}
+	for i := 0; i < len(spelled); i += 8 {
+		var value, mask byte
+		for _, c := range spelled[i : i+8] {
+			value, mask = value<<1, mask<<1
+			if c != '.' {
+				value |= byte(c - '0')
+				mask |= 1
+			}
+		}
+		p.Value = append(p.Value, value)
+		p.Mask = append(p.Mask, mask)
+	}
+	return p, nil
+}
+
+// Bits returns the number of significant bits.
+func (p *BitPattern) Bits() int {
+	n := 0
+	for _, m := range p.Mask {
+		for ; m != 0; m &= m - 1 {
+			n++
+		}
+	}
+	return n
+}
+
+// Match reports whether data starts with the pattern.
+func (p *BitPattern) Match(data []byte) bool {
+	if len(data) < len(p.Value) {
+		return false
+	}
+	for i, v := range p.Value {
+		if data[i]&p.Mask[i] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// FuncStart is the <funcstart> or <possiblefuncstart> action of a pattern.
+// After names what must precede the function ("defined", "function", "data",
+// ...) and ValidCode the instructions that must decode from the start,
+// usually a number; the tools matching patterns apply them.
+type FuncStart struct {
+	Possible   bool
+	After      string
+	ValidCode  string
+	Contiguous bool
+	Label      string
+	Thunk      bool
+}
+
+// ContextSetting is a <setcontext> action, the value of a context variable
+// at the matched address, e.g. TMode for Thumb code.
+type ContextSetting struct {
+	Name  string
+	Value uint32
+}
+
+// Pattern is a <pattern> of a pattern file, or a <patternpairs> when Pre is
+// set: one of Post must match at the address and, for pairs, one of Pre must
+// end there, with at least TotalBits significant bits in both and PostBits
+// in the post pattern.
+type Pattern struct {
+	Pre       []*BitPattern
+	Post      []*BitPattern
+	TotalBits int
+	PostBits  int
+
+	FuncStart    *FuncStart // nil when the pattern does not mark a function
+	CodeBoundary bool
+	Context      []ContextSetting
+
+	// the address plus AlignMark must be a multiple of 1<<AlignBits
+	AlignMark int
+	AlignBits int
+}
+
+// PatternMatch is an address where a pattern matched.
+type PatternMatch struct {
+	Addr    uint64
+	Pattern *Pattern
+}
+
+// PatternList is the content of one or more pattern files.
+type PatternList struct {
+	Patterns []*Pattern
+}
+
+type funcStartXML struct {
+	After      string `xml:"after,attr"`
+	ValidCode  string `xml:"validcode,attr"`
+	Contiguous bool   `xml:"contiguous,attr"`
+	Label      string `xml:"label,attr"`
+	Thunk      bool   `xml:"thunk,attr"`
+}
+
+type patternXML struct {
+	Data              []string      `xml:"data"`
+	FuncStart         *funcStartXML `xml:"funcstart"`
+	PossibleFuncStart *funcStartXML `xml:"possiblefuncstart"`
+	CodeBoundary      *struct{}     `xml:"codeboundary"`
+	Align             *struct {
+		Mark int `xml:"mark,attr"`
+		Bits int `xml:"bits,attr"`
+	} `xml:"align"`
+	SetContext []struct {
+		Name  string `xml:"name,attr"`
+		Value uint32 `xml:"value,attr"`
+	} `xml:"setcontext"`
+}
+
+type patternPairsXML struct {
+	TotalBits int        `xml:"totalbits,attr"`
+	PostBits  int        `xml:"postbits,attr"`
+	Pre       []string   `xml:"prepatterns>data"`
+	Post      patternXML `xml:"postpatterns"`
+}
+
+type patternListXML struct {
+	Patterns []patternXML      `xml:"pattern"`
+	Pairs    []patternPairsXML `xml:"patternpairs"`
+}
+
+func parseBitPatterns(data []string) ([]*BitPattern, error) {
+	var out []*BitPattern
+	for _, d := range data {
+		p, err := ParseBitPattern(d)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+func (x *patternXML) pattern() (*Pattern, error) {
+	post, err := parseBitPatterns(x.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Pattern{Post: post, CodeBoundary: x.CodeBoundary != nil}
+	start, possible := x.FuncStart, false
+	if start == nil && x.PossibleFuncStart != nil {
+		start, possible = x.PossibleFuncStart, true
+	}
+	if start != nil {
+		p.FuncStart = &FuncStart{
+			Possible:   possible,
+			After:      start.After,
+			ValidCode:  start.ValidCode,
+			Contiguous: start.Contiguous,
+			Label:      start.Label,
+			Thunk:      start.Thunk,
+		}
+	}
+	if x.Align != nil {
+		p.AlignMark, p.AlignBits = x.Align.Mark, x.Align.Bits
+	}
+	for _, c := range x.SetContext {
+		p.Context = append(p.Context, ContextSetting{Name: c.Name, Value: c.Value})
+	}
+	return p, nil
+}
+
+// ParsePatterns parses a pattern file, whose root element is <patternlist>.
+func ParsePatterns(data []byte) (*PatternList, error) {
+	var x patternListXML
+	if err := unmarshalSpec(data, &x); err != nil {
+		return nil, err
+	}
+
+	l := &PatternList{}
+	for i := range x.Patterns {
+		p, err := x.Patterns[i].pattern()
+		if err != nil {
+			return nil, err
+		}
+		l.Patterns = append(l.Patterns, p)
+	}
+	for i := range x.Pairs {
+		pair := &x.Pairs[i]
+		p, err := pair.Post.pattern()
+		if err != nil {
+			return nil, err
+		}
+		if p.Pre, err = parseBitPatterns(pair.Pre); err != nil {
+			return nil, err
+		}
+		p.TotalBits, p.PostBits = pair.TotalBits, pair.PostBits
+		l.Patterns = append(l.Patterns, p)
+	}
+	return l, nil
+}
+
+// Scan returns the matches of the patterns in data, loaded at base, sorted by
+// address. The address of a match is the mark of the pattern.
+func (l *PatternList) Scan(data []byte, base uint64) []PatternMatch {
+	var matches []PatternMatch
+	for _, p := range l.Patterns {
+		seen := map[int]bool{}
+		for i := range data {
+			for _, mark := range p.matchAt(data, i) {
+				addr := base + uint64(mark)
+				if seen[mark] || !p.aligned(addr) {
+					continue
+				}
+				seen[mark] = true
+				matches = append(matches, PatternMatch{Addr: addr, Pattern: p})
+			}
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Addr < matches[j].Addr
+	})
+	return matches
+}
+
+// matchAt returns the marks of the post patterns matching at offset i of
+// data, preceded by a pre pattern for pairs.
+func (p *Pattern) matchAt(data []byte, i int) []int {
+	var marks []int
+	for _, post := range p.Post {
+		if !post.Match(data[i:]) || !p.preMatch(data, i, post.Bits()) {
+			continue
+		}
+		marks = append(marks, i+post.Mark)
+	}
+	return marks
+}
+
+func (p *Pattern) preMatch(data []byte, i int, postBits int) bool {
+	if p.Pre == nil {
+		return true
+	}
+	if postBits < p.PostBits {
+		return false
+	}
+	for _, pre := range p.Pre {
+		start := i - len(pre.Value)
+		if start >= 0 && pre.Bits()+postBits >= p.TotalBits && pre.Match(data[start:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Pattern) aligned(addr uint64) bool {
+	return (addr+uint64(p.AlignMark))&(1<<uint(p.AlignBits)-1) == 0
+}
+
+// FunctionStarts returns the addresses where patterns with a funcstart or
+// possiblefuncstart action match.
+func (l *PatternList) FunctionStarts(data []byte, base uint64) []PatternMatch {
+	var out []PatternMatch
+	for _, m := range l.Scan(data, base) {
+		if m.Pattern.FuncStart != nil {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+type patternConstraintsXML struct {
+	Languages []struct {
+		ID           string   `xml:"id,attr"`
+		PatternFiles []string `xml:"patternfile"`
+		Compilers    []struct {
+			ID           string   `xml:"id,attr"`
+			PatternFiles []string `xml:"patternfile"`
+		} `xml:"compiler"`
+	} `xml:"language"`
+}
+
+// matchLanguageID matches a language id against one of patternconstraints.xml,
+// where "*" matches any field.
+func matchLanguageID(pattern, id string) bool {
+	pf, f := strings.Split(pattern, ":"), strings.Split(id, ":")
+	if len(pf) != len(f) {
+		return false
+	}
+	for i := range pf {
+		if pf[i] != "*" && !strings.EqualFold(pf[i], f[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Patterns returns the function start patterns of the language for the given
+// compiler spec, read from the data/patterns directory of its processor
+// family as listed by patternconstraints.xml and prepatternconstraints.xml.
+// The list is empty when the family has none.
+func (al *ArchitectureLanguage) Patterns(compilerID string) (*PatternList, error) {
+	l := &PatternList{}
+	if al.family == nil {
+		return l, nil
+	}
+
+	seen := map[string]bool{}
+	for _, constraints := range []string{"patternconstraints.xml", "prepatternconstraints.xml"} {
+		data, err := fs.ReadFile(al.family.fsys, path.Join("data/patterns", constraints))
+		if err != nil {
+			continue
+		}
+		var x patternConstraintsXML
+		if err := unmarshalSpec(data, &x); err != nil {
+			return nil, fmt.Errorf("could not unmarshal %s: %v", constraints, err)
+		}
+
+		var files []string
+		for _, lang := range x.Languages {
+			if !matchLanguageID(lang.ID, al.LanguageID) {
+				continue
+			}
+			files = append(files, lang.PatternFiles...)
+			for _, c := range lang.Compilers {
+				if strings.EqualFold(c.ID, compilerID) {
+					files = append(files, c.PatternFiles...)
+				}
+			}
+		}
+
+		for _, file := range files {
+			file = strings.TrimSpace(file)
+			if seen[file] {
+				continue
+			}
+			seen[file] = true
+
+			data, err := fs.ReadFile(al.family.fsys, path.Join("data/patterns", file))
+			if err != nil {
+				return nil, fmt.Errorf("could not read %s: %v", file, err)
+			}
+			pl, err := ParsePatterns(bytes.TrimSpace(data))
+			if err != nil {
+				return nil, fmt.Errorf("could not unmarshal %s: %v", file, err)
+			}
+			l.Patterns = append(l.Patterns, pl.Patterns...)
+		}
+	}
+	return l, nil
+}
+
+// ThunkPatterns returns the thunk patterns of the processor family of the
+// language, the data/*Thunks.xml and data/*Stubs.xml files such as
+// aarch64-pltThunks.xml. Their patterns match whole stubs, as written in the
+// files, and have no actions.
+func (al *ArchitectureLanguage) ThunkPatterns() (*PatternList, error) {
+	l := &PatternList{}
+	if al.family == nil {
+		return l, nil
+	}
+
+	files, err := fs.Glob(al.family.fsys, "data/*.xml")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file, "Thunks.xml") && !strings.HasSuffix(file, "Stubs.xml") {
+			continue
+		}
+
+		data, err := fs.ReadFile(al.family.fsys, file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %v", file, err)
+		}
+		pl, err := ParsePatterns(bytes.TrimSpace(data))
+		if err != nil {
+			return nil, fmt.Errorf("could not unmarshal %s: %v", path.Base(file), err)
+		}
+		l.Patterns = append(l.Patterns, pl.Patterns...)
+	}
+	return l, nil
+}
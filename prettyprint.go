@@ -6,7 +6,9 @@ import (
 )
 
 var (
-	DefaultPcodeFormatter = newPcodeFormatter()
+	DefaultPcodeFormatter prettyPrinter = defaultPcodeFormatter
+
+	defaultPcodeFormatter = newPcodeFormatter()
 )
 
 type prettyPrinter interface {
@@ -17,6 +19,14 @@ type prettyPrinter interface {
 
 type pcodePrettyPrinter struct {
 	opcodeHandlers map[OpCode]prettyPrinter
+	userOpName     func(index uint64) (string, bool)
+}
+
+// withUserOps returns a copy of the formatter rendering CALLOTHER ops as
+// calls of the named user operations.
+func (pp pcodePrettyPrinter) withUserOps(userOpName func(index uint64) (string, bool)) pcodePrettyPrinter {
+	pp.userOpName = userOpName
+	return pp
 }
 
 func (pp pcodePrettyPrinter) formatPcodeOp(pco PcodeOp) string {
@@ -28,6 +38,12 @@ func (pp pcodePrettyPrinter) formatPcodeOp(pco PcodeOp) string {
 		formatter = pcodeDefaultPrettyPrinter{}
 	}
 
+	if pco.Opcode == CPUI_CALLOTHER && pp.userOpName != nil && len(pco.Inputs) != 0 {
+		if name, ok := pp.userOpName(pco.Inputs[0].Offset); ok {
+			formatter = pcodePrettyUserOp{name: name}
+		}
+	}
+
 	var formatted string
 
 	if pco.Output != nil {
@@ -104,6 +120,21 @@ func (pp pcodePrettyFunction) formatPcodeOp(pco PcodeOp) string {
 	return fmt.Sprintf("%s(%s)", pp.operator, strings.Join(formatted_inputs, ", "))
 }
 
+// pcodePrettyUserOp renders a CALLOTHER op as a call of the user operation,
+// without the constant index.
+type pcodePrettyUserOp struct {
+	pcodeDefaultPrettyPrinter
+	name string
+}
+
+func (pp pcodePrettyUserOp) formatPcodeOp(pco PcodeOp) string {
+	var formatted_inputs []string
+	for _, input := range pco.Inputs[1:] {
+		formatted_inputs = append(formatted_inputs, pp.formatVarNode(*input))
+	}
+	return fmt.Sprintf("%s(%s)", pp.name, strings.Join(formatted_inputs, ", "))
+}
+
 type pcodePrettySpecial struct {
 	pcodeDefaultPrettyPrinter
 	operator string
@@ -164,7 +195,7 @@ func (pp pcodePrettySpecial) formatPcodeOp(pco PcodeOp) string {
 	}
 }
 
-func newPcodeFormatter() prettyPrinter {
+func newPcodeFormatter() pcodePrettyPrinter {
 	return pcodePrettyPrinter{
 		opcodeHandlers: map[OpCode]prettyPrinter{
 			CPUI_BOOL_AND:          pcodePrettyBinary{operator: "&&"},
@@ -1,6 +0,0 @@
-package gopcode
-
-import "embed"
-
-//go:embed processors/*
-var ProcessorsFS embed.FS
@@ -0,0 +1,16 @@
+// Package mos6502 registers the 6502 processor family with gopcode when imported.
+package mos6502
+
+import (
+	"embed"
+
+	"github.com/dzonerzy/gopcode"
+)
+
+//go:embed data/languages/*.ldefs data/languages/*.pspec data/languages/*.cspec data/languages/*.sla
+var FS embed.FS
+
+func init() {
+	// failures are recorded by the registry and reported by NewContext
+	_ = gopcode.RegisterProcessor("6502", FS)
+}
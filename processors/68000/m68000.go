@@ -0,0 +1,16 @@
+// Package m68000 registers the 68000 processor family with gopcode when imported.
+package m68000
+
+import (
+	"embed"
+
+	"github.com/dzonerzy/gopcode"
+)
+
+//go:embed data/languages/*.ldefs data/languages/*.pspec data/languages/*.cspec data/languages/*.sla data/languages/*.opinion data/patterns
+var FS embed.FS
+
+func init() {
+	// failures are recorded by the registry and reported by NewContext
+	_ = gopcode.RegisterProcessor("68000", FS)
+}
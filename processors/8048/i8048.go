@@ -0,0 +1,16 @@
+// Package i8048 registers the 8048 processor family with gopcode when imported.
+package i8048
+
+import (
+	"embed"
+
+	"github.com/dzonerzy/gopcode"
+)
+
+//go:embed data/languages/*.ldefs data/languages/*.pspec data/languages/*.cspec data/languages/*.sla
+var FS embed.FS
+
+func init() {
+	// failures are recorded by the registry and reported by NewContext
+	_ = gopcode.RegisterProcessor("8048", FS)
+}
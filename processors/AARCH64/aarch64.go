@@ -0,0 +1,16 @@
+// Package aarch64 registers the AARCH64 processor family with gopcode when imported.
+package aarch64
+
+import (
+	"embed"
+
+	"github.com/dzonerzy/gopcode"
+)
+
+//go:embed data/languages/*.ldefs data/languages/*.pspec data/languages/*.cspec data/languages/*.sla data/languages/*.opinion data/patterns data/*.xml
+var FS embed.FS
+
+func init() {
+	// failures are recorded by the registry and reported by NewContext
+	_ = gopcode.RegisterProcessor("AARCH64", FS)
+}
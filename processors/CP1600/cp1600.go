@@ -0,0 +1,16 @@
+// Package cp1600 registers the CP1600 processor family with gopcode when imported.
+package cp1600
+
+import (
+	"embed"
+
+	"github.com/dzonerzy/gopcode"
+)
+
+//go:embed data/languages/*.ldefs data/languages/*.pspec data/languages/*.cspec data/languages/*.sla data/languages/*.opinion
+var FS embed.FS
+
+func init() {
+	// failures are recorded by the registry and reported by NewContext
+	_ = gopcode.RegisterProcessor("CP1600", FS)
+}
@@ -0,0 +1,16 @@
+// Package mc6800 registers the MC6800 processor family with gopcode when imported.
+package mc6800
+
+import (
+	"embed"
+
+	"github.com/dzonerzy/gopcode"
+)
+
+//go:embed data/languages/*.ldefs data/languages/*.pspec data/languages/*.cspec data/languages/*.sla
+var FS embed.FS
+
+func init() {
+	// failures are recorded by the registry and reported by NewContext
+	_ = gopcode.RegisterProcessor("MC6800", FS)
+}
@@ -0,0 +1,16 @@
+// Package mcs96 registers the MCS96 processor family with gopcode when imported.
+package mcs96
+
+import (
+	"embed"
+
+	"github.com/dzonerzy/gopcode"
+)
+
+//go:embed data/languages/*.ldefs data/languages/*.pspec data/languages/*.cspec data/languages/*.sla
+var FS embed.FS
+
+func init() {
+	// failures are recorded by the registry and reported by NewContext
+	_ = gopcode.RegisterProcessor("MCS96", FS)
+}
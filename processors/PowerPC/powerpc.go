@@ -0,0 +1,16 @@
+// Package powerpc registers the PowerPC processor family with gopcode when imported.
+package powerpc
+
+import (
+	"embed"
+
+	"github.com/dzonerzy/gopcode"
+)
+
+//go:embed data/languages/*.ldefs data/languages/*.pspec data/languages/*.cspec data/languages/*.sla data/languages/*.opinion data/patterns data/*.xml
+var FS embed.FS
+
+func init() {
+	// failures are recorded by the registry and reported by NewContext
+	_ = gopcode.RegisterProcessor("PowerPC", FS)
+}
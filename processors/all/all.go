@@ -0,0 +1,41 @@
+// Package all registers every processor family shipped with gopcode. Import it
+// for side effects when the binary size is not a concern.
+package all
+
+import (
+	_ "github.com/dzonerzy/gopcode/processors/6502"
+	_ "github.com/dzonerzy/gopcode/processors/68000"
+	_ "github.com/dzonerzy/gopcode/processors/8048"
+	_ "github.com/dzonerzy/gopcode/processors/8051"
+	_ "github.com/dzonerzy/gopcode/processors/8085"
+	_ "github.com/dzonerzy/gopcode/processors/AARCH64"
+	_ "github.com/dzonerzy/gopcode/processors/ARM"
+	_ "github.com/dzonerzy/gopcode/processors/Atmel"
+	_ "github.com/dzonerzy/gopcode/processors/BPF"
+	_ "github.com/dzonerzy/gopcode/processors/CP1600"
+	_ "github.com/dzonerzy/gopcode/processors/CR16"
+	_ "github.com/dzonerzy/gopcode/processors/DATA"
+	_ "github.com/dzonerzy/gopcode/processors/Dalvik"
+	_ "github.com/dzonerzy/gopcode/processors/HCS08"
+	_ "github.com/dzonerzy/gopcode/processors/HCS12"
+	_ "github.com/dzonerzy/gopcode/processors/JVM"
+	_ "github.com/dzonerzy/gopcode/processors/Loongarch"
+	_ "github.com/dzonerzy/gopcode/processors/M8C"
+	_ "github.com/dzonerzy/gopcode/processors/MC6800"
+	_ "github.com/dzonerzy/gopcode/processors/MCS96"
+	_ "github.com/dzonerzy/gopcode/processors/MIPS"
+	_ "github.com/dzonerzy/gopcode/processors/PA-RISC"
+	_ "github.com/dzonerzy/gopcode/processors/PIC"
+	_ "github.com/dzonerzy/gopcode/processors/PowerPC"
+	_ "github.com/dzonerzy/gopcode/processors/RISCV"
+	_ "github.com/dzonerzy/gopcode/processors/Sparc"
+	_ "github.com/dzonerzy/gopcode/processors/SuperH"
+	_ "github.com/dzonerzy/gopcode/processors/SuperH4"
+	_ "github.com/dzonerzy/gopcode/processors/Toy"
+	_ "github.com/dzonerzy/gopcode/processors/V850"
+	_ "github.com/dzonerzy/gopcode/processors/Xtensa"
+	_ "github.com/dzonerzy/gopcode/processors/Z80"
+	_ "github.com/dzonerzy/gopcode/processors/eBPF"
+	_ "github.com/dzonerzy/gopcode/processors/tricore"
+	_ "github.com/dzonerzy/gopcode/processors/x86"
+)
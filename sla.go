@@ -0,0 +1,267 @@
+package gopcode
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+// Compiled SLEIGH specifications (format version 4) are "sla", a version byte
+// and the zlib compressed packed encoding of the specification. The element
+// and attribute ids below are the ones of Ghidra's slaformat.cc.
+const (
+	slaFormatVersion = 4
+
+	slaElemUserOp     = 25
+	slaElemUserOpHead = 26
+	slaElemCommit     = 79
+
+	slaAttribID    = 3
+	slaAttribIndex = 9
+	slaAttribName  = 12
+)
+
+// Header bytes and attribute types of the packed encoding.
+const (
+	packedTypeMask     = 0xc0
+	packedElementStart = 0x40
+	packedElementEnd   = 0x80
+	packedAttribute    = 0xc0
+	packedExtension    = 0x20
+	packedIDMask       = 0x1f
+
+	packedTypeBool            = 1
+	packedTypeSignedPositive  = 2
+	packedTypeSignedNegative  = 3
+	packedTypeUnsigned        = 4
+	packedTypeAddressSpace    = 5
+	packedTypeSpecialSpace    = 6
+	packedTypeString          = 7
+	packedIntegerChunkBits    = 7
+	packedIntegerChunkMask    = 0x7f
+	packedAttributeLengthMask = 0x0f
+)
+
+type packedDecoder struct {
+	r *bufio.Reader
+}
+
+func (d *packedDecoder) readID(header byte) (uint64, error) {
+	id := uint64(header & packedIDMask)
+	if header&packedExtension != 0 {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		id = id<<packedIntegerChunkBits | uint64(b&packedIntegerChunkMask)
+	}
+	return id, nil
+}
+
+func (d *packedDecoder) readInteger(length int) (uint64, error) {
+	var v uint64
+	for i := 0; i < length; i++ {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<packedIntegerChunkBits | uint64(b&packedIntegerChunkMask)
+	}
+	return v, nil
+}
+
+// readValue reads the value of an attribute. Integers are returned as is,
+// strings only when keep is set.
+func (d *packedDecoder) readValue(keep bool) (uint64, string, error) {
+	t, err := d.r.ReadByte()
+	if err != nil {
+		return 0, "", err
+	}
+	length := int(t & packedAttributeLengthMask)
+
+	switch t >> 4 {
+	case packedTypeBool, packedTypeSpecialSpace:
+		return uint64(length), "", nil
+	case packedTypeSignedPositive, packedTypeSignedNegative, packedTypeUnsigned, packedTypeAddressSpace:
+		v, err := d.readInteger(length)
+		return v, "", err
+	case packedTypeString:
+		n, err := d.readInteger(length)
+		if err != nil {
+			return 0, "", err
+		}
+		if !keep {
+			_, err := d.r.Discard(int(n))
+			return 0, "", err
+		}
+		buf := make([]byte, n)
+		_, err = io.ReadFull(d.r, buf)
+		return 0, string(buf), err
+	}
+
+	return 0, "", fmt.Errorf("invalid attribute type 0x%x", t)
+}
+
+// slaInfo is what is read from a compiled specification besides what the
+// native library loads.
+type slaInfo struct {
+	// userOps holds the names of the user defined operations, indexed like
+	// the first input of CALLOTHER ops.
+	userOps []string
+	// commits reports whether instructions change the context of other
+	// addresses (SLEIGH globalset).
+	commits bool
+}
+
+func parseSLA(sla []byte) (*slaInfo, error) {
+	if len(sla) < 4 || string(sla[:3]) != "sla" {
+		return nil, fmt.Errorf("not a compiled SLEIGH specification")
+	}
+	if sla[3] != slaFormatVersion {
+		return nil, fmt.Errorf("unsupported SLEIGH format version %d", sla[3])
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(sla[4:]))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	d := &packedDecoder{r: bufio.NewReader(zr)}
+
+	// user operations are declared as a head with the name, and later
+	// defined with their index, both referencing the symbol id
+	names := map[uint64]string{}
+	indexes := map[uint64]uint64{}
+	info := &slaInfo{}
+
+	var elem, id, index uint64
+	var name string
+	flush := func() {
+		switch elem {
+		case slaElemUserOpHead:
+			names[id] = name
+		case slaElemUserOp:
+			indexes[id] = index
+		}
+		elem, id, index, name = 0, 0, 0, ""
+	}
+
+	for {
+		header, err := d.r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch header & packedTypeMask {
+		case packedElementStart:
+			flush()
+			if elem, err = d.readID(header); err != nil {
+				return nil, err
+			}
+			info.commits = info.commits || elem == slaElemCommit
+		case packedElementEnd:
+			flush()
+			if _, err := d.readID(header); err != nil {
+				return nil, err
+			}
+		case packedAttribute:
+			attrib, err := d.readID(header)
+			if err != nil {
+				return nil, err
+			}
+
+			keep := elem == slaElemUserOpHead && attrib == slaAttribName
+			v, s, err := d.readValue(keep)
+			if err != nil {
+				return nil, err
+			}
+
+			switch {
+			case attrib == slaAttribID:
+				id = v
+			case attrib == slaAttribIndex:
+				index = v
+			case keep:
+				name = s
+			}
+		default:
+			return nil, fmt.Errorf("invalid header byte 0x%x", header)
+		}
+	}
+
+	for id, index := range indexes {
+		for uint64(len(info.userOps)) <= index {
+			info.userOps = append(info.userOps, "")
+		}
+		info.userOps[index] = names[id]
+	}
+
+	return info, nil
+}
+
+// slaInfo loads the language and parses its specification once.
+func (al *ArchitectureLanguage) slaInfo() (*slaInfo, error) {
+	if err := al.Load(); err != nil {
+		return nil, err
+	}
+
+	al.slaOnce.Do(func() {
+		al.sla, al.slaErr = parseSLA(al.Sla)
+	})
+	return al.sla, al.slaErr
+}
+
+// UserOpNames returns the names of the user defined operations of the
+// language (SLEIGH "define pcodeop"), indexed like the constant first input
+// of CALLOTHER ops. The language is loaded if needed.
+func (al *ArchitectureLanguage) UserOpNames() ([]string, error) {
+	info, err := al.slaInfo()
+	if err != nil {
+		return nil, err
+	}
+	return info.userOps, nil
+}
+
+// GetUserOpNames returns the names of the user defined operations of the
+// language of the context, see ArchitectureLanguage.UserOpNames.
+func (c *Context) GetUserOpNames() []string {
+	if c._lang == nil {
+		return nil
+	}
+
+	names, _ := c._lang.UserOpNames()
+	return names
+}
+
+// UserOpName returns the name of the user defined operation with the given
+// index, the constant first input of a CALLOTHER op.
+func (c *Context) UserOpName(index uint64) (string, bool) {
+	names := c.GetUserOpNames()
+	if index >= uint64(len(names)) || names[index] == "" {
+		return "", false
+	}
+	return names[index], true
+}
+
+// commitsContext reports whether the instructions of the language may change
+// the context of other addresses, assuming they do when it is unknown.
+func (c *Context) commitsContext() bool {
+	if c._lang == nil {
+		return true
+	}
+
+	info, err := c._lang.slaInfo()
+	return err != nil || info.commits
+}
+
+// formatter returns the formatter of the ops translated by the context, which
+// renders CALLOTHER ops with the names of the user operations.
+func (c *Context) formatter() prettyPrinter {
+	return defaultPcodeFormatter.withUserOps(c.UserOpName)
+}
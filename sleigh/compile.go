@@ -0,0 +1,1084 @@
+// Package sleigh compiles SLEIGH processor specifications (.slaspec) into the
+// compiled .sla form the decompiler library loads.
+//
+// The compiler follows Ghidra's sleigh compiler: the same preprocessor, the
+// same language and the same checks, and it lays out the tables, patterns
+// and semantics the way Ghidra does, so that the result decodes the same
+// instructions.
+package sleigh
+
+import (
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// Options are the options of Compile.
+type Options struct {
+	// Defines are preprocessor macros, as if defined with @define before
+	// the specification.
+	Defines map[string]string
+}
+
+// Error is an error of a specification, at a line of one of its files.
+type Error struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.File == "" {
+		return e.Msg
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// ErrorList is the list of the errors of a specification.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", l[0], len(l)-1)
+}
+
+// maxUniqueSize is the room reserved for each temporary of the unique
+// space.
+const maxUniqueSize = 0x80
+
+// maxErrors stops the compilation of a broken specification.
+const maxErrors = 100
+
+// Compile compiles the specification at path in fsys. The files it
+// includes are looked up relative to it. The errors of the specification
+// are returned as an ErrorList.
+func Compile(fsys fs.FS, path string, opts *Options) ([]byte, error) {
+	pp := &preprocessor{fsys: fsys, defines: make(map[string]string)}
+	if opts != nil {
+		for k, v := range opts.Defines {
+			pp.defines[k] = v
+		}
+	}
+	if err := pp.include(path, path[strings.LastIndexByte(path, '/')+1:], "", 0); err != nil {
+		return nil, err
+	}
+
+	c := newCompiler()
+	p := &parser{c: c, lx: &lexer{text: pp.text, lines: pp.lines}}
+	p.parse()
+	if len(c.errs) == 0 {
+		c.process()
+	}
+	if len(c.errs) != 0 {
+		return nil, c.errs
+	}
+	return c.encode()
+}
+
+// fieldQuality is a field of a token or of the context being defined.
+type fieldQuality struct {
+	name      string
+	low, high int
+	signed    bool
+	flow      bool
+}
+
+// contextFieldDef is a field of a context register waiting for the layout
+// of the context.
+type contextFieldDef struct {
+	reg  *varnodeSymbol
+	qual fieldQuality
+}
+
+// withBlock is a with block: a table, a pattern and context changes shared
+// by the constructors within.
+type withBlock struct {
+	table   *subtableSymbol
+	pateq   equation
+	context []contextChange
+}
+
+// sectionVector is the semantics of a constructor: the main section and
+// the named ones, each with the scope of its labels.
+type sectionVector struct {
+	main      *constructTpl
+	mainScope *scope
+	named     []*constructTpl
+	scopes    []*scope
+	next      int
+}
+
+func (v *sectionVector) append(tpl *constructTpl, s *scope) {
+	for len(v.named) <= v.next {
+		v.named = append(v.named, nil)
+		v.scopes = append(v.scopes, nil)
+	}
+	v.named[v.next] = tpl
+	v.scopes[v.next] = s
+}
+
+// compiler holds the state of a compilation.
+type compiler struct {
+	errs         ErrorList
+	file         string
+	source       string // file as included, recorded in the constructors
+	line         int
+	symtab       *symbolTable
+	spaces       []*space
+	constSpace   *space
+	uniqSpace    *space
+	defaultSpace *space
+	bigEndian    bool
+	alignment    int
+	uniqueBase   uint64
+	maxDelay     int
+
+	tokens          []*token
+	userOpCount     int
+	sections        []*sectionSymbol
+	macros          []*constructTpl
+	root            *subtableSymbol
+	tables          []*subtableSymbol
+	contextDefs     []contextFieldDef
+	contextLock     bool
+	withs           []withBlock
+	curCt           *constructor
+	curMacro        *macroSymbol
+	labelCount      int
+	enforceLocalKey bool
+
+	sourceFiles []string
+	sourceIndex map[string]int
+}
+
+func newCompiler() *compiler {
+	return &compiler{alignment: 1, sourceIndex: make(map[string]int)}
+}
+
+// errorf reports an error at the current location.
+func (c *compiler) errorf(format string, args ...interface{}) {
+	c.errorAt(c.file, c.line, format, args...)
+}
+
+func (c *compiler) errorAt(file string, line int, format string, args ...interface{}) {
+	c.errs = append(c.errs, &Error{File: file, Line: line, Msg: fmt.Sprintf(format, args...)})
+}
+
+// addSymbol adds sym to the current scope, reporting a duplicate name.
+func (c *compiler) addSymbol(sym symbol) {
+	if err := c.symtab.add(sym); err != nil {
+		c.errorf("%v", err)
+	}
+}
+
+// sourceFile returns the index of the source file name.
+func (c *compiler) sourceFile(name string) int {
+	if i, ok := c.sourceIndex[name]; ok {
+		return i
+	}
+	i := len(c.sourceFiles)
+	c.sourceIndex[name] = i
+	c.sourceFiles = append(c.sourceFiles, name)
+	return i
+}
+
+// setEndian starts the specification: the endianness comes first as it
+// is the one of the predefined spaces.
+func (c *compiler) setEndian(big bool) {
+	c.bigEndian = big
+	c.predefinedSymbols()
+}
+
+func (c *compiler) predefinedSymbols() {
+	c.symtab = newSymbolTable()
+	c.root = &subtableSymbol{symbolBase: symbolBase{name: "instruction"}}
+	c.addSymbol(c.root)
+
+	c.constSpace = &space{name: "const", typ: spaceConstant, index: 0, size: 8, wordSize: 1, bigEndian: c.bigEndian}
+	other := &space{name: "OTHER", typ: spaceOther, index: 1, size: 8, wordSize: 1, bigEndian: c.bigEndian}
+	c.uniqSpace = &space{name: "unique", typ: spaceUnique, index: 2, size: 4, wordSize: 1, bigEndian: c.bigEndian}
+	c.spaces = []*space{c.constSpace, other, c.uniqSpace}
+	for _, spc := range c.spaces {
+		c.addSymbol(&spaceSymbol{symbolBase: symbolBase{name: spc.name}, space: spc})
+	}
+
+	for _, a := range []struct {
+		name string
+		elem int
+		exp  int
+		kind constType
+	}{
+		{"inst_start", elemStartSym, elemStartExp, constStart},
+		{"inst_next", elemEndSym, elemEndExp, constNext},
+		{"inst_next2", elemNext2Sym, elemNext2Exp, constNext2},
+	} {
+		c.addSymbol(&addressSymbol{
+			symbolBase: symbolBase{name: a.name},
+			elem:       a.elem,
+			patexp:     &addressValue{elem: a.exp},
+			kind:       a.kind,
+			constSpace: c.constSpace,
+		})
+	}
+	c.addSymbol(&epsilonSymbol{symbolBase: symbolBase{name: "epsilon"}, constSpace: c.constSpace})
+}
+
+func (c *compiler) setAlignment(val int) {
+	c.alignment = val
+}
+
+// newSpace defines an address space.
+func (c *compiler) newSpace(name string, register bool, size, wordSize int, isDefault bool) {
+	if size == 0 {
+		c.errorf("space definition '%s' missing size attribute", name)
+		return
+	}
+	if wordSize == 0 {
+		wordSize = 1
+	}
+	delay := 1
+	if register {
+		delay = 0
+	}
+	spc := &space{name: name, typ: spaceProcessor, index: len(c.spaces), size: size, wordSize: wordSize, bigEndian: c.bigEndian, delay: delay}
+	c.spaces = append(c.spaces, spc)
+	if isDefault {
+		if c.defaultSpace != nil {
+			c.errorf("multiple default spaces -- '%s', '%s'", c.defaultSpace.name, name)
+		} else {
+			c.defaultSpace = spc
+		}
+	}
+	c.addSymbol(&spaceSymbol{symbolBase: symbolBase{name: name}, space: spc})
+}
+
+// defineVarnodes names consecutive varnodes of size bytes from offset on,
+// "_" skipping one.
+func (c *compiler) defineVarnodes(spc *space, offset uint64, size int, names []string) {
+	for _, name := range names {
+		if name != "_" {
+			c.addSymbol(&varnodeSymbol{symbolBase: symbolBase{name: name}, space: spc, offset: offset, size: size})
+		}
+		offset += uint64(size)
+	}
+}
+
+func (c *compiler) defineBitrange(name string, sym *varnodeSymbol, bitOffset, numBits int) {
+	size := 8 * sym.size
+	if numBits == 0 {
+		c.errorf("size of bitrange is zero for '%s'", name)
+		return
+	}
+	if bitOffset >= size || bitOffset+numBits > size {
+		c.errorf("bad bitrange for '%s'", name)
+		return
+	}
+	if bitOffset%8 == 0 && numBits%8 == 0 {
+		// a whole number of bytes is a varnode of its own
+		offset := sym.offset + uint64(bitOffset/8)
+		if c.bigEndian {
+			offset = sym.offset + uint64((size-bitOffset-numBits)/8)
+		}
+		c.addSymbol(&varnodeSymbol{symbolBase: symbolBase{name: name}, space: sym.space, offset: offset, size: numBits / 8})
+		return
+	}
+	c.addSymbol(&bitrangeSymbol{symbolBase: symbolBase{name: name}, vn: sym, bitOffset: bitOffset, numBits: numBits})
+}
+
+func (c *compiler) addUserOp(names []string) {
+	for _, name := range names {
+		c.addSymbol(&userOpSymbol{symbolBase: symbolBase{name: name}, index: c.userOpCount})
+		c.userOpCount++
+	}
+}
+
+// defineToken defines a token of size bits, endian being 0 for the
+// endianness of the specification.
+func (c *compiler) defineToken(name string, size, endian int) *token {
+	if size%8 != 0 {
+		c.errorf("definition of '%s' token -- size must be multiple of 8", name)
+		size = (size + 7) / 8 * 8
+	}
+	big := c.bigEndian
+	if endian != 0 {
+		big = endian > 0
+	}
+	tok := &token{name: name, size: size / 8, bigEndian: big, index: len(c.tokens)}
+	c.tokens = append(c.tokens, tok)
+	c.addSymbol(&tokenSymbol{symbolBase: symbolBase{name: name}, tok: tok})
+	return tok
+}
+
+func (c *compiler) addTokenField(tok *token, qual fieldQuality) {
+	if qual.low > qual.high {
+		c.errorf("field '%s' starts after it ends", qual.name)
+		return
+	}
+	if qual.high >= tok.size*8 {
+		c.errorf("field '%s' high must be less than token size", qual.name)
+		return
+	}
+	c.addSymbol(&valueSymbol{symbolBase: symbolBase{name: qual.name}, patval: newTokenField(tok, qual.signed, qual.low, qual.high)})
+}
+
+func (c *compiler) addContextField(reg *varnodeSymbol, qual fieldQuality) {
+	if qual.low > qual.high {
+		c.errorf("context field '%s' starts after it ends", qual.name)
+		return
+	}
+	if qual.high-qual.low >= 32 {
+		c.errorf("context field '%s' spans more than 32 bits", qual.name)
+		return
+	}
+	if qual.high >= reg.size*8 {
+		c.errorf("context field '%s' extends beyond the register", qual.name)
+		return
+	}
+	if c.contextLock {
+		c.errorf("all context definitions must come before constructors")
+		return
+	}
+	c.contextDefs = append(c.contextDefs, contextFieldDef{reg: reg, qual: qual})
+}
+
+// calcContextLayout packs the fields of the context register, each group
+// of overlapping fields after the previous one without crossing a 32-bit
+// word, and defines their symbols. The layout is computed once, before the
+// first attach, with block or constructor.
+func (c *compiler) calcContextLayout() {
+	if c.contextLock {
+		return
+	}
+	c.contextLock = true
+	defs := c.contextDefs
+	c.contextDefs = nil
+	if len(defs) == 0 {
+		return
+	}
+	sort.SliceStable(defs, func(i, j int) bool {
+		if defs[i].reg.name != defs[j].reg.name {
+			return defs[i].reg.name < defs[j].reg.name
+		}
+		return defs[i].qual.low < defs[j].qual.low
+	})
+
+	reg := defs[0].reg
+	if reg.size%4 != 0 {
+		c.errorf("context register '%s' size must be a multiple of 4 bytes", reg.name)
+	}
+	numBits := 0
+	for i := 0; i < len(defs); {
+		min, max := defs[i].qual.low, defs[i].qual.high
+		j := i + 1
+		for ; j < len(defs) && defs[j].qual.low <= max; j++ {
+			if defs[j].qual.high > max {
+				max = defs[j].qual.high
+			}
+		}
+		alloc := max - min + 1
+		if endWord := (numBits + alloc - 1) / 32; numBits/32 != endWord {
+			numBits = endWord * 32
+		}
+		low := numBits
+		numBits += alloc
+		for ; i < j; i++ {
+			d := defs[i]
+			c.addSymbol(&contextSymbol{
+				symbolBase: symbolBase{name: d.qual.name},
+				patval:     newContextField(d.qual.signed, d.qual.low-min+low, numBits-1-(max-d.qual.high)),
+				vn:         reg,
+				low:        d.qual.low,
+				high:       d.qual.high,
+				flow:       d.qual.flow,
+			})
+		}
+	}
+}
+
+// attachValues maps the values of the fields to integers.
+func (c *compiler) attachValues(syms []familySymbol, values []int64) {
+	for _, sym := range syms {
+		patval := sym.patternValue()
+		if patval.maxValue()+1 != int64(len(values)) {
+			c.errorf("attach value '%s' is wrong size for list", sym.base().name)
+		}
+		c.symtab.replace(sym, &valueMapSymbol{symbolBase: symbolBase{name: sym.base().name}, patval: patval, values: values})
+	}
+}
+
+// attachNames maps the values of the fields to names, "_" making the
+// instruction invalid.
+func (c *compiler) attachNames(syms []familySymbol, names []string) {
+	for _, sym := range syms {
+		patval := sym.patternValue()
+		if patval.maxValue()+1 != int64(len(names)) {
+			c.errorf("attach name '%s' is wrong size for list", sym.base().name)
+		}
+		c.symtab.replace(sym, &nameSymbol{symbolBase: symbolBase{name: sym.base().name}, patval: patval, names: names})
+	}
+}
+
+// attachVarnodes maps the values of the fields to registers.
+func (c *compiler) attachVarnodes(syms []familySymbol, vars []*varnodeSymbol) {
+	for _, sym := range syms {
+		patval := sym.patternValue()
+		if patval.maxValue()+1 != int64(len(vars)) {
+			c.errorf("attach varnode '%s' is wrong size for list", sym.base().name)
+		}
+		size := 0
+		for _, v := range vars {
+			if v == nil {
+				continue
+			}
+			if size == 0 {
+				size = v.size
+			} else if size != v.size {
+				c.errorf("attach statement contains varnodes of different sizes")
+				break
+			}
+		}
+		c.symtab.replace(sym, &varListSymbol{symbolBase: symbolBase{name: sym.base().name}, patval: patval, vars: vars})
+	}
+}
+
+// newTable defines a subtable from its first constructor.
+func (c *compiler) newTable(name string) *subtableSymbol {
+	sym := &subtableSymbol{symbolBase: symbolBase{name: name}}
+	c.addSymbol(sym)
+	c.tables = append(c.tables, sym)
+	return sym
+}
+
+func (c *compiler) currentSubtable() *subtableSymbol {
+	for _, w := range c.withs {
+		if w.table != nil {
+			return w.table
+		}
+	}
+	return nil
+}
+
+// createConstructor starts a constructor of table, nil for the table of
+// the with blocks or the root one, at the current line.
+func (c *compiler) createConstructor(table *subtableSymbol) *constructor {
+	if table == nil {
+		table = c.currentSubtable()
+	}
+	if table == nil {
+		table = c.root
+	}
+	c.curMacro = nil
+	ct := newConstructor(table)
+	ct.file, ct.line = c.file, c.line
+	ct.source = c.sourceFile(c.source)
+	c.curCt = ct
+	c.symtab.push()
+	c.labelCount = 0
+	return ct
+}
+
+func (c *compiler) isInRoot(ct *constructor) bool {
+	return ct.parent == c.root
+}
+
+// newOperand adds an operand of the display of ct.
+func (c *compiler) newOperand(ct *constructor, name string) {
+	sym := newOperandSymbol(name, len(ct.operands), ct)
+	c.addSymbol(sym)
+	ct.addOperand(sym)
+}
+
+// selfDefine defines an operand of the display by the global symbol of
+// the same name.
+func (c *compiler) selfDefine(sym *operandSymbol) {
+	glob := c.symtab.findGlobal(sym.name)
+	var err error
+	switch g := glob.(type) {
+	case nil:
+		c.errorf("no matching global symbol '%s'", sym.name)
+		return
+	case *valueSymbol:
+		err = sym.defineExpr(g.patval)
+	case *contextSymbol:
+		err = sym.defineExpr(g.patval)
+	case familySymbol, specificSymbol, *subtableSymbol:
+		err = sym.defineSymbol(glob)
+	default:
+		c.errorf("global symbol '%s' cannot define an operand", sym.name)
+		return
+	}
+	if err != nil {
+		c.errorf("%v", err)
+	}
+}
+
+// defineInvisibleOperand adds an operand that is in the pattern but not in
+// the display.
+func (c *compiler) defineInvisibleOperand(sym symbol) equation {
+	ct := c.curCt
+	opsym := newOperandSymbol(sym.base().name, len(ct.operands), ct)
+	c.addSymbol(opsym)
+	ct.operands = append(ct.operands, opsym)
+	var err error
+	switch s := sym.(type) {
+	case *valueSymbol:
+		err = opsym.defineExpr(s.patval)
+	case *contextSymbol:
+		err = opsym.defineExpr(s.patval)
+	default:
+		err = opsym.defineSymbol(sym)
+	}
+	if err != nil {
+		c.errorf("%v", err)
+	}
+	return &operandEquation{index: opsym.index}
+}
+
+// constrainOperand constrains the field an operand is defined by.
+func (c *compiler) constrainOperand(sym *operandSymbol, expr patternExpr) equation {
+	fam, ok := sym.triple.(familySymbol)
+	if !ok {
+		c.errorf("constraining currently undefined operand %s", sym.name)
+		return nil
+	}
+	return &compareEquation{op: cmpEqual, lhs: fam.patternValue(), rhs: expr}
+}
+
+// defineOperand defines an operand by an expression in the context block.
+func (c *compiler) defineOperand(sym *operandSymbol, expr patternExpr) {
+	if err := sym.defineExpr(expr); err != nil {
+		c.errorf("%v", err)
+		return
+	}
+	sym.offsetIrrelevant = true
+}
+
+// contextMod sets a context field while the instruction is decoded.
+func (c *compiler) contextMod(changes []contextChange, sym *contextSymbol, expr patternExpr) []contextChange {
+	for _, v := range expr.listValues(nil) {
+		if a, ok := v.(*addressValue); ok && a.elem != elemStartExp {
+			c.errorf("cannot use 'inst_next' or 'inst_next2' in context expression")
+			return changes
+		}
+	}
+	num, shift, mask, err := maskWord(sym.patval.startBit, sym.patval.endBit)
+	if err != nil {
+		c.errorf("%v", err)
+		return changes
+	}
+	return append(changes, &contextOp{num: num, shift: shift, mask: mask, expr: expr})
+}
+
+// contextSet makes the change of a context field stick from the address
+// of sym on.
+func (c *compiler) contextSet(changes []contextChange, sym symbol, cvar *contextSymbol) []contextChange {
+	num, _, mask, err := maskWord(cvar.patval.startBit, cvar.patval.endBit)
+	if err != nil {
+		c.errorf("%v", err)
+		return changes
+	}
+	return append(changes, &contextCommit{sym: sym, num: num, mask: mask, flow: cvar.flow})
+}
+
+func (c *compiler) pushWith(table *subtableSymbol, pateq equation, changes []contextChange) {
+	c.withs = append(c.withs, withBlock{table: table, pateq: pateq, context: changes})
+}
+
+func (c *compiler) popWith() {
+	c.withs = c.withs[:len(c.withs)-1]
+}
+
+// newSectionSymbol defines the name of a named section.
+func (c *compiler) newSectionSymbol(name string) *sectionSymbol {
+	sym := &sectionSymbol{symbolBase: symbolBase{name: name}, index: len(c.sections)}
+	if err := c.symtab.addGlobal(sym); err != nil {
+		c.errorf("%v", err)
+	}
+	c.sections = append(c.sections, sym)
+	return sym
+}
+
+func (c *compiler) standaloneSection(main *constructTpl) *sectionVector {
+	return &sectionVector{main: main, mainScope: c.symtab.cur}
+}
+
+func (c *compiler) firstNamedSection(main *constructTpl, sym *sectionSymbol) *sectionVector {
+	v := &sectionVector{main: main, mainScope: c.symtab.cur, next: sym.index}
+	c.symtab.push()
+	return v
+}
+
+func (c *compiler) nextNamedSection(v *sectionVector, tpl *constructTpl, sym *sectionSymbol) *sectionVector {
+	cur := c.symtab.cur
+	c.symtab.pop()
+	c.symtab.push()
+	v.append(tpl, cur)
+	v.next = sym.index
+	return v
+}
+
+func (c *compiler) finalNamedSection(v *sectionVector, tpl *constructTpl) *sectionVector {
+	v.append(tpl, c.symtab.cur)
+	c.symtab.pop()
+	return v
+}
+
+// buildConstructor completes ct with its pattern, context changes and
+// semantics, sections being nil for unimpl.
+func (c *compiler) buildConstructor(ct *constructor, pateq equation, changes []contextChange, sections *sectionVector) {
+	ok := true
+	if sections != nil {
+		ok = c.finalizeSections(ct, sections)
+		if ok {
+			ct.templ = sections.main
+			for i, tpl := range sections.named {
+				if tpl != nil {
+					ct.setNamedSection(tpl, i)
+				}
+			}
+		}
+	}
+	if ok {
+		for _, w := range c.withs {
+			if w.pateq != nil {
+				pateq = &andEquation{left: w.pateq, right: pateq}
+			}
+		}
+		var all []contextChange
+		for _, w := range c.withs {
+			all = append(all, w.context...)
+		}
+		ct.pateq = pateq
+		ct.removeTrailingSpace()
+		ct.context = append(all, changes...)
+	}
+	c.symtab.pop()
+	c.curCt = nil
+}
+
+// checkSymbols reports the labels of a scope that are not both placed and
+// used.
+func checkSymbols(s *scope) string {
+	names := make([]string, 0, len(s.syms))
+	for name := range s.syms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var msg strings.Builder
+	for _, name := range names {
+		lab, ok := s.syms[name].(*labelSymbol)
+		if !ok {
+			continue
+		}
+		if lab.refCount == 0 {
+			fmt.Fprintf(&msg, "label <%s> was placed but not used", name)
+		} else if !lab.placed {
+			fmt.Fprintf(&msg, "label <%s> was referenced but never placed", name)
+		}
+	}
+	return msg.String()
+}
+
+// finalizeSections expands the macros of the sections of ct, adds the
+// builds of its subtable operands and sizes the varnodes.
+func (c *compiler) finalizeSections(ct *constructor, v *sectionVector) bool {
+	var errs []string
+	tpl, s := v.main, v.mainScope
+	name := "main section"
+	for i := -1; ; {
+		if msg := checkSymbols(s); msg != "" {
+			errs = append(errs, name+": "+msg)
+		} else {
+			if !c.expandMacros(tpl) {
+				errs = append(errs, name+": could not expand macros")
+			}
+			switch tpl.fillinBuild(ct.markSubtableOperands(), c.constSpace) {
+			case 1:
+				errs = append(errs, name+": duplicate BUILD statements")
+			case 2:
+				errs = append(errs, name+": unnecessary BUILD statements")
+			}
+			if ok, err := propagateSize(tpl); err != nil {
+				errs = append(errs, name+": "+err.Error())
+			} else if !ok {
+				errs = append(errs, name+": could not resolve at least 1 variable size")
+			}
+		}
+		if i < 0 && tpl.result != nil {
+			if ct.parent == c.root {
+				errs = append(errs, "cannot have export statement in root constructor")
+			} else if !c.forceExportSize(tpl) {
+				errs = append(errs, "size of export is unknown")
+			}
+		}
+		if tpl.delaySlot > c.maxDelay {
+			c.maxDelay = tpl.delaySlot
+		}
+		for i++; i < len(v.named) && v.named[i] == nil; i++ {
+		}
+		if i >= len(v.named) {
+			break
+		}
+		tpl, s = v.named[i], v.scopes[i]
+		name = c.sections[i].name + " section"
+	}
+	for _, msg := range errs {
+		c.errorAt(ct.file, ct.line, "%s", msg)
+	}
+	return len(errs) == 0
+}
+
+// forceExportSize sizes the pointer or the temporary a constructor exports
+// when the semantics leave them unknown.
+func (c *compiler) forceExportSize(tpl *constructTpl) bool {
+	res := tpl.result
+	isUnique := func(ct constTpl) bool {
+		return ct.typ == constSpaceID && ct.space.typ == spaceUnique
+	}
+	// tempSize returns the size of the temporary the semantics write at
+	// the offset of the export
+	tempSize := func() (constTpl, bool) {
+		for _, op := range tpl.ops {
+			out := op.output
+			if out != nil && out.isLocalTemp() && out.offset.equal(res.ptrOffset) && !out.size.isZero() {
+				return out.size, true
+			}
+		}
+		return constTpl{}, false
+	}
+	if isUnique(res.ptrSpace) && res.ptrSize.isZero() {
+		if size, ok := tempSize(); ok {
+			res.ptrSize = size
+			return true
+		}
+		size := realConst(8)
+		if res.space.typ == constSpaceID {
+			size = realConst(uint64(res.space.space.size))
+		}
+		vt := &varnodeTpl{space: res.ptrSpace, offset: res.ptrOffset, size: res.ptrSize}
+		if err := forceSize(vt, size, tpl.ops); err != nil {
+			return false
+		}
+		res.ptrSize = size
+	} else if isUnique(res.space) && res.size.isZero() {
+		if size, ok := tempSize(); ok {
+			res.size = size
+		}
+	}
+	return !(isUnique(res.space) && res.size.isZero())
+}
+
+// createMacro starts the definition of a macro.
+func (c *compiler) createMacro(name string, params []string) *macroSymbol {
+	c.curCt = nil
+	sym := &macroSymbol{symbolBase: symbolBase{name: name}, index: len(c.macros)}
+	c.addSymbol(sym)
+	c.curMacro = sym
+	c.symtab.push()
+	c.labelCount = 0
+	for i, p := range params {
+		op := newOperandSymbol(p, i, nil)
+		c.addSymbol(op)
+		sym.params = append(sym.params, op)
+	}
+	return sym
+}
+
+func (c *compiler) buildMacro(sym *macroSymbol, tpl *constructTpl) {
+	defer c.symtab.pop()
+	if msg := checkSymbols(c.symtab.cur); msg != "" {
+		c.errorf("in definition of macro '%s': %s", sym.name, msg)
+		return
+	}
+	if !c.expandMacros(tpl) {
+		c.errorf("could not expand submacro in definition of macro '%s'", sym.name)
+		return
+	}
+	if _, err := propagateSize(tpl); err != nil {
+		c.errorf("in definition of macro '%s': %v", sym.name, err)
+	}
+	sym.body = tpl
+	c.macros = append(c.macros, tpl)
+	c.curMacro = nil
+}
+
+// createMacroUse returns the placeholder of an invocation of a macro,
+// expanded by expandMacros once the section is complete.
+func (c *compiler) createMacroUse(sym *macroSymbol, params []*exprTree) []*opTpl {
+	if len(params) != len(sym.params) {
+		much := "few"
+		if len(params) > len(sym.params) {
+			much = "many"
+		}
+		c.errorf("invocation of macro \"%s\" passes too %s parameters", sym.name, much)
+		return nil
+	}
+	for i, p := range params {
+		out := p.out
+		if out == nil || out.offset.typ != constHandle {
+			continue
+		}
+		var parent *operandSymbol
+		if c.curCt != nil {
+			parent = c.curCt.operands[out.offset.handle]
+		} else if c.curMacro != nil {
+			parent = c.curMacro.params[out.offset.handle]
+		}
+		if parent != nil && sym.params[i].codeAddress {
+			parent.codeAddress = true
+		}
+	}
+	return appendParams(newOp(opMacroBuild, c.constVarnode(uint64(sym.index), 4)), params)
+}
+
+// expandMacros replaces the macro invocations of tpl by the bodies of the
+// macros.
+func (c *compiler) expandMacros(tpl *constructTpl) bool {
+	var ops []*opTpl
+	for _, op := range tpl.ops {
+		if op.code != opMacroBuild {
+			ops = append(ops, op)
+			continue
+		}
+		index := int(op.inputs[0].offset.val)
+		if index >= len(c.macros) {
+			return false
+		}
+		b := &macroBuilder{c: c, labelCount: tpl.numLabels}
+		for _, in := range op.inputs[1:] {
+			b.params = append(b.params, newHandle(in))
+		}
+		macro := c.macros[index]
+		b.build(macro)
+		ops = append(ops, b.out...)
+		tpl.numLabels += macro.numLabels
+		if b.failed {
+			return false
+		}
+	}
+	tpl.ops = ops
+	return true
+}
+
+// macroBuilder expands the body of a macro for an invocation, its
+// parameters being the handles of the arguments.
+type macroBuilder struct {
+	c          *compiler
+	params     []*handleTpl
+	out        []*opTpl
+	labelBase  int
+	labelCount int
+	failed     bool
+}
+
+func (b *macroBuilder) build(tpl *constructTpl) {
+	oldBase := b.labelBase
+	b.labelBase = b.labelCount
+	b.labelCount += tpl.numLabels
+	for _, op := range tpl.ops {
+		if op.code == opLabelBuild {
+			vn := op.inputs[0].clone()
+			vn.offset.val += uint64(b.labelBase)
+			b.out = append(b.out, newOp(opLabelBuild, vn))
+			continue
+		}
+		b.dump(op)
+	}
+	b.labelBase = oldBase
+}
+
+func (b *macroBuilder) dump(op *opTpl) {
+	clone := newOp(op.code)
+	if op.output != nil {
+		clone.output = op.output.clone()
+	}
+	for _, in := range op.inputs {
+		vn := in.clone()
+		if vn.offset.typ == constRelative {
+			vn.offset.val += uint64(b.labelBase)
+		}
+		clone.inputs = append(clone.inputs, vn)
+	}
+	b.transferOp(clone)
+}
+
+// transferOp replaces the parameters of the macro in op by the arguments,
+// truncating these with a SUBPIECE where the macro takes part of one.
+func (b *macroBuilder) transferOp(op *opTpl) {
+	if op.output != nil {
+		plus, err := b.transfer(op.output)
+		if err == nil && plus >= 0 {
+			err = fmt.Errorf("cannot currently assign to bitrange of macro parameter that is a temporary")
+		}
+		if err != nil {
+			b.c.errorf("%v", err)
+			b.failed = true
+			return
+		}
+	}
+	handle := 0
+	realSize := false
+	var size uint64
+	for i, vn := range op.inputs {
+		if vn.offset.typ == constHandle {
+			handle = vn.offset.handle
+			realSize = vn.size.typ == constReal
+			size = vn.size.val
+		}
+		plus, err := b.transfer(vn)
+		if err != nil {
+			b.c.errorf("%v", err)
+			b.failed = true
+			return
+		}
+		if plus < 0 {
+			continue
+		}
+		if !realSize {
+			b.c.errorf("problem with bit range operator in macro")
+			b.failed = true
+			return
+		}
+		tmp := &varnodeTpl{space: spaceConst(b.c.uniqSpace), offset: realConst(b.c.allocateTemp()), size: realConst(size)}
+		hand := b.params[handle]
+		sub := newOp(opSubpiece,
+			&varnodeTpl{space: hand.space, offset: hand.ptrOffset, size: hand.size},
+			b.c.constVarnode(uint64(plus), 4))
+		sub.output = tmp
+		b.out = append(b.out, sub)
+		op.inputs[i] = tmp.clone()
+	}
+	b.out = append(b.out, op)
+}
+
+// transfer replaces the parameters in vn, and returns the truncation of a
+// parameter that cannot be expressed as an offset, -1 if none.
+func (b *macroBuilder) transfer(vn *varnodeTpl) (int64, error) {
+	plus := int64(-1)
+	handle := -1
+	if vn.offset.typ == constHandle && vn.offset.sel == selOffsetPlus {
+		handle = vn.offset.handle
+		plus = int64(vn.offset.val)
+	}
+	for _, ct := range []*constTpl{&vn.space, &vn.offset, &vn.size} {
+		if err := b.transferConst(ct); err != nil {
+			return -1, err
+		}
+	}
+	if handle >= 0 && (vn.isLocalTemp() || b.params[handle].size.isZero()) {
+		return plus, nil
+	}
+	return -1, nil
+}
+
+func (b *macroBuilder) transferConst(ct *constTpl) error {
+	if ct.typ != constHandle {
+		return nil
+	}
+	hand := b.params[ct.handle]
+	switch ct.sel {
+	case selSpace:
+		*ct = hand.space
+	case selOffset:
+		*ct = hand.ptrOffset
+	case selSize:
+		*ct = hand.size
+	case selOffsetPlus:
+		plus := ct.val
+		*ct = hand.ptrOffset
+		switch {
+		case ct.typ == constReal:
+			ct.val += plus & 0xffff
+		case ct.typ == constHandle && ct.sel == selOffset:
+			ct.sel = selOffsetPlus
+			ct.val = plus
+		default:
+			return fmt.Errorf("cannot truncate macro input in this way")
+		}
+	}
+	return nil
+}
+
+// process checks the parsed specification, and builds the patterns and
+// the decision trees.
+func (c *compiler) process() {
+	if c.defaultSpace == nil {
+		c.errorf("no default space specified")
+		return
+	}
+	c.buildPatterns()
+	if len(c.errs) != 0 {
+		return
+	}
+	c.checkConsistency()
+	if len(c.errs) != 0 {
+		return
+	}
+	c.buildDecisionTrees()
+	if len(c.errs) != 0 {
+		return
+	}
+	c.symtab.purge()
+}
+
+func (c *compiler) buildPatterns() {
+	c.buildTablePattern(c.root)
+	if c.root.errors {
+		return
+	}
+	for _, t := range c.tables {
+		if t.errors {
+			c.errorf("problem in table '%s'", t.name)
+		}
+	}
+}
+
+func (c *compiler) buildDecisionTrees() {
+	errs := &decisionErrors{}
+	c.root.buildDecisionTree(errs)
+	for _, t := range c.tables {
+		t.buildDecisionTree(errs)
+	}
+	for _, p := range errs.identical {
+		c.errorAt(p[0].file, p[0].line, "constructor has identical pattern to constructor at %s:%d", p[1].file, p[1].line)
+	}
+	for _, err := range errs.failures {
+		c.errorf("%v", err)
+	}
+}
+
+// encode returns the compiled specification.
+func (c *compiler) encode() ([]byte, error) {
+	e := &encoder{}
+	e.open(elemSleigh)
+	e.signed(attribVersion, formatVersion)
+	e.bool(attribBigEndian, c.bigEndian)
+	e.signed(attribAlign, int64(c.alignment))
+	e.unsigned(attribUniqBase, c.uniqueBase)
+	if c.maxDelay > 0 {
+		e.unsigned(attribMaxDelay, uint64(c.maxDelay))
+	}
+	e.open(elemSourceFiles)
+	for i, name := range c.sourceFiles {
+		e.open(elemSourceFile)
+		e.string(attribName, name)
+		e.signed(attribIndex, int64(i))
+		e.close(elemSourceFile)
+	}
+	e.close(elemSourceFiles)
+	e.open(elemSpaces)
+	e.string(attribDefaultSpace, c.defaultSpace.name)
+	for _, spc := range c.spaces[1:] {
+		spc.encode(e)
+	}
+	e.close(elemSpaces)
+	c.symtab.encode(e)
+	e.close(elemSleigh)
+	return e.bytes()
+}
@@ -0,0 +1,133 @@
+package sleigh_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/dzonerzy/gopcode/sleigh"
+)
+
+const toySpec = `define endian=little;
+define alignment=1;
+
+define space ram type=ram_space size=2 default;
+define space register type=register_space size=1;
+
+define register offset=0x00 size=1 [ A X ];
+define register offset=0x10 size=2 [ PC ];
+
+define token opbyte (8) op = (0,7);
+define token data8 (8) imm8 = (0,7);
+
+:NOP is op=0xea {}
+:LDA "#"imm8 is op=0xa9; imm8 { A = imm8; }
+@ifdef WITH_INX
+:INX is op=0xe8 { X = X + 1; }
+@endif
+`
+
+func payload(t *testing.T, sla []byte) []byte {
+	t.Helper()
+	if len(sla) < 4 || string(sla[:3]) != "sla" {
+		t.Fatalf("bad sla header % x", sla[:min(len(sla), 4)])
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(sla[4:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func TestCompileDefines(t *testing.T) {
+	fsys := fstest.MapFS{"toy.slaspec": &fstest.MapFile{Data: []byte(toySpec)}}
+
+	without, err := sleigh.Compile(fsys, "toy.slaspec", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	with, err := sleigh.Compile(fsys, "toy.slaspec", &sleigh.Options{Defines: map[string]string{"WITH_INX": ""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(payload(t, without), []byte("INX")) {
+		t.Fatal("INX compiled without its define")
+	}
+	if !bytes.Contains(payload(t, with), []byte("INX")) {
+		t.Fatal("INX missing with its define")
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	fsys := fstest.MapFS{
+		"toy.slaspec": &fstest.MapFile{Data: []byte(toySpec + "@include \"ext/bad.sinc\"\n")},
+		"ext/bad.sinc": &fstest.MapFile{Data: []byte(`# extension
+:TAX is op=0xaa { X = A; }
+:TXA is op=0x8a { A = Y; }
+`)},
+	}
+
+	_, err := sleigh.Compile(fsys, "toy.slaspec", nil)
+	var list sleigh.ErrorList
+	if !errors.As(err, &list) || len(list) == 0 {
+		t.Fatalf("expected an ErrorList, got %v", err)
+	}
+	if list[0].File != "ext/bad.sinc" || list[0].Line != 3 {
+		t.Fatalf("expected an error at ext/bad.sinc:3, got %v", list[0])
+	}
+
+	_, err = sleigh.Compile(fsys, "missing.slaspec", nil)
+	if err == nil {
+		t.Fatal("expected an error for a missing specification")
+	}
+
+	fsys["toy.slaspec"] = &fstest.MapFile{Data: []byte("@if defined(X\n" + toySpec)}
+	_, err = sleigh.Compile(fsys, "toy.slaspec", nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "toy.slaspec:1: ") {
+		t.Fatalf("expected a preprocessor error at toy.slaspec:1, got %v", err)
+	}
+}
+
+// TestCompileShipped checks the specifications shipped with the processors
+// compile to the same .sla as Ghidra's compiler.
+func TestCompileShipped(t *testing.T) {
+	for _, spec := range []string{
+		"6502/data/languages/6502.slaspec",
+		"6502/data/languages/65c02.slaspec",
+		"x86/data/languages/x86-64.slaspec",
+	} {
+		t.Run(filepath.Base(spec), func(t *testing.T) {
+			dir, file := filepath.Split(filepath.Join("..", "processors", filepath.FromSlash(spec)))
+			sla, err := sleigh.Compile(os.DirFS(dir), file, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want, err := os.ReadFile(filepath.Join(dir, strings.TrimSuffix(file, ".slaspec")+".sla"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(payload(t, sla), payload(t, want)) {
+				t.Fatal("compiled specification differs from the shipped one")
+			}
+		})
+	}
+}
@@ -0,0 +1,515 @@
+package sleigh
+
+import (
+	"fmt"
+	"sort"
+)
+
+// checkConsistency checks the exports of the tables, adjusts the
+// truncations of the operands to their sizes, and drops the temporaries
+// that only copy a value.
+func (c *compiler) checkConsistency() {
+	postorder, sizemap := c.postOrder()
+	for _, t := range postorder {
+		c.checkSubtable(t, sizemap)
+	}
+	if len(c.errs) != 0 {
+		return
+	}
+	for _, t := range postorder {
+		for _, ct := range t.constructors {
+			for k := -1; k < len(ct.namedTempl); k++ {
+				if tpl := ct.section(k); tpl != nil {
+					c.testTruncations(ct, tpl, sizemap)
+				}
+			}
+		}
+	}
+	if len(c.errs) != 0 {
+		return
+	}
+	for _, t := range postorder {
+		for _, ct := range t.constructors {
+			c.optimize(ct)
+		}
+	}
+}
+
+// postOrder returns the tables reachable from the root, each after the
+// tables of its operands, with the size map of their exports all marked
+// unknown.
+func (c *compiler) postOrder() ([]*subtableSymbol, map[*subtableSymbol]int) {
+	var postorder []*subtableSymbol
+	sizemap := map[*subtableSymbol]int{c.root: -1}
+	type frame struct {
+		t       *subtableSymbol
+		ct, opr int
+	}
+	path := []*frame{{t: c.root}}
+	for len(path) != 0 {
+		cur := path[len(path)-1]
+		if cur.ct >= len(cur.t.constructors) {
+			path = path[:len(path)-1]
+			postorder = append(postorder, cur.t)
+			continue
+		}
+		ct := cur.t.constructors[cur.ct]
+		if cur.opr >= len(ct.operands) {
+			cur.ct++
+			cur.opr = 0
+			continue
+		}
+		op := ct.operands[cur.opr]
+		cur.opr++
+		if sub, ok := op.triple.(*subtableSymbol); ok {
+			if _, seen := sizemap[sub]; !seen {
+				sizemap[sub] = -1
+				path = append(path, &frame{t: sub})
+			}
+		}
+	}
+	return postorder, sizemap
+}
+
+// operandSize returns the size of the varnode an operand stands for, -1
+// for a subtable and 0 when unknown.
+func operandSize(op *operandSymbol) int {
+	switch t := op.triple.(type) {
+	case *varnodeSymbol:
+		return t.size
+	case *varListSymbol:
+		for _, v := range t.vars {
+			if v != nil {
+				return v.size
+			}
+		}
+	case *subtableSymbol:
+		return -1
+	}
+	return 0
+}
+
+// recoverSize returns the size a size constant of ct stands for.
+func recoverSize(size constTpl, ct *constructor, sizemap map[*subtableSymbol]int) (int, error) {
+	switch size.typ {
+	case constReal:
+		return int(size.val), nil
+	case constHandle:
+		op := ct.operands[size.handle]
+		sz := operandSize(op)
+		if sz == -1 {
+			sub := op.triple.(*subtableSymbol)
+			s, ok := sizemap[sub]
+			if !ok {
+				return 0, fmt.Errorf("subtable out of order")
+			}
+			sz = s
+		}
+		return sz, nil
+	}
+	return 0, fmt.Errorf("bad constant type as varnode template size")
+}
+
+// checkSubtable checks that the constructors of t all export, or none,
+// and with the same size, which it records in sizemap.
+func (c *compiler) checkSubtable(t *subtableSymbol, sizemap map[*subtableSymbol]int) {
+	tableSize := 0
+	seenEmpty, seenExport := false, false
+	for _, ct := range t.constructors {
+		for k := -1; k < len(ct.namedTempl); k++ {
+			if tpl := ct.section(k); tpl != nil {
+				for _, op := range tpl.ops {
+					c.sizeRestriction(t, ct, op, sizemap)
+				}
+			}
+		}
+		if ct.templ == nil {
+			continue
+		}
+		res := ct.templ.result
+		if res == nil {
+			if seenExport && !seenEmpty {
+				c.errorAt(ct.file, ct.line, "table '%s' exports inconsistently", t.name)
+			}
+			seenEmpty = true
+			continue
+		}
+		if seenEmpty && !seenExport {
+			c.errorAt(ct.file, ct.line, "table '%s' exports inconsistently", t.name)
+		}
+		seenExport = true
+		size, err := recoverSize(res.size, ct, sizemap)
+		if err != nil {
+			c.errorAt(ct.file, ct.line, "%v", err)
+			continue
+		}
+		if tableSize == 0 {
+			tableSize = size
+		}
+		if size != 0 && size != tableSize {
+			c.errorAt(ct.file, ct.line, "table '%s' has inconsistent export size", t.name)
+		}
+	}
+	if !seenExport {
+		tableSize = -1
+	}
+	sizemap[t] = tableSize
+}
+
+// sizeRestriction checks the sizes of the inputs and the output of op
+// against each other, and turns the extensions and the truncations that
+// keep the size into copies.
+func (c *compiler) sizeRestriction(t *subtableSymbol, ct *constructor, op *opTpl, sizemap map[*subtableSymbol]int) {
+	size := func(vn *varnodeTpl) (int, bool) {
+		sz, err := recoverSize(vn.size, ct, sizemap)
+		if err != nil {
+			c.errorAt(ct.file, ct.line, "%v", err)
+			return 0, false
+		}
+		if sz == -1 {
+			c.errorAt(ct.file, ct.line, "size restriction error in table '%s': using subtable with exports in expression", t.name)
+			return 0, false
+		}
+		return sz, true
+	}
+	fail := func(msg string) {
+		c.errorAt(ct.file, ct.line, "size restriction error in table '%s': %s", t.name, msg)
+	}
+
+	switch op.code {
+	case opCopy, opInt2Comp, opIntNegate, opFloatNeg, opFloatAbs, opFloatSqrt, opFloatCeil, opFloatFloor, opFloatRound:
+		out, ok1 := size(op.output)
+		in0, ok2 := size(op.inputs[0])
+		if ok1 && ok2 && out != 0 && in0 != 0 && out != in0 {
+			fail("input and output sizes must match")
+		}
+	case opIntAdd, opIntSub, opIntXor, opIntAnd, opIntOr, opIntMult, opIntDiv, opIntSDiv, opIntRem, opIntSRem,
+		opFloatAdd, opFloatDiv, opFloatMult, opFloatSub:
+		out, ok1 := size(op.output)
+		in0, ok2 := size(op.inputs[0])
+		in1, ok3 := size(op.inputs[1])
+		if !ok1 || !ok2 || !ok3 {
+			return
+		}
+		if out != 0 && in0 != 0 && out != in0 || out != 0 && in1 != 0 && out != in1 || in0 != 0 && in1 != 0 && in0 != in1 {
+			fail("the output and all input sizes must match")
+		}
+	case opFloatNaN:
+		if out, ok := size(op.output); ok && out != 0 && out != 1 {
+			fail("output must be a boolean (size 1)")
+		}
+	case opIntEqual, opIntNotEqual, opIntSLess, opIntSLessEqual, opIntLess, opIntLessEqual, opIntCarry, opIntSCarry, opIntSBorrow,
+		opFloatEqual, opFloatNotEqual, opFloatLess, opFloatLessEqual:
+		if out, ok := size(op.output); ok && out != 0 && out != 1 {
+			fail("output must be a boolean (size 1)")
+			return
+		}
+		in0, ok1 := size(op.inputs[0])
+		in1, ok2 := size(op.inputs[1])
+		if ok1 && ok2 && in0 != 0 && in1 != 0 && in0 != in1 {
+			fail("inputs must be the same size")
+		}
+	case opBoolAnd, opBoolXor, opBoolOr, opBoolNegate:
+		if out, ok := size(op.output); ok && out != 0 && out != 1 {
+			fail("output must be a boolean (size 1)")
+			return
+		}
+		if in0, ok := size(op.inputs[0]); ok && in0 != 0 && in0 != 1 {
+			fail("input must be a boolean (size 1)")
+		}
+	case opIntLeft, opIntRight, opIntSRight:
+		out, ok1 := size(op.output)
+		in0, ok2 := size(op.inputs[0])
+		if ok1 && ok2 && out != 0 && in0 != 0 && out != in0 {
+			fail("output and first input must be the same size")
+		}
+	case opIntZExt, opIntSExt:
+		out, ok1 := size(op.output)
+		in0, ok2 := size(op.inputs[0])
+		if !ok1 || !ok2 || out == 0 || in0 == 0 {
+			return
+		}
+		if out == in0 {
+			op.code = opCopy
+		} else if out < in0 {
+			fail("output size must be strictly bigger than input size")
+		}
+	case opCBranch:
+		if in1, ok := size(op.inputs[1]); ok && in1 != 1 {
+			fail("parameter must be a boolean (size 1)")
+		}
+	case opLoad, opStore:
+		if op.inputs[0].offset.typ != constSpaceID {
+			return
+		}
+		if in1, ok := size(op.inputs[1]); ok && in1 != 0 && in1 != op.inputs[0].offset.space.size {
+			fail("pointer size must match size of space")
+		}
+	case opSubpiece:
+		out, ok1 := size(op.output)
+		in0, ok2 := size(op.inputs[0])
+		if !ok1 || !ok2 || out == 0 || in0 == 0 {
+			return
+		}
+		in1 := int(op.inputs[1].offset.val)
+		if in1 == 0 && out == in0 {
+			op.code = opCopy
+			op.inputs = op.inputs[:1]
+		} else if in1+out > in0 {
+			fail("too many bytes truncated")
+		}
+	}
+}
+
+// testTruncations checks the truncations of the operands of ct, whose
+// sizes are now known, and encodes them for the endianness.
+func (c *compiler) testTruncations(ct *constructor, tpl *constructTpl, sizemap map[*subtableSymbol]int) {
+	for _, op := range tpl.ops {
+		vns := op.inputs
+		if op.output != nil {
+			vns = append([]*varnodeTpl{op.output}, vns...)
+		}
+		for _, vn := range vns {
+			if vn.offset.typ != constHandle || vn.offset.sel != selOffsetPlus {
+				continue
+			}
+			if vn.size.typ != constReal && vn.size.typ != constHandle {
+				c.errorAt(ct.file, ct.line, "bad truncation expression")
+				continue
+			}
+			sz, err := recoverSize(handleConst(vn.offset.handle, selSize), ct, sizemap)
+			if err != nil || sz <= 0 {
+				c.errorAt(ct.file, ct.line, "could not recover size")
+				continue
+			}
+			if !c.adjustTruncation(vn, sz) {
+				c.errorAt(ct.file, ct.line, "truncation operator out of bounds")
+			}
+		}
+	}
+}
+
+// adjustTruncation checks that the truncation vn fits in the sz bytes of
+// the operand, and encodes the bytes it skips from the start of the
+// varnode in the low 16 bits of the addend.
+func (c *compiler) adjustTruncation(vn *varnodeTpl, sz int) bool {
+	if vn.size.typ != constReal {
+		return false
+	}
+	numBytes := int(vn.size.val)
+	byteOffset := int(vn.offset.val)
+	if numBytes+byteOffset > sz {
+		return false
+	}
+	val := uint64(byteOffset) << 16
+	if c.bigEndian {
+		val |= uint64(sz - (numBytes + byteOffset))
+	} else {
+		val |= uint64(byteOffset)
+	}
+	vn.offset.val = val
+	return true
+}
+
+// optimizeRecord counts the reads and writes of a temporary.
+type optimizeRecord struct {
+	writeOp, readOp           int
+	inSlot                    int
+	writeCount, readCount     int
+	writeSection, readSection int
+	optType                   int
+}
+
+func newOptimizeRecord() *optimizeRecord {
+	return &optimizeRecord{writeOp: -1, readOp: -1, inSlot: -1, writeSection: -2, readSection: -2, optType: -1}
+}
+
+// optimize drops the copies from or to the temporaries written and read
+// once, then reports the temporaries read but never written.
+func (c *compiler) optimize(ct *constructor) {
+	var recs map[uint64]*optimizeRecord
+	for {
+		recs = make(map[uint64]*optimizeRecord)
+		for i := -1; i < len(ct.namedTempl); i++ {
+			gatherTemps(ct, recs, i)
+			gatherExports(ct, recs, i)
+		}
+		rec, err := findValidRule(ct, recs)
+		if err != nil {
+			c.errorAt(ct.file, ct.line, "%v", err)
+			return
+		}
+		if rec == nil {
+			break
+		}
+		applyOptimization(ct, rec)
+	}
+	for _, off := range sortedOffsets(recs) {
+		if rec := recs[off]; rec.readCount != 0 && rec.writeCount == 0 {
+			c.errorAt(ct.file, ct.line, "temporary is read but not written")
+		}
+	}
+}
+
+func sortedOffsets(recs map[uint64]*optimizeRecord) []uint64 {
+	offs := make([]uint64, 0, len(recs))
+	for off := range recs {
+		offs = append(offs, off)
+	}
+	sort.Slice(offs, func(i, j int) bool { return offs[i] < offs[j] })
+	return offs
+}
+
+func isUniqueConst(ct constTpl) bool {
+	return ct.typ == constSpaceID && ct.space.typ == spaceUnique
+}
+
+func isConstSpace(ct constTpl) bool {
+	return ct.typ == constSpaceID && ct.space.typ == spaceConstant
+}
+
+func gatherTemps(ct *constructor, recs map[uint64]*optimizeRecord, section int) {
+	tpl := ct.section(section)
+	if tpl == nil {
+		return
+	}
+	examine := func(vn *varnodeTpl, i, slot int) {
+		if vn == nil || !isUniqueConst(vn.space) || vn.offset.typ != constReal {
+			return
+		}
+		rec, ok := recs[vn.offset.val]
+		if !ok {
+			rec = newOptimizeRecord()
+			recs[vn.offset.val] = rec
+		}
+		if slot >= 0 {
+			rec.readOp = i
+			rec.readCount++
+			rec.inSlot = slot
+			rec.readSection = section
+		} else {
+			rec.writeOp = i
+			rec.writeCount++
+			rec.writeSection = section
+		}
+	}
+	for i, op := range tpl.ops {
+		for j, in := range op.inputs {
+			examine(in, i, j)
+		}
+		examine(op.output, i, -1)
+	}
+}
+
+// gatherExports keeps the temporaries a constructor exports.
+func gatherExports(ct *constructor, recs map[uint64]*optimizeRecord, section int) {
+	tpl := ct.section(section)
+	if tpl == nil || tpl.result == nil {
+		return
+	}
+	hand := tpl.result
+	keep := func(off uint64) {
+		rec, ok := recs[off]
+		if !ok {
+			rec = newOptimizeRecord()
+			recs[off] = rec
+		}
+		rec.writeOp, rec.readOp = 0, 0
+		rec.writeCount, rec.readCount = 2, 2
+		rec.writeSection, rec.readSection = -2, -2
+	}
+	if isUniqueConst(hand.ptrSpace) && hand.ptrOffset.typ == constReal {
+		keep(hand.ptrOffset.val)
+	}
+	if isUniqueConst(hand.space) && hand.ptrSpace.typ == constReal && hand.ptrOffset.typ == constReal {
+		keep(hand.ptrOffset.val)
+	}
+}
+
+// findValidRule returns a temporary written then read once, by ops of
+// which one is a copy nothing in between interferes with.
+func findValidRule(ct *constructor, recs map[uint64]*optimizeRecord) (*optimizeRecord, error) {
+	for _, off := range sortedOffsets(recs) {
+		rec := recs[off]
+		if rec.writeCount != 1 || rec.readCount != 1 || rec.readSection != rec.writeSection {
+			continue
+		}
+		ops := ct.section(rec.readSection).ops
+		if rec.writeOp >= rec.readOp {
+			return nil, fmt.Errorf("read of temporary before write")
+		}
+		if op := ops[rec.readOp]; op.code == opCopy {
+			rec.optType = 0
+			if !interferes(op.output, ops[rec.writeOp+1:rec.readOp], true) {
+				return rec, nil
+			}
+		}
+		if op := ops[rec.writeOp]; op.code == opCopy {
+			rec.optType = 1
+			if !interferes(op.inputs[0], ops[rec.writeOp+1:rec.readOp], false) {
+				return rec, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func interferes(vn *varnodeTpl, ops []*opTpl, checkRead bool) bool {
+	for _, op := range ops {
+		if readWriteInterference(vn, op, checkRead) {
+			return true
+		}
+	}
+	return false
+}
+
+func readWriteInterference(vn *varnodeTpl, op *opTpl, checkRead bool) bool {
+	switch op.code {
+	case opBuild, opCrossBuild, opDelaySlot, opMacroBuild, opLoad, opStore, opBranch, opCBranch,
+		opBranchInd, opCall, opCallInd, opCallOther, opReturn, opLabelBuild:
+		return true
+	}
+	if checkRead {
+		for _, in := range op.inputs {
+			if possibleIntersection(vn, in) {
+				return true
+			}
+		}
+	}
+	return op.output != nil && possibleIntersection(vn, op.output)
+}
+
+// possibleIntersection reports whether the varnodes may overlap.
+func possibleIntersection(a, b *varnodeTpl) bool {
+	if isConstSpace(a.space) || isConstSpace(b.space) {
+		return false
+	}
+	if isUniqueConst(a.space) != isUniqueConst(b.space) {
+		return false
+	}
+	if a.space.typ != constSpaceID || b.space.typ != constSpaceID {
+		return true
+	}
+	if a.space.space != b.space.space {
+		return false
+	}
+	if a.offset.typ != constReal || a.size.typ != constReal || b.offset.typ != constReal || b.size.typ != constReal {
+		return true
+	}
+	if b.offset.val+b.size.val-1 < a.offset.val {
+		return false
+	}
+	return b.offset.val <= a.offset.val+a.size.val-1
+}
+
+func applyOptimization(ct *constructor, rec *optimizeRecord) {
+	tpl := ct.section(rec.readSection)
+	del := rec.writeOp
+	if rec.optType == 0 {
+		tpl.ops[rec.writeOp].output = tpl.ops[rec.readOp].output.clone()
+		del = rec.readOp
+	} else {
+		tpl.ops[rec.readOp].inputs[rec.inSlot] = tpl.ops[rec.writeOp].inputs[0].clone()
+	}
+	tpl.ops = append(tpl.ops[:del], tpl.ops[del+1:]...)
+}
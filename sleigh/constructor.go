@@ -0,0 +1,736 @@
+package sleigh
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"sync"
+)
+
+// printPiece is a piece of the display of a constructor: text, or the
+// operand printed there.
+type printPiece struct {
+	text    string
+	operand int // -1 for text
+}
+
+// constructor is a pattern of a subtable with its display, operands and
+// semantics.
+type constructor struct {
+	parent          *subtableSymbol
+	id              int
+	operands        []*operandSymbol
+	print           []printPiece
+	firstWhitespace int
+	minLength       int
+	file            string
+	source, line    int
+
+	pateq      equation
+	pattern    *tokenPattern
+	context    []contextChange
+	templ      *constructTpl
+	namedTempl []*constructTpl
+}
+
+func newConstructor(parent *subtableSymbol) *constructor {
+	ct := &constructor{parent: parent, id: len(parent.constructors), firstWhitespace: -1}
+	parent.constructors = append(parent.constructors, ct)
+	return ct
+}
+
+// addSyntax appends text to the display, collapsing the whitespace.
+func (ct *constructor) addSyntax(syn string) {
+	if syn == "" {
+		return
+	}
+	hasNonSpace := false
+	for i := 0; i < len(syn); i++ {
+		if syn[i] != ' ' {
+			hasNonSpace = true
+			break
+		}
+	}
+	if !hasNonSpace {
+		syn = " "
+	}
+	if ct.firstWhitespace == -1 && syn == " " {
+		ct.firstWhitespace = len(ct.print)
+	}
+	n := len(ct.print)
+	switch {
+	case n == 0:
+		ct.print = append(ct.print, printPiece{text: syn, operand: -1})
+	case ct.print[n-1].operand == -1 && ct.print[n-1].text == " " && syn == " ":
+	case ct.print[n-1].operand != -1 || ct.print[n-1].text == " " || syn == " ":
+		ct.print = append(ct.print, printPiece{text: syn, operand: -1})
+	default:
+		ct.print[n-1].text += syn
+	}
+}
+
+// addOperand appends an operand to the operands and the display.
+func (ct *constructor) addOperand(sym *operandSymbol) {
+	ct.print = append(ct.print, printPiece{operand: len(ct.operands)})
+	ct.operands = append(ct.operands, sym)
+}
+
+func (ct *constructor) removeTrailingSpace() {
+	if n := len(ct.print); n != 0 && ct.print[n-1].operand == -1 && ct.print[n-1].text == " " {
+		ct.print = ct.print[:n-1]
+	}
+}
+
+// section returns the semantics of section i, -1 for the main one.
+func (ct *constructor) section(i int) *constructTpl {
+	if i < 0 {
+		return ct.templ
+	}
+	if i < len(ct.namedTempl) {
+		return ct.namedTempl[i]
+	}
+	return nil
+}
+
+func (ct *constructor) setNamedSection(tpl *constructTpl, i int) {
+	for len(ct.namedTempl) <= i {
+		ct.namedTempl = append(ct.namedTempl, nil)
+	}
+	ct.namedTempl[i] = tpl
+}
+
+// markSubtableOperands returns the check list of fillinBuild: 0 for the
+// subtable operands, 2 for the others.
+func (ct *constructor) markSubtableOperands() []int {
+	check := make([]int, len(ct.operands))
+	for i, op := range ct.operands {
+		if _, ok := op.triple.(*subtableSymbol); !ok {
+			check[i] = 2
+		}
+	}
+	return check
+}
+
+// buildPattern builds the pattern of ct from its equation and the patterns
+// of its operands, and lays out the operands.
+func (c *compiler) buildPattern(ct *constructor) error {
+	if ct.pattern != nil {
+		return nil
+	}
+	var oppattern []tokenPattern
+	recursion := false
+	for _, sym := range ct.operands {
+		switch {
+		case sym.triple != nil:
+			if sub, ok := sym.triple.(*subtableSymbol); ok {
+				if sub.beingBuilt {
+					if recursion {
+						return fmt.Errorf("illegal recursion")
+					}
+					recursion = true
+					oppattern = append(oppattern, newTruePattern())
+				} else {
+					oppattern = append(oppattern, *c.buildTablePattern(sub))
+				}
+			} else {
+				expr, err := patternExprOf(sym.triple)
+				if err != nil {
+					return err
+				}
+				oppattern = append(oppattern, minPattern(expr, oppattern))
+			}
+		case sym.defexp != nil:
+			oppattern = append(oppattern, minPattern(sym.defexp, oppattern))
+		default:
+			return fmt.Errorf("%s: operand is undefined", sym.name)
+		}
+		pat := oppattern[len(oppattern)-1]
+		sym.minLength = pat.minimumLength()
+		if pat.leftEllipsis || pat.rightEllipsis {
+			sym.variableLength = true
+		}
+	}
+
+	if ct.pateq == nil {
+		return fmt.Errorf("missing equation")
+	}
+	if err := ct.pateq.genPattern(oppattern); err != nil {
+		return err
+	}
+	pat := ct.pateq.tokenPattern()
+	pat.pattern = pat.pattern.simplifyClone()
+	if pat.alwaysFalse() {
+		return fmt.Errorf("impossible pattern")
+	}
+	if recursion {
+		pat.rightEllipsis = true
+	}
+	ct.pattern = &pat
+	ct.minLength = pat.minimumLength()
+
+	state := &operandResolve{operands: ct.operands, base: -1, rightmost: -1}
+	if !ct.pateq.resolveOperandLeft(state) {
+		return fmt.Errorf("unable to resolve operand offsets")
+	}
+	// make the offsets absolute where the operands in between have a fixed
+	// length
+	for _, op := range ct.operands {
+		if op.offsetIrrelevant {
+			op.offsetBase = -1
+			op.relOffset = 0
+			continue
+		}
+		base, offset := op.offsetBase, op.relOffset
+		for base >= 0 {
+			sym := ct.operands[base]
+			if sym.variableLength {
+				break
+			}
+			base = sym.offsetBase
+			offset += sym.minLength + sym.relOffset
+			if base < 0 {
+				op.offsetBase = base
+				op.relOffset = offset
+			}
+		}
+	}
+
+	for _, ch := range ct.context {
+		if err := ch.validate(); err != nil {
+			return err
+		}
+	}
+	return ct.orderOperands()
+}
+
+// orderOperands orders the operands so that each comes after the operand
+// its offset is relative to, the ones without offset last, and renumbers
+// their references.
+func (ct *constructor) orderOperands() error {
+	order := ct.pateq.operandOrder(ct, nil)
+	for _, sym := range ct.operands {
+		if !sym.mark {
+			order = append(order, sym)
+			sym.mark = true
+		}
+	}
+	var newops []*operandSymbol
+	for {
+		last := len(newops)
+		for _, sym := range order {
+			if !sym.mark || sym.offsetIrrelevant {
+				continue
+			}
+			if sym.offsetBase == -1 || !ct.operands[sym.offsetBase].mark {
+				newops = append(newops, sym)
+				sym.mark = false
+			}
+		}
+		if len(newops) == last {
+			break
+		}
+	}
+	for _, sym := range order {
+		if sym.offsetIrrelevant {
+			newops = append(newops, sym)
+			sym.mark = false
+		}
+	}
+	if len(newops) != len(ct.operands) {
+		return fmt.Errorf("circular offset dependency between operands")
+	}
+
+	for i, sym := range newops {
+		sym.index = i
+	}
+	handmap := make([]int, len(ct.operands))
+	for i, sym := range ct.operands {
+		handmap[i] = sym.index
+	}
+	for _, sym := range newops {
+		if sym.offsetBase != -1 {
+			sym.offsetBase = handmap[sym.offsetBase]
+		}
+	}
+	if ct.templ != nil {
+		ct.templ.changeHandleIndex(handmap)
+	}
+	for _, tpl := range ct.namedTempl {
+		if tpl != nil {
+			tpl.changeHandleIndex(handmap)
+		}
+	}
+	for i := range ct.print {
+		if op := ct.print[i].operand; op != -1 {
+			ct.print[i].operand = handmap[op]
+		}
+	}
+	ct.operands = newops
+	return nil
+}
+
+func (ct *constructor) encode(e *encoder) {
+	e.open(elemConstructor)
+	e.unsigned(attribParent, uint64(ct.parent.id))
+	e.signed(attribFirst, int64(ct.firstWhitespace))
+	e.signed(attribLength, int64(ct.minLength))
+	e.signed(attribSource, int64(ct.source))
+	e.signed(attribLine, int64(ct.line))
+	for _, op := range ct.operands {
+		e.open(elemOper)
+		e.unsigned(attribID, uint64(op.id))
+		e.close(elemOper)
+	}
+	for _, p := range ct.print {
+		if p.operand != -1 {
+			e.open(elemOpPrint)
+			e.signed(attribID, int64(p.operand))
+			e.close(elemOpPrint)
+		} else {
+			e.open(elemPrint)
+			e.string(attribPiece, p.text)
+			e.close(elemPrint)
+		}
+	}
+	for _, ch := range ct.context {
+		ch.encode(e)
+	}
+	if ct.templ != nil {
+		ct.templ.encode(e, -1)
+	}
+	for i, tpl := range ct.namedTempl {
+		if tpl != nil {
+			tpl.encode(e, i)
+		}
+	}
+	e.close(elemConstructor)
+}
+
+// buildTablePattern builds the patterns of the constructors of t, and the
+// pattern common to them. The errors are reported per constructor.
+func (c *compiler) buildTablePattern(t *subtableSymbol) *tokenPattern {
+	if t.pattern != nil {
+		return t.pattern
+	}
+	t.beingBuilt = true
+	t.pattern = &tokenPattern{pattern: newInstructionPattern(true)}
+	if len(t.constructors) == 0 {
+		c.errorf("there are no constructors in table: %s", t.name)
+		t.errors = true
+		return t.pattern
+	}
+	for i, ct := range t.constructors {
+		if err := c.buildPattern(ct); err != nil {
+			c.errorAt(ct.file, ct.line, "%v", err)
+			t.errors = true
+			continue
+		}
+		if i == 0 {
+			pat := *ct.pattern
+			t.pattern = &pat
+			continue
+		}
+		pat, err := ct.pattern.commonSubPattern(*t.pattern)
+		if err != nil {
+			c.errorAt(ct.file, ct.line, "%v", err)
+			t.errors = true
+			continue
+		}
+		t.pattern = &pat
+	}
+	t.beingBuilt = false
+	return t.pattern
+}
+
+// patternExprOf returns the expression a symbol stands for in a pattern
+// expression.
+func patternExprOf(sym symbol) (patternExpr, error) {
+	switch s := sym.(type) {
+	case familySymbol:
+		return s.patternValue(), nil
+	case *varnodeSymbol, *epsilonSymbol:
+		return &constantValue{}, nil
+	case *addressSymbol:
+		return s.patexp, nil
+	case *operandSymbol:
+		return s.local, nil
+	}
+	return nil, fmt.Errorf("cannot use symbol '%s' in a pattern expression", sym.base().name)
+}
+
+// contextChange is a change of the context by a constructor.
+type contextChange interface {
+	validate() error
+	encode(e *encoder)
+}
+
+// maskWord returns the word of the packed context holding the bits sbit to
+// ebit, their shift and their mask.
+func maskWord(sbit, ebit int) (num, shift int, mask uint32, err error) {
+	num = sbit / 32
+	if num != ebit/32 {
+		return 0, 0, 0, fmt.Errorf("context field not contained within one machine int")
+	}
+	sbit -= num * 32
+	ebit -= num * 32
+	shift = 32 - ebit - 1
+	mask = ^uint32(0) >> uint(sbit+shift)
+	mask <<= uint(shift)
+	return num, shift, mask, nil
+}
+
+// contextOp sets a context field to an expression while the instruction is
+// decoded.
+type contextOp struct {
+	num, shift int
+	mask       uint32
+	expr       patternExpr
+}
+
+func (o *contextOp) validate() error {
+	for _, v := range o.expr.listValues(nil) {
+		if ov, ok := v.(*operandValue); ok && ov.op.offsetBase != -1 {
+			return fmt.Errorf("%s: cannot be used in context expression", ov.op.name)
+		}
+	}
+	return nil
+}
+
+func (o *contextOp) encode(e *encoder) {
+	e.open(elemContextOp)
+	e.signed(attribI, int64(o.num))
+	e.signed(attribShift, int64(o.shift))
+	e.unsigned(attribMask, uint64(o.mask))
+	o.expr.encode(e)
+	e.close(elemContextOp)
+}
+
+// contextCommit makes a context field change from the address of sym on,
+// for globalset.
+type contextCommit struct {
+	sym  symbol
+	num  int
+	mask uint32
+	flow bool
+}
+
+func (o *contextCommit) validate() error { return nil }
+
+func (o *contextCommit) encode(e *encoder) {
+	e.open(elemCommit)
+	e.unsigned(attribID, uint64(o.sym.base().id))
+	e.signed(attribNumber, int64(o.num))
+	e.unsigned(attribMask, uint64(o.mask))
+	e.bool(attribFlow, o.flow)
+	e.close(elemCommit)
+}
+
+// decisionPair is a disjoint pattern of a constructor.
+type decisionPair struct {
+	pat disjointPattern
+	ct  *constructor
+}
+
+// decisionNode selects the constructor matching an instruction by the
+// value of a field of the instruction or the context, down to a list of
+// patterns tried in order.
+type decisionNode struct {
+	parent   *decisionNode
+	list     []decisionPair
+	children []*decisionNode
+	num      int
+	context  bool
+	startBit int
+	bitSize  int
+}
+
+// decisionErrors collects the constructors whose patterns cannot be told
+// apart.
+type decisionErrors struct {
+	identical   [][2]*constructor
+	conflicting [][2]*constructor
+	failures    []error
+}
+
+func (t *subtableSymbol) buildDecisionTree(errs *decisionErrors) {
+	if t.pattern == nil {
+		return
+	}
+	t.decision = &decisionNode{}
+	for _, ct := range t.constructors {
+		if ct.pattern == nil {
+			continue
+		}
+		pat := ct.pattern.pattern
+		if ds := pat.disjoints(); len(ds) != 0 {
+			for _, d := range ds {
+				t.decision.add(d, ct)
+			}
+		} else {
+			t.decision.add(pat.(disjointPattern), ct)
+		}
+	}
+	t.decision.split(errs)
+}
+
+func (n *decisionNode) add(pat disjointPattern, ct *constructor) {
+	n.list = append(n.list, decisionPair{pat: pat.simplifyClone().(disjointPattern), ct: ct})
+	n.num++
+}
+
+func (n *decisionNode) maximumLength(context bool) int {
+	max := 0
+	for _, p := range n.list {
+		if l := disjointLength(p.pat, context); l > max {
+			max = l
+		}
+	}
+	return max
+}
+
+// numFixed returns the number of patterns fixing every bit of the field.
+func (n *decisionNode) numFixed(low, size int, context bool) int {
+	m := uint32(1)<<uint(size) - 1
+	if size == 32 {
+		m = ^uint32(0)
+	}
+	count := 0
+	for _, p := range n.list {
+		if disjointMask(p.pat, low, size, context)&m == m {
+			count++
+		}
+	}
+	return count
+}
+
+// score returns the entropy of the values of the field over the patterns
+// fixing it, -1 if the field does not split them.
+func (n *decisionNode) score(low, size int, context bool) float64 {
+	m := uint32(1)<<uint(size) - 1
+	count := make([]int, 1<<uint(size))
+	total := 0
+	for _, p := range n.list {
+		if disjointMask(p.pat, low, size, context)&m != m {
+			continue
+		}
+		count[disjointValue(p.pat, low, size, context)]++
+		total++
+	}
+	if total <= 0 {
+		return -1
+	}
+	sc := 0.0
+	for _, c := range count {
+		if c <= 0 {
+			continue
+		}
+		if c >= len(n.list) {
+			return -1
+		}
+		p := float64(c) / float64(total)
+		sc -= p * roundedLog(p)
+	}
+	return sc / math.Ln2
+}
+
+var logCache sync.Map // float64 -> float64
+
+// roundedLog returns the natural logarithm of x in (0, 1] correctly
+// rounded, so that the choice between fields that split the patterns
+// alike does not depend on the last bit of math.Log.
+func roundedLog(x float64) float64 {
+	if x == 1 {
+		return 0
+	}
+	if v, ok := logCache.Load(x); ok {
+		return v.(float64)
+	}
+	const prec = 256
+	m := new(big.Float).SetPrec(prec)
+	e := new(big.Float).SetPrec(prec).SetFloat64(x).MantExp(m)
+	res := new(big.Float).SetPrec(prec).SetInt64(int64(e))
+	res.Mul(res, bigLog(new(big.Float).SetPrec(prec).SetInt64(2)))
+	res.Add(res, bigLog(m))
+	v, _ := res.Float64()
+	logCache.Store(x, v)
+	return v
+}
+
+// bigLog returns the natural logarithm of m, for m in [0.5, 2], as the
+// series of 2*atanh((m-1)/(m+1)).
+func bigLog(m *big.Float) *big.Float {
+	prec := m.Prec()
+	one := new(big.Float).SetPrec(prec).SetInt64(1)
+	z := new(big.Float).SetPrec(prec).Sub(m, one)
+	z.Quo(z, new(big.Float).SetPrec(prec).Add(m, one))
+	z2 := new(big.Float).SetPrec(prec).Mul(z, z)
+	sum := new(big.Float).SetPrec(prec).Set(z)
+	pow := new(big.Float).SetPrec(prec).Set(z)
+	limit := new(big.Float).SetMantExp(one, -int(prec))
+	term := new(big.Float).SetPrec(prec)
+	for k := int64(3); ; k += 2 {
+		pow.Mul(pow, z2)
+		term.Quo(pow, new(big.Float).SetPrec(prec).SetInt64(k))
+		if term.Sign() == 0 || new(big.Float).Abs(term).Cmp(limit) < 0 {
+			break
+		}
+		sum.Add(sum, term)
+	}
+	return sum.Mul(sum, new(big.Float).SetPrec(prec).SetInt64(2))
+}
+
+// chooseOptimalField picks the field fixed by the most patterns, and of
+// these the one splitting them best.
+func (n *decisionNode) chooseOptimalField() {
+	score := 0.0
+	maxfixed := 1
+	for _, context := range []bool{true, false} {
+		maxlength := 8 * n.maximumLength(context)
+		for sbit := 0; sbit < maxlength; sbit++ {
+			numfixed := n.numFixed(sbit, 1, context)
+			if numfixed < maxfixed {
+				continue
+			}
+			sc := n.score(sbit, 1, context)
+			if numfixed > maxfixed && sc > 0 || sc > score {
+				maxfixed = numfixed
+				score = sc
+				n.startBit = sbit
+				n.bitSize = 1
+				n.context = context
+			}
+		}
+	}
+	for _, context := range []bool{true, false} {
+		maxlength := 8 * n.maximumLength(context)
+		for size := 2; size <= 8; size++ {
+			for sbit := 0; sbit < maxlength-size+1; sbit++ {
+				if n.numFixed(sbit, size, context) < maxfixed {
+					continue
+				}
+				if sc := n.score(sbit, size, context); sc > score {
+					score = sc
+					n.startBit = sbit
+					n.bitSize = size
+					n.context = context
+				}
+			}
+		}
+	}
+	if score <= 0 {
+		n.bitSize = 0
+	}
+}
+
+// consistentValues returns the values of the field pat matches.
+func (n *decisionNode) consistentValues(pat disjointPattern) []uint32 {
+	m := uint32(1)<<uint(n.bitSize) - 1
+	commonMask := m & disjointMask(pat, n.startBit, n.bitSize, n.context)
+	commonValue := commonMask & disjointValue(pat, n.startBit, n.bitSize, n.context)
+	dontCare := m ^ commonMask
+	var bins []uint32
+	for i := uint32(0); i <= dontCare; i++ {
+		if i&dontCare == i {
+			bins = append(bins, commonValue|i)
+		}
+	}
+	return bins
+}
+
+func (n *decisionNode) split(errs *decisionErrors) {
+	if len(n.list) <= 1 {
+		n.bitSize = 0
+		return
+	}
+	n.chooseOptimalField()
+	if n.bitSize == 0 {
+		n.orderPatterns(errs)
+		return
+	}
+	if n.parent != nil && len(n.list) >= n.parent.num {
+		errs.failures = append(errs.failures, fmt.Errorf("child has as many patterns as parent"))
+		return
+	}
+	n.children = make([]*decisionNode, 1<<uint(n.bitSize))
+	for i := range n.children {
+		n.children[i] = &decisionNode{parent: n}
+	}
+	for _, p := range n.list {
+		for _, v := range n.consistentValues(p.pat) {
+			n.children[v].add(p.pat, p.ct)
+		}
+	}
+	n.list = nil
+	for _, child := range n.children {
+		child.split(errs)
+	}
+}
+
+// orderPatterns sorts the patterns a node cannot tell apart so that the
+// more specific ones are tried first, and records the pairs of patterns
+// neither of which is more specific, unless another pattern matches their
+// intersection.
+func (n *decisionNode) orderPatterns(errs *decisionErrors) {
+	for i := range n.list {
+		for j := 0; j < i; j++ {
+			if identical(n.list[i].pat, n.list[j].pat) {
+				errs.identical = append(errs.identical, [2]*constructor{n.list[i].ct, n.list[j].ct})
+			}
+		}
+	}
+
+	newlist := append([]decisionPair(nil), n.list...)
+	var conflicts []decisionPair
+	for i := range n.list {
+		j := 0
+		for ; j < i; j++ {
+			ipat, jpat := newlist[i].pat, n.list[j].pat
+			if specializes(ipat, jpat) {
+				break
+			}
+			if !specializes(jpat, ipat) {
+				if newlist[i].ct == n.list[j].ct {
+					continue
+				}
+				conflicts = append(conflicts, newlist[i], n.list[j])
+			}
+		}
+		copy(n.list[j+1:i+1], n.list[j:i])
+		n.list[j] = newlist[i]
+	}
+
+	for i := 0; i < len(conflicts); i += 2 {
+		a, b := conflicts[i], conflicts[i+1]
+		resolved := false
+		for _, p := range n.list {
+			if p == a || p == b {
+				break
+			}
+			if resolvesIntersect(p.pat, a.pat, b.pat) {
+				resolved = true
+				break
+			}
+		}
+		if !resolved {
+			errs.conflicting = append(errs.conflicting, [2]*constructor{a.ct, b.ct})
+		}
+	}
+}
+
+func (n *decisionNode) encode(e *encoder) {
+	e.open(elemDecision)
+	e.signed(attribNumber, int64(n.num))
+	e.bool(attribContext, n.context)
+	e.signed(attribStartBit, int64(n.startBit))
+	e.signed(attribSize, int64(n.bitSize))
+	for _, p := range n.list {
+		e.open(elemPair)
+		e.signed(attribID, int64(p.ct.id))
+		p.pat.encode(e)
+		e.close(elemPair)
+	}
+	for _, child := range n.children {
+		child.encode(e)
+	}
+	e.close(elemDecision)
+}
@@ -0,0 +1,271 @@
+package sleigh
+
+import (
+	"bytes"
+	"compress/zlib"
+)
+
+// Element and attribute ids of the compiled format, the ones of Ghidra's
+// slaformat.cc.
+const (
+	elemConstReal = iota + 1
+	elemVarnodeTpl
+	elemConstSpaceID
+	elemConstHandle
+	elemOpTpl
+	elemMaskWord
+	elemPatBlock
+	elemPrint
+	elemPair
+	elemContextPat
+	elemNull
+	elemOperandExp
+	elemOperandSym
+	elemOperandSymHead
+	elemOper
+	elemDecision
+	elemOpPrint
+	elemInstructPat
+	elemCombinePat
+	elemConstructor
+	elemConstructTpl
+	elemScope
+	elemVarnodeSym
+	elemVarnodeSymHead
+	elemUserOp
+	elemUserOpHead
+	elemTokenField
+	elemVar
+	elemContextField
+	elemHandleTpl
+	elemConstRelative
+	elemContextOp
+	elemSleigh
+	elemSpaces
+	elemSourceFiles
+	elemSourceFile
+	elemSpace
+	elemSymbolTable
+	elemValueSym
+	elemValueSymHead
+	elemContextSym
+	elemContextSymHead
+	elemEndSym
+	elemEndSymHead
+	elemSpaceOther
+	elemSpaceUnique
+	elemAndExp
+	elemDivExp
+	elemLshiftExp
+	elemMinusExp
+	elemMultExp
+	elemNotExp
+	elemOrExp
+	elemPlusExp
+	elemRshiftExp
+	elemSubExp
+	elemXorExp
+	elemIntb
+	elemEndExp
+	elemNext2Exp
+	elemStartExp
+	elemEpsilonSym
+	elemEpsilonSymHead
+	elemNameSym
+	elemNameSymHead
+	elemNameTab
+	elemNext2Sym
+	elemNext2SymHead
+	elemStartSym
+	elemStartSymHead
+	elemSubtableSym
+	elemSubtableSymHead
+	elemValueMapSym
+	elemValueMapSymHead
+	elemValueTab
+	elemVarListSym
+	elemVarListSymHead
+	elemOrPat
+	elemCommit
+	elemConstStart
+	elemConstNext
+	elemConstNext2
+	elemConstCurSpace
+	elemConstCurSpaceSize
+	elemConstFlowRef
+	elemConstFlowRefSize
+	elemConstFlowDest
+	elemConstFlowDestSize
+)
+
+const (
+	attribVal = iota + 2
+	attribID
+	attribSpace
+	attribS
+	attribOff
+	attribCode
+	attribMask
+	attribIndex
+	attribNonzero
+	attribPiece
+	attribName
+	attribScope
+	attribStartBit
+	attribSize
+	attribTable
+	attribCt
+	attribMinLen
+	attribBase
+	attribNumber
+	attribContext
+	attribParent
+	attribSubSym
+	attribLine
+	attribSource
+	attribLength
+	attribFirst
+	attribPlus
+	attribShift
+	attribEndBit
+	attribSignBit
+	attribEndByte
+	attribStartByte
+	attribVersion
+	attribBigEndian
+	attribAlign
+	attribUniqBase
+	attribMaxDelay
+	attribUniqMask
+	attribNumSections
+	attribDefaultSpace
+	attribDelay
+	attribWordSize
+	attribPhysical
+	attribScopeSize
+	attribSymbolSize
+	attribVarnode
+	attribLow
+	attribHigh
+	attribFlow
+	attribContain
+	attribI
+	attribNumCt
+	attribSection
+	attribLabels
+)
+
+// formatVersion is the version of the compiled format.
+const formatVersion = 4
+
+// Header bytes and value types of the packed encoding, see Ghidra's
+// marshal.cc.
+const (
+	packedElementStart = 0x40
+	packedElementEnd   = 0x80
+	packedAttribute    = 0xc0
+	packedExtension    = 0x20
+	packedRawMarker    = 0x80
+	packedRawBits      = 7
+	packedRawMask      = 0x7f
+
+	packedTypeBool           = 1
+	packedTypeSignedPositive = 2
+	packedTypeSignedNegative = 3
+	packedTypeUnsigned       = 4
+	packedTypeAddressSpace   = 5
+	packedTypeString         = 7
+)
+
+// encoder writes the packed encoding of the specification.
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) header(kind byte, id int) {
+	if id > 0x1f {
+		e.buf.WriteByte(kind | packedExtension | byte(id>>packedRawBits))
+		e.buf.WriteByte(byte(id&packedRawMask) | packedRawMarker)
+		return
+	}
+	e.buf.WriteByte(kind | byte(id))
+}
+
+func (e *encoder) integer(typ byte, v uint64) {
+	n := 1
+	for x := v >> packedRawBits; x != 0; x >>= packedRawBits {
+		n++
+	}
+	if v == 0 {
+		n = 0
+	}
+	e.buf.WriteByte(typ<<4 | byte(n))
+	for sa := (n - 1) * packedRawBits; sa >= 0; sa -= packedRawBits {
+		e.buf.WriteByte(byte(v>>uint(sa))&packedRawMask | packedRawMarker)
+	}
+}
+
+func (e *encoder) open(elem int) {
+	e.header(packedElementStart, elem)
+}
+
+func (e *encoder) close(elem int) {
+	e.header(packedElementEnd, elem)
+}
+
+// empty writes an element without attributes or children.
+func (e *encoder) empty(elem int) {
+	e.open(elem)
+	e.close(elem)
+}
+
+func (e *encoder) bool(attrib int, v bool) {
+	e.header(packedAttribute, attrib)
+	b := byte(packedTypeBool << 4)
+	if v {
+		b |= 1
+	}
+	e.buf.WriteByte(b)
+}
+
+func (e *encoder) signed(attrib int, v int64) {
+	e.header(packedAttribute, attrib)
+	if v < 0 {
+		e.integer(packedTypeSignedNegative, uint64(-v))
+		return
+	}
+	e.integer(packedTypeSignedPositive, uint64(v))
+}
+
+func (e *encoder) unsigned(attrib int, v uint64) {
+	e.header(packedAttribute, attrib)
+	e.integer(packedTypeUnsigned, v)
+}
+
+func (e *encoder) string(attrib int, s string) {
+	e.header(packedAttribute, attrib)
+	e.integer(packedTypeString, uint64(len(s)))
+	e.buf.WriteString(s)
+}
+
+func (e *encoder) space(attrib int, spc *space) {
+	e.header(packedAttribute, attrib)
+	e.integer(packedTypeAddressSpace, uint64(spc.index))
+}
+
+// bytes returns the compiled specification: "sla", the format version and
+// the zlib compressed encoding.
+func (e *encoder) bytes() ([]byte, error) {
+	var out bytes.Buffer
+	out.WriteString("sla")
+	out.WriteByte(formatVersion)
+
+	zw := zlib.NewWriter(&out)
+	if _, err := zw.Write(e.buf.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,379 @@
+package sleigh
+
+import "fmt"
+
+// operandResolve is the state of resolveOperandLeft, walking an equation
+// from left to right.
+type operandResolve struct {
+	operands []*operandSymbol
+	base     int // operand the offset is relative to, -1 for the start, -2 for none
+	offset   int // bytes from the start of base
+	// rightmost is the rightmost operand seen and size the bytes traversed
+	// since it, -1 when unknown.
+	rightmost int
+	size      int
+}
+
+// equation is the pattern of a constructor: constraints on fields combined
+// with '&', '|' and ';'.
+type equation interface {
+	genPattern(ops []tokenPattern) error
+	tokenPattern() tokenPattern
+	// resolveOperandLeft sets the offset of the operands relative to the
+	// operand to their left.
+	resolveOperandLeft(state *operandResolve) bool
+	operandOrder(ct *constructor, order []*operandSymbol) []*operandSymbol
+}
+
+// operandEquation is an operand in the pattern.
+type operandEquation struct {
+	index  int
+	result tokenPattern
+}
+
+func (q *operandEquation) genPattern(ops []tokenPattern) error {
+	q.result = ops[q.index]
+	return nil
+}
+
+func (q *operandEquation) tokenPattern() tokenPattern { return q.result }
+
+func (q *operandEquation) resolveOperandLeft(state *operandResolve) bool {
+	sym := state.operands[q.index]
+	if sym.offsetIrrelevant {
+		sym.offsetBase = -1
+		sym.relOffset = 0
+		return true
+	}
+	if state.base == -2 {
+		return false
+	}
+	sym.offsetBase = state.base
+	sym.relOffset = state.offset
+	state.rightmost = q.index
+	state.size = 0
+	return true
+}
+
+func (q *operandEquation) operandOrder(ct *constructor, order []*operandSymbol) []*operandSymbol {
+	sym := ct.operands[q.index]
+	if !sym.mark {
+		order = append(order, sym)
+		sym.mark = true
+	}
+	return order
+}
+
+// unconstrainedEquation is a symbol without operand in the pattern, e.g.
+// epsilon.
+type unconstrainedEquation struct {
+	expr   patternExpr
+	result tokenPattern
+}
+
+func (q *unconstrainedEquation) genPattern(ops []tokenPattern) error {
+	q.result = minPattern(q.expr, ops)
+	return nil
+}
+
+func (q *unconstrainedEquation) tokenPattern() tokenPattern { return q.result }
+
+func (q *unconstrainedEquation) resolveOperandLeft(state *operandResolve) bool {
+	state.rightmost = -1
+	state.size = q.result.minimumLength()
+	return true
+}
+
+func (q *unconstrainedEquation) operandOrder(ct *constructor, order []*operandSymbol) []*operandSymbol {
+	return order
+}
+
+// minPattern returns the pattern an expression requires at least: the
+// tokens of its fields.
+func minPattern(p patternExpr, ops []tokenPattern) tokenPattern {
+	if v, ok := p.(patternValue); ok {
+		return v.genMinPattern(ops)
+	}
+	return newTruePattern()
+}
+
+type compareOp int
+
+const (
+	cmpEqual compareOp = iota
+	cmpNotEqual
+	cmpLess
+	cmpLessEqual
+	cmpGreater
+	cmpGreaterEqual
+)
+
+var compareNames = [...]string{
+	cmpEqual:        "Equal",
+	cmpNotEqual:     "Notequal",
+	cmpLess:         "Less",
+	cmpLessEqual:    "Less or equal",
+	cmpGreater:      "Greater",
+	cmpGreaterEqual: "Greater or equal",
+}
+
+// compareEquation constrains a field against an expression.
+type compareEquation struct {
+	op     compareOp
+	lhs    patternValue
+	rhs    patternExpr
+	result tokenPattern
+}
+
+func (q *compareEquation) holds(lhs, rhs int64) bool {
+	switch q.op {
+	case cmpNotEqual:
+		return lhs != rhs
+	case cmpLess:
+		return lhs < rhs
+	case cmpLessEqual:
+		return lhs <= rhs
+	case cmpGreater:
+		return lhs > rhs
+	case cmpGreaterEqual:
+		return lhs >= rhs
+	}
+	return lhs == rhs
+}
+
+// genPattern ors the patterns of every combination of the values of the
+// fields of the expression with the values of the field it satisfies.
+func (q *compareEquation) genPattern(ops []tokenPattern) error {
+	lhsmin, lhsmax := q.lhs.minValue(), q.lhs.maxValue()
+	semval := q.rhs.listValues(nil)
+	min, max := q.rhs.getMinMax(nil, nil)
+	cur := append([]int64(nil), min...)
+
+	count := 0
+	add := func(lhsval int64) error {
+		pat, err := buildConstraint(q.lhs, lhsval, semval, cur)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			q.result = pat
+		} else if q.result, err = q.result.doOr(pat); err != nil {
+			return err
+		}
+		count++
+		return nil
+	}
+	for {
+		val := subValue(q.rhs, cur)
+		if q.op == cmpEqual {
+			if val >= lhsmin && val <= lhsmax {
+				if err := add(val); err != nil {
+					return err
+				}
+			}
+		} else {
+			for lhsval := lhsmin; lhsval <= lhsmax; lhsval++ {
+				if q.holds(lhsval, val) {
+					if err := add(lhsval); err != nil {
+						return err
+					}
+				}
+				if lhsval == lhsmax {
+					break
+				}
+			}
+		}
+		if !advanceCombo(cur, min, max) {
+			break
+		}
+	}
+	if count == 0 {
+		return fmt.Errorf("%s constraint is impossible to match", compareNames[q.op])
+	}
+	return nil
+}
+
+func buildConstraint(lhs patternValue, lhsval int64, semval []patternValue, val []int64) (tokenPattern, error) {
+	res, err := lhs.genPattern(lhsval)
+	if err != nil {
+		return res, err
+	}
+	for i, v := range semval {
+		pat, err := v.genPattern(val[i])
+		if err != nil {
+			return res, err
+		}
+		if res, err = res.doAnd(pat); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// advanceCombo steps val to the next combination of values between min and
+// max, and reports false once they are exhausted.
+func advanceCombo(val, min, max []int64) bool {
+	for i := range val {
+		val[i]++
+		if val[i] <= max[i] {
+			return true
+		}
+		val[i] = min[i]
+	}
+	return false
+}
+
+func (q *compareEquation) tokenPattern() tokenPattern { return q.result }
+
+func (q *compareEquation) resolveOperandLeft(state *operandResolve) bool {
+	state.rightmost = -1
+	state.size = q.result.minimumLength()
+	return true
+}
+
+func (q *compareEquation) operandOrder(ct *constructor, order []*operandSymbol) []*operandSymbol {
+	return order
+}
+
+// andEquation and orEquation constrain the same tokens.
+type andEquation struct {
+	or          bool
+	left, right equation
+	result      tokenPattern
+}
+
+func (q *andEquation) genPattern(ops []tokenPattern) error {
+	if err := q.left.genPattern(ops); err != nil {
+		return err
+	}
+	if err := q.right.genPattern(ops); err != nil {
+		return err
+	}
+	var err error
+	if q.or {
+		q.result, err = q.left.tokenPattern().doOr(q.right.tokenPattern())
+	} else {
+		q.result, err = q.left.tokenPattern().doAnd(q.right.tokenPattern())
+	}
+	return err
+}
+
+func (q *andEquation) tokenPattern() tokenPattern { return q.result }
+
+func (q *andEquation) resolveOperandLeft(state *operandResolve) bool {
+	rightmost, size := -1, -1
+	if !q.right.resolveOperandLeft(state) {
+		return false
+	}
+	if state.rightmost != -1 && state.size != -1 {
+		rightmost, size = state.rightmost, state.size
+	}
+	if !q.left.resolveOperandLeft(state) {
+		return false
+	}
+	if state.rightmost == -1 || state.size == -1 {
+		state.rightmost, state.size = rightmost, size
+	}
+	return true
+}
+
+func (q *andEquation) operandOrder(ct *constructor, order []*operandSymbol) []*operandSymbol {
+	return q.right.operandOrder(ct, q.left.operandOrder(ct, order))
+}
+
+// catEquation concatenates the tokens of its sides.
+type catEquation struct {
+	left, right equation
+	result      tokenPattern
+}
+
+func (q *catEquation) genPattern(ops []tokenPattern) error {
+	if err := q.left.genPattern(ops); err != nil {
+		return err
+	}
+	if err := q.right.genPattern(ops); err != nil {
+		return err
+	}
+	var err error
+	q.result, err = q.left.tokenPattern().doCat(q.right.tokenPattern())
+	return err
+}
+
+func (q *catEquation) tokenPattern() tokenPattern { return q.result }
+
+func (q *catEquation) resolveOperandLeft(state *operandResolve) bool {
+	if !q.left.resolveOperandLeft(state) {
+		return false
+	}
+	base, offset := state.base, state.offset
+	left := q.left.tokenPattern()
+	switch {
+	case !left.leftEllipsis && !left.rightEllipsis:
+		state.offset += left.minimumLength()
+	case state.rightmost != -1:
+		state.base = state.rightmost
+		state.offset = state.size
+	case state.size != -1:
+		state.offset += state.size
+	default:
+		state.base = -2
+	}
+	rightmost, size := state.rightmost, state.size
+	if !q.right.resolveOperandLeft(state) {
+		return false
+	}
+	state.base, state.offset = base, offset
+	if state.rightmost == -1 && state.size != -1 && rightmost != -1 && size != -1 {
+		state.rightmost = rightmost
+		state.size += size
+	}
+	return true
+}
+
+func (q *catEquation) operandOrder(ct *constructor, order []*operandSymbol) []*operandSymbol {
+	return q.right.operandOrder(ct, q.left.operandOrder(ct, order))
+}
+
+// ellipsisEquation lets the pattern of eq be preceded (left) or followed by
+// more tokens.
+type ellipsisEquation struct {
+	left   bool
+	eq     equation
+	result tokenPattern
+}
+
+func (q *ellipsisEquation) genPattern(ops []tokenPattern) error {
+	if err := q.eq.genPattern(ops); err != nil {
+		return err
+	}
+	q.result = q.eq.tokenPattern()
+	if q.left {
+		q.result.leftEllipsis = true
+	} else {
+		q.result.rightEllipsis = true
+	}
+	return nil
+}
+
+func (q *ellipsisEquation) tokenPattern() tokenPattern { return q.result }
+
+func (q *ellipsisEquation) resolveOperandLeft(state *operandResolve) bool {
+	if q.left {
+		base := state.base
+		state.base = -2
+		if !q.eq.resolveOperandLeft(state) {
+			return false
+		}
+		state.base = base
+		return true
+	}
+	if !q.eq.resolveOperandLeft(state) {
+		return false
+	}
+	state.size = -1
+	return true
+}
+
+func (q *ellipsisEquation) operandOrder(ct *constructor, order []*operandSymbol) []*operandSymbol {
+	return q.eq.operandOrder(ct, order)
+}
@@ -0,0 +1,677 @@
+package sleigh
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// srcLine is a line of the preprocessed source.
+type srcLine struct {
+	start  int // offset in the text
+	file   string
+	source string // name of the file as included
+	line   int
+}
+
+// ifState is an @if block of the preprocessor.
+type ifState struct {
+	active   bool // lines are kept
+	taken    bool // a branch was kept
+	outer    bool // the enclosing block is active
+	seenElse bool
+}
+
+// maxIncludeDepth stops recursive @include.
+const maxIncludeDepth = 32
+
+// preprocessor expands the @include, @define and @if directives and the
+// $(NAME) macros of a specification into a single text.
+type preprocessor struct {
+	fsys    fs.FS
+	defines map[string]string
+	text    []byte
+	lines   []srcLine
+	depth   int
+}
+
+func (pp *preprocessor) errorf(file string, line int, format string, args ...interface{}) error {
+	return &Error{File: file, Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// include preprocesses the file name, included as source from line of file.
+func (pp *preprocessor) include(name, source string, file string, line int) error {
+	if pp.depth >= maxIncludeDepth {
+		return pp.errorf(file, line, "@include nested too deeply")
+	}
+	data, err := fs.ReadFile(pp.fsys, name)
+	if err != nil {
+		if file == "" {
+			return err
+		}
+		return pp.errorf(file, line, "%v", err)
+	}
+	pp.depth++
+	defer func() { pp.depth-- }()
+
+	var stack []ifState
+	active := func() bool { return len(stack) == 0 || stack[len(stack)-1].active }
+	for i, l := range strings.Split(string(data), "\n") {
+		lineno := i + 1
+		l = strings.TrimSuffix(l, "\r")
+		trimmed := strings.TrimLeft(l, " \t\v\f")
+		if !strings.HasPrefix(trimmed, "@") {
+			if !active() {
+				continue
+			}
+			expanded, err := pp.expand(l, true)
+			if err != nil {
+				return pp.errorf(name, lineno, "%v", err)
+			}
+			pp.lines = append(pp.lines, srcLine{start: len(pp.text), file: name, source: source, line: lineno})
+			pp.text = append(pp.text, expanded...)
+			pp.text = append(pp.text, '\n')
+			continue
+		}
+
+		d := &directiveLexer{s: stripComment(trimmed[1:])}
+		word := d.ident()
+		switch word {
+		case "if", "ifdef", "ifndef":
+			st := ifState{outer: active()}
+			if st.outer {
+				cond, err := pp.condition(word, d)
+				if err != nil {
+					return pp.errorf(name, lineno, "%v", err)
+				}
+				st.active, st.taken = cond, cond
+			}
+			stack = append(stack, st)
+			continue
+		case "elif", "else", "endif":
+			if len(stack) == 0 {
+				return pp.errorf(name, lineno, "@%s without @if", word)
+			}
+			st := &stack[len(stack)-1]
+			switch word {
+			case "endif":
+				stack = stack[:len(stack)-1]
+			case "else":
+				if st.seenElse {
+					return pp.errorf(name, lineno, "duplicate @else")
+				}
+				st.seenElse = true
+				st.active = st.outer && !st.taken
+				st.taken = true
+			case "elif":
+				if st.seenElse {
+					return pp.errorf(name, lineno, "@elif after @else")
+				}
+				st.active = false
+				if st.outer && !st.taken {
+					cond, err := pp.condition("if", d)
+					if err != nil {
+						return pp.errorf(name, lineno, "%v", err)
+					}
+					st.active, st.taken = cond, cond
+				}
+			}
+			continue
+		}
+		if !active() {
+			continue
+		}
+
+		switch word {
+		case "include":
+			d.skipSpace()
+			file, ok := d.quoted()
+			if !ok {
+				return pp.errorf(name, lineno, "expecting a quoted file name after @include")
+			}
+			file, err := pp.expand(file, false)
+			if err != nil {
+				return pp.errorf(name, lineno, "%v", err)
+			}
+			included := file
+			if !path.IsAbs(file) {
+				file = path.Join(path.Dir(name), file)
+				included = source[:strings.LastIndexByte(source, '/')+1] + included
+			}
+			if err := pp.include(strings.TrimPrefix(file, "/"), included, name, lineno); err != nil {
+				return err
+			}
+		case "define":
+			d.skipSpace()
+			key := d.ident()
+			if key == "" {
+				return pp.errorf(name, lineno, "expecting a macro name after @define")
+			}
+			d.skipSpace()
+			val, ok := d.quoted()
+			if !ok {
+				val = strings.TrimSpace(d.s[d.pos:])
+			}
+			pp.defines[key] = val
+		case "undef":
+			d.skipSpace()
+			delete(pp.defines, d.ident())
+		default:
+			return pp.errorf(name, lineno, "unknown preprocessing directive @%s", word)
+		}
+	}
+	if len(stack) != 0 {
+		return pp.errorf(name, len(strings.Split(string(data), "\n")), "missing @endif")
+	}
+	return nil
+}
+
+// stripComment drops a '#' comment outside quotes.
+func stripComment(s string) string {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case '#':
+			if !quoted {
+				return s[:i]
+			}
+		}
+	}
+	return s
+}
+
+// macroBoundary surrounds the expanded macros of the text: a macro ends the
+// token before it and the value is split into its own tokens.
+const macroBoundary = '\x00'
+
+// expand replaces the $(NAME) macros of s by their values, outside of the
+// comments, between macro boundaries if bounded.
+func (pp *preprocessor) expand(s string, bounded bool) (string, error) {
+	if !strings.Contains(s, "$(") {
+		return s, nil
+	}
+	var b strings.Builder
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == '#' && !quoted:
+			b.WriteString(s[i:])
+			return b.String(), nil
+		case strings.HasPrefix(s[i:], "$("):
+			j := strings.IndexByte(s[i:], ')')
+			if j < 0 {
+				return "", fmt.Errorf("unterminated macro in %q", s)
+			}
+			key := s[i+2 : i+j]
+			val, ok := pp.defines[key]
+			if !ok {
+				return "", fmt.Errorf("unknown preprocessing macro '%s'", key)
+			}
+			if bounded && !quoted {
+				b.WriteByte(macroBoundary)
+				b.WriteString(val)
+				b.WriteByte(macroBoundary)
+			} else {
+				b.WriteString(val)
+			}
+			i += j
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String(), nil
+}
+
+func (pp *preprocessor) condition(word string, d *directiveLexer) (bool, error) {
+	switch word {
+	case "ifdef", "ifndef":
+		d.skipSpace()
+		key := d.ident()
+		if key == "" {
+			return false, fmt.Errorf("expecting a macro name after @%s", word)
+		}
+		_, ok := pp.defines[key]
+		return ok == (word == "ifdef"), nil
+	}
+	res, err := pp.orExpr(d)
+	if err != nil {
+		return false, err
+	}
+	d.skipSpace()
+	if d.pos != len(d.s) {
+		return false, fmt.Errorf("unexpected %q in @if condition", d.s[d.pos:])
+	}
+	return res, nil
+}
+
+func (pp *preprocessor) orExpr(d *directiveLexer) (bool, error) {
+	res, err := pp.andExpr(d)
+	for err == nil {
+		d.skipSpace()
+		var op string
+		switch {
+		case d.consume("||"):
+			op = "||"
+		case d.consume("^^"):
+			op = "^^"
+		default:
+			return res, nil
+		}
+		var rhs bool
+		if rhs, err = pp.andExpr(d); err == nil {
+			if op == "||" {
+				res = res || rhs
+			} else {
+				res = res != rhs
+			}
+		}
+	}
+	return false, err
+}
+
+func (pp *preprocessor) andExpr(d *directiveLexer) (bool, error) {
+	res, err := pp.unaryExpr(d)
+	for err == nil {
+		d.skipSpace()
+		if !d.consume("&&") {
+			return res, nil
+		}
+		var rhs bool
+		if rhs, err = pp.unaryExpr(d); err == nil {
+			res = res && rhs
+		}
+	}
+	return false, err
+}
+
+func (pp *preprocessor) unaryExpr(d *directiveLexer) (bool, error) {
+	d.skipSpace()
+	switch {
+	case d.consume("!") && !d.peek("="):
+		res, err := pp.unaryExpr(d)
+		return !res, err
+	case d.consume("("):
+		res, err := pp.orExpr(d)
+		if err != nil {
+			return false, err
+		}
+		d.skipSpace()
+		if !d.consume(")") {
+			return false, fmt.Errorf("missing ')' in @if condition")
+		}
+		return res, nil
+	}
+	if d.peekIdent("defined") {
+		d.ident()
+		d.skipSpace()
+		if !d.consume("(") {
+			return false, fmt.Errorf("expecting '(' after defined")
+		}
+		d.skipSpace()
+		key := d.ident()
+		d.skipSpace()
+		if key == "" || !d.consume(")") {
+			return false, fmt.Errorf("bad defined() in @if condition")
+		}
+		_, ok := pp.defines[key]
+		return ok, nil
+	}
+	lhs, err := pp.value(d)
+	if err != nil {
+		return false, err
+	}
+	d.skipSpace()
+	var eq bool
+	switch {
+	case d.consume("=="):
+		eq = true
+	case d.consume("!="):
+	default:
+		return false, fmt.Errorf("expecting '==' or '!=' in @if condition")
+	}
+	rhs, err := pp.value(d)
+	if err != nil {
+		return false, err
+	}
+	return (lhs == rhs) == eq, nil
+}
+
+func (pp *preprocessor) value(d *directiveLexer) (string, error) {
+	d.skipSpace()
+	if s, ok := d.quoted(); ok {
+		return s, nil
+	}
+	key := d.ident()
+	if key == "" {
+		return "", fmt.Errorf("bad value in @if condition")
+	}
+	val, ok := pp.defines[key]
+	if !ok {
+		return "", fmt.Errorf("unknown preprocessing macro '%s'", key)
+	}
+	return val, nil
+}
+
+// directiveLexer scans a preprocessing directive.
+type directiveLexer struct {
+	s   string
+	pos int
+}
+
+func (d *directiveLexer) skipSpace() {
+	for d.pos < len(d.s) && isSpace(d.s[d.pos]) {
+		d.pos++
+	}
+}
+
+func (d *directiveLexer) peek(s string) bool { return strings.HasPrefix(d.s[d.pos:], s) }
+
+func (d *directiveLexer) consume(s string) bool {
+	if d.peek(s) {
+		d.pos += len(s)
+		return true
+	}
+	return false
+}
+
+func (d *directiveLexer) ident() string {
+	start := d.pos
+	if d.pos < len(d.s) && isIdentStart(d.s[d.pos]) {
+		d.pos++
+		for d.pos < len(d.s) && isIdentChar(d.s[d.pos]) {
+			d.pos++
+		}
+	}
+	return d.s[start:d.pos]
+}
+
+func (d *directiveLexer) peekIdent(s string) bool {
+	save := d.pos
+	ok := d.ident() == s
+	d.pos = save
+	return ok
+}
+
+func (d *directiveLexer) quoted() (string, bool) {
+	if !d.peek(`"`) {
+		return "", false
+	}
+	end := strings.IndexByte(d.s[d.pos+1:], '"')
+	if end < 0 {
+		return "", false
+	}
+	s := d.s[d.pos+1 : d.pos+1+end]
+	d.pos += end + 2
+	return s, true
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\v' || c == '\f'
+}
+
+func isIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '.'
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9'
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokInt
+	tokString
+	tokPunct
+	tokSpace // whitespace of a display
+)
+
+// lexToken is a token of the specification.
+type lexToken struct {
+	kind tokenKind
+	text string
+	val  uint64
+	pos  int
+	end  int
+}
+
+func (t lexToken) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of file"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return "'" + t.text + "'"
+}
+
+// lexMode selects how the text is split into tokens: the displays and the
+// semantics have their own tokens.
+type lexMode int
+
+const (
+	modeDefine lexMode = iota
+	modePrint
+	modeSem
+)
+
+// Operators of the modes, longest first.
+var (
+	defineOps = []string{"...", "$and", "$xor", "$or", "!=", "<=", ">=", "<<", ">>", "=="}
+	semOps    = []string{
+		"s>>", "s<=", "s>=", "f==", "f!=", "f<=", "f>=",
+		"==", "!=", "<=", ">=", "<<", ">>", "&&", "||", "^^",
+		"s<", "s>", "s/", "s%", "f<", "f>", "f+", "f-", "f*", "f/",
+	}
+)
+
+const printChars = "~!@#$%&*()-=+[]{}|;:<>?,/0123456789"
+
+// lexer splits the preprocessed specification into tokens.
+type lexer struct {
+	text  []byte
+	lines []srcLine
+	pos   int
+}
+
+// lineAt returns the source line of an offset of the text.
+func (lx *lexer) lineAt(pos int) srcLine {
+	i := sort.Search(len(lx.lines), func(i int) bool { return lx.lines[i].start > pos }) - 1
+	if i < 0 {
+		if len(lx.lines) == 0 {
+			return srcLine{}
+		}
+		i = 0
+	}
+	return lx.lines[i]
+}
+
+// location returns the file and line of an offset of the text.
+func (lx *lexer) location(pos int) (string, int) {
+	l := lx.lineAt(pos)
+	return l.file, l.line
+}
+
+func (lx *lexer) skipSpace() {
+	for lx.pos < len(lx.text) {
+		c := lx.text[lx.pos]
+		switch {
+		case isSpace(c) || c == macroBoundary:
+			lx.pos++
+		case c == '#':
+			for lx.pos < len(lx.text) && lx.text[lx.pos] != '\n' {
+				lx.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (lx *lexer) hasPrefix(s string) bool {
+	return strings.HasPrefix(string(lx.text[lx.pos:min(lx.pos+len(s), len(lx.text))]), s)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (lx *lexer) identEnd(pos int) int {
+	if pos >= len(lx.text) || !isIdentStart(lx.text[pos]) {
+		return pos
+	}
+	pos++
+	for pos < len(lx.text) && isIdentChar(lx.text[pos]) {
+		pos++
+	}
+	return pos
+}
+
+// next returns the token at the position in the given mode, and moves past
+// it.
+func (lx *lexer) next(mode lexMode) (lexToken, error) {
+	if mode == modePrint {
+		return lx.nextPrint()
+	}
+	lx.skipSpace()
+	tok := lexToken{pos: lx.pos}
+	if lx.pos >= len(lx.text) {
+		tok.end = lx.pos
+		return tok, nil
+	}
+	c := lx.text[lx.pos]
+
+	ops := defineOps
+	if mode == modeSem {
+		ops = semOps
+	}
+	opLen := 0
+	for _, op := range ops {
+		if lx.hasPrefix(op) {
+			opLen = len(op)
+			break
+		}
+	}
+	identLen := lx.identEnd(lx.pos) - lx.pos
+	switch {
+	case opLen != 0 && opLen >= identLen:
+		tok.kind = tokPunct
+		tok.text = string(lx.text[lx.pos : lx.pos+opLen])
+		lx.pos += opLen
+	case identLen != 0:
+		tok.kind = tokIdent
+		tok.text = string(lx.text[lx.pos : lx.pos+identLen])
+		lx.pos += identLen
+	case c >= '0' && c <= '9':
+		if err := lx.number(&tok); err != nil {
+			return tok, err
+		}
+	case c == '"':
+		s, err := lx.quoted()
+		if err != nil {
+			return tok, err
+		}
+		tok.kind = tokString
+		tok.text = s
+	default:
+		tok.kind = tokPunct
+		tok.text = string(c)
+		lx.pos++
+	}
+	tok.end = lx.pos
+	return tok, nil
+}
+
+func (lx *lexer) number(tok *lexToken) error {
+	start := lx.pos
+	base := 10
+	digits := "0123456789"
+	if lx.hasPrefix("0x") || lx.hasPrefix("0X") {
+		base, digits = 16, "0123456789abcdefABCDEF"
+		lx.pos += 2
+	} else if lx.hasPrefix("0b") || lx.hasPrefix("0B") {
+		base, digits = 2, "01"
+		lx.pos += 2
+	}
+	ds := lx.pos
+	for lx.pos < len(lx.text) && strings.IndexByte(digits, lx.text[lx.pos]) >= 0 {
+		lx.pos++
+	}
+	tok.kind = tokInt
+	tok.text = string(lx.text[start:lx.pos])
+	v, err := strconv.ParseUint(string(lx.text[ds:lx.pos]), base, 64)
+	if err != nil {
+		return fmt.Errorf("bad integer %s", tok.text)
+	}
+	tok.val = v
+	return nil
+}
+
+// quoted scans a quoted string, "" standing for a quote.
+func (lx *lexer) quoted() (string, error) {
+	var b strings.Builder
+	lx.pos++
+	for {
+		if lx.pos >= len(lx.text) || lx.text[lx.pos] == '\n' {
+			return "", fmt.Errorf("unterminated string")
+		}
+		c := lx.text[lx.pos]
+		lx.pos++
+		if c == '"' {
+			if lx.pos < len(lx.text) && lx.text[lx.pos] == '"' {
+				lx.pos++
+			} else {
+				return b.String(), nil
+			}
+		}
+		b.WriteByte(c)
+	}
+}
+
+func (lx *lexer) nextPrint() (lexToken, error) {
+	for lx.pos < len(lx.text) && lx.text[lx.pos] == macroBoundary {
+		lx.pos++
+	}
+	tok := lexToken{pos: lx.pos}
+	if lx.pos >= len(lx.text) {
+		tok.end = lx.pos
+		return tok, nil
+	}
+	c := lx.text[lx.pos]
+	switch {
+	case isSpace(c) || c == '#':
+		lx.skipSpace()
+		tok.kind = tokSpace
+		tok.text = " "
+	case c == '"':
+		s, err := lx.quoted()
+		if err != nil {
+			return tok, err
+		}
+		tok.kind = tokString
+		tok.text = s
+	case isIdentStart(c):
+		end := lx.identEnd(lx.pos)
+		tok.kind = tokIdent
+		tok.text = string(lx.text[lx.pos:end])
+		lx.pos = end
+	default:
+		tok.kind = tokPunct
+		tok.text = string(c)
+		lx.pos++
+	}
+	tok.end = lx.pos
+	return tok, nil
+}
@@ -0,0 +1,1332 @@
+package sleigh
+
+// bailout aborts the parse on a syntax error.
+type bailout struct{}
+
+// parser is a recursive descent parser of the specification, calling the
+// compiler for each definition.
+type parser struct {
+	c  *compiler
+	lx *lexer
+
+	cached    bool
+	cache     lexToken
+	cacheAt   int
+	cacheMode lexMode
+}
+
+func (p *parser) fail(tok lexToken, format string, args ...interface{}) {
+	file, line := p.lx.location(tok.pos)
+	p.c.errorAt(file, line, format, args...)
+	panic(bailout{})
+}
+
+func (p *parser) peek(mode lexMode) lexToken {
+	if p.cached && p.cacheAt == p.lx.pos && p.cacheMode == mode {
+		return p.cache
+	}
+	save := p.lx.pos
+	tok, err := p.lx.next(mode)
+	p.lx.pos = save
+	if err != nil {
+		p.fail(tok, "%v", err)
+	}
+	p.cache, p.cacheAt, p.cacheMode, p.cached = tok, save, mode, true
+	return tok
+}
+
+// next consumes the next token, which becomes the location of the errors.
+func (p *parser) next(mode lexMode) lexToken {
+	tok := p.peek(mode)
+	p.lx.pos = tok.end
+	l := p.lx.lineAt(tok.pos)
+	p.c.file, p.c.source, p.c.line = l.file, l.source, l.line
+	if len(p.c.errs) >= maxErrors {
+		panic(bailout{})
+	}
+	return tok
+}
+
+func isPunct(tok lexToken, s string) bool { return tok.kind == tokPunct && tok.text == s }
+
+func isIdent(tok lexToken, s string) bool { return tok.kind == tokIdent && tok.text == s }
+
+// accept consumes the punctuation s if it is next.
+func (p *parser) accept(mode lexMode, s string) bool {
+	if isPunct(p.peek(mode), s) {
+		p.next(mode)
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(mode lexMode, s string) lexToken {
+	tok := p.next(mode)
+	if !isPunct(tok, s) {
+		p.fail(tok, "syntax error: unexpected %s, expecting '%s'", tok, s)
+	}
+	return tok
+}
+
+func (p *parser) expectKeyword(mode lexMode, s string) {
+	if tok := p.next(mode); !isIdent(tok, s) {
+		p.fail(tok, "syntax error: unexpected %s, expecting '%s'", tok, s)
+	}
+}
+
+func (p *parser) expectIdent(mode lexMode) lexToken {
+	tok := p.next(mode)
+	if tok.kind != tokIdent {
+		p.fail(tok, "syntax error: unexpected %s, expecting an identifier", tok)
+	}
+	return tok
+}
+
+func (p *parser) expectInt(mode lexMode) lexToken {
+	tok := p.next(mode)
+	if tok.kind != tokInt {
+		p.fail(tok, "syntax error: unexpected %s, expecting an integer", tok)
+	}
+	return tok
+}
+
+func (p *parser) expectInt32(mode lexMode) int {
+	tok := p.expectInt(mode)
+	if tok.val > 1<<31-1 {
+		p.fail(tok, "integer %s is too large", tok.text)
+	}
+	return int(tok.val)
+}
+
+func (p *parser) lookup(name string) symbol {
+	if p.c.symtab == nil {
+		return nil
+	}
+	return p.c.symtab.find(name)
+}
+
+func (p *parser) parse() {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(bailout); !ok {
+				panic(r)
+			}
+		}
+	}()
+
+	tok := p.next(modeDefine)
+	if !isIdent(tok, "define") || !isIdent(p.peek(modeDefine), "endian") {
+		p.fail(tok, "the specification must start with the endian definition")
+	}
+	p.next(modeDefine)
+	p.expect(modeDefine, "=")
+	switch tok := p.expectIdent(modeDefine); tok.text {
+	case "big":
+		p.c.setEndian(true)
+	case "little":
+		p.c.setEndian(false)
+	default:
+		p.fail(tok, "unknown endianness '%s'", tok.text)
+	}
+	p.expect(modeDefine, ";")
+	p.parseItems(false)
+}
+
+// parseItems parses the definitions, up to the end of the file or of a
+// with block.
+func (p *parser) parseItems(inWith bool) {
+	for {
+		tok := p.peek(modeDefine)
+		switch {
+		case tok.kind == tokEOF:
+			if inWith {
+				p.fail(tok, "syntax error: missing '}' at the end of a with block")
+			}
+			return
+		case inWith && isPunct(tok, "}"):
+			return
+		case isIdent(tok, "define"):
+			p.next(modeDefine)
+			p.parseDefine()
+		case isIdent(tok, "attach"):
+			p.next(modeDefine)
+			p.c.calcContextLayout()
+			p.parseAttach()
+		case isIdent(tok, "macro"):
+			p.next(modeDefine)
+			p.parseMacro()
+		case isIdent(tok, "with"):
+			p.next(modeDefine)
+			p.c.calcContextLayout()
+			p.parseWith()
+		case isPunct(tok, ":") || tok.kind == tokIdent:
+			p.c.calcContextLayout()
+			p.parseConstructor()
+		default:
+			p.fail(tok, "syntax error: unexpected %s", tok)
+		}
+	}
+}
+
+func (p *parser) parseDefine() {
+	tok := p.expectIdent(modeDefine)
+	switch tok.text {
+	case "endian":
+		p.fail(tok, "endianness is already defined")
+	case "alignment":
+		p.expect(modeDefine, "=")
+		p.c.setAlignment(p.expectInt32(modeDefine))
+	case "space":
+		p.parseSpace()
+		return
+	case "token":
+		p.parseToken()
+		return
+	case "context":
+		p.parseContext()
+		return
+	case "pcodeop":
+		p.c.addUserOp(p.parseNameList())
+		return
+	case "bitrange":
+		p.parseBitranges()
+	default:
+		sym, ok := p.lookup(tok.text).(*spaceSymbol)
+		if !ok {
+			p.fail(tok, "syntax error: unexpected %s after define", tok)
+		}
+		p.expectKeyword(modeDefine, "offset")
+		p.expect(modeDefine, "=")
+		offset := p.expectInt(modeDefine).val
+		p.expectKeyword(modeDefine, "size")
+		p.expect(modeDefine, "=")
+		size := p.expectInt32(modeDefine)
+		p.c.defineVarnodes(sym.space, offset, size, p.parseNameList())
+		return
+	}
+	p.expect(modeDefine, ";")
+}
+
+func (p *parser) parseSpace() {
+	name := p.expectIdent(modeDefine).text
+	register := false
+	size, wordSize := 0, 0
+	isDefault := false
+	for {
+		tok := p.next(modeDefine)
+		switch {
+		case isPunct(tok, ";"):
+			p.c.newSpace(name, register, size, wordSize, isDefault)
+			return
+		case isIdent(tok, "type"):
+			p.expect(modeDefine, "=")
+			switch typ := p.expectIdent(modeDefine); typ.text {
+			case "ram_space", "rom_space":
+				register = false
+			case "register_space":
+				register = true
+			default:
+				p.fail(typ, "unknown space type '%s'", typ.text)
+			}
+		case isIdent(tok, "size"):
+			p.expect(modeDefine, "=")
+			size = p.expectInt32(modeDefine)
+		case isIdent(tok, "wordsize"):
+			p.expect(modeDefine, "=")
+			wordSize = p.expectInt32(modeDefine)
+		case isIdent(tok, "default"):
+			isDefault = true
+		default:
+			p.fail(tok, "syntax error: unexpected %s in space definition", tok)
+		}
+	}
+}
+
+// parseNameList parses a name or a bracketed list of names, "_" included,
+// up to the ';'.
+func (p *parser) parseNameList() []string {
+	var names []string
+	if p.accept(modeDefine, "[") {
+		for !p.accept(modeDefine, "]") {
+			names = append(names, p.expectIdent(modeDefine).text)
+		}
+	} else {
+		names = append(names, p.expectIdent(modeDefine).text)
+	}
+	p.expect(modeDefine, ";")
+	return names
+}
+
+func (p *parser) parseToken() {
+	name := p.expectIdent(modeDefine).text
+	p.expect(modeDefine, "(")
+	size := p.expectInt32(modeDefine)
+	p.expect(modeDefine, ")")
+	endian := 0
+	if isIdent(p.peek(modeDefine), "endian") {
+		p.next(modeDefine)
+		p.expect(modeDefine, "=")
+		switch tok := p.expectIdent(modeDefine); tok.text {
+		case "big":
+			endian = 1
+		case "little":
+			endian = -1
+		default:
+			p.fail(tok, "unknown endianness '%s'", tok.text)
+		}
+	}
+	tok := p.c.defineToken(name, size, endian)
+	for !p.accept(modeDefine, ";") {
+		p.c.addTokenField(tok, p.parseField(false))
+	}
+}
+
+// parseField parses NAME = (low,high) and the attributes of the field.
+func (p *parser) parseField(context bool) fieldQuality {
+	q := fieldQuality{name: p.expectIdent(modeDefine).text, flow: true}
+	p.expect(modeDefine, "=")
+	p.expect(modeDefine, "(")
+	q.low = p.expectInt32(modeDefine)
+	p.expect(modeDefine, ",")
+	q.high = p.expectInt32(modeDefine)
+	p.expect(modeDefine, ")")
+	for {
+		tok := p.peek(modeDefine)
+		switch {
+		case isIdent(tok, "signed"):
+			q.signed = true
+		case isIdent(tok, "hex"), isIdent(tok, "dec"):
+		case context && isIdent(tok, "noflow"):
+			q.flow = false
+		default:
+			return q
+		}
+		p.next(modeDefine)
+	}
+}
+
+func (p *parser) parseContext() {
+	tok := p.expectIdent(modeDefine)
+	reg, ok := p.lookup(tok.text).(*varnodeSymbol)
+	if !ok {
+		p.fail(tok, "'%s' is not a register", tok.text)
+	}
+	for !p.accept(modeDefine, ";") {
+		p.c.addContextField(reg, p.parseField(true))
+	}
+}
+
+func (p *parser) parseBitranges() {
+	for {
+		name := p.expectIdent(modeDefine).text
+		p.expect(modeDefine, "=")
+		tok := p.expectIdent(modeDefine)
+		reg, ok := p.lookup(tok.text).(*varnodeSymbol)
+		if !ok {
+			p.fail(tok, "'%s' is not a register", tok.text)
+		}
+		p.expect(modeDefine, "[")
+		bitOffset := p.expectInt32(modeDefine)
+		p.expect(modeDefine, ",")
+		numBits := p.expectInt32(modeDefine)
+		p.expect(modeDefine, "]")
+		p.c.defineBitrange(name, reg, bitOffset, numBits)
+		if isPunct(p.peek(modeDefine), ";") {
+			return
+		}
+	}
+}
+
+func (p *parser) parseAttach() {
+	kind := p.expectIdent(modeDefine)
+	var syms []familySymbol
+	field := func() {
+		tok := p.expectIdent(modeDefine)
+		switch sym := p.lookup(tok.text).(type) {
+		case *valueSymbol:
+			syms = append(syms, sym)
+		case *contextSymbol:
+			syms = append(syms, sym)
+		default:
+			p.fail(tok, "'%s' is not a field that can be attached", tok.text)
+		}
+	}
+	if p.accept(modeDefine, "[") {
+		for !p.accept(modeDefine, "]") {
+			field()
+		}
+	} else {
+		field()
+	}
+
+	list := func(item func(tok lexToken)) {
+		if p.accept(modeDefine, "[") {
+			for {
+				tok := p.next(modeDefine)
+				if isPunct(tok, "]") {
+					break
+				}
+				item(tok)
+			}
+		} else {
+			item(p.next(modeDefine))
+		}
+	}
+	switch kind.text {
+	case "variables":
+		var vars []*varnodeSymbol
+		list(func(tok lexToken) {
+			if isIdent(tok, "_") {
+				vars = append(vars, nil)
+				return
+			}
+			vn, ok := p.lookup(tok.text).(*varnodeSymbol)
+			if tok.kind != tokIdent || !ok {
+				p.fail(tok, "%s is not a register", tok)
+			}
+			vars = append(vars, vn)
+		})
+		p.c.attachVarnodes(syms, vars)
+	case "names":
+		var names []string
+		list(func(tok lexToken) {
+			switch {
+			case isIdent(tok, "_"):
+				names = append(names, "\t")
+			case tok.kind == tokIdent || tok.kind == tokString:
+				names = append(names, tok.text)
+			default:
+				p.fail(tok, "syntax error: unexpected %s in a list of names", tok)
+			}
+		})
+		p.c.attachNames(syms, names)
+	case "values":
+		var values []int64
+		list(func(tok lexToken) {
+			neg := false
+			if isPunct(tok, "-") {
+				neg = true
+				tok = p.next(modeDefine)
+			}
+			switch {
+			case isIdent(tok, "_") && !neg:
+				values = append(values, 0xBADBEEF)
+			case tok.kind == tokInt:
+				v := int64(tok.val)
+				if neg {
+					v = -v
+				}
+				values = append(values, v)
+			default:
+				p.fail(tok, "syntax error: unexpected %s in a list of values", tok)
+			}
+		})
+		p.c.attachValues(syms, values)
+	default:
+		p.fail(kind, "syntax error: unexpected %s after attach", kind)
+	}
+	p.expect(modeDefine, ";")
+}
+
+func (p *parser) parseMacro() {
+	name := p.expectIdent(modeDefine)
+	if p.lookup(name.text) != nil {
+		p.fail(name, "duplicate symbol name '%s'", name.text)
+	}
+	p.expect(modeDefine, "(")
+	var params []string
+	if !p.accept(modeDefine, ")") {
+		for {
+			params = append(params, p.expectIdent(modeDefine).text)
+			if p.accept(modeDefine, ")") {
+				break
+			}
+			p.expect(modeDefine, ",")
+		}
+	}
+	sym := p.c.createMacro(name.text, params)
+	p.expect(modeSem, "{")
+	tpl := p.parseRtl()
+	p.expect(modeSem, "}")
+	p.c.buildMacro(sym, tpl)
+}
+
+func (p *parser) parseWith() {
+	var table *subtableSymbol
+	if tok := p.peek(modeDefine); tok.kind == tokIdent {
+		p.next(modeDefine)
+		switch sym := p.lookup(tok.text).(type) {
+		case nil:
+			table = p.c.newTable(tok.text)
+		case *subtableSymbol:
+			table = sym
+		default:
+			p.fail(tok, "'%s' is not a table", tok.text)
+		}
+	}
+	p.expect(modeDefine, ":")
+	var pateq equation
+	if tok := p.peek(modeDefine); !isPunct(tok, "[") && !isPunct(tok, "{") {
+		pateq = p.parseEquation()
+	}
+	var changes []contextChange
+	if isPunct(p.peek(modeDefine), "[") {
+		changes = p.parseContextBlock()
+	}
+	p.expect(modeDefine, "{")
+	p.c.pushWith(table, pateq, changes)
+	p.parseItems(true)
+	p.expect(modeDefine, "}")
+	p.c.popWith()
+}
+
+func (p *parser) parseConstructor() {
+	var table *subtableSymbol
+	if tok := p.peek(modeDefine); tok.kind == tokIdent {
+		p.next(modeDefine)
+		if !isPunct(p.peek(modeDefine), ":") {
+			p.fail(tok, "syntax error: unexpected %s", tok)
+		}
+		switch sym := p.lookup(tok.text).(type) {
+		case nil:
+			table = p.c.newTable(tok.text)
+		case *subtableSymbol:
+			table = sym
+		default:
+			p.fail(tok, "'%s' is not a table", tok.text)
+		}
+	}
+	p.expect(modeDefine, ":")
+	ct := p.c.createConstructor(table)
+	p.parseDisplay(ct)
+
+	pateq := p.parseEquation()
+	var changes []contextChange
+	if isPunct(p.peek(modeDefine), "[") {
+		changes = p.parseContextBlock()
+	}
+	var sections *sectionVector
+	if isIdent(p.peek(modeDefine), "unimpl") {
+		p.next(modeDefine)
+	} else {
+		p.expect(modeSem, "{")
+		sections = p.parseSections()
+		p.expect(modeSem, "}")
+	}
+	p.c.buildConstructor(ct, pateq, changes, sections)
+}
+
+// parseDisplay parses the display of ct, up to "is".
+func (p *parser) parseDisplay(ct *constructor) {
+	p.lx.skipSpace()
+	root := p.c.isInRoot(ct)
+	for first := true; ; first = false {
+		tok := p.next(modePrint)
+		switch tok.kind {
+		case tokEOF:
+			p.fail(tok, "syntax error: missing 'is' after the display")
+		case tokIdent:
+			switch {
+			case tok.text == "is":
+				return
+			case first && root:
+				ct.addSyntax(tok.text)
+			default:
+				p.c.newOperand(ct, tok.text)
+			}
+		case tokPunct:
+			if tok.text == "^" {
+				if first && !root {
+					p.fail(tok, "unexpected '^' at start of print pieces")
+				}
+				continue
+			}
+			ct.addSyntax(tok.text)
+		default:
+			ct.addSyntax(tok.text)
+		}
+	}
+}
+
+// parseEquation parses a pattern: '|' binds least, then ';', then '&'.
+func (p *parser) parseEquation() equation {
+	left := p.parseCat()
+	for p.accept(modeDefine, "|") {
+		left = &andEquation{or: true, left: left, right: p.parseCat()}
+	}
+	return left
+}
+
+func (p *parser) parseCat() equation {
+	left := p.parseAnd()
+	for p.accept(modeDefine, ";") {
+		left = &catEquation{left: left, right: p.parseAnd()}
+	}
+	return left
+}
+
+func (p *parser) parseAnd() equation {
+	left := p.parseEllipsis()
+	for p.accept(modeDefine, "&") {
+		left = &andEquation{left: left, right: p.parseEllipsis()}
+	}
+	return left
+}
+
+func (p *parser) parseEllipsis() equation {
+	if p.accept(modeDefine, "...") {
+		return &ellipsisEquation{left: true, eq: p.parseEllipsisRight()}
+	}
+	return p.parseEllipsisRight()
+}
+
+func (p *parser) parseEllipsisRight() equation {
+	eq := p.parseAtomic()
+	if p.accept(modeDefine, "...") {
+		return &ellipsisEquation{eq: eq}
+	}
+	return eq
+}
+
+var compareOps = map[string]compareOp{
+	"=":  cmpEqual,
+	"!=": cmpNotEqual,
+	"<":  cmpLess,
+	"<=": cmpLessEqual,
+	">":  cmpGreater,
+	">=": cmpGreaterEqual,
+}
+
+func (p *parser) parseAtomic() equation {
+	if p.accept(modeDefine, "(") {
+		eq := p.parseEquation()
+		p.expect(modeDefine, ")")
+		return eq
+	}
+	tok := p.expectIdent(modeDefine)
+	switch sym := p.lookup(tok.text).(type) {
+	case nil:
+		p.fail(tok, "unknown symbol '%s' in pattern", tok.text)
+	case *operandSymbol:
+		if p.accept(modeDefine, "=") {
+			if eq := p.c.constrainOperand(sym, p.parsePatternExpr(false)); eq != nil {
+				return eq
+			}
+			panic(bailout{})
+		}
+		p.c.selfDefine(sym)
+		return &operandEquation{index: sym.index}
+	case familySymbol:
+		if next := p.peek(modeDefine); next.kind == tokPunct {
+			if op, ok := compareOps[next.text]; ok {
+				p.next(modeDefine)
+				return &compareEquation{op: op, lhs: sym.patternValue(), rhs: p.parsePatternExpr(false)}
+			}
+		}
+		return p.invisibleOperand(tok, sym)
+	case *epsilonSymbol:
+		return &unconstrainedEquation{expr: &constantValue{}}
+	case *subtableSymbol, *varnodeSymbol:
+		return p.invisibleOperand(tok, sym)
+	default:
+		p.fail(tok, "symbol '%s' cannot be used in a pattern", tok.text)
+	}
+	return nil
+}
+
+func (p *parser) invisibleOperand(tok lexToken, sym symbol) equation {
+	if p.c.curCt == nil {
+		p.fail(tok, "'%s' cannot be an operand outside of a constructor", tok.text)
+	}
+	return p.c.defineInvisibleOperand(sym)
+}
+
+// Operators of the pattern expressions, by precedence. The context block
+// also takes '|', '^' and '&', which are equation operators in patterns.
+var patternOps = [][]struct {
+	tok  string
+	op   binaryOp
+	full bool // context block only
+}{
+	{{"$or", opOr, false}, {"|", opOr, true}},
+	{{"$xor", opXor, false}, {"^", opXor, true}},
+	{{"$and", opAnd, false}, {"&", opAnd, true}},
+	{{"<<", opLeftShift, false}, {">>", opRightShift, false}},
+	{{"+", opPlus, false}, {"-", opSub, false}},
+	{{"*", opMult, false}, {"/", opDiv, false}},
+}
+
+// parsePatternExpr parses an expression over fields, full for the ones of
+// the context block.
+func (p *parser) parsePatternExpr(full bool) patternExpr {
+	return p.parsePatternBinary(0, full)
+}
+
+func (p *parser) parsePatternBinary(level int, full bool) patternExpr {
+	if level == len(patternOps) {
+		return p.parsePatternUnary(full)
+	}
+	left := p.parsePatternBinary(level+1, full)
+	for {
+		tok := p.peek(modeDefine)
+		found := false
+		for _, o := range patternOps[level] {
+			if isPunct(tok, o.tok) && (full || !o.full) {
+				p.next(modeDefine)
+				left = &binaryExpr{op: o.op, left: left, right: p.parsePatternBinary(level+1, full)}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return left
+		}
+	}
+}
+
+func (p *parser) parsePatternUnary(full bool) patternExpr {
+	tok := p.next(modeDefine)
+	switch {
+	case isPunct(tok, "-"):
+		return &unaryExpr{operand: p.parsePatternUnary(full)}
+	case isPunct(tok, "~"):
+		return &unaryExpr{not: true, operand: p.parsePatternUnary(full)}
+	case isPunct(tok, "("):
+		expr := p.parsePatternExpr(full)
+		p.expect(modeDefine, ")")
+		return expr
+	case tok.kind == tokInt:
+		return &constantValue{val: int64(tok.val)}
+	case tok.kind == tokIdent:
+		sym := p.lookup(tok.text)
+		if sym == nil {
+			p.fail(tok, "unknown symbol '%s' in expression", tok.text)
+		}
+		expr, err := patternExprOf(sym)
+		if err != nil {
+			p.fail(tok, "%v", err)
+		}
+		return expr
+	}
+	p.fail(tok, "syntax error: unexpected %s in expression", tok)
+	return nil
+}
+
+// parseContextBlock parses the context changes between brackets.
+func (p *parser) parseContextBlock() []contextChange {
+	var changes []contextChange
+	p.expect(modeDefine, "[")
+	for !p.accept(modeDefine, "]") {
+		tok := p.expectIdent(modeDefine)
+		if tok.text == "globalset" {
+			p.expect(modeDefine, "(")
+			arg := p.expectIdent(modeDefine)
+			sym := p.lookup(arg.text)
+			if sym == nil {
+				p.fail(arg, "unknown symbol '%s'", arg.text)
+			}
+			p.expect(modeDefine, ",")
+			cv := p.expectIdent(modeDefine)
+			cvar, ok := p.lookup(cv.text).(*contextSymbol)
+			if !ok {
+				p.fail(cv, "'%s' is not a context field", cv.text)
+			}
+			p.expect(modeDefine, ")")
+			p.expect(modeDefine, ";")
+			changes = p.c.contextSet(changes, sym, cvar)
+			continue
+		}
+		switch sym := p.lookup(tok.text).(type) {
+		case *contextSymbol:
+			p.expect(modeDefine, "=")
+			changes = p.c.contextMod(changes, sym, p.parsePatternExpr(true))
+		case *operandSymbol:
+			p.expect(modeDefine, "=")
+			p.c.defineOperand(sym, p.parsePatternExpr(true))
+		default:
+			p.fail(tok, "'%s' cannot be set in a context block", tok.text)
+		}
+		p.expect(modeDefine, ";")
+	}
+	return changes
+}
+
+// parseSections parses the semantics of a constructor and its named
+// sections, up to the closing brace.
+func (p *parser) parseSections() *sectionVector {
+	tpl := p.parseRtl()
+	if !isPunct(p.peek(modeSem), "[") {
+		return p.c.standaloneSection(tpl)
+	}
+	var v *sectionVector
+	for p.accept(modeSem, "[") {
+		tok := p.expectIdent(modeSem)
+		p.expect(modeSem, "]")
+		var sym *sectionSymbol
+		switch s := p.lookup(tok.text).(type) {
+		case nil:
+			sym = p.c.newSectionSymbol(tok.text)
+		case *sectionSymbol:
+			sym = s
+		default:
+			p.fail(tok, "'%s' is not a section name", tok.text)
+		}
+		if v == nil {
+			v = p.c.firstNamedSection(tpl, sym)
+		} else {
+			v = p.c.nextNamedSection(v, tpl, sym)
+		}
+		tpl = p.parseRtl()
+	}
+	return p.c.finalNamedSection(v, tpl)
+}
+
+// parseRtl parses semantic statements up to a closing brace or a section
+// name.
+func (p *parser) parseRtl() *constructTpl {
+	tpl := &constructTpl{}
+	for {
+		tok := p.peek(modeSem)
+		switch {
+		case tok.kind == tokEOF:
+			p.fail(tok, "syntax error: missing '}'")
+		case isPunct(tok, "}"), isPunct(tok, "["):
+			return tpl
+		case isIdent(tok, "export"):
+			p.next(modeSem)
+			tpl.result = p.parseExport()
+			if tok := p.peek(modeSem); !isPunct(tok, "}") && !isPunct(tok, "[") {
+				p.fail(tok, "syntax error: export must be the last statement of a section")
+			}
+			return tpl
+		}
+		if !tpl.addOps(p.parseStatement()) {
+			p.c.errorf("multiple delayslot declarations")
+		}
+	}
+}
+
+func (p *parser) parseExport() *handleTpl {
+	if isPunct(p.peek(modeSem), "*") {
+		p.next(modeSem)
+		qual := p.parseSizedStar()
+		tok := p.expectIdent(modeSem)
+		sym, ok := p.lookup(tok.text).(specificSymbol)
+		if !ok {
+			p.fail(tok, "unknown pointer varnode '%s'", tok.text)
+		}
+		vn := sym.varnode()
+		p.expect(modeSem, ";")
+		return newPointerHandle(qual.id, realConst(uint64(qual.size)), vn, p.c.uniqSpace, p.c.allocateTemp())
+	}
+	var vn *varnodeTpl
+	tok := p.peek(modeSem)
+	switch {
+	case isPunct(tok, "&") || tok.kind == tokInt:
+		vn = p.parseIntegerVarnode()
+	default:
+		p.next(modeSem)
+		vn = p.specificVarnode(tok)
+	}
+	p.expect(modeSem, ";")
+	return newHandle(vn)
+}
+
+// specificVarnode returns the varnode of the symbol tok names.
+func (p *parser) specificVarnode(tok lexToken) *varnodeTpl {
+	if tok.kind != tokIdent {
+		p.fail(tok, "syntax error: unexpected %s, expecting a varnode", tok)
+	}
+	switch sym := p.lookup(tok.text).(type) {
+	case specificSymbol:
+		return sym.varnode()
+	case *subtableSymbol:
+		p.fail(tok, "subtable '%s' not attached to operand", tok.text)
+	case nil:
+		p.fail(tok, "unknown varnode parameter '%s'", tok.text)
+	}
+	p.fail(tok, "'%s' is not a varnode", tok.text)
+	return nil
+}
+
+// parseSizedStar parses the space and the size of a dereference, after
+// the '*'.
+func (p *parser) parseSizedStar() *starQuality {
+	qual := &starQuality{id: spaceConst(p.c.defaultSpace)}
+	if p.accept(modeSem, "[") {
+		tok := p.expectIdent(modeSem)
+		sym, ok := p.lookup(tok.text).(*spaceSymbol)
+		if !ok {
+			p.fail(tok, "'%s' is not an address space", tok.text)
+		}
+		qual.id = spaceConst(sym.space)
+		p.expect(modeSem, "]")
+	}
+	if p.accept(modeSem, ":") {
+		qual.size = p.expectInt32(modeSem)
+	}
+	if qual.id.space == nil {
+		p.c.errorf("no default space specified")
+		qual.id = spaceConst(p.c.constSpace)
+	}
+	return qual
+}
+
+// parseLabel parses the name of a label after the '<', defining it if
+// new.
+func (p *parser) parseLabel() *labelSymbol {
+	tok := p.expectIdent(modeSem)
+	p.expect(modeSem, ">")
+	switch sym := p.lookup(tok.text).(type) {
+	case nil:
+		lab, err := p.c.defineLabel(tok.text)
+		if err != nil {
+			p.c.errorf("%v", err)
+		}
+		return lab
+	case *labelSymbol:
+		return sym
+	}
+	p.fail(tok, "'%s' is not a label", tok.text)
+	return nil
+}
+
+func (p *parser) parseStatement() []*opTpl {
+	c := p.c
+	tok := p.next(modeSem)
+	switch {
+	case isPunct(tok, "<"):
+		return c.placeLabel(p.parseLabel())
+	case isPunct(tok, "*"):
+		qual := p.parseSizedStar()
+		ptr := p.parseExpr()
+		p.expect(modeSem, "=")
+		val := p.parseExpr()
+		p.expect(modeSem, ";")
+		ops, err := c.createStore(qual, ptr, val)
+		if err != nil {
+			c.errorf("%v", err)
+		}
+		return ops
+	case tok.kind != tokIdent:
+		p.fail(tok, "syntax error: unexpected %s", tok)
+	}
+
+	switch tok.text {
+	case "local":
+		name := p.expectIdent(modeSem)
+		if p.lookup(name.text) != nil {
+			p.fail(name, "redefinition of symbol: %s", name.text)
+		}
+		size := 0
+		if p.accept(modeSem, ":") {
+			size = p.expectInt32(modeSem)
+		}
+		if p.accept(modeSem, ";") {
+			if err := c.newLocalDefinition(name.text, size); err != nil {
+				c.errorf("%v", err)
+			}
+			return nil
+		}
+		p.expect(modeSem, "=")
+		return p.assignNew(name.text, size, true)
+	case "build":
+		op := p.expectIdent(modeSem)
+		sym, ok := p.lookup(op.text).(*operandSymbol)
+		if !ok {
+			p.fail(op, "'%s' is not an operand", op.text)
+		}
+		p.expect(modeSem, ";")
+		return c.createOpConst(opBuild, uint64(sym.index))
+	case "crossbuild":
+		p.fail(tok, "crossbuild is not supported")
+	case "delayslot":
+		p.expect(modeSem, "(")
+		n := p.expectInt(modeSem).val
+		p.expect(modeSem, ")")
+		p.expect(modeSem, ";")
+		return c.createOpConst(opDelaySlot, n)
+	case "goto", "call":
+		direct, indirect := opBranch, opBranchInd
+		if tok.text == "call" {
+			direct, indirect = opCall, opCallInd
+		}
+		if p.accept(modeSem, "[") {
+			e := p.parseExpr()
+			p.expect(modeSem, "]")
+			p.expect(modeSem, ";")
+			return c.createOpNoOut(indirect, e)
+		}
+		dest := p.parseJumpDest()
+		p.expect(modeSem, ";")
+		return c.createOpNoOut(direct, varnodeExpr(dest))
+	case "if":
+		cond := p.parseExpr()
+		p.expectKeyword(modeSem, "goto")
+		dest := p.parseJumpDest()
+		p.expect(modeSem, ";")
+		return c.createOpNoOut(opCBranch, varnodeExpr(dest), cond)
+	case "return":
+		if !p.accept(modeSem, "[") {
+			p.fail(tok, "must specify an indirect parameter for return")
+		}
+		e := p.parseExpr()
+		p.expect(modeSem, "]")
+		p.expect(modeSem, ";")
+		return c.createOpNoOut(opReturn, e)
+	}
+
+	switch sym := p.lookup(tok.text).(type) {
+	case nil:
+		size := 0
+		local := false
+		if p.accept(modeSem, ":") {
+			size = p.expectInt32(modeSem)
+			local = true
+		}
+		p.expect(modeSem, "=")
+		return p.assignNew(tok.text, size, local)
+	case *userOpSymbol:
+		params := p.parseParams()
+		p.expect(modeSem, ";")
+		return c.createUserOpNoOut(sym, params)
+	case *macroSymbol:
+		params := p.parseParams()
+		p.expect(modeSem, ";")
+		return c.createMacroUse(sym, params)
+	case *bitrangeSymbol:
+		p.expect(modeSem, "=")
+		e := p.parseExpr()
+		p.expect(modeSem, ";")
+		ops, err := c.assignBitRange(sym.vn.varnode(), sym.bitOffset, sym.numBits, e)
+		if err != nil {
+			c.errorf("%v", err)
+		}
+		return ops
+	case specificSymbol:
+		vn := sym.varnode()
+		next := p.next(modeSem)
+		switch {
+		case isPunct(next, "="):
+			e := p.parseExpr()
+			p.expect(modeSem, ";")
+			if err := e.setOutput(vn); err != nil {
+				c.errorf("%v", err)
+			}
+			return e.ops
+		case isPunct(next, "["):
+			bitOffset := p.expectInt32(modeSem)
+			p.expect(modeSem, ",")
+			numBits := p.expectInt32(modeSem)
+			p.expect(modeSem, "]")
+			p.expect(modeSem, "=")
+			e := p.parseExpr()
+			p.expect(modeSem, ";")
+			ops, err := c.assignBitRange(vn, bitOffset, numBits, e)
+			if err != nil {
+				c.errorf("%v", err)
+			}
+			return ops
+		case isPunct(next, ":"):
+			p.fail(next, "illegal truncation on left-hand side of assignment")
+		case isPunct(next, "("):
+			p.fail(next, "illegal subpiece on left-hand side of assignment")
+		}
+		p.fail(next, "syntax error: unexpected %s", next)
+	case *subtableSymbol:
+		p.fail(tok, "subtable '%s' not attached to operand", tok.text)
+	}
+	p.fail(tok, "syntax error: unexpected %s", tok)
+	return nil
+}
+
+// assignNew parses the value of a new local, after the '='.
+func (p *parser) assignNew(name string, size int, local bool) []*opTpl {
+	e := p.parseExpr()
+	p.expect(modeSem, ";")
+	ops, err := p.c.newOutput(local, e, name, size)
+	if err != nil {
+		p.c.errorf("%v", err)
+	}
+	return ops
+}
+
+func (p *parser) parseParams() []*exprTree {
+	var params []*exprTree
+	p.expect(modeSem, "(")
+	if p.accept(modeSem, ")") {
+		return nil
+	}
+	for {
+		params = append(params, p.parseExpr())
+		if p.accept(modeSem, ")") {
+			return params
+		}
+		p.expect(modeSem, ",")
+	}
+}
+
+func (p *parser) parseJumpDest() *varnodeTpl {
+	c := p.c
+	tok := p.next(modeSem)
+	switch {
+	case isPunct(tok, "<"):
+		lab := p.parseLabel()
+		lab.refCount++
+		return &varnodeTpl{space: spaceConst(c.constSpace), offset: constTpl{typ: constRelative, val: uint64(lab.index)}, size: realConst(4)}
+	case tok.kind == tokInt:
+		if p.accept(modeSem, "[") {
+			name := p.expectIdent(modeSem)
+			sym, ok := p.lookup(name.text).(*spaceSymbol)
+			if !ok {
+				p.fail(name, "'%s' is not an address space", name.text)
+			}
+			p.expect(modeSem, "]")
+			return &varnodeTpl{space: spaceConst(sym.space), offset: realConst(tok.val), size: realConst(uint64(sym.space.size))}
+		}
+		return &varnodeTpl{space: constTpl{typ: constCurSpace}, offset: realConst(tok.val), size: constTpl{typ: constCurSpaceSize}}
+	case tok.kind == tokIdent:
+		switch sym := p.lookup(tok.text).(type) {
+		case *addressSymbol:
+			return &varnodeTpl{space: constTpl{typ: constCurSpace}, offset: constTpl{typ: sym.kind}, size: constTpl{typ: constCurSpaceSize}}
+		case *operandSymbol:
+			sym.codeAddress = true
+			return sym.varnode()
+		case specificSymbol:
+			return sym.varnode()
+		case nil:
+			p.fail(tok, "unknown jump destination '%s'", tok.text)
+		}
+	}
+	p.fail(tok, "syntax error: unexpected %s, expecting a jump destination", tok)
+	return nil
+}
+
+// parseIntegerVarnode parses a constant, sized or not, or the address of a
+// varnode.
+func (p *parser) parseIntegerVarnode() *varnodeTpl {
+	c := p.c
+	tok := p.next(modeSem)
+	switch {
+	case tok.kind == tokInt:
+		size := 0
+		if p.accept(modeSem, ":") {
+			size = p.expectInt32(modeSem)
+		}
+		return c.constVarnode(tok.val, size)
+	case isPunct(tok, "&"):
+		size := 0
+		if p.accept(modeSem, ":") {
+			size = p.expectInt32(modeSem)
+		}
+		next := p.peek(modeSem)
+		var vn *varnodeTpl
+		if next.kind == tokInt || isPunct(next, "&") {
+			vn = p.parseIntegerVarnode()
+		} else {
+			vn = p.specificVarnode(p.next(modeSem))
+		}
+		return c.addressOf(vn, size)
+	}
+	p.fail(tok, "syntax error: unexpected %s, expecting an integer", tok)
+	return nil
+}
+
+// Binary operators of the semantics by precedence, the comparisons with
+// swapped operands marked.
+var semOpLevels = [][]struct {
+	tok  string
+	code int
+	swap bool
+}{
+	{{"||", opBoolOr, false}},
+	{{"&&", opBoolAnd, false}, {"^^", opBoolXor, false}},
+	{{"|", opIntOr, false}},
+	{{"^", opIntXor, false}},
+	{{"&", opIntAnd, false}},
+	{{"==", opIntEqual, false}, {"!=", opIntNotEqual, false}, {"f==", opFloatEqual, false}, {"f!=", opFloatNotEqual, false}},
+	{
+		{"<", opIntLess, false}, {"<=", opIntLessEqual, false}, {">", opIntLess, true}, {">=", opIntLessEqual, true},
+		{"s<", opIntSLess, false}, {"s<=", opIntSLessEqual, false}, {"s>", opIntSLess, true}, {"s>=", opIntSLessEqual, true},
+		{"f<", opFloatLess, false}, {"f<=", opFloatLessEqual, false}, {"f>", opFloatLess, true}, {"f>=", opFloatLessEqual, true},
+	},
+	{{"<<", opIntLeft, false}, {">>", opIntRight, false}, {"s>>", opIntSRight, false}},
+	{{"+", opIntAdd, false}, {"-", opIntSub, false}, {"f+", opFloatAdd, false}, {"f-", opFloatSub, false}},
+	{
+		{"*", opIntMult, false}, {"/", opIntDiv, false}, {"%", opIntRem, false}, {"s/", opIntSDiv, false},
+		{"s%", opIntSRem, false}, {"f*", opFloatMult, false}, {"f/", opFloatDiv, false},
+	},
+}
+
+// compareLevel is the level of the comparisons, which do not chain.
+const compareLevel = 6
+
+func (p *parser) parseExpr() *exprTree {
+	return p.parseBinary(0)
+}
+
+func (p *parser) parseBinary(level int) *exprTree {
+	if level == len(semOpLevels) {
+		return p.parseUnary()
+	}
+	left := p.parseBinary(level + 1)
+	for {
+		tok := p.peek(modeSem)
+		found := false
+		for _, o := range semOpLevels[level] {
+			if !isPunct(tok, o.tok) {
+				continue
+			}
+			p.next(modeSem)
+			right := p.parseBinary(level + 1)
+			if o.swap {
+				left = p.c.createBinaryOp(o.code, right, left)
+			} else {
+				left = p.c.createBinaryOp(o.code, left, right)
+			}
+			found = true
+			break
+		}
+		if !found || level == compareLevel {
+			return left
+		}
+	}
+}
+
+var unaryOps = map[string]int{
+	"-":  opInt2Comp,
+	"~":  opIntNegate,
+	"!":  opBoolNegate,
+	"f-": opFloatNeg,
+}
+
+func (p *parser) parseUnary() *exprTree {
+	tok := p.peek(modeSem)
+	if isPunct(tok, "*") {
+		p.next(modeSem)
+		qual := p.parseSizedStar()
+		e, err := p.c.createLoad(qual, p.parseUnary())
+		if err != nil {
+			p.c.errorf("%v", err)
+		}
+		return e
+	}
+	if code, ok := unaryOps[tok.text]; ok && tok.kind == tokPunct {
+		p.next(modeSem)
+		return p.c.createOp(code, p.parseUnary())
+	}
+	return p.parsePrimary()
+}
+
+// Functions of the semantics taking one operand, and the ones taking two.
+var (
+	unaryFuncs = map[string]int{
+		"abs":         opFloatAbs,
+		"sqrt":        opFloatSqrt,
+		"sext":        opIntSExt,
+		"zext":        opIntZExt,
+		"float2float": opFloatFloat2Float,
+		"int2float":   opFloatInt2Float,
+		"nan":         opFloatNaN,
+		"trunc":       opFloatTrunc,
+		"ceil":        opFloatCeil,
+		"floor":       opFloatFloor,
+		"round":       opFloatRound,
+		"popcount":    opPopcount,
+		"lzcount":     opLzcount,
+	}
+	binaryFuncs = map[string]int{
+		"carry":   opIntCarry,
+		"scarry":  opIntSCarry,
+		"sborrow": opIntSBorrow,
+	}
+)
+
+func (p *parser) parsePrimary() *exprTree {
+	c := p.c
+	tok := p.peek(modeSem)
+	switch {
+	case isPunct(tok, "("):
+		p.next(modeSem)
+		e := p.parseExpr()
+		p.expect(modeSem, ")")
+		return e
+	case tok.kind == tokInt || isPunct(tok, "&"):
+		return varnodeExpr(p.parseIntegerVarnode())
+	case tok.kind != tokIdent:
+		p.fail(tok, "syntax error: unexpected %s in expression", tok)
+	}
+	p.next(modeSem)
+
+	if code, ok := unaryFuncs[tok.text]; ok {
+		p.expect(modeSem, "(")
+		e := p.parseExpr()
+		p.expect(modeSem, ")")
+		return c.createOp(code, e)
+	}
+	if code, ok := binaryFuncs[tok.text]; ok {
+		p.expect(modeSem, "(")
+		a := p.parseExpr()
+		p.expect(modeSem, ",")
+		b := p.parseExpr()
+		p.expect(modeSem, ")")
+		return c.createBinaryOp(code, a, b)
+	}
+	switch tok.text {
+	case "newobject":
+		params := p.parseParams()
+		switch len(params) {
+		case 1:
+			return c.createOp(opNew, params[0])
+		case 2:
+			return c.createBinaryOp(opNew, params[0], params[1])
+		}
+		p.fail(tok, "newobject takes one or two parameters")
+	case "cpool":
+		params := p.parseParams()
+		if len(params) < 2 {
+			p.fail(tok, "must at least two inputs to cpool")
+		}
+		return c.createVariadic(opCPoolRef, params)
+	}
+
+	switch sym := p.lookup(tok.text).(type) {
+	case *userOpSymbol:
+		return c.createUserOp(sym, p.parseParams())
+	case *bitrangeSymbol:
+		e, err := c.createBitRange(sym.vn, sym.bitOffset, sym.numBits)
+		if err != nil {
+			c.errorf("%v", err)
+		}
+		return e
+	case specificSymbol:
+		switch next := p.peek(modeSem); {
+		case isPunct(next, "("):
+			p.next(modeSem)
+			vn := p.parseIntegerVarnode()
+			p.expect(modeSem, ")")
+			return c.createBinaryOp(opSubpiece, varnodeExpr(sym.varnode()), varnodeExpr(vn))
+		case isPunct(next, ":"):
+			p.next(modeSem)
+			size := p.expectInt32(modeSem)
+			e, err := c.createBitRange(sym, 0, size*8)
+			if err != nil {
+				c.errorf("%v", err)
+			}
+			return e
+		case isPunct(next, "["):
+			p.next(modeSem)
+			bitOffset := p.expectInt32(modeSem)
+			p.expect(modeSem, ",")
+			numBits := p.expectInt32(modeSem)
+			p.expect(modeSem, "]")
+			e, err := c.createBitRange(sym, bitOffset, numBits)
+			if err != nil {
+				c.errorf("%v", err)
+			}
+			return e
+		}
+		return varnodeExpr(sym.varnode())
+	}
+	return varnodeExpr(p.specificVarnode(tok))
+}
@@ -0,0 +1,667 @@
+package sleigh
+
+import "fmt"
+
+// token is a unit of instruction bytes fields are defined on.
+type token struct {
+	name      string
+	size      int // in bytes
+	bigEndian bool
+	index     int
+}
+
+// patternExpr is an expression over the fields of the instruction and the
+// context, used by constraints, operand definitions and context changes.
+type patternExpr interface {
+	// listValues lists the values the expression depends on, in the order
+	// getSubValue consumes them.
+	listValues(list []patternValue) []patternValue
+	getMinMax(min, max []int64) ([]int64, []int64)
+	getSubValue(replace []int64, pos *int) int64
+	encode(e *encoder)
+}
+
+// patternValue is a leaf of a patternExpr.
+type patternValue interface {
+	patternExpr
+	genMinPattern(ops []tokenPattern) tokenPattern
+	genPattern(val int64) (tokenPattern, error)
+	minValue() int64
+	maxValue() int64
+}
+
+func subValue(p patternExpr, replace []int64) int64 {
+	pos := 0
+	return p.getSubValue(replace, &pos)
+}
+
+func valueListValues(v patternValue, list []patternValue) []patternValue {
+	return append(list, v)
+}
+
+func valueMinMax(v patternValue, min, max []int64) ([]int64, []int64) {
+	return append(min, v.minValue()), append(max, v.maxValue())
+}
+
+func valueSubValue(replace []int64, pos *int) int64 {
+	v := replace[*pos]
+	*pos++
+	return v
+}
+
+func bitMax(bits int) int64 {
+	if bits >= 64 {
+		return -1
+	}
+	return int64(1)<<uint(bits) - 1
+}
+
+// tokenField is a bit range of a token.
+type tokenField struct {
+	tok                *token
+	bigEndian          bool
+	signBit            bool
+	bitStart, bitEnd   int
+	byteStart, byteEnd int
+	shift              int
+}
+
+func newTokenField(tok *token, signed bool, bitStart, bitEnd int) *tokenField {
+	f := &tokenField{tok: tok, bigEndian: tok.bigEndian, signBit: signed, bitStart: bitStart, bitEnd: bitEnd}
+	if tok.bigEndian {
+		f.byteEnd = (tok.size*8 - bitStart - 1) / 8
+		f.byteStart = (tok.size*8 - bitEnd - 1) / 8
+	} else {
+		f.byteStart = bitStart / 8
+		f.byteEnd = bitEnd / 8
+	}
+	f.shift = bitStart % 8
+	return f
+}
+
+func (f *tokenField) listValues(list []patternValue) []patternValue { return valueListValues(f, list) }
+func (f *tokenField) getMinMax(min, max []int64) ([]int64, []int64) {
+	return valueMinMax(f, min, max)
+}
+func (f *tokenField) getSubValue(replace []int64, pos *int) int64 { return valueSubValue(replace, pos) }
+func (f *tokenField) minValue() int64                             { return 0 }
+func (f *tokenField) maxValue() int64                             { return bitMax(f.bitEnd - f.bitStart + 1) }
+
+func (f *tokenField) genMinPattern(ops []tokenPattern) tokenPattern {
+	return tokenPattern{pattern: newInstructionPattern(true), toks: []*token{f.tok}}
+}
+
+func (f *tokenField) genPattern(val int64) (tokenPattern, error) {
+	return newFieldPattern(f.tok, val, f.bitStart, f.bitEnd), nil
+}
+
+func (f *tokenField) encode(e *encoder) {
+	e.open(elemTokenField)
+	e.bool(attribBigEndian, f.bigEndian)
+	e.bool(attribSignBit, f.signBit)
+	e.signed(attribStartBit, int64(f.bitStart))
+	e.signed(attribEndBit, int64(f.bitEnd))
+	e.signed(attribStartByte, int64(f.byteStart))
+	e.signed(attribEndByte, int64(f.byteEnd))
+	e.signed(attribShift, int64(f.shift))
+	e.close(elemTokenField)
+}
+
+// contextField is a bit range of the packed context, bit 0 being the most
+// significant bit of the first word.
+type contextField struct {
+	signBit            bool
+	startBit, endBit   int
+	startByte, endByte int
+	shift              int
+}
+
+func newContextField(signed bool, startBit, endBit int) *contextField {
+	return &contextField{
+		signBit:   signed,
+		startBit:  startBit,
+		endBit:    endBit,
+		startByte: startBit / 8,
+		endByte:   endBit / 8,
+		shift:     7 - endBit%8,
+	}
+}
+
+func (f *contextField) listValues(list []patternValue) []patternValue {
+	return valueListValues(f, list)
+}
+func (f *contextField) getMinMax(min, max []int64) ([]int64, []int64) {
+	return valueMinMax(f, min, max)
+}
+func (f *contextField) getSubValue(replace []int64, pos *int) int64 {
+	return valueSubValue(replace, pos)
+}
+func (f *contextField) minValue() int64 { return 0 }
+func (f *contextField) maxValue() int64 { return bitMax(f.endBit - f.startBit + 1) }
+
+func (f *contextField) genMinPattern(ops []tokenPattern) tokenPattern {
+	return tokenPattern{pattern: newInstructionPattern(true)}
+}
+
+func (f *contextField) genPattern(val int64) (tokenPattern, error) {
+	size := f.endBit/8 + 1
+	block := buildBigBlock(size, size*8-1-f.endBit, size*8-1-f.startBit, val)
+	return tokenPattern{pattern: &contextPattern{mask: block}}, nil
+}
+
+func (f *contextField) encode(e *encoder) {
+	e.open(elemContextField)
+	e.bool(attribSignBit, f.signBit)
+	e.signed(attribStartBit, int64(f.startBit))
+	e.signed(attribEndBit, int64(f.endBit))
+	e.signed(attribStartByte, int64(f.startByte))
+	e.signed(attribEndByte, int64(f.endByte))
+	e.signed(attribShift, int64(f.shift))
+	e.close(elemContextField)
+}
+
+type constantValue struct {
+	val int64
+}
+
+func (c *constantValue) listValues(list []patternValue) []patternValue {
+	return valueListValues(c, list)
+}
+func (c *constantValue) getMinMax(min, max []int64) ([]int64, []int64) {
+	return valueMinMax(c, min, max)
+}
+func (c *constantValue) getSubValue(replace []int64, pos *int) int64 {
+	return valueSubValue(replace, pos)
+}
+func (c *constantValue) minValue() int64 { return c.val }
+func (c *constantValue) maxValue() int64 { return c.val }
+
+func (c *constantValue) genMinPattern(ops []tokenPattern) tokenPattern {
+	return tokenPattern{pattern: newInstructionPattern(true)}
+}
+
+func (c *constantValue) genPattern(val int64) (tokenPattern, error) {
+	return tokenPattern{pattern: newInstructionPattern(c.val == val)}, nil
+}
+
+func (c *constantValue) encode(e *encoder) {
+	e.open(elemIntb)
+	e.signed(attribVal, c.val)
+	e.close(elemIntb)
+}
+
+// addressValue is inst_start, inst_next or inst_next2 in an expression.
+type addressValue struct {
+	elem int
+}
+
+func (a *addressValue) listValues(list []patternValue) []patternValue {
+	return valueListValues(a, list)
+}
+func (a *addressValue) getMinMax(min, max []int64) ([]int64, []int64) {
+	return valueMinMax(a, min, max)
+}
+func (a *addressValue) getSubValue(replace []int64, pos *int) int64 {
+	return valueSubValue(replace, pos)
+}
+func (a *addressValue) minValue() int64 { return 0 }
+func (a *addressValue) maxValue() int64 { return 0 }
+
+func (a *addressValue) genMinPattern(ops []tokenPattern) tokenPattern {
+	return tokenPattern{pattern: newInstructionPattern(true)}
+}
+
+func (a *addressValue) genPattern(val int64) (tokenPattern, error) {
+	return tokenPattern{pattern: newInstructionPattern(true)}, nil
+}
+
+func (a *addressValue) encode(e *encoder) {
+	e.empty(a.elem)
+}
+
+// operandValue is the value of an operand of a constructor, which is fixed
+// only once the operands are laid out.
+type operandValue struct {
+	op *operandSymbol
+}
+
+func (o *operandValue) listValues(list []patternValue) []patternValue {
+	return valueListValues(o, list)
+}
+func (o *operandValue) getMinMax(min, max []int64) ([]int64, []int64) {
+	return valueMinMax(o, min, max)
+}
+func (o *operandValue) getSubValue(replace []int64, pos *int) int64 {
+	return valueSubValue(replace, pos)
+}
+
+// The bounds of an operand are unknown; constraints using it are rejected
+// by genPattern before they are needed.
+func (o *operandValue) minValue() int64 { return 0 }
+func (o *operandValue) maxValue() int64 { return 0 }
+
+func (o *operandValue) genMinPattern(ops []tokenPattern) tokenPattern {
+	return ops[o.op.index]
+}
+
+func (o *operandValue) genPattern(val int64) (tokenPattern, error) {
+	return tokenPattern{}, fmt.Errorf("operand used in pattern expression")
+}
+
+func (o *operandValue) encode(e *encoder) {
+	e.open(elemOperandExp)
+	e.signed(attribIndex, int64(o.op.index))
+	e.unsigned(attribTable, uint64(o.op.ct.parent.id))
+	e.unsigned(attribCt, uint64(o.op.ct.id))
+	e.close(elemOperandExp)
+}
+
+type binaryOp int
+
+const (
+	opPlus binaryOp = iota
+	opSub
+	opMult
+	opLeftShift
+	opRightShift
+	opAnd
+	opOr
+	opXor
+	opDiv
+)
+
+var binaryElems = [...]int{
+	opPlus:       elemPlusExp,
+	opSub:        elemSubExp,
+	opMult:       elemMultExp,
+	opLeftShift:  elemLshiftExp,
+	opRightShift: elemRshiftExp,
+	opAnd:        elemAndExp,
+	opOr:         elemOrExp,
+	opXor:        elemXorExp,
+	opDiv:        elemDivExp,
+}
+
+type binaryExpr struct {
+	op          binaryOp
+	left, right patternExpr
+}
+
+func (b *binaryExpr) listValues(list []patternValue) []patternValue {
+	return b.right.listValues(b.left.listValues(list))
+}
+
+func (b *binaryExpr) getMinMax(min, max []int64) ([]int64, []int64) {
+	min, max = b.left.getMinMax(min, max)
+	return b.right.getMinMax(min, max)
+}
+
+func (b *binaryExpr) getSubValue(replace []int64, pos *int) int64 {
+	l := b.left.getSubValue(replace, pos)
+	r := b.right.getSubValue(replace, pos)
+	switch b.op {
+	case opPlus:
+		return l + r
+	case opSub:
+		return l - r
+	case opMult:
+		return l * r
+	case opLeftShift:
+		return l << uint64(r)
+	case opRightShift:
+		return l >> uint64(r)
+	case opAnd:
+		return l & r
+	case opOr:
+		return l | r
+	case opXor:
+		return l ^ r
+	case opDiv:
+		if r == 0 {
+			return 0
+		}
+		return l / r
+	}
+	return 0
+}
+
+func (b *binaryExpr) encode(e *encoder) {
+	elem := binaryElems[b.op]
+	e.open(elem)
+	b.left.encode(e)
+	b.right.encode(e)
+	e.close(elem)
+}
+
+// unaryExpr is a negation (minus) or a complement (not).
+type unaryExpr struct {
+	not     bool
+	operand patternExpr
+}
+
+func (u *unaryExpr) listValues(list []patternValue) []patternValue {
+	return u.operand.listValues(list)
+}
+
+func (u *unaryExpr) getMinMax(min, max []int64) ([]int64, []int64) {
+	return u.operand.getMinMax(min, max)
+}
+
+func (u *unaryExpr) getSubValue(replace []int64, pos *int) int64 {
+	v := u.operand.getSubValue(replace, pos)
+	if u.not {
+		return ^v
+	}
+	return -v
+}
+
+func (u *unaryExpr) encode(e *encoder) {
+	elem := elemMinusExp
+	if u.not {
+		elem = elemNotExp
+	}
+	e.open(elem)
+	u.operand.encode(e)
+	e.close(elem)
+}
+
+// tokenPattern is a pattern along with the tokens it spans, and whether it
+// may be preceded or followed by more tokens (an ellipsis).
+type tokenPattern struct {
+	pattern       pattern
+	toks          []*token
+	leftEllipsis  bool
+	rightEllipsis bool
+}
+
+func newTruePattern() tokenPattern {
+	return tokenPattern{pattern: newInstructionPattern(true)}
+}
+
+// newFieldPattern returns the pattern of a token field holding val.
+func newFieldPattern(tok *token, val int64, bitStart, bitEnd int) tokenPattern {
+	var block *patternBlock
+	if tok.bigEndian {
+		block = buildBigBlock(tok.size, bitStart, bitEnd, val)
+	} else {
+		block = buildLittleBlock(tok.size, bitStart, bitEnd, val)
+	}
+	return tokenPattern{pattern: &instructionPattern{mask: block}, toks: []*token{tok}}
+}
+
+// buildSingle returns the block of the bits startbit to endbit, numbered
+// from the most significant bit, holding the low bits of val.
+func buildSingle(startbit, endbit int, val uint32) *patternBlock {
+	offset := 0
+	size := endbit - startbit + 1
+	for startbit >= 8 {
+		offset++
+		startbit -= 8
+		endbit -= 8
+	}
+	mask := ^uint32(0) << uint(32-size)
+	val = val << uint(32-size) & mask
+	mask >>= uint(startbit)
+	val >>= uint(startbit)
+	return newWordBlock(offset, mask, val)
+}
+
+func buildBigBlock(size, bitStart, bitEnd int, val int64) *patternBlock {
+	startbit := 8*size - 1 - bitEnd
+	endbit := 8*size - 1 - bitStart
+
+	var block *patternBlock
+	for endbit >= startbit {
+		tmpstart := endbit - endbit&7
+		if tmpstart < startbit {
+			tmpstart = startbit
+		}
+		tmp := buildSingle(tmpstart, endbit, uint32(val))
+		if block == nil {
+			block = tmp
+		} else {
+			block = block.intersect(tmp)
+		}
+		val >>= uint(endbit - tmpstart + 1)
+		endbit = tmpstart - 1
+	}
+	return block
+}
+
+// buildLittleBlock is buildBigBlock for little endian tokens, whose bits
+// are numbered from the least significant bit of the first byte.
+func buildLittleBlock(size, bitStart, bitEnd int, val int64) *patternBlock {
+	var block *patternBlock
+	for lo := bitStart; lo <= bitEnd; {
+		hi := lo | 7
+		if hi > bitEnd {
+			hi = bitEnd
+		}
+		base := lo &^ 7
+		tmp := buildSingle(base+7-hi%8, base+7-lo%8, uint32(val>>uint(lo-bitStart)))
+		if block == nil {
+			block = tmp
+		} else {
+			block = block.intersect(tmp)
+		}
+		lo = hi + 1
+	}
+	return block
+}
+
+func tokenSizes(toks []*token) int {
+	n := 0
+	for _, t := range toks {
+		n += t.size
+	}
+	return n
+}
+
+func (t tokenPattern) minimumLength() int {
+	return tokenSizes(t.toks)
+}
+
+func (t tokenPattern) alwaysTrue() bool            { return t.pattern.alwaysTrue() }
+func (t tokenPattern) alwaysFalse() bool           { return t.pattern.alwaysFalse() }
+func (t tokenPattern) alwaysInstructionTrue() bool { return t.pattern.alwaysInstructionTrue() }
+
+// resolveTokens aligns the tokens of a and b, setting the tokens and
+// ellipses of t, and returns how much b is shifted relative to a.
+func (t *tokenPattern) resolveTokens(a, b tokenPattern) (int, error) {
+	reverse := false
+	t.leftEllipsis = false
+	t.rightEllipsis = false
+	minsize := len(a.toks)
+	if len(b.toks) < minsize {
+		minsize = len(b.toks)
+	}
+	if minsize == 0 {
+		// a pattern without tokens nor ellipsis does not care about them
+		if len(a.toks) == 0 && !a.leftEllipsis && !a.rightEllipsis {
+			t.toks = b.toks
+			t.leftEllipsis = b.leftEllipsis
+			t.rightEllipsis = b.rightEllipsis
+			return 0, nil
+		}
+		if len(b.toks) == 0 && !b.leftEllipsis && !b.rightEllipsis {
+			t.toks = a.toks
+			t.leftEllipsis = a.leftEllipsis
+			t.rightEllipsis = a.rightEllipsis
+			return 0, nil
+		}
+	}
+
+	mismatch := func(n, m int) error {
+		return fmt.Errorf("mismatched pattern sizes -- %d != %d", n, m)
+	}
+	switch {
+	case a.leftEllipsis:
+		reverse = true
+		switch {
+		case b.rightEllipsis:
+			return 0, fmt.Errorf("right/left ellipsis")
+		case b.leftEllipsis:
+			t.leftEllipsis = true
+		case len(a.toks) != minsize:
+			return 0, mismatch(len(a.toks), minsize)
+		case len(a.toks) == len(b.toks):
+			return 0, fmt.Errorf("pattern size cannot vary (missing '...'?)")
+		}
+	case a.rightEllipsis:
+		switch {
+		case b.leftEllipsis:
+			return 0, fmt.Errorf("left/right ellipsis")
+		case b.rightEllipsis:
+			t.rightEllipsis = true
+		case len(a.toks) != minsize:
+			return 0, mismatch(len(a.toks), minsize)
+		case len(a.toks) == len(b.toks):
+			return 0, fmt.Errorf("pattern size cannot vary (missing '...'?)")
+		}
+	case b.leftEllipsis || b.rightEllipsis:
+		reverse = b.leftEllipsis
+		if len(b.toks) != minsize {
+			return 0, mismatch(len(b.toks), minsize)
+		}
+		if len(a.toks) == len(b.toks) {
+			return 0, fmt.Errorf("pattern size cannot vary (missing '...'?)")
+		}
+	default:
+		if len(b.toks) != len(a.toks) {
+			return 0, mismatch(len(b.toks), len(a.toks))
+		}
+	}
+
+	sa := 0
+	if reverse {
+		for i := 0; i < minsize; i++ {
+			ta, tb := a.toks[len(a.toks)-1-i], b.toks[len(b.toks)-1-i]
+			if ta != tb {
+				return 0, fmt.Errorf("mismatched tokens when combining patterns -- %s != %s", ta.name, tb.name)
+			}
+		}
+		if len(a.toks) <= len(b.toks) {
+			for i := minsize; i < len(b.toks); i++ {
+				sa += b.toks[len(b.toks)-1-i].size
+			}
+		} else {
+			for i := minsize; i < len(a.toks); i++ {
+				sa += a.toks[len(a.toks)-1-i].size
+			}
+		}
+		if len(a.toks) < len(b.toks) {
+			sa = -sa
+		}
+	} else {
+		for i := 0; i < minsize; i++ {
+			if a.toks[i] != b.toks[i] {
+				return 0, fmt.Errorf("mismatched tokens when combining patterns -- %s != %s", a.toks[i].name, b.toks[i].name)
+			}
+		}
+	}
+
+	if len(a.toks) <= len(b.toks) {
+		t.toks = b.toks
+	} else {
+		t.toks = a.toks
+	}
+	return sa, nil
+}
+
+func (t tokenPattern) doAnd(b tokenPattern) (tokenPattern, error) {
+	var res tokenPattern
+	sa, err := res.resolveTokens(t, b)
+	if err != nil {
+		return res, err
+	}
+	res.pattern = t.pattern.doAnd(b.pattern, sa)
+	return res, nil
+}
+
+func (t tokenPattern) doOr(b tokenPattern) (tokenPattern, error) {
+	var res tokenPattern
+	sa, err := res.resolveTokens(t, b)
+	if err != nil {
+		return res, err
+	}
+	res.pattern = t.pattern.doOr(b.pattern, sa)
+	return res, nil
+}
+
+func (t tokenPattern) doCat(b tokenPattern) (tokenPattern, error) {
+	res := tokenPattern{
+		leftEllipsis:  t.leftEllipsis,
+		rightEllipsis: t.rightEllipsis,
+		toks:          append([]*token(nil), t.toks...),
+	}
+	sa := -1
+	if t.rightEllipsis || b.leftEllipsis {
+		// an interior ellipsis must not hide any constraint
+		if t.rightEllipsis && !b.alwaysInstructionTrue() {
+			return res, fmt.Errorf("interior ellipsis in pattern")
+		}
+		if b.leftEllipsis {
+			if !t.alwaysInstructionTrue() {
+				return res, fmt.Errorf("interior ellipsis in pattern")
+			}
+			res.leftEllipsis = true
+		}
+	} else {
+		sa = tokenSizes(t.toks)
+		res.toks = append(res.toks, b.toks...)
+		res.rightEllipsis = b.rightEllipsis
+	}
+	if res.rightEllipsis && res.leftEllipsis {
+		return res, fmt.Errorf("double ellipsis in pattern")
+	}
+	if sa < 0 {
+		sa = 0
+	}
+	res.pattern = t.pattern.doAnd(b.pattern, sa)
+	return res, nil
+}
+
+// commonSubPattern returns the pattern matching whatever t or b matches.
+func (t tokenPattern) commonSubPattern(b tokenPattern) (tokenPattern, error) {
+	var res tokenPattern
+	reverse := false
+	if t.leftEllipsis || b.leftEllipsis {
+		if t.rightEllipsis || b.rightEllipsis {
+			return res, fmt.Errorf("right/left ellipsis in commonSubPattern")
+		}
+		reverse = true
+	}
+
+	res.leftEllipsis = t.leftEllipsis || b.leftEllipsis
+	res.rightEllipsis = t.rightEllipsis || b.rightEllipsis
+	minnum, maxnum := len(t.toks), len(b.toks)
+	if maxnum < minnum {
+		minnum, maxnum = maxnum, minnum
+	}
+	i := 0
+	if reverse {
+		for ; i < minnum; i++ {
+			tok := t.toks[len(t.toks)-1-i]
+			if tok != b.toks[len(b.toks)-1-i] {
+				break
+			}
+			res.toks = append([]*token{tok}, res.toks...)
+		}
+		if i < maxnum {
+			res.leftEllipsis = true
+		}
+	} else {
+		for ; i < minnum; i++ {
+			tok := t.toks[i]
+			if tok != b.toks[i] {
+				break
+			}
+			res.toks = append(res.toks, tok)
+		}
+		if i < maxnum {
+			res.rightEllipsis = true
+		}
+	}
+	res.pattern = t.pattern.commonSubPattern(b.pattern, 0)
+	return res, nil
+}
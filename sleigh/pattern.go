@@ -0,0 +1,691 @@
+package sleigh
+
+// patternBlock is a mask and value over a run of bytes, starting offset
+// bytes into the instruction or context. Bit 0 of a word is its most
+// significant bit. nonzero is the number of bytes up to the last one with a
+// mask bit set, 0 for a block matching anything and -1 for one matching
+// nothing.
+type patternBlock struct {
+	offset  int
+	nonzero int
+	mask    []uint32
+	value   []uint32
+}
+
+func newBlock(always bool) *patternBlock {
+	if always {
+		return &patternBlock{}
+	}
+	return &patternBlock{nonzero: -1}
+}
+
+func newWordBlock(offset int, mask, value uint32) *patternBlock {
+	b := &patternBlock{offset: offset, nonzero: 4, mask: []uint32{mask}, value: []uint32{value}}
+	b.normalize()
+	return b
+}
+
+func (b *patternBlock) clone() *patternBlock {
+	return &patternBlock{
+		offset:  b.offset,
+		nonzero: b.nonzero,
+		mask:    append([]uint32(nil), b.mask...),
+		value:   append([]uint32(nil), b.value...),
+	}
+}
+
+func (b *patternBlock) alwaysTrue() bool  { return b.nonzero == 0 }
+func (b *patternBlock) alwaysFalse() bool { return b.nonzero == -1 }
+func (b *patternBlock) length() int       { return b.offset + b.nonzero }
+
+// normalize drops the zero mask bytes at both ends, moving offset past the
+// leading ones.
+func (b *patternBlock) normalize() {
+	if b.nonzero <= 0 {
+		b.offset = 0
+		b.mask = nil
+		b.value = nil
+		return
+	}
+
+	i := 0
+	for i < len(b.mask) && b.mask[i] == 0 {
+		i++
+		b.offset += 4
+	}
+	b.mask = b.mask[i:]
+	b.value = b.value[i:]
+
+	if len(b.mask) != 0 {
+		n := 0
+		for tmp := b.mask[0]; tmp != 0; tmp >>= 8 {
+			n++
+		}
+		if sub := 4 - n; sub != 0 {
+			b.offset += sub
+			slide := func(v []uint32) {
+				for i := 0; i < len(v)-1; i++ {
+					v[i] = v[i]<<uint(sub*8) | v[i+1]>>uint((4-sub)*8)
+				}
+				v[len(v)-1] <<= uint(sub * 8)
+			}
+			slide(b.mask)
+			slide(b.value)
+		}
+
+		end := len(b.mask)
+		for end > 0 && b.mask[end-1] == 0 {
+			end--
+		}
+		b.mask = b.mask[:end]
+		b.value = b.value[:end]
+	}
+
+	if len(b.mask) == 0 {
+		b.offset = 0
+		b.nonzero = 0
+		return
+	}
+	b.nonzero = len(b.mask) * 4
+	for tmp := b.mask[len(b.mask)-1]; tmp&0xff == 0; tmp >>= 8 {
+		b.nonzero--
+	}
+}
+
+func (b *patternBlock) shift(sa int) {
+	b.offset += sa
+	b.normalize()
+}
+
+// bits returns size bits of v starting at startbit, in the low bits of the
+// result.
+func (b *patternBlock) bits(v []uint32, startbit, size int) uint32 {
+	startbit -= 8 * b.offset
+	word1 := floorDiv(startbit, 32)
+	shift := startbit - word1*32
+	word2 := floorDiv(startbit+size-1, 32)
+
+	at := func(i int) uint32 {
+		if i < 0 || i >= len(v) {
+			return 0
+		}
+		return v[i]
+	}
+
+	res := at(word1) << uint(shift)
+	if word1 != word2 {
+		res |= at(word2) >> uint(32-shift)
+	}
+	return res >> uint(32-size)
+}
+
+func (b *patternBlock) getMask(startbit, size int) uint32 {
+	return b.bits(b.mask, startbit, size)
+}
+
+func (b *patternBlock) getValue(startbit, size int) uint32 {
+	return b.bits(b.value, startbit, size)
+}
+
+func (b *patternBlock) intersect(o *patternBlock) *patternBlock {
+	if b.alwaysFalse() || o.alwaysFalse() {
+		return newBlock(false)
+	}
+	res := newBlock(true)
+	n := b.length()
+	if o.length() > n {
+		n = o.length()
+	}
+	for off := 0; off < n; off += 4 {
+		m1, v1 := b.getMask(off*8, 32), b.getValue(off*8, 32)
+		m2, v2 := o.getMask(off*8, 32), o.getValue(off*8, 32)
+		common := m1 & m2
+		if common&v1 != common&v2 {
+			res.nonzero = -1
+			res.normalize()
+			return res
+		}
+		res.mask = append(res.mask, m1|m2)
+		res.value = append(res.value, m1&v1|m2&v2)
+	}
+	res.nonzero = n
+	res.normalize()
+	return res
+}
+
+// commonSubPattern returns the block matching what both blocks match: the
+// bits set in both masks with the same value.
+func (b *patternBlock) commonSubPattern(o *patternBlock) *patternBlock {
+	res := newBlock(true)
+	n := b.length()
+	if o.length() > n {
+		n = o.length()
+	}
+	for off := 0; off < n; off += 4 {
+		m1, v1 := b.getMask(off*8, 32), b.getValue(off*8, 32)
+		m2, v2 := o.getMask(off*8, 32), o.getValue(off*8, 32)
+		m := m1 & m2 &^ (v1 ^ v2)
+		res.mask = append(res.mask, m)
+		res.value = append(res.value, v1&v2&m)
+	}
+	res.nonzero = n
+	res.normalize()
+	return res
+}
+
+// specializes reports whether the bits set in the mask of o are set in the
+// mask of b with the same value.
+func (b *patternBlock) specializes(o *patternBlock) bool {
+	length := 8 * o.length()
+	for sbit := 0; sbit < length; {
+		n := length - sbit
+		if n > 32 {
+			n = 32
+		}
+		m1, v1 := b.getMask(sbit, n), b.getValue(sbit, n)
+		m2, v2 := o.getMask(sbit, n), o.getValue(sbit, n)
+		if m1&m2 != m2 || v1&m2 != v2&m2 {
+			return false
+		}
+		sbit += n
+	}
+	return true
+}
+
+func (b *patternBlock) identical(o *patternBlock) bool {
+	length := 8 * o.length()
+	if l := 8 * b.length(); l > length {
+		length = l
+	}
+	for sbit := 0; sbit < length; {
+		n := length - sbit
+		if n > 32 {
+			n = 32
+		}
+		m1, v1 := b.getMask(sbit, n), b.getValue(sbit, n)
+		m2, v2 := o.getMask(sbit, n), o.getValue(sbit, n)
+		if m1 != m2 || m1&v1 != m2&v2 {
+			return false
+		}
+		sbit += n
+	}
+	return true
+}
+
+func (b *patternBlock) encode(e *encoder) {
+	e.open(elemPatBlock)
+	e.signed(attribOff, int64(b.offset))
+	e.signed(attribNonzero, int64(b.nonzero))
+	for i := range b.mask {
+		e.open(elemMaskWord)
+		e.unsigned(attribMask, uint64(b.mask[i]))
+		e.unsigned(attribVal, uint64(b.value[i]))
+		e.close(elemMaskWord)
+	}
+	e.close(elemPatBlock)
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// pattern is a constraint on the instruction bytes and the context: an
+// instructionPattern, a contextPattern, a combinePattern of both, or an
+// orPattern of these disjoint patterns. sa shifts the instruction part of
+// the second operand of the binary operations, or of the receiver when
+// negative.
+type pattern interface {
+	simplifyClone() pattern
+	shiftInstruction(sa int)
+	doOr(b pattern, sa int) pattern
+	doAnd(b pattern, sa int) pattern
+	commonSubPattern(b pattern, sa int) pattern
+	disjoints() []disjointPattern
+	alwaysTrue() bool
+	alwaysFalse() bool
+	alwaysInstructionTrue() bool
+	encode(e *encoder)
+}
+
+// disjointPattern is a pattern without alternatives.
+type disjointPattern interface {
+	pattern
+	block(context bool) *patternBlock
+}
+
+func disjointMask(p disjointPattern, startbit, size int, context bool) uint32 {
+	if b := p.block(context); b != nil {
+		return b.getMask(startbit, size)
+	}
+	return 0
+}
+
+func disjointValue(p disjointPattern, startbit, size int, context bool) uint32 {
+	if b := p.block(context); b != nil {
+		return b.getValue(startbit, size)
+	}
+	return 0
+}
+
+func disjointLength(p disjointPattern, context bool) int {
+	if b := p.block(context); b != nil {
+		return b.length()
+	}
+	return 0
+}
+
+// specializes reports whether a matches a subset of what b matches.
+func specializes(a, b disjointPattern) bool {
+	for _, context := range []bool{false, true} {
+		ba, bb := a.block(context), b.block(context)
+		if bb != nil && !bb.alwaysTrue() {
+			if ba == nil || !ba.specializes(bb) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func identical(a, b disjointPattern) bool {
+	for _, context := range []bool{false, true} {
+		ba, bb := a.block(context), b.block(context)
+		switch {
+		case bb != nil && ba == nil:
+			if !bb.alwaysTrue() {
+				return false
+			}
+		case bb != nil:
+			if !ba.identical(bb) {
+				return false
+			}
+		case ba != nil && !ba.alwaysTrue():
+			return false
+		}
+	}
+	return true
+}
+
+// resolvesIntersect reports whether p is the intersection of a and b.
+func resolvesIntersect(p, a, b disjointPattern) bool {
+	for _, context := range []bool{false, true} {
+		bl1, bl2, this := a.block(context), b.block(context), p.block(context)
+		inter := bl1
+		switch {
+		case bl1 == nil:
+			inter = bl2
+		case bl2 != nil:
+			inter = bl1.intersect(bl2)
+		}
+		switch {
+		case inter == nil:
+			if this != nil {
+				return false
+			}
+		case this == nil:
+			return false
+		case !this.identical(inter):
+			return false
+		}
+	}
+	return true
+}
+
+type instructionPattern struct {
+	mask *patternBlock
+}
+
+func newInstructionPattern(always bool) *instructionPattern {
+	return &instructionPattern{mask: newBlock(always)}
+}
+
+func (p *instructionPattern) block(context bool) *patternBlock {
+	if context {
+		return nil
+	}
+	return p.mask
+}
+
+func (p *instructionPattern) simplifyClone() pattern {
+	return &instructionPattern{mask: p.mask.clone()}
+}
+
+func (p *instructionPattern) shiftInstruction(sa int)      { p.mask.shift(sa) }
+func (p *instructionPattern) disjoints() []disjointPattern { return nil }
+func (p *instructionPattern) alwaysTrue() bool             { return p.mask.alwaysTrue() }
+func (p *instructionPattern) alwaysFalse() bool            { return p.mask.alwaysFalse() }
+func (p *instructionPattern) alwaysInstructionTrue() bool  { return p.mask.alwaysTrue() }
+
+func (p *instructionPattern) doOr(b pattern, sa int) pattern {
+	if _, ok := b.(*instructionPattern); !ok {
+		if _, ok := b.(*contextPattern); !ok {
+			return b.doOr(p, -sa)
+		}
+	}
+	res1 := p.simplifyClone().(disjointPattern)
+	res2 := b.simplifyClone().(disjointPattern)
+	if sa < 0 {
+		res1.shiftInstruction(-sa)
+	} else {
+		res2.shiftInstruction(sa)
+	}
+	return &orPattern{list: []disjointPattern{res1, res2}}
+}
+
+func (p *instructionPattern) doAnd(b pattern, sa int) pattern {
+	switch b := b.(type) {
+	case *orPattern, *combinePattern:
+		return b.doAnd(p, -sa)
+	case *contextPattern:
+		np := p.simplifyClone().(*instructionPattern)
+		if sa < 0 {
+			np.shiftInstruction(-sa)
+		}
+		return &combinePattern{context: b.simplifyClone().(*contextPattern), instr: np}
+	case *instructionPattern:
+		if sa < 0 {
+			a := p.mask.clone()
+			a.shift(-sa)
+			return &instructionPattern{mask: a.intersect(b.mask)}
+		}
+		c := b.mask.clone()
+		c.shift(sa)
+		return &instructionPattern{mask: p.mask.intersect(c)}
+	}
+	return nil
+}
+
+func (p *instructionPattern) commonSubPattern(b pattern, sa int) pattern {
+	switch b := b.(type) {
+	case *orPattern, *combinePattern:
+		return b.commonSubPattern(p, -sa)
+	case *contextPattern:
+		return newInstructionPattern(true)
+	case *instructionPattern:
+		if sa < 0 {
+			a := p.mask.clone()
+			a.shift(-sa)
+			return &instructionPattern{mask: a.commonSubPattern(b.mask)}
+		}
+		c := b.mask.clone()
+		c.shift(sa)
+		return &instructionPattern{mask: p.mask.commonSubPattern(c)}
+	}
+	return nil
+}
+
+func (p *instructionPattern) encode(e *encoder) {
+	e.open(elemInstructPat)
+	p.mask.encode(e)
+	e.close(elemInstructPat)
+}
+
+type contextPattern struct {
+	mask *patternBlock
+}
+
+func (p *contextPattern) block(context bool) *patternBlock {
+	if context {
+		return p.mask
+	}
+	return nil
+}
+
+func (p *contextPattern) simplifyClone() pattern {
+	return &contextPattern{mask: p.mask.clone()}
+}
+
+func (p *contextPattern) shiftInstruction(sa int)      {}
+func (p *contextPattern) disjoints() []disjointPattern { return nil }
+func (p *contextPattern) alwaysTrue() bool             { return p.mask.alwaysTrue() }
+func (p *contextPattern) alwaysFalse() bool            { return p.mask.alwaysFalse() }
+func (p *contextPattern) alwaysInstructionTrue() bool  { return true }
+
+func (p *contextPattern) doOr(b pattern, sa int) pattern {
+	b2, ok := b.(*contextPattern)
+	if !ok {
+		return b.doOr(p, -sa)
+	}
+	return &orPattern{list: []disjointPattern{p.simplifyClone().(disjointPattern), b2.simplifyClone().(disjointPattern)}}
+}
+
+func (p *contextPattern) doAnd(b pattern, sa int) pattern {
+	b2, ok := b.(*contextPattern)
+	if !ok {
+		return b.doAnd(p, -sa)
+	}
+	return &contextPattern{mask: p.mask.intersect(b2.mask)}
+}
+
+func (p *contextPattern) commonSubPattern(b pattern, sa int) pattern {
+	b2, ok := b.(*contextPattern)
+	if !ok {
+		return b.commonSubPattern(p, -sa)
+	}
+	return &contextPattern{mask: p.mask.commonSubPattern(b2.mask)}
+}
+
+func (p *contextPattern) encode(e *encoder) {
+	e.open(elemContextPat)
+	p.mask.encode(e)
+	e.close(elemContextPat)
+}
+
+// combinePattern constrains both the context and the instruction.
+type combinePattern struct {
+	context *contextPattern
+	instr   *instructionPattern
+}
+
+func (p *combinePattern) block(context bool) *patternBlock {
+	if context {
+		return p.context.mask
+	}
+	return p.instr.mask
+}
+
+func (p *combinePattern) simplifyClone() pattern {
+	switch {
+	case p.context.alwaysTrue():
+		return p.instr.simplifyClone()
+	case p.instr.alwaysTrue():
+		return p.context.simplifyClone()
+	case p.context.alwaysFalse() || p.instr.alwaysFalse():
+		return newInstructionPattern(false)
+	}
+	return &combinePattern{
+		context: p.context.simplifyClone().(*contextPattern),
+		instr:   p.instr.simplifyClone().(*instructionPattern),
+	}
+}
+
+func (p *combinePattern) shiftInstruction(sa int)      { p.instr.shiftInstruction(sa) }
+func (p *combinePattern) disjoints() []disjointPattern { return nil }
+func (p *combinePattern) alwaysTrue() bool             { return p.context.alwaysTrue() && p.instr.alwaysTrue() }
+func (p *combinePattern) alwaysFalse() bool            { return p.context.alwaysFalse() || p.instr.alwaysFalse() }
+func (p *combinePattern) alwaysInstructionTrue() bool  { return p.instr.alwaysInstructionTrue() }
+
+func (p *combinePattern) doOr(b pattern, sa int) pattern {
+	if _, ok := b.(*orPattern); ok {
+		return b.doOr(p, -sa)
+	}
+	res1 := p.simplifyClone().(disjointPattern)
+	res2 := b.simplifyClone().(disjointPattern)
+	if sa < 0 {
+		res1.shiftInstruction(-sa)
+	} else {
+		res2.shiftInstruction(sa)
+	}
+	return &orPattern{list: []disjointPattern{res1, res2}}
+}
+
+func (p *combinePattern) doAnd(b pattern, sa int) pattern {
+	switch b := b.(type) {
+	case *orPattern:
+		return b.doAnd(p, -sa)
+	case *combinePattern:
+		c := p.context.doAnd(b.context, 0).(*contextPattern)
+		i := p.instr.doAnd(b.instr, sa).(*instructionPattern)
+		return &combinePattern{context: c, instr: i}
+	case *instructionPattern:
+		i := p.instr.doAnd(b, sa).(*instructionPattern)
+		return &combinePattern{context: p.context.simplifyClone().(*contextPattern), instr: i}
+	case *contextPattern:
+		c := p.context.doAnd(b, 0).(*contextPattern)
+		np := p.instr.simplifyClone().(*instructionPattern)
+		if sa < 0 {
+			np.shiftInstruction(-sa)
+		}
+		return &combinePattern{context: c, instr: np}
+	}
+	return nil
+}
+
+func (p *combinePattern) commonSubPattern(b pattern, sa int) pattern {
+	switch b := b.(type) {
+	case *orPattern:
+		return b.commonSubPattern(p, -sa)
+	case *combinePattern:
+		c := p.context.commonSubPattern(b.context, 0).(*contextPattern)
+		i := p.instr.commonSubPattern(b.instr, sa).(*instructionPattern)
+		return &combinePattern{context: c, instr: i}
+	case *instructionPattern:
+		return p.instr.commonSubPattern(b, sa)
+	default:
+		return p.context.commonSubPattern(b, 0)
+	}
+}
+
+func (p *combinePattern) encode(e *encoder) {
+	e.open(elemCombinePat)
+	p.context.encode(e)
+	p.instr.encode(e)
+	e.close(elemCombinePat)
+}
+
+// orPattern matches any of its disjoint patterns.
+type orPattern struct {
+	list []disjointPattern
+}
+
+func (p *orPattern) disjoints() []disjointPattern { return p.list }
+
+func (p *orPattern) alwaysTrue() bool {
+	for _, d := range p.list {
+		if d.alwaysTrue() {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *orPattern) alwaysFalse() bool {
+	for _, d := range p.list {
+		if !d.alwaysFalse() {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *orPattern) alwaysInstructionTrue() bool {
+	for _, d := range p.list {
+		if !d.alwaysInstructionTrue() {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *orPattern) shiftInstruction(sa int) {
+	for _, d := range p.list {
+		d.shiftInstruction(sa)
+	}
+}
+
+func (p *orPattern) doAnd(b pattern, sa int) pattern {
+	var list []disjointPattern
+	if b2, ok := b.(*orPattern); ok {
+		for _, d := range p.list {
+			for _, d2 := range b2.list {
+				list = append(list, d.doAnd(d2, sa).(disjointPattern))
+			}
+		}
+	} else {
+		for _, d := range p.list {
+			list = append(list, d.doAnd(b, sa).(disjointPattern))
+		}
+	}
+	return &orPattern{list: list}
+}
+
+func (p *orPattern) doOr(b pattern, sa int) pattern {
+	var list []disjointPattern
+	for _, d := range p.list {
+		c := d.simplifyClone().(disjointPattern)
+		if sa < 0 {
+			c.shiftInstruction(-sa)
+		}
+		list = append(list, c)
+	}
+
+	var others []pattern
+	if ds := b.disjoints(); len(ds) != 0 {
+		for _, d := range ds {
+			others = append(others, d.simplifyClone())
+		}
+	} else {
+		others = append(others, b.simplifyClone())
+	}
+	for _, o := range others {
+		if sa > 0 {
+			o.shiftInstruction(sa)
+		}
+		list = append(list, o.(disjointPattern))
+	}
+	return &orPattern{list: list}
+}
+
+func (p *orPattern) commonSubPattern(b pattern, sa int) pattern {
+	res := p.list[0].commonSubPattern(b, sa)
+	if sa > 0 {
+		sa = 0
+	}
+	for _, d := range p.list[1:] {
+		res = d.commonSubPattern(res, sa)
+	}
+	return res
+}
+
+func (p *orPattern) simplifyClone() pattern {
+	for _, d := range p.list {
+		if d.alwaysTrue() {
+			return newInstructionPattern(true)
+		}
+	}
+	var list []disjointPattern
+	for _, d := range p.list {
+		if !d.alwaysFalse() {
+			list = append(list, d.simplifyClone().(disjointPattern))
+		}
+	}
+	switch len(list) {
+	case 0:
+		return newInstructionPattern(false)
+	case 1:
+		return list[0]
+	}
+	return &orPattern{list: list}
+}
+
+func (p *orPattern) encode(e *encoder) {
+	e.open(elemOrPat)
+	for _, d := range p.list {
+		d.encode(e)
+	}
+	e.close(elemOrPat)
+}
@@ -0,0 +1,553 @@
+package sleigh
+
+import "fmt"
+
+// exprTree is a semantic expression: the ops computing it and the varnode
+// holding its value.
+type exprTree struct {
+	ops []*opTpl
+	out *varnodeTpl
+}
+
+func varnodeExpr(vn *varnodeTpl) *exprTree {
+	return &exprTree{out: vn}
+}
+
+// setOutput makes out the varnode of the expression, replacing the output of
+// its last op when it is a temporary, or adding a copy.
+func (x *exprTree) setOutput(out *varnodeTpl) error {
+	if x.out == nil {
+		return fmt.Errorf("expression has no output")
+	}
+	if x.out.unnamed {
+		x.ops[len(x.ops)-1].output = out
+	} else {
+		op := newOp(opCopy, x.out)
+		op.output = out
+		x.ops = append(x.ops, op)
+	}
+	x.out = out.clone()
+	return nil
+}
+
+// appendParams returns the ops of the parameters followed by op, taking
+// their values as inputs.
+func appendParams(op *opTpl, params []*exprTree) []*opTpl {
+	var res []*opTpl
+	for _, p := range params {
+		res = append(res, p.ops...)
+		op.inputs = append(op.inputs, p.out)
+	}
+	return append(res, op)
+}
+
+// starQuality is the space and size of a dereference.
+type starQuality struct {
+	id   constTpl
+	size int
+}
+
+// allocateTemp reserves a temporary of the unique space.
+func (c *compiler) allocateTemp() uint64 {
+	base := c.uniqueBase
+	c.uniqueBase += maxUniqueSize
+	return base
+}
+
+func (c *compiler) buildTemporary() *varnodeTpl {
+	return &varnodeTpl{space: spaceConst(c.uniqSpace), offset: realConst(c.allocateTemp()), size: realConst(0), unnamed: true}
+}
+
+func (c *compiler) constVarnode(v uint64, size int) *varnodeTpl {
+	return &varnodeTpl{space: spaceConst(c.constSpace), offset: realConst(v), size: realConst(uint64(size))}
+}
+
+// forceSize sets the size of vt if unknown and, for a temporary, of its
+// other occurrences in ops.
+func forceSize(vt *varnodeTpl, size constTpl, ops []*opTpl) error {
+	if !vt.size.isZero() {
+		return nil
+	}
+	vt.size = size
+	if !vt.isLocalTemp() {
+		return nil
+	}
+	for _, op := range ops {
+		if vn := op.output; vn != nil && vn.isLocalTemp() && vn.offset.equal(vt.offset) {
+			if size.typ == constReal && vn.size.typ == constReal && vn.size.val != 0 && vn.size.val != size.val {
+				return fmt.Errorf("localtemp size mismatch")
+			}
+			vn.size = size
+		}
+		for _, vn := range op.inputs {
+			if vn.isLocalTemp() && vn.offset.equal(vt.offset) {
+				if size.typ == constReal && vn.size.typ == constReal && vn.size.val != 0 && vn.size.val != size.val {
+					return fmt.Errorf("input size mismatch")
+				}
+				vn.size = size
+			}
+		}
+	}
+	return nil
+}
+
+// matchSize sizes slot j of op (-1 for the output) like its other varnodes.
+func matchSize(j int, op *opTpl, inputOnly bool, ops []*opTpl) error {
+	vt := op.output
+	if j != -1 {
+		vt = op.inputs[j]
+	}
+	var match *varnodeTpl
+	if !inputOnly && op.output != nil && !op.output.size.isZero() {
+		match = op.output
+	}
+	for _, in := range op.inputs {
+		if match != nil {
+			break
+		}
+		if !in.size.isZero() {
+			match = in
+		}
+	}
+	if match != nil {
+		return forceSize(vt, match.size, ops)
+	}
+	return nil
+}
+
+func (o *opTpl) isZeroSize() bool {
+	if o.output != nil && o.output.size.isZero() {
+		return true
+	}
+	for _, in := range o.inputs {
+		if in.size.isZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// fillinZero infers the unknown sizes of the varnodes of op from the
+// opcode.
+func fillinZero(op *opTpl, ops []*opTpl) error {
+	switch op.code {
+	case opCopy, opIntAdd, opIntSub, opInt2Comp, opIntNegate, opIntXor, opIntAnd, opIntOr,
+		opIntMult, opIntDiv, opIntSDiv, opIntRem, opIntSRem, opFloatAdd, opFloatDiv,
+		opFloatMult, opFloatSub, opFloatNeg, opFloatAbs, opFloatSqrt, opFloatCeil,
+		opFloatFloor, opFloatRound:
+		if op.output != nil && op.output.size.isZero() {
+			if err := matchSize(-1, op, false, ops); err != nil {
+				return err
+			}
+		}
+		for i, in := range op.inputs {
+			if in.size.isZero() {
+				if err := matchSize(i, op, false, ops); err != nil {
+					return err
+				}
+			}
+		}
+	case opIntEqual, opIntNotEqual, opIntSLess, opIntSLessEqual, opIntLess, opIntLessEqual,
+		opIntCarry, opIntSCarry, opIntSBorrow, opFloatEqual, opFloatNotEqual, opFloatLess,
+		opFloatLessEqual, opFloatNaN, opBoolNegate, opBoolXor, opBoolAnd, opBoolOr:
+		if op.output != nil && op.output.size.isZero() {
+			if err := forceSize(op.output, realConst(1), ops); err != nil {
+				return err
+			}
+		}
+		for i, in := range op.inputs {
+			if in.size.isZero() {
+				if err := matchSize(i, op, true, ops); err != nil {
+					return err
+				}
+			}
+		}
+	case opIntLeft, opIntRight, opIntSRight, opSubpiece:
+		if op.code != opSubpiece {
+			if op.output != nil && op.output.size.isZero() {
+				if !op.inputs[0].size.isZero() {
+					if err := forceSize(op.output, op.inputs[0].size, ops); err != nil {
+						return err
+					}
+				}
+			} else if op.inputs[0].size.isZero() {
+				if err := forceSize(op.inputs[0], op.output.size, ops); err != nil {
+					return err
+				}
+			}
+		}
+		if op.inputs[1].size.isZero() {
+			return forceSize(op.inputs[1], realConst(4), ops)
+		}
+	case opCPoolRef:
+		if op.output.size.isZero() && !op.inputs[0].size.isZero() {
+			if err := forceSize(op.output, op.inputs[0].size, ops); err != nil {
+				return err
+			}
+		}
+		if op.inputs[0].size.isZero() && !op.output.size.isZero() {
+			if err := forceSize(op.inputs[0], op.output.size, ops); err != nil {
+				return err
+			}
+		}
+		for _, in := range op.inputs[1:] {
+			if in.size.isZero() {
+				if err := forceSize(in, realConst(8), ops); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// propagateSize fills in the unknown sizes of the varnodes of ct, and
+// reports false if some remain unknown.
+func propagateSize(ct *constructTpl) (bool, error) {
+	var zero []*opTpl
+	for _, op := range ct.ops {
+		if op.isZeroSize() {
+			if err := fillinZero(op, ct.ops); err != nil {
+				return false, err
+			}
+			if op.isZeroSize() {
+				zero = append(zero, op)
+			}
+		}
+	}
+	last := len(zero) + 1
+	for len(zero) < last {
+		last = len(zero)
+		var zero2 []*opTpl
+		for _, op := range zero {
+			if err := fillinZero(op, ct.ops); err != nil {
+				return false, err
+			}
+			if op.isZeroSize() {
+				zero2 = append(zero2, op)
+			}
+		}
+		zero = zero2
+	}
+	return last == 0, nil
+}
+
+func (c *compiler) defineLabel(name string) (*labelSymbol, error) {
+	sym := &labelSymbol{symbolBase: symbolBase{name: name}, index: c.labelCount}
+	c.labelCount++
+	return sym, c.symtab.add(sym)
+}
+
+func (c *compiler) placeLabel(sym *labelSymbol) []*opTpl {
+	if sym.placed {
+		c.errorf("label '%s' is placed more than once", sym.name)
+	}
+	sym.placed = true
+	return []*opTpl{newOp(opLabelBuild, c.constVarnode(uint64(sym.index), 4))}
+}
+
+// newOutput assigns rhs to a new local named name.
+func (c *compiler) newOutput(usesLocal bool, rhs *exprTree, name string, size int) ([]*opTpl, error) {
+	tmp := c.buildTemporary()
+	if size != 0 {
+		tmp.size = realConst(uint64(size))
+	} else if rhs.out.size.typ == constReal && rhs.out.size.val != 0 {
+		tmp.size = rhs.out.size
+	}
+	if err := rhs.setOutput(tmp); err != nil {
+		return nil, err
+	}
+	sym := &varnodeSymbol{symbolBase: symbolBase{name: name}, space: c.uniqSpace, offset: tmp.offset.val, size: int(tmp.size.val)}
+	if err := c.symtab.add(sym); err != nil {
+		return nil, err
+	}
+	if !usesLocal && c.enforceLocalKey {
+		c.errorf("must use 'local' keyword to define symbol '%s'", name)
+	}
+	return rhs.ops, nil
+}
+
+func (c *compiler) newLocalDefinition(name string, size int) error {
+	sym := &varnodeSymbol{symbolBase: symbolBase{name: name}, space: c.uniqSpace, offset: c.allocateTemp(), size: size}
+	return c.symtab.add(sym)
+}
+
+func (c *compiler) createOp(code int, vn *exprTree) *exprTree {
+	out := c.buildTemporary()
+	op := newOp(code, vn.out)
+	op.output = out
+	vn.ops = append(vn.ops, op)
+	vn.out = out.clone()
+	return vn
+}
+
+func (c *compiler) createBinaryOp(code int, vn1, vn2 *exprTree) *exprTree {
+	return c.createOpOut(c.buildTemporary(), code, vn1, vn2)
+}
+
+func (c *compiler) createOpOut(out *varnodeTpl, code int, vn1, vn2 *exprTree) *exprTree {
+	vn1.ops = append(vn1.ops, vn2.ops...)
+	op := newOp(code, vn1.out, vn2.out)
+	op.output = out
+	vn1.ops = append(vn1.ops, op)
+	vn1.out = out.clone()
+	return vn1
+}
+
+func (c *compiler) createOpOutUnary(out *varnodeTpl, code int, vn *exprTree) *exprTree {
+	op := newOp(code, vn.out)
+	op.output = out
+	vn.ops = append(vn.ops, op)
+	vn.out = out.clone()
+	return vn
+}
+
+func (c *compiler) createOpNoOut(code int, vns ...*exprTree) []*opTpl {
+	var res []*opTpl
+	op := newOp(code)
+	for _, vn := range vns {
+		res = append(res, vn.ops...)
+		op.inputs = append(op.inputs, vn.out)
+	}
+	return append(res, op)
+}
+
+func (c *compiler) createOpConst(code int, val uint64) []*opTpl {
+	return []*opTpl{newOp(code, c.constVarnode(val, 4))}
+}
+
+func (c *compiler) createLoad(qual *starQuality, ptr *exprTree) (*exprTree, error) {
+	out := c.buildTemporary()
+	spc := &varnodeTpl{space: spaceConst(c.constSpace), offset: qual.id, size: realConst(8)}
+	op := newOp(opLoad, spc, ptr.out)
+	op.output = out
+	ptr.ops = append(ptr.ops, op)
+	if qual.size > 0 {
+		if err := forceSize(out, realConst(uint64(qual.size)), ptr.ops); err != nil {
+			return nil, err
+		}
+	}
+	ptr.out = out.clone()
+	return ptr, nil
+}
+
+func (c *compiler) createStore(qual *starQuality, ptr, val *exprTree) ([]*opTpl, error) {
+	res := append(ptr.ops, val.ops...)
+	spc := &varnodeTpl{space: spaceConst(c.constSpace), offset: qual.id, size: realConst(8)}
+	res = append(res, newOp(opStore, spc, ptr.out, val.out))
+	return res, forceSize(val.out, realConst(uint64(qual.size)), res)
+}
+
+func (c *compiler) createUserOp(sym *userOpSymbol, params []*exprTree) *exprTree {
+	out := c.buildTemporary()
+	ops := c.createUserOpNoOut(sym, params)
+	ops[len(ops)-1].output = out
+	return &exprTree{ops: ops, out: out.clone()}
+}
+
+func (c *compiler) createUserOpNoOut(sym *userOpSymbol, params []*exprTree) []*opTpl {
+	return appendParams(newOp(opCallOther, c.constVarnode(uint64(sym.index), 4)), params)
+}
+
+func (c *compiler) createVariadic(code int, params []*exprTree) *exprTree {
+	out := c.buildTemporary()
+	ops := appendParams(newOp(code), params)
+	ops[len(ops)-1].output = out
+	return &exprTree{ops: ops, out: out.clone()}
+}
+
+// appendOp combines the value of res with a constant.
+func (c *compiler) appendOp(code int, res *exprTree, val uint64, size int) {
+	out := c.buildTemporary()
+	op := newOp(code, res.out, c.constVarnode(val, size))
+	op.output = out
+	res.ops = append(res.ops, op)
+	res.out = out.clone()
+}
+
+// buildTruncatedVarnode returns the varnode of the bits of vn if they are
+// whole bytes it can address directly, nil otherwise.
+func (c *compiler) buildTruncatedVarnode(vn *varnodeTpl, bitOffset, numBits int) (*varnodeTpl, error) {
+	byteOffset := uint64(bitOffset / 8)
+	numBytes := uint64(numBits / 8)
+	var fullsz uint64
+	if vn.size.typ == constReal {
+		fullsz = vn.size.val
+		if fullsz == 0 {
+			return nil, nil
+		}
+		if byteOffset+numBytes > fullsz {
+			return nil, fmt.Errorf("requested bit range out of bounds")
+		}
+	}
+	if bitOffset%8 != 0 || numBits%8 != 0 {
+		return nil, nil
+	}
+	if vn.space.typ == constSpaceID && vn.space.space.typ == spaceUnique {
+		return nil, nil
+	}
+
+	var off constTpl
+	switch vn.offset.typ {
+	case constHandle:
+		// big endian specifications are adjusted once the sizes of the
+		// exports are known
+		off = constTpl{typ: constHandle, handle: vn.offset.handle, sel: selOffsetPlus, val: byteOffset}
+	case constReal:
+		if vn.size.typ != constReal {
+			return nil, fmt.Errorf("could not construct requested bit range")
+		}
+		plus := byteOffset
+		if c.defaultSpace.bigEndian {
+			plus = fullsz - (byteOffset + numBytes)
+		}
+		off = realConst(vn.offset.val + plus)
+	default:
+		return nil, nil
+	}
+	return &varnodeTpl{space: vn.space, offset: off, size: realConst(numBytes)}, nil
+}
+
+// assignBitRange assigns rhs to bits of vn.
+func (c *compiler) assignBitRange(vn *varnodeTpl, bitOffset, numBits int, rhs *exprTree) ([]*opTpl, error) {
+	errmsg := ""
+	if numBits == 0 {
+		errmsg = "size of bitrange is zero"
+	}
+	smallsize := (numBits + 7) / 8
+	shiftNeeded := bitOffset != 0
+	zextNeeded := true
+	mask := ^((uint64(2)<<uint(numBits-1) - 1) << uint(bitOffset))
+
+	if vn.size.typ == constReal {
+		symsize := int(vn.size.val)
+		if symsize > 0 {
+			zextNeeded = symsize > smallsize
+		}
+		symsize *= 8
+		if bitOffset >= symsize || bitOffset+numBits > symsize {
+			errmsg = "assigned bitrange is bad"
+		} else if bitOffset == 0 && numBits == symsize {
+			errmsg = "assigning to bitrange is superfluous"
+		}
+	}
+	if errmsg != "" {
+		c.errorf("%s", errmsg)
+		return rhs.ops, nil
+	}
+
+	if err := forceSize(rhs.out, realConst(uint64(smallsize)), rhs.ops); err != nil {
+		return nil, err
+	}
+	var res *exprTree
+	final, err := c.buildTruncatedVarnode(vn, bitOffset, numBits)
+	if err != nil {
+		return nil, err
+	}
+	if final != nil {
+		res = c.createOpOutUnary(final, opCopy, rhs)
+	} else {
+		if bitOffset+numBits > 64 {
+			errmsg = "assigned bitrange extends past first 64 bits"
+		}
+		res = varnodeExpr(vn)
+		c.appendOp(opIntAnd, res, mask, 0)
+		if zextNeeded {
+			c.createOp(opIntZExt, rhs)
+		}
+		if shiftNeeded {
+			c.appendOp(opIntLeft, rhs, uint64(bitOffset), 4)
+		}
+		res = c.createOpOut(vn.clone(), opIntOr, res, rhs)
+	}
+	if errmsg != "" {
+		c.errorf("%s", errmsg)
+	}
+	return res.ops, nil
+}
+
+// createBitRange returns the bits of sym shifted down, in the fewest bytes
+// holding them.
+func (c *compiler) createBitRange(sym specificSymbol, bitOffset, numBits int) (*exprTree, error) {
+	errmsg := ""
+	if numBits == 0 {
+		errmsg = "size of bitrange is zero"
+	}
+	vn := sym.varnode()
+	finalsize := (numBits + 7) / 8
+	truncshift := 0
+	maskNeeded := numBits%8 != 0
+	truncNeeded := true
+
+	if errmsg == "" && bitOffset == 0 && !maskNeeded {
+		if vn.space.typ == constHandle && vn.size.isZero() {
+			vn.size = realConst(uint64(finalsize))
+			return varnodeExpr(vn), nil
+		}
+	}
+	if errmsg == "" {
+		trunc, err := c.buildTruncatedVarnode(vn, bitOffset, numBits)
+		if err != nil {
+			return nil, err
+		}
+		if trunc != nil {
+			return varnodeExpr(trunc), nil
+		}
+	}
+
+	if vn.size.typ == constReal {
+		insize := int(vn.size.val)
+		if insize > 0 {
+			truncNeeded = finalsize < insize
+			insize *= 8
+			if bitOffset >= insize || bitOffset+numBits > insize {
+				errmsg = "bitrange is bad"
+			}
+			if maskNeeded && bitOffset+numBits == insize {
+				maskNeeded = false
+			}
+		}
+	}
+	mask := uint64(2)<<uint(numBits-1) - 1
+	if truncNeeded && bitOffset%8 == 0 {
+		truncshift = bitOffset / 8
+		bitOffset = 0
+	}
+	if bitOffset == 0 && !truncNeeded && !maskNeeded {
+		errmsg = "superfluous bitrange"
+	}
+	if maskNeeded && finalsize > 8 {
+		errmsg = "illegal masked bitrange producing varnode larger than 64 bits: " + sym.base().name
+	}
+
+	res := varnodeExpr(vn)
+	if errmsg != "" {
+		c.errorf("%s", errmsg)
+		return res, nil
+	}
+	if bitOffset != 0 {
+		c.appendOp(opIntRight, res, uint64(bitOffset), 4)
+	}
+	if truncNeeded {
+		c.appendOp(opSubpiece, res, uint64(truncshift), 4)
+	}
+	if maskNeeded {
+		c.appendOp(opIntAnd, res, mask, finalsize)
+	}
+	return res, forceSize(res.out, realConst(uint64(finalsize)), res.ops)
+}
+
+// addressOf returns the offset of vn as a constant.
+func (c *compiler) addressOf(vn *varnodeTpl, size int) *varnodeTpl {
+	if size == 0 && vn.space.typ == constSpaceID {
+		size = vn.space.space.size
+	}
+	if vn.offset.typ == constReal && vn.space.typ == constSpaceID {
+		off := vn.offset.val
+		if ws := vn.space.space.wordSize; ws > 1 {
+			off /= uint64(ws)
+		}
+		return c.constVarnode(off, size)
+	}
+	return &varnodeTpl{space: spaceConst(c.constSpace), offset: vn.offset, size: realConst(uint64(size))}
+}
@@ -0,0 +1,401 @@
+package sleigh
+
+// Opcodes of the p-code ops, and the ones of the templates only.
+const (
+	opCopy             = 1
+	opLoad             = 2
+	opStore            = 3
+	opBranch           = 4
+	opCBranch          = 5
+	opBranchInd        = 6
+	opCall             = 7
+	opCallInd          = 8
+	opCallOther        = 9
+	opReturn           = 10
+	opIntEqual         = 11
+	opIntNotEqual      = 12
+	opIntSLess         = 13
+	opIntSLessEqual    = 14
+	opIntLess          = 15
+	opIntLessEqual     = 16
+	opIntZExt          = 17
+	opIntSExt          = 18
+	opIntAdd           = 19
+	opIntSub           = 20
+	opIntCarry         = 21
+	opIntSCarry        = 22
+	opIntSBorrow       = 23
+	opInt2Comp         = 24
+	opIntNegate        = 25
+	opIntXor           = 26
+	opIntAnd           = 27
+	opIntOr            = 28
+	opIntLeft          = 29
+	opIntRight         = 30
+	opIntSRight        = 31
+	opIntMult          = 32
+	opIntDiv           = 33
+	opIntSDiv          = 34
+	opIntRem           = 35
+	opIntSRem          = 36
+	opBoolNegate       = 37
+	opBoolXor          = 38
+	opBoolAnd          = 39
+	opBoolOr           = 40
+	opFloatEqual       = 41
+	opFloatNotEqual    = 42
+	opFloatLess        = 43
+	opFloatLessEqual   = 44
+	opFloatNaN         = 46
+	opFloatAdd         = 47
+	opFloatDiv         = 48
+	opFloatMult        = 49
+	opFloatSub         = 50
+	opFloatNeg         = 51
+	opFloatAbs         = 52
+	opFloatSqrt        = 53
+	opFloatInt2Float   = 54
+	opFloatFloat2Float = 55
+	opFloatTrunc       = 56
+	opFloatCeil        = 57
+	opFloatFloor       = 58
+	opFloatRound       = 59
+	opPiece            = 62
+	opSubpiece         = 63
+	opCPoolRef         = 68
+	opNew              = 69
+	opInsert           = 70
+	opExtract          = 71
+	opPopcount         = 72
+	opLzcount          = 73
+
+	opBuild      = 60 // MULTIEQUAL
+	opDelaySlot  = 61 // INDIRECT
+	opMacroBuild = 64 // CAST
+	opLabelBuild = 65 // PTRADD
+	opCrossBuild = 66 // PTRSUB
+)
+
+type constType int
+
+const (
+	constReal constType = iota
+	constHandle
+	constStart
+	constNext
+	constNext2
+	constCurSpace
+	constCurSpaceSize
+	constSpaceID
+	constRelative
+	constFlowRef
+	constFlowRefSize
+	constFlowDest
+	constFlowDestSize
+)
+
+// Parts of the varnode of an operand a handle constant selects.
+const (
+	selSpace = iota
+	selOffset
+	selSize
+	selOffsetPlus
+)
+
+var constElems = [...]int{
+	constStart:        elemConstStart,
+	constNext:         elemConstNext,
+	constNext2:        elemConstNext2,
+	constCurSpace:     elemConstCurSpace,
+	constCurSpaceSize: elemConstCurSpaceSize,
+	constFlowRef:      elemConstFlowRef,
+	constFlowRefSize:  elemConstFlowRefSize,
+	constFlowDest:     elemConstFlowDest,
+	constFlowDestSize: elemConstFlowDestSize,
+}
+
+// constTpl is a constant of a template, fixed or filled in when the
+// instruction is decoded.
+type constTpl struct {
+	typ    constType
+	val    uint64 // constReal, constRelative, and the addend of selOffsetPlus
+	space  *space
+	handle int
+	sel    int
+}
+
+func realConst(v uint64) constTpl { return constTpl{typ: constReal, val: v} }
+
+func spaceConst(spc *space) constTpl { return constTpl{typ: constSpaceID, space: spc} }
+
+func handleConst(index, sel int) constTpl {
+	return constTpl{typ: constHandle, handle: index, sel: sel}
+}
+
+func (c constTpl) isZero() bool { return c.typ == constReal && c.val == 0 }
+
+func (c constTpl) equal(o constTpl) bool {
+	if c.typ != o.typ {
+		return false
+	}
+	switch c.typ {
+	case constReal, constRelative:
+		return c.val == o.val
+	case constHandle:
+		return c.handle == o.handle && c.sel == o.sel && (c.sel != selOffsetPlus || c.val == o.val)
+	case constSpaceID:
+		return c.space == o.space
+	}
+	return true
+}
+
+func (c *constTpl) changeHandleIndex(handmap []int) {
+	if c.typ == constHandle {
+		c.handle = handmap[c.handle]
+	}
+}
+
+func (c constTpl) encode(e *encoder) {
+	switch c.typ {
+	case constReal:
+		e.open(elemConstReal)
+		e.unsigned(attribVal, c.val)
+		e.close(elemConstReal)
+	case constHandle:
+		e.open(elemConstHandle)
+		e.signed(attribVal, int64(c.handle))
+		e.signed(attribS, int64(c.sel))
+		if c.sel == selOffsetPlus {
+			e.unsigned(attribPlus, c.val)
+		}
+		e.close(elemConstHandle)
+	case constSpaceID:
+		e.open(elemConstSpaceID)
+		e.space(attribSpace, c.space)
+		e.close(elemConstSpaceID)
+	case constRelative:
+		e.open(elemConstRelative)
+		e.unsigned(attribVal, c.val)
+		e.close(elemConstRelative)
+	default:
+		e.empty(constElems[c.typ])
+	}
+}
+
+// varnodeTpl is a varnode of a template.
+type varnodeTpl struct {
+	space, offset, size constTpl
+	unnamed             bool
+}
+
+func handleVarnode(index int, zeroSize bool) *varnodeTpl {
+	vn := &varnodeTpl{space: handleConst(index, selSpace), offset: handleConst(index, selOffset), size: handleConst(index, selSize)}
+	if zeroSize {
+		vn.size = realConst(0)
+	}
+	return vn
+}
+
+func (v *varnodeTpl) clone() *varnodeTpl {
+	c := *v
+	return &c
+}
+
+// isLocalTemp reports whether v is a temporary of the unique space.
+func (v *varnodeTpl) isLocalTemp() bool {
+	return v.space.typ == constSpaceID && v.space.space.typ == spaceUnique
+}
+
+func (v *varnodeTpl) equal(o *varnodeTpl) bool {
+	return v.space.equal(o.space) && v.offset.equal(o.offset) && v.size.equal(o.size)
+}
+
+func (v *varnodeTpl) changeHandleIndex(handmap []int) {
+	v.space.changeHandleIndex(handmap)
+	v.offset.changeHandleIndex(handmap)
+	v.size.changeHandleIndex(handmap)
+}
+
+func (v *varnodeTpl) encode(e *encoder) {
+	e.open(elemVarnodeTpl)
+	v.space.encode(e)
+	v.offset.encode(e)
+	v.size.encode(e)
+	e.close(elemVarnodeTpl)
+}
+
+// handleTpl is the varnode a constructor exports, possibly through a
+// pointer.
+type handleTpl struct {
+	space, size                  constTpl
+	ptrSpace, ptrOffset, ptrSize constTpl
+	tempSpace, tempOffset        constTpl
+}
+
+// newHandle exports vn itself.
+func newHandle(vn *varnodeTpl) *handleTpl {
+	return &handleTpl{space: vn.space, size: vn.size, ptrSpace: realConst(0), ptrOffset: vn.offset}
+}
+
+// newPointerHandle exports the varnode of size sz in spc at the address vn
+// holds, computed in the temporary at off.
+func newPointerHandle(spc, sz constTpl, vn *varnodeTpl, tempSpace *space, off uint64) *handleTpl {
+	return &handleTpl{
+		space:      spc,
+		size:       sz,
+		ptrSpace:   vn.space,
+		ptrOffset:  vn.offset,
+		ptrSize:    vn.size,
+		tempSpace:  spaceConst(tempSpace),
+		tempOffset: realConst(off),
+	}
+}
+
+func (h *handleTpl) changeHandleIndex(handmap []int) {
+	for _, c := range []*constTpl{&h.space, &h.size, &h.ptrSpace, &h.ptrOffset, &h.ptrSize, &h.tempSpace, &h.tempOffset} {
+		c.changeHandleIndex(handmap)
+	}
+}
+
+func (h *handleTpl) encode(e *encoder) {
+	e.open(elemHandleTpl)
+	for _, c := range []constTpl{h.space, h.size, h.ptrSpace, h.ptrOffset, h.ptrSize, h.tempSpace, h.tempOffset} {
+		c.encode(e)
+	}
+	e.close(elemHandleTpl)
+}
+
+// opTpl is a p-code op of a template.
+type opTpl struct {
+	code   int
+	output *varnodeTpl
+	inputs []*varnodeTpl
+}
+
+func newOp(code int, inputs ...*varnodeTpl) *opTpl {
+	return &opTpl{code: code, inputs: inputs}
+}
+
+func (o *opTpl) changeHandleIndex(handmap []int) {
+	if o.output != nil {
+		o.output.changeHandleIndex(handmap)
+	}
+	for _, in := range o.inputs {
+		in.changeHandleIndex(handmap)
+	}
+}
+
+func (o *opTpl) encode(e *encoder) {
+	e.open(elemOpTpl)
+	e.signed(attribCode, int64(o.code))
+	if o.output == nil {
+		e.empty(elemNull)
+	} else {
+		o.output.encode(e)
+	}
+	for _, in := range o.inputs {
+		in.encode(e)
+	}
+	e.close(elemOpTpl)
+}
+
+// constructTpl is the semantics of a constructor, or of one of its named
+// sections.
+type constructTpl struct {
+	delaySlot int
+	numLabels int
+	ops       []*opTpl
+	result    *handleTpl
+}
+
+// addOp appends op, and reports false for a second delay slot.
+func (c *constructTpl) addOp(op *opTpl) bool {
+	switch op.code {
+	case opDelaySlot:
+		if c.delaySlot != 0 {
+			return false
+		}
+		c.delaySlot = int(op.inputs[0].offset.val)
+	case opLabelBuild:
+		c.numLabels++
+	}
+	c.ops = append(c.ops, op)
+	return true
+}
+
+func (c *constructTpl) addOps(ops []*opTpl) bool {
+	for _, op := range ops {
+		if !c.addOp(op) {
+			return false
+		}
+	}
+	return true
+}
+
+// fillinBuild adds the missing builds of the subtable operands, check
+// marking these with 0. It returns 1 for a duplicate build and 2 for the
+// build of another operand.
+func (c *constructTpl) fillinBuild(check []int, constSpace *space) int {
+	for _, op := range c.ops {
+		if op.code == opBuild {
+			index := op.inputs[0].offset.val
+			if check[index] != 0 {
+				return check[index]
+			}
+			check[index] = 1
+		}
+	}
+	for i, v := range check {
+		if v == 0 {
+			op := newOp(opBuild, &varnodeTpl{space: spaceConst(constSpace), offset: realConst(uint64(i)), size: realConst(4)})
+			c.ops = append([]*opTpl{op}, c.ops...)
+		}
+	}
+	return 0
+}
+
+func (c *constructTpl) buildOnly() bool {
+	for _, op := range c.ops {
+		if op.code != opBuild {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *constructTpl) changeHandleIndex(handmap []int) {
+	for _, op := range c.ops {
+		if op.code == opBuild {
+			in := op.inputs[0]
+			in.offset.val = uint64(handmap[in.offset.val])
+		} else {
+			op.changeHandleIndex(handmap)
+		}
+	}
+	if c.result != nil {
+		c.result.changeHandleIndex(handmap)
+	}
+}
+
+// section is -1 for the main semantics.
+func (c *constructTpl) encode(e *encoder, section int) {
+	e.open(elemConstructTpl)
+	if section >= 0 {
+		e.signed(attribSection, int64(section))
+	}
+	if c.delaySlot != 0 {
+		e.signed(attribDelay, int64(c.delaySlot))
+	}
+	if c.numLabels != 0 {
+		e.signed(attribLabels, int64(c.numLabels))
+	}
+	if c.result != nil {
+		c.result.encode(e)
+	} else {
+		e.empty(elemNull)
+	}
+	for _, op := range c.ops {
+		op.encode(e)
+	}
+	e.close(elemConstructTpl)
+}
@@ -0,0 +1,567 @@
+package sleigh
+
+import "fmt"
+
+type spaceType int
+
+const (
+	spaceConstant spaceType = iota
+	spaceProcessor
+	spaceUnique
+	spaceOther
+)
+
+// space is an address space of the specification.
+type space struct {
+	name      string
+	typ       spaceType
+	index     int
+	size      int
+	wordSize  int
+	bigEndian bool
+	delay     int
+}
+
+func (s *space) encode(e *encoder) {
+	elem := elemSpace
+	switch s.typ {
+	case spaceUnique:
+		elem = elemSpaceUnique
+	case spaceOther:
+		elem = elemSpaceOther
+	}
+	e.open(elem)
+	e.string(attribName, s.name)
+	e.signed(attribIndex, int64(s.index))
+	e.bool(attribBigEndian, s.bigEndian)
+	e.signed(attribDelay, int64(s.delay))
+	e.signed(attribSize, int64(s.size))
+	if s.wordSize > 1 {
+		e.unsigned(attribWordSize, uint64(s.wordSize))
+	}
+	e.bool(attribPhysical, s.typ != spaceOther)
+	e.close(elem)
+}
+
+// symbol is a name of the specification. Only the symbols the decoder needs
+// are encoded, by encodeHeader and encode.
+type symbol interface {
+	base() *symbolBase
+}
+
+type symbolBase struct {
+	name  string
+	id    int
+	scope int
+}
+
+func (s *symbolBase) base() *symbolBase { return s }
+
+// encodedSymbol is a symbol kept in the compiled specification.
+type encodedSymbol interface {
+	symbol
+	headElem() int
+	encode(e *encoder)
+}
+
+// familySymbol is a symbol attached to a field.
+type familySymbol interface {
+	symbol
+	patternValue() patternValue
+}
+
+// specificSymbol is a symbol with a fixed varnode in the semantics.
+type specificSymbol interface {
+	symbol
+	varnode() *varnodeTpl
+}
+
+type spaceSymbol struct {
+	symbolBase
+	space *space
+}
+
+type tokenSymbol struct {
+	symbolBase
+	tok *token
+}
+
+type sectionSymbol struct {
+	symbolBase
+	index int
+}
+
+type userOpSymbol struct {
+	symbolBase
+	index int
+}
+
+func (s *userOpSymbol) headElem() int { return elemUserOpHead }
+
+func (s *userOpSymbol) encode(e *encoder) {
+	e.open(elemUserOp)
+	e.unsigned(attribID, uint64(s.id))
+	e.signed(attribIndex, int64(s.index))
+	e.close(elemUserOp)
+}
+
+// valueSymbol is a field used as an integer.
+type valueSymbol struct {
+	symbolBase
+	patval patternValue
+}
+
+func (s *valueSymbol) patternValue() patternValue { return s.patval }
+func (s *valueSymbol) headElem() int              { return elemValueSymHead }
+
+func (s *valueSymbol) encode(e *encoder) {
+	e.open(elemValueSym)
+	e.unsigned(attribID, uint64(s.id))
+	s.patval.encode(e)
+	e.close(elemValueSym)
+}
+
+// valueMapSymbol is a field whose values are mapped to other integers.
+type valueMapSymbol struct {
+	symbolBase
+	patval patternValue
+	values []int64
+}
+
+func (s *valueMapSymbol) patternValue() patternValue { return s.patval }
+func (s *valueMapSymbol) headElem() int              { return elemValueMapSymHead }
+
+func (s *valueMapSymbol) encode(e *encoder) {
+	e.open(elemValueMapSym)
+	e.unsigned(attribID, uint64(s.id))
+	s.patval.encode(e)
+	for _, v := range s.values {
+		e.open(elemValueTab)
+		e.signed(attribVal, v)
+		e.close(elemValueTab)
+	}
+	e.close(elemValueMapSym)
+}
+
+// nameSymbol is a field whose values are displayed as names. "\t" marks the
+// values that make the instruction invalid.
+type nameSymbol struct {
+	symbolBase
+	patval patternValue
+	names  []string
+}
+
+func (s *nameSymbol) patternValue() patternValue { return s.patval }
+func (s *nameSymbol) headElem() int              { return elemNameSymHead }
+
+func (s *nameSymbol) encode(e *encoder) {
+	e.open(elemNameSym)
+	e.unsigned(attribID, uint64(s.id))
+	s.patval.encode(e)
+	for _, n := range s.names {
+		e.open(elemNameTab)
+		if n != "\t" {
+			e.string(attribName, n)
+		}
+		e.close(elemNameTab)
+	}
+	e.close(elemNameSym)
+}
+
+// varnodeSymbol is a named register or memory location.
+type varnodeSymbol struct {
+	symbolBase
+	space  *space
+	offset uint64
+	size   int
+}
+
+func (s *varnodeSymbol) headElem() int { return elemVarnodeSymHead }
+
+func (s *varnodeSymbol) varnode() *varnodeTpl {
+	return &varnodeTpl{space: spaceConst(s.space), offset: realConst(s.offset), size: realConst(uint64(s.size))}
+}
+
+func (s *varnodeSymbol) encode(e *encoder) {
+	e.open(elemVarnodeSym)
+	e.unsigned(attribID, uint64(s.id))
+	e.space(attribSpace, s.space)
+	e.unsigned(attribOff, s.offset)
+	e.signed(attribSize, int64(s.size))
+	e.close(elemVarnodeSym)
+}
+
+// varListSymbol is a field selecting a register.
+type varListSymbol struct {
+	symbolBase
+	patval patternValue
+	vars   []*varnodeSymbol
+}
+
+func (s *varListSymbol) patternValue() patternValue { return s.patval }
+func (s *varListSymbol) headElem() int              { return elemVarListSymHead }
+
+func (s *varListSymbol) encode(e *encoder) {
+	e.open(elemVarListSym)
+	e.unsigned(attribID, uint64(s.id))
+	s.patval.encode(e)
+	for _, v := range s.vars {
+		if v == nil {
+			e.empty(elemNull)
+			continue
+		}
+		e.open(elemVar)
+		e.unsigned(attribID, uint64(v.id))
+		e.close(elemVar)
+	}
+	e.close(elemVarListSym)
+}
+
+// contextSymbol is a field of a context register.
+type contextSymbol struct {
+	symbolBase
+	patval    *contextField
+	vn        *varnodeSymbol
+	low, high int
+	flow      bool
+}
+
+func (s *contextSymbol) patternValue() patternValue { return s.patval }
+func (s *contextSymbol) headElem() int              { return elemContextSymHead }
+
+func (s *contextSymbol) encode(e *encoder) {
+	e.open(elemContextSym)
+	e.unsigned(attribID, uint64(s.id))
+	e.unsigned(attribVarnode, uint64(s.vn.id))
+	e.signed(attribLow, int64(s.low))
+	e.signed(attribHigh, int64(s.high))
+	e.bool(attribFlow, s.flow)
+	s.patval.encode(e)
+	e.close(elemContextSym)
+}
+
+// bitrangeSymbol is a range of bits of a register.
+type bitrangeSymbol struct {
+	symbolBase
+	vn        *varnodeSymbol
+	bitOffset int
+	numBits   int
+}
+
+// addressSymbol is inst_start, inst_next or inst_next2.
+type addressSymbol struct {
+	symbolBase
+	elem       int // elemStartSym, elemEndSym or elemNext2Sym
+	patexp     *addressValue
+	kind       constType
+	constSpace *space
+}
+
+func (s *addressSymbol) headElem() int { return s.elem + 1 }
+
+func (s *addressSymbol) varnode() *varnodeTpl {
+	return &varnodeTpl{space: spaceConst(s.constSpace), offset: constTpl{typ: s.kind}, size: realConst(0)}
+}
+
+func (s *addressSymbol) encode(e *encoder) {
+	e.open(s.elem)
+	e.unsigned(attribID, uint64(s.id))
+	e.close(s.elem)
+}
+
+type epsilonSymbol struct {
+	symbolBase
+	constSpace *space
+}
+
+func (s *epsilonSymbol) varnode() *varnodeTpl {
+	return &varnodeTpl{space: spaceConst(s.constSpace), offset: realConst(0), size: realConst(0)}
+}
+
+// operandSymbol is an operand of a constructor.
+type operandSymbol struct {
+	symbolBase
+	index  int // hand
+	ct     *constructor
+	local  *operandValue
+	defexp patternExpr
+	triple symbol
+
+	relOffset, offsetBase int
+	minLength             int
+	offsetIrrelevant      bool
+	variableLength        bool
+	codeAddress           bool
+	mark                  bool
+}
+
+func newOperandSymbol(name string, index int, ct *constructor) *operandSymbol {
+	sym := &operandSymbol{symbolBase: symbolBase{name: name}, index: index, ct: ct, offsetBase: -1}
+	sym.local = &operandValue{op: sym}
+	return sym
+}
+
+func (s *operandSymbol) headElem() int { return elemOperandSymHead }
+
+func (s *operandSymbol) defineExpr(p patternExpr) error {
+	if s.defexp != nil || s.triple != nil {
+		return fmt.Errorf("redefining operand %s", s.name)
+	}
+	s.defexp = p
+	return nil
+}
+
+func (s *operandSymbol) defineSymbol(sym symbol) error {
+	if s.defexp != nil || s.triple != nil {
+		return fmt.Errorf("redefining operand %s", s.name)
+	}
+	s.triple = sym
+	return nil
+}
+
+func (s *operandSymbol) varnode() *varnodeTpl {
+	if s.defexp != nil {
+		return handleVarnode(s.index, true)
+	}
+	switch t := s.triple.(type) {
+	case specificSymbol:
+		return t.varnode()
+	case *valueMapSymbol, *nameSymbol:
+		return handleVarnode(s.index, true)
+	}
+	return handleVarnode(s.index, false)
+}
+
+func (s *operandSymbol) encode(e *encoder) {
+	e.open(elemOperandSym)
+	e.unsigned(attribID, uint64(s.id))
+	if s.triple != nil {
+		e.unsigned(attribSubSym, uint64(s.triple.base().id))
+	}
+	e.signed(attribOff, int64(s.relOffset))
+	e.signed(attribBase, int64(s.offsetBase))
+	e.signed(attribMinLen, int64(s.minLength))
+	if s.codeAddress {
+		e.bool(attribCode, true)
+	}
+	e.signed(attribIndex, int64(s.index))
+	s.local.encode(e)
+	if s.defexp != nil {
+		s.defexp.encode(e)
+	}
+	e.close(elemOperandSym)
+}
+
+// labelSymbol is a label of the semantics of a constructor.
+type labelSymbol struct {
+	symbolBase
+	index    int
+	refCount int
+	placed   bool
+}
+
+// macroSymbol is a macro, expanded where it is used.
+type macroSymbol struct {
+	symbolBase
+	index  int
+	params []*operandSymbol
+	body   *constructTpl
+	ct     *constructor // holds the parameters
+}
+
+// subtableSymbol is a table of constructors, instruction being the root
+// one.
+type subtableSymbol struct {
+	symbolBase
+	constructors []*constructor
+	pattern      *tokenPattern
+	beingBuilt   bool
+	errors       bool
+	decision     *decisionNode
+}
+
+func (s *subtableSymbol) headElem() int { return elemSubtableSymHead }
+
+func (s *subtableSymbol) encode(e *encoder) {
+	e.open(elemSubtableSym)
+	e.unsigned(attribID, uint64(s.id))
+	e.signed(attribNumCt, int64(len(s.constructors)))
+	for _, ct := range s.constructors {
+		ct.encode(e)
+	}
+	if s.decision != nil {
+		s.decision.encode(e)
+	}
+	e.close(elemSubtableSym)
+}
+
+// scope holds the symbols of the specification, or the local ones of a
+// constructor or a macro.
+type scope struct {
+	id     int
+	parent *scope
+	syms   map[string]symbol
+}
+
+// symbolTable is the table of the symbols, every symbol having an id and
+// belonging to a scope.
+type symbolTable struct {
+	scopes  []*scope
+	symbols []symbol
+	cur     *scope
+}
+
+func newSymbolTable() *symbolTable {
+	t := &symbolTable{}
+	t.cur = t.newScope()
+	return t
+}
+
+func (t *symbolTable) global() *scope { return t.scopes[0] }
+
+func (t *symbolTable) newScope() *scope {
+	s := &scope{id: len(t.scopes), parent: t.cur, syms: make(map[string]symbol)}
+	t.scopes = append(t.scopes, s)
+	return s
+}
+
+// push enters a new scope nested in the current one.
+func (t *symbolTable) push() {
+	t.cur = t.newScope()
+}
+
+func (t *symbolTable) pop() {
+	t.cur = t.cur.parent
+}
+
+func (t *symbolTable) add(sym symbol) error {
+	return t.addTo(t.cur, sym)
+}
+
+func (t *symbolTable) addGlobal(sym symbol) error {
+	return t.addTo(t.global(), sym)
+}
+
+func (t *symbolTable) addTo(s *scope, sym symbol) error {
+	b := sym.base()
+	b.id = len(t.symbols)
+	b.scope = s.id
+	t.symbols = append(t.symbols, sym)
+	if _, ok := s.syms[b.name]; ok {
+		return fmt.Errorf("duplicate symbol name '%s'", b.name)
+	}
+	s.syms[b.name] = sym
+	return nil
+}
+
+// replace puts b in place of a, with the id of a.
+func (t *symbolTable) replace(a, b symbol) {
+	ab, bb := a.base(), b.base()
+	bb.id, bb.scope = ab.id, ab.scope
+	t.symbols[ab.id] = b
+	t.scopes[ab.scope].syms[bb.name] = b
+}
+
+// find looks name up from the current scope outwards.
+func (t *symbolTable) find(name string) symbol {
+	for s := t.cur; s != nil; s = s.parent {
+		if sym, ok := s.syms[name]; ok {
+			return sym
+		}
+	}
+	return nil
+}
+
+func (t *symbolTable) findGlobal(name string) symbol {
+	return t.global().syms[name]
+}
+
+func (t *symbolTable) remove(sym symbol) {
+	b := sym.base()
+	delete(t.scopes[b.scope].syms, b.name)
+	t.symbols[b.id] = nil
+}
+
+// purge drops the symbols the decoder does not need, and the empty scopes,
+// and renumbers the others.
+func (t *symbolTable) purge() {
+	for _, sym := range t.symbols {
+		if sym == nil {
+			continue
+		}
+		if sym.base().scope != 0 {
+			if _, ok := sym.(*operandSymbol); ok {
+				continue
+			}
+		} else {
+			switch s := sym.(type) {
+			case *spaceSymbol, *tokenSymbol, *epsilonSymbol, *sectionSymbol, *bitrangeSymbol:
+			case *macroSymbol:
+				for _, op := range s.params {
+					t.remove(op)
+				}
+			case *subtableSymbol:
+				if s.pattern != nil {
+					continue
+				}
+				for _, ct := range s.constructors {
+					for _, op := range ct.operands {
+						t.remove(op)
+					}
+				}
+			default:
+				continue
+			}
+		}
+		t.remove(sym)
+	}
+
+	var scopes []*scope
+	for i, s := range t.scopes {
+		if i == 0 || len(s.syms) != 0 {
+			s.id = len(scopes)
+			scopes = append(scopes, s)
+		}
+	}
+	var symbols []symbol
+	for _, sym := range t.symbols {
+		if sym != nil {
+			b := sym.base()
+			b.scope = t.scopes[b.scope].id
+			b.id = len(symbols)
+			symbols = append(symbols, sym)
+		}
+	}
+	t.scopes = scopes
+	t.symbols = symbols
+}
+
+func (t *symbolTable) encode(e *encoder) {
+	e.open(elemSymbolTable)
+	e.signed(attribScopeSize, int64(len(t.scopes)))
+	e.signed(attribSymbolSize, int64(len(t.symbols)))
+	for _, s := range t.scopes {
+		e.open(elemScope)
+		e.unsigned(attribID, uint64(s.id))
+		parent := 0
+		if s.parent != nil {
+			parent = s.parent.id
+		}
+		e.unsigned(attribParent, uint64(parent))
+		e.close(elemScope)
+	}
+	for _, sym := range t.symbols {
+		es := sym.(encodedSymbol)
+		b := sym.base()
+		elem := es.headElem()
+		e.open(elem)
+		e.string(attribName, b.name)
+		e.unsigned(attribID, uint64(b.id))
+		e.unsigned(attribScope, uint64(b.scope))
+		e.close(elem)
+	}
+	for _, sym := range t.symbols {
+		sym.(encodedSymbol).encode(e)
+	}
+	e.close(elemSymbolTable)
+}
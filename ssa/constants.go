@@ -0,0 +1,416 @@
+package ssa
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/dzonerzy/gopcode"
+	"github.com/dzonerzy/gopcode/cfg"
+	"github.com/dzonerzy/gopcode/internal/word"
+)
+
+// Known is a value found by Propagate: a constant or, when Stack is set, an
+// offset from the value of the stack pointer at the entry of the function.
+type Known struct {
+	Value uint64
+	Stack bool
+}
+
+// StackAccess is a LOAD or STORE of the stack, at Offset from the value of
+// the stack pointer at the entry of the function.
+type StackAccess struct {
+	Addr   uint64 // of the instruction
+	Offset int64
+	Size   int32
+	Store  bool
+}
+
+// Constants holds the values of a Function found by Propagate.
+type Constants struct {
+	Function *Function
+
+	// StackOffsets holds the offset of the stack pointer from its value
+	// at the entry, before each instruction where it is known.
+	StackOffsets map[uint64]int64
+
+	// Returns holds the offset of the stack pointer at the RETURN ops
+	// where it is known, by address of their instruction. ExtraPop is the
+	// offset the default prototype of the compiler spec expects there,
+	// e.g. 8 on x86-64 for the popped return address; Imbalanced lists the
+	// returns where it is another or unknown, or where the returns
+	// disagree when ExtraPop is gopcode.UnknownExtraPop.
+	Returns    map[uint64]int64
+	ExtraPop   gopcode.ExtraPop
+	Imbalanced []uint64
+
+	// Targets holds the constant targets of the CALLIND and BRANCHIND ops,
+	// by address of their instruction.
+	Targets map[uint64][]uint64
+
+	StackAccesses []StackAccess
+
+	sp         *gopcode.VarNode
+	spaceName  string // of the stack
+	unaffected []*gopcode.VarNode
+	values     map[*Value]lattice
+}
+
+// kind orders the lattice of the values: undefined values are not
+// evaluated yet, varying ones are not known.
+type kind uint8
+
+const (
+	undefined kind = iota
+	known
+	varying
+)
+
+type lattice struct {
+	kind  kind
+	known Known
+}
+
+func constant(v uint64, size int32) lattice {
+	return lattice{kind: known, known: Known{Value: v & word.Mask(int(size))}}
+}
+
+func join(a, b lattice) lattice {
+	switch {
+	case a.kind == undefined:
+		return b
+	case b.kind == undefined || a == b:
+		return a
+	}
+	return lattice{kind: varying}
+}
+
+// Propagate finds the constants of f and tracks the stack pointer named
+// in the <stackpointer> of spec, the compiler spec of its language.
+//
+// The values of f are evaluated until they no longer change; the stack
+// pointer is an offset from its value at the entry. A call changes it by
+// the extrapop of the default prototype and preserves the registers of its
+// <unaffected> list, the INDIRECT ops of the other registers are not known.
+// The Values loaded from memory are not known.
+func Propagate(ctx *gopcode.Context, spec *gopcode.CompilerSpec, f *Function) (*Constants, error) {
+	regs := map[string]*gopcode.VarNode{}
+	for _, r := range ctx.GetAllRegisters() {
+		regs[r.Name] = r.Node
+	}
+	sp, ok := regs[spec.StackPointer.Register]
+	if !ok {
+		return nil, fmt.Errorf("unknown stack pointer %q", spec.StackPointer.Register)
+	}
+
+	c := &Constants{
+		Function:     f,
+		StackOffsets: map[uint64]int64{},
+		Returns:      map[uint64]int64{},
+		ExtraPop:     spec.DefaultPrototype.ExtraPop,
+		Targets:      map[uint64][]uint64{},
+		sp:           sp,
+		spaceName:    spec.StackPointer.Space,
+		values:       map[*Value]lattice{},
+	}
+	for _, s := range spec.DefaultPrototype.Unaffected.Locations {
+		if r, ok := regs[s.Register]; ok {
+			c.unaffected = append(c.unaffected, r)
+		}
+	}
+
+	c.propagate()
+	c.trackStack()
+	for _, b := range f.Blocks {
+		for _, op := range b.Ops {
+			c.collect(op)
+		}
+	}
+	return c, nil
+}
+
+// Value returns the value of v, if known.
+func (c *Constants) Value(v *Value) (Known, bool) {
+	l := c.get(v)
+	return l.known, l.kind == known
+}
+
+// Resolve returns the targets of an indirect branch or call found by
+// Propagate, to rebuild the graph with a cfg.Builder.
+func (c *Constants) Resolve(site *cfg.IndirectSite) []uint64 {
+	return c.Targets[site.Addr]
+}
+
+func (c *Constants) isSP(v *Value) bool {
+	return v.Space.Name == c.sp.Space.Name && v.Offset == c.sp.Offset && v.Size == c.sp.Size
+}
+
+// offset returns the offset of a stack value, sign extended.
+func (c *Constants) offset(v uint64) int64 {
+	return word.SignExtend(v, int(c.sp.Size))
+}
+
+// get returns the value of v.
+func (c *Constants) get(v *Value) lattice {
+	if v.Def != nil {
+		return c.values[v]
+	}
+	switch {
+	case v.IsConstant():
+		return constant(v.Offset, v.Size)
+	case c.isSP(v):
+		return lattice{kind: known, known: Known{Stack: true}}
+	}
+	return lattice{kind: varying}
+}
+
+// propagate evaluates the ops of the function until their outputs no
+// longer change.
+func (c *Constants) propagate() {
+	var work []*Op
+	for _, b := range c.Function.Blocks {
+		work = append(work, b.Ops...)
+	}
+	for len(work) != 0 {
+		op := work[0]
+		work = work[1:]
+		if op.Output == nil {
+			continue
+		}
+
+		// values only go down the lattice, so that this ends
+		l, old := c.eval(op), c.values[op.Output]
+		if old.kind != undefined {
+			l = join(old, l)
+		}
+		if l != old {
+			c.values[op.Output] = l
+			work = append(work, op.Output.Uses...)
+		}
+	}
+}
+
+// eval returns the value of the output of op.
+func (c *Constants) eval(op *Op) lattice {
+	out := op.Output
+	switch op.Opcode {
+	case gopcode.CPUI_MULTIEQUAL:
+		var l lattice
+		for _, in := range op.Inputs {
+			l = join(l, c.get(in))
+		}
+		return l
+	case gopcode.CPUI_INDIRECT:
+		in := c.get(op.Inputs[0])
+		switch {
+		case in.kind == undefined:
+			return in
+		case c.isSP(out):
+			if in.kind != known || !in.known.Stack || c.ExtraPop == gopcode.UnknownExtraPop {
+				return lattice{kind: varying}
+			}
+			in.known.Value = (in.known.Value + uint64(c.ExtraPop)) & word.Mask(int(out.Size))
+			return in
+		case c.preserved(out):
+			return in
+		}
+		return lattice{kind: varying}
+	}
+	if out.Size > 8 {
+		return lattice{kind: varying}
+	}
+
+	// x ^ x, x - x, x & 0 and x * 0 are known whatever x
+	switch op.Opcode {
+	case gopcode.CPUI_INT_XOR, gopcode.CPUI_INT_SUB:
+		if op.Inputs[0] == op.Inputs[1] {
+			return constant(0, out.Size)
+		}
+	case gopcode.CPUI_INT_AND, gopcode.CPUI_INT_MULT:
+		for _, in := range op.Inputs {
+			if l := c.get(in); l.kind == known && !l.known.Stack && l.known.Value == 0 {
+				return constant(0, out.Size)
+			}
+		}
+	}
+
+	ins := make([]lattice, len(op.Inputs))
+	stack := false
+	for i, in := range op.Inputs {
+		ins[i] = c.get(in)
+		if ins[i].kind != known {
+			return ins[i]
+		}
+		stack = stack || ins[i].known.Stack
+	}
+	if op.Opcode == gopcode.CPUI_LOAD || op.Opcode == gopcode.CPUI_CALLOTHER {
+		return lattice{kind: varying}
+	}
+
+	if stack {
+		return c.evalStack(op, ins)
+	}
+	vals := make([]uint64, len(ins))
+	for i, l := range ins {
+		vals[i] = l.known.Value
+	}
+	v, err := gopcode.EvaluateUint(op.pcode(), vals)
+	if err != nil {
+		return lattice{kind: varying}
+	}
+	return constant(v, out.Size)
+}
+
+// evalStack evaluates the ops of stack values, which only move them.
+func (c *Constants) evalStack(op *Op, ins []lattice) lattice {
+	stack := func(v uint64) lattice {
+		return lattice{kind: known, known: Known{Value: v & word.Mask(int(op.Output.Size)), Stack: true}}
+	}
+	a := ins[0].known
+	switch op.Opcode {
+	case gopcode.CPUI_COPY:
+		return ins[0]
+	case gopcode.CPUI_INT_ADD:
+		b := ins[1].known
+		switch {
+		case a.Stack && !b.Stack:
+			return stack(a.Value + b.Value)
+		case !a.Stack && b.Stack:
+			return stack(a.Value + b.Value)
+		}
+	case gopcode.CPUI_INT_SUB:
+		b := ins[1].known
+		switch {
+		case a.Stack && !b.Stack:
+			return stack(a.Value - b.Value)
+		case a.Stack && b.Stack:
+			return constant(a.Value-b.Value, op.Output.Size)
+		}
+	}
+	return lattice{kind: varying}
+}
+
+// preserved reports whether a call preserves v, a part of a register of
+// the unaffected list.
+func (c *Constants) preserved(v *Value) bool {
+	for _, r := range c.unaffected {
+		if v.Space.Name == r.Space.Name && v.Offset >= r.Offset && v.Offset+uint64(v.Size) <= r.Offset+uint64(r.Size) {
+			return true
+		}
+	}
+	return false
+}
+
+// trackStack finds the offset of the stack pointer before each
+// instruction, joining the offsets at the end of the predecessors of the
+// blocks until they no longer change.
+func (c *Constants) trackStack() {
+	blocks := c.Function.Blocks
+	exits := make([]lattice, len(blocks))
+
+	// walk returns the offset at the end of b, calling fn before each
+	// instruction and op
+	walk := func(b *Block, fn func(instr *gopcode.Instruction, op *Op, sp lattice)) lattice {
+		var sp lattice
+		if b == c.Function.Entry {
+			sp = lattice{kind: known, known: Known{Stack: true}}
+		}
+		for _, p := range b.Preds {
+			sp = join(sp, exits[p.Index])
+		}
+
+		instrs := b.instructions()
+		next := 0
+		for _, op := range b.Ops {
+			for op.Instruction != nil && next < len(instrs) && instrs[next].Address <= op.Instruction.Address {
+				fn(instrs[next], nil, sp)
+				next++
+			}
+			fn(op.Instruction, op, sp)
+			if out := op.Output; out != nil && out.Space.Name == c.sp.Space.Name &&
+				out.Offset < c.sp.Offset+uint64(c.sp.Size) && c.sp.Offset < out.Offset+uint64(out.Size) {
+				if c.isSP(out) {
+					sp = c.get(out)
+				} else {
+					sp = lattice{kind: varying}
+				}
+			}
+		}
+		for ; next < len(instrs); next++ {
+			fn(instrs[next], nil, sp)
+		}
+		return sp
+	}
+
+	nop := func(*gopcode.Instruction, *Op, lattice) {}
+	for changed := true; changed; {
+		changed = false
+		for _, b := range blocks {
+			if sp := walk(b, nop); sp != exits[b.Index] {
+				exits[b.Index] = sp
+				changed = true
+			}
+		}
+	}
+
+	var returns []uint64
+	for _, b := range blocks {
+		walk(b, func(instr *gopcode.Instruction, op *Op, sp lattice) {
+			known := sp.kind == known && sp.known.Stack
+			switch {
+			case op == nil && known:
+				c.StackOffsets[instr.Address] = c.offset(sp.known.Value)
+			case op != nil && op.Opcode == gopcode.CPUI_RETURN:
+				returns = append(returns, instr.Address)
+				if known {
+					c.Returns[instr.Address] = c.offset(sp.known.Value)
+				}
+			}
+		})
+	}
+
+	sort.Slice(returns, func(i, j int) bool { return returns[i] < returns[j] })
+	want, ok := int64(c.ExtraPop), c.ExtraPop != gopcode.UnknownExtraPop
+	for _, addr := range returns {
+		off, known := c.Returns[addr]
+		if known && !ok {
+			want, ok = off, true
+		}
+		if !known || off != want {
+			c.Imbalanced = append(c.Imbalanced, addr)
+		}
+	}
+}
+
+// collect records the targets and stack accesses of op.
+func (c *Constants) collect(op *Op) {
+	switch op.Opcode {
+	case gopcode.CPUI_CALLIND, gopcode.CPUI_BRANCHIND:
+		l := c.get(op.Inputs[0])
+		if l.kind != known || l.known.Stack {
+			return
+		}
+		addr := op.Instruction.Address
+		for _, t := range c.Targets[addr] {
+			if t == l.known.Value {
+				return
+			}
+		}
+		c.Targets[addr] = append(c.Targets[addr], l.known.Value)
+	case gopcode.CPUI_LOAD, gopcode.CPUI_STORE:
+		l := c.get(op.Inputs[1])
+		if l.kind != known || !l.known.Stack {
+			return
+		}
+		if space := op.Inputs[0].GetSpaceFromConst(); space == nil || space.Name != c.spaceName {
+			return
+		}
+
+		a := StackAccess{Addr: op.Instruction.Address, Offset: c.offset(l.known.Value)}
+		if op.Opcode == gopcode.CPUI_STORE {
+			a.Size, a.Store = op.Inputs[2].Size, true
+		} else {
+			a.Size = op.Output.Size
+		}
+		c.StackAccesses = append(c.StackAccesses, a)
+	}
+}
@@ -0,0 +1,1027 @@
+// Package ssa builds the static single assignment form of the pcode of a
+// function of a cfg.Graph.
+//
+// The varnodes of the register and unique spaces are renamed by location: a
+// location is a range of one of these spaces made of the varnodes of the
+// function that overlap, e.g. AL, AH, AX, EAX and RAX of x86-64 are parts of
+// the location of RAX. Each write of a location defines a new Value of it.
+// The write of a part of a location, such as EAX, is merged into a Value of
+// the whole location with SUBPIECE and PIECE ops once the location is read
+// beyond that part, merged where control flow joins or passed to a call,
+// and the read of a part is a SUBPIECE of the Value holding it.
+// MULTIEQUAL ops, the phi-nodes, merge the Values of a location where
+// control flow joins, and INDIRECT ops give the register locations a new
+// Value after each CALL and CALLIND, as the callee may change them:
+//
+//	g, _ := cfg.Build(ctx, prog, entry)
+//	f, _ := ssa.Build(g, entry)
+//	for _, b := range f.Blocks {
+//		for _, op := range b.Ops {
+//			fmt.Println(op) // e.g. RAX_3 = MULTIEQUAL RAX_1, RAX_2
+//		}
+//	}
+//
+// The def-use chains are the Uses of the Values, the use-def chains the Def
+// of the inputs of the Ops. Constants and the varnodes of other spaces, such
+// as ram, are not renamed. A block of the graph is split where the ops of an
+// instruction branch between them or out of the instruction, such as around
+// the move of a conditional move or at the exit of a rep prefix, so that the
+// Values merge where these branches join.
+//
+// Propagate finds the constants of a Function and tracks its stack pointer.
+package ssa
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dzonerzy/gopcode"
+	"github.com/dzonerzy/gopcode/cfg"
+	"github.com/dzonerzy/gopcode/internal/word"
+)
+
+// Value is a varnode of the function, defined once.
+type Value struct {
+	gopcode.VarNode
+	ID int // index in Function.Values
+
+	// Version numbers the Values of a location in the order they are
+	// defined, from 1. It is 0 for constants, varnodes that are not
+	// renamed and the inputs of the function.
+	Version int
+
+	// Def is the op defining the value, nil for constants, varnodes that
+	// are not renamed and the inputs of the function. Uses are the ops
+	// reading it.
+	Def  *Op
+	Uses []*Op
+}
+
+// IsConstant reports whether v is a constant.
+func (v *Value) IsConstant() bool {
+	return v.Space.Name == "const"
+}
+
+func (v *Value) String() string {
+	var name string
+	switch v.Space.Name {
+	case "const":
+		return fmt.Sprintf("0x%x", v.Offset)
+	case "register":
+		name = v.GetRegisterName()
+	}
+	if name == "" {
+		name = fmt.Sprintf("%s[%x:%d]", v.Space.Name, v.Offset, v.Size)
+	}
+	if v.Version != 0 {
+		name = fmt.Sprintf("%s_%d", name, v.Version)
+	}
+	return name
+}
+
+// Op is a pcode op of the function.
+type Op struct {
+	Opcode gopcode.OpCode
+	Output *Value
+	Inputs []*Value
+	Block  *Block
+
+	// Instruction is the instruction of the op, or the one an inserted op
+	// precedes or follows; nil for the MULTIEQUAL ops.
+	Instruction *gopcode.Instruction
+
+	// Inserted marks the MULTIEQUAL, INDIRECT, PIECE and SUBPIECE ops of
+	// the SSA form, which are not in the pcode of the instructions.
+	Inserted bool
+
+	// Call is the CALL or CALLIND op of an INDIRECT op.
+	Call *Op
+}
+
+// pcode returns op as a pcode op reading and writing the varnodes of its
+// values.
+func (op *Op) pcode() gopcode.PcodeOp {
+	p := gopcode.PcodeOp{Opcode: op.Opcode, Inputs: make([]*gopcode.VarNode, len(op.Inputs))}
+	if op.Output != nil {
+		p.Output = &op.Output.VarNode
+	}
+	for i, in := range op.Inputs {
+		p.Inputs[i] = &in.VarNode
+	}
+	return p
+}
+
+func (op *Op) String() string {
+	var inputs []string
+	for _, in := range op.Inputs {
+		inputs = append(inputs, in.String())
+	}
+	s := fmt.Sprintf("%s %s", op.Opcode, strings.Join(inputs, ", "))
+	if op.Output != nil {
+		s = fmt.Sprintf("%s = %s", op.Output, s)
+	}
+	return s
+}
+
+// Block is a basic block of the function. The ops of an instruction
+// branching between them split its cfg.Block into several Blocks sharing
+// it, the first of which dominates the others.
+type Block struct {
+	*cfg.Block
+	Index int // in Function.Blocks
+
+	// Ops holds the ops of the block, its MULTIEQUAL ops first.
+	Ops  []*Op
+	code []span // the ops of the instructions of the block
+
+	// Preds and Succs are the blocks of the function the block is
+	// reached from and goes to; call edges are left out. The inputs of a
+	// MULTIEQUAL op follow the order of Preds.
+	Preds []*Block
+	Succs []*Block
+
+	// Idom is the immediate dominator of the block, nil for the entry,
+	// Dominated the blocks it immediately dominates and Frontier its
+	// dominance frontier.
+	Idom      *Block
+	Dominated []*Block
+	Frontier  []*Block
+}
+
+// span is a range of the ops of an instruction.
+type span struct {
+	instr    *gopcode.Instruction
+	from, to int
+}
+
+// instructions returns the instructions starting in b.
+func (b *Block) instructions() []*gopcode.Instruction {
+	var instrs []*gopcode.Instruction
+	for _, s := range b.code {
+		if s.from == 0 {
+			instrs = append(instrs, s.instr)
+		}
+	}
+	return instrs
+}
+
+// last returns the instruction of the last op of b.
+func (b *Block) last() *gopcode.Instruction {
+	return b.code[len(b.code)-1].instr
+}
+
+// Dominates reports whether every path from the entry to o goes through b.
+func (b *Block) Dominates(o *Block) bool {
+	for ; o != nil; o = o.Idom {
+		if o == b {
+			return true
+		}
+	}
+	return false
+}
+
+// Function is the SSA form of a function.
+type Function struct {
+	Entry  *Block
+	Blocks []*Block // in reverse postorder, the entry first
+
+	// Inputs holds the Values of the locations read before they are
+	// written, the registers the function takes.
+	Inputs []*Value
+	Values []*Value
+}
+
+// Block returns the block starting at addr.
+func (f *Function) Block(addr uint64) (*Block, bool) {
+	for _, b := range f.Blocks {
+		if b.Start == addr {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// location is a range of the register or unique space made of overlapping
+// varnodes.
+type location struct {
+	space     *gopcode.AddrSpace
+	offset    uint64
+	size      int32
+	bigEndian bool
+
+	global   bool // read before being written in a block
+	defs     map[*Block]bool
+	versions int
+	stack    []*state
+	input    *Value
+}
+
+// state is the content of a location during the renaming: a Value of the
+// whole location, nil for the input of the function, and the Values of the
+// disjoint parts written since, which are merged into it when needed.
+type state struct {
+	whole *Value
+	parts []*Value
+}
+
+// lsb returns the significance of the least significant byte of the part
+// of v at offset, the truncation of the SUBPIECE reading it.
+func (l *location) lsb(v *Value, offset uint64, size int32) uint64 {
+	if l.bigEndian {
+		return v.Offset + uint64(v.Size) - offset - uint64(size)
+	}
+	return offset - v.Offset
+}
+
+// part returns the offset of the part of v of size bytes whose least
+// significant byte has significance lsb.
+func (l *location) part(v *Value, lsb uint64, size int32) uint64 {
+	if l.bigEndian {
+		return v.Offset + uint64(v.Size) - lsb - uint64(size)
+	}
+	return v.Offset + lsb
+}
+
+// within reports whether the range at offset of size bytes is within v.
+func within(offset uint64, size int32, v *Value) bool {
+	return offset >= v.Offset && offset+uint64(size) <= v.Offset+uint64(v.Size)
+}
+
+// overlaps reports whether the range at offset of size bytes overlaps v.
+func overlaps(offset uint64, size int32, v *Value) bool {
+	return offset < v.Offset+uint64(v.Size) && v.Offset < offset+uint64(size)
+}
+
+type varKey struct {
+	space  string
+	offset uint64
+	size   int32
+}
+
+type subKey struct {
+	value  *Value
+	offset uint64
+	size   int32
+}
+
+type builder struct {
+	f          *Function
+	locs       map[varKey]*location
+	phis       map[*Op]*location
+	subs       map[subKey]*Value // the parts of Values read or written
+	constSpace *gopcode.AddrSpace
+
+	pushed []*location // the locations whose stack grew, in order
+	cached []subKey    // the keys added to subs, in order
+	pos    int         // where inserted ops go in their block, -1 at the end
+}
+
+// renamed reports whether the varnodes of the space are renamed.
+func renamed(space *gopcode.AddrSpace) bool {
+	return space.Name == "register" || space.Name == "unique"
+}
+
+// calls reports whether the op is a call, after which the register
+// locations get INDIRECT ops.
+func calls(opcode gopcode.OpCode) bool {
+	return opcode == gopcode.CPUI_CALL || opcode == gopcode.CPUI_CALLIND
+}
+
+// branches reports whether the op ends its block.
+func branches(opcode gopcode.OpCode) bool {
+	switch opcode {
+	case gopcode.CPUI_BRANCH, gopcode.CPUI_CBRANCH, gopcode.CPUI_BRANCHIND, gopcode.CPUI_RETURN:
+		return true
+	}
+	return false
+}
+
+// Build builds the SSA form of the function of g at entry: the blocks
+// reachable from the block at entry, call edges left out.
+func Build(g *cfg.Graph, entry uint64) (*Function, error) {
+	start, ok := g.Block(entry)
+	if !ok {
+		return nil, fmt.Errorf("no block at 0x%x", entry)
+	}
+
+	bd := &builder{
+		f:    &Function{},
+		locs: map[varKey]*location{},
+		phis: map[*Op]*location{},
+		subs: map[subKey]*Value{},
+		pos:  -1,
+	}
+	bd.blocks(start)
+	bd.dominators()
+	bd.locations()
+	bd.placePhis()
+	bd.rename(bd.f.Entry)
+
+	for _, b := range bd.f.Blocks {
+		for _, op := range b.Ops {
+			for _, in := range op.Inputs {
+				in.Uses = append(in.Uses, op)
+			}
+		}
+	}
+	return bd.f, nil
+}
+
+// blocks collects the blocks of the function in reverse postorder.
+func (bd *builder) blocks(start *cfg.Block) {
+	parts := map[*cfg.Block][]*part{}
+	partsOf := func(cb *cfg.Block) []*part {
+		ps, ok := parts[cb]
+		if !ok {
+			ps = split(cb)
+			parts[cb] = ps
+		}
+		return ps
+	}
+
+	visited := map[*part]bool{}
+	var post []*Block
+	var visit func(p *part)
+	visit = func(p *part) {
+		visited[p] = true
+		ps := partsOf(p.b.Block)
+		var succs []*part
+		for _, n := range p.next {
+			succs = append(succs, ps[n])
+		}
+		for _, cb := range p.out {
+			succs = append(succs, partsOf(cb)[0])
+		}
+		for _, succ := range succs {
+			if containsBlock(p.b.Succs, succ.b) {
+				continue
+			}
+			if !visited[succ] {
+				visit(succ)
+			}
+			p.b.Succs = append(p.b.Succs, succ.b)
+			succ.b.Preds = append(succ.b.Preds, p.b)
+		}
+		post = append(post, p.b)
+	}
+	visit(partsOf(start)[0])
+
+	for i := len(post) - 1; i >= 0; i-- {
+		b := post[i]
+		b.Index = len(bd.f.Blocks)
+		bd.f.Blocks = append(bd.f.Blocks, b)
+	}
+	bd.f.Entry = bd.f.Blocks[0]
+}
+
+// part is a Block of the ops of a cfg.Block, with the parts of the same
+// cfg.Block it goes to and the cfg.Blocks it leaves to.
+type part struct {
+	b    *Block
+	next []int
+	out  []*cfg.Block
+}
+
+// split splits the ops of cb into parts where the ops of an instruction
+// branch between them or out of the instruction, e.g. around the move of a
+// conditional move.
+func split(cb *cfg.Block) []*part {
+	type pos struct{ instr, op int }
+	instrs := cb.Instructions
+
+	// exit is where the ops go: a position of cb, or an address it is
+	// left to
+	type exit struct {
+		internal bool
+		at       pos
+		addr     uint64
+	}
+	at := func(k, i int) exit {
+		switch {
+		case i < len(instrs[k].Ops):
+			return exit{internal: true, at: pos{k, i}}
+		case k+1 < len(instrs):
+			return exit{internal: true, at: pos{k + 1, 0}}
+		}
+		return exit{addr: instrs[k].FallThrough}
+	}
+	// target returns where the BRANCH or CBRANCH op i of instruction k
+	// goes, a branch to the next instruction ending the instruction
+	target := func(k, i int) (exit, bool) {
+		instr := instrs[k]
+		dest := instr.Ops[i].Inputs[0]
+		switch {
+		case dest.Space.Name == "const":
+			j := i + int(word.SignExtend(dest.Offset, int(dest.Size)))
+			return at(k, j), j >= 0 && j <= len(instr.Ops)
+		case dest.Space.Name != instr.Ops[0].Inputs[0].Space.Name:
+			return exit{}, false
+		case dest.Offset == instr.FallThrough:
+			return at(k, len(instr.Ops)), true
+		}
+		return exit{addr: dest.Offset}, true
+	}
+
+	// the parts start at the targets of the branches and after them
+	leaders := map[pos]bool{{0, 0}: true}
+	for k, instr := range instrs {
+		for i, op := range instr.Ops {
+			if !branches(op.Opcode) {
+				continue
+			}
+			if op.Opcode == gopcode.CPUI_BRANCH || op.Opcode == gopcode.CPUI_CBRANCH {
+				if e, ok := target(k, i); ok && e.internal {
+					leaders[e.at] = true
+				}
+			}
+			if e := at(k, i+1); e.internal {
+				leaders[e.at] = true
+			}
+		}
+	}
+
+	var parts []*part
+	index := map[pos]int{}
+	var ends []pos // the last op of each part
+	var prev pos
+	for k, instr := range instrs {
+		for i := range instr.Ops {
+			if leaders[pos{k, i}] {
+				if len(parts) != 0 {
+					ends = append(ends, prev)
+				}
+				index[pos{k, i}] = len(parts)
+				parts = append(parts, &part{b: &Block{Block: cb}})
+			}
+			b := parts[len(parts)-1].b
+			if n := len(b.code); n == 0 || b.code[n-1].instr != instr {
+				b.code = append(b.code, span{instr: instr, from: i, to: i})
+			}
+			b.code[len(b.code)-1].to = i + 1
+			prev = pos{k, i}
+		}
+	}
+	ends = append(ends, prev)
+
+	// the edges of cb go from the parts leaving to their target, the
+	// others from the last part
+	exits := make([][]uint64, len(parts))
+	indirect := make([]bool, len(parts))
+	for n, end := range ends {
+		p := parts[n]
+		add := func(e exit) {
+			if e.internal {
+				p.next = append(p.next, index[e.at])
+			} else {
+				exits[n] = append(exits[n], e.addr)
+			}
+		}
+		switch instrs[end.instr].Ops[end.op].Opcode {
+		case gopcode.CPUI_BRANCH, gopcode.CPUI_CBRANCH:
+			if e, ok := target(end.instr, end.op); ok {
+				add(e)
+			}
+			if instrs[end.instr].Ops[end.op].Opcode == gopcode.CPUI_CBRANCH {
+				add(at(end.instr, end.op+1))
+			}
+		case gopcode.CPUI_BRANCHIND:
+			indirect[n] = true
+		case gopcode.CPUI_RETURN:
+		default:
+			add(at(end.instr, end.op+1))
+		}
+	}
+	for _, e := range cb.Succs {
+		if e.Kind == cfg.EdgeCall {
+			continue
+		}
+		found := false
+		for n, p := range parts {
+			if indirect[n] && e.Kind == cfg.EdgeIndirect || containsAddr(exits[n], e.To.Start) {
+				p.out = append(p.out, e.To)
+				found = true
+			}
+		}
+		if !found {
+			p := parts[len(parts)-1]
+			p.out = append(p.out, e.To)
+		}
+	}
+	return parts
+}
+
+func containsAddr(addrs []uint64, addr uint64) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// dominators computes the dominator tree and the dominance frontiers, as
+// in "A Simple, Fast Dominance Algorithm" by Cooper, Harvey and Kennedy.
+func (bd *builder) dominators() {
+	blocks := bd.f.Blocks
+	idom := make([]int, len(blocks))
+	for i := range idom {
+		idom[i] = -1
+	}
+	idom[0] = 0
+
+	intersect := func(a, b int) int {
+		for a != b {
+			for a > b {
+				a = idom[a]
+			}
+			for b > a {
+				b = idom[b]
+			}
+		}
+		return a
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, b := range blocks[1:] {
+			d := -1
+			for _, p := range b.Preds {
+				if idom[p.Index] == -1 {
+					continue
+				}
+				if d == -1 {
+					d = p.Index
+				} else {
+					d = intersect(d, p.Index)
+				}
+			}
+			if d != idom[b.Index] {
+				idom[b.Index] = d
+				changed = true
+			}
+		}
+	}
+
+	for _, b := range blocks[1:] {
+		b.Idom = blocks[idom[b.Index]]
+		b.Idom.Dominated = append(b.Idom.Dominated, b)
+	}
+	for _, b := range blocks {
+		if len(b.Preds) < 2 {
+			continue
+		}
+		for _, p := range b.Preds {
+			for runner := p; runner != b.Idom; runner = runner.Idom {
+				if !containsBlock(runner.Frontier, b) {
+					runner.Frontier = append(runner.Frontier, b)
+				}
+			}
+		}
+	}
+}
+
+func containsBlock(blocks []*Block, b *Block) bool {
+	for _, o := range blocks {
+		if o == b {
+			return true
+		}
+	}
+	return false
+}
+
+// locations merges the overlapping varnodes of the renamed spaces into
+// locations and finds the blocks defining them.
+func (bd *builder) locations() {
+	spaces := map[string]*gopcode.AddrSpace{}
+	ranges := map[string][]varKey{}
+	add := func(vn *gopcode.VarNode) {
+		if vn.Space.Name == "const" && bd.constSpace == nil {
+			bd.constSpace = vn.Space
+		}
+		if !renamed(vn.Space) {
+			return
+		}
+		k := varKey{vn.Space.Name, vn.Offset, vn.Size}
+		if _, ok := bd.locs[k]; !ok {
+			bd.locs[k] = nil
+			spaces[k.space] = vn.Space
+			ranges[k.space] = append(ranges[k.space], k)
+		}
+	}
+	bd.eachOp(func(b *Block, op *gopcode.PcodeOp) {
+		for _, in := range op.Inputs {
+			add(in)
+		}
+		if op.Output != nil {
+			add(op.Output)
+		}
+	})
+	if bd.constSpace == nil {
+		bd.constSpace = &gopcode.AddrSpace{Name: "const"}
+	}
+
+	names := make([]string, 0, len(ranges))
+	for name := range ranges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		keys := ranges[name]
+		sort.Slice(keys, func(i, j int) bool { return keys[i].offset < keys[j].offset })
+
+		var cur *location
+		for _, k := range keys {
+			if cur == nil || k.offset >= cur.offset+uint64(cur.size) {
+				cur = &location{
+					space:     spaces[name],
+					offset:    k.offset,
+					bigEndian: spaces[name].Flags&gopcode.BigEndian != 0,
+					defs:      map[*Block]bool{},
+				}
+			}
+			if end := k.offset + uint64(k.size); end > cur.offset+uint64(cur.size) {
+				cur.size = int32(end - cur.offset)
+			}
+			bd.locs[k] = cur
+		}
+	}
+
+	// a location is global when a block reads a byte of it before writing
+	// that byte
+	var written map[*location]map[uint64]bool
+	var last *Block
+	callers := map[*Block]bool{}
+	bd.eachOp(func(b *Block, op *gopcode.PcodeOp) {
+		if b != last {
+			written = map[*location]map[uint64]bool{}
+			last = b
+		}
+		for _, in := range op.Inputs {
+			l := bd.loc(in)
+			if l == nil || l.global {
+				continue
+			}
+			for i := uint64(0); i < uint64(in.Size); i++ {
+				if !written[l][in.Offset+i] {
+					l.global = true
+					break
+				}
+			}
+		}
+		if l := bd.loc(op.Output); l != nil {
+			l.defs[b] = true
+			if written[l] == nil {
+				written[l] = map[uint64]bool{}
+			}
+			for i := uint64(0); i < uint64(op.Output.Size); i++ {
+				written[l][op.Output.Offset+i] = true
+			}
+		}
+		if calls(op.Opcode) {
+			callers[b] = true
+		}
+	})
+	for _, l := range bd.indirects() {
+		for b := range callers {
+			l.defs[b] = true
+		}
+	}
+}
+
+// eachOp calls fn with the ops of the instructions of the blocks.
+func (bd *builder) eachOp(fn func(b *Block, op *gopcode.PcodeOp)) {
+	for _, b := range bd.f.Blocks {
+		for _, c := range b.code {
+			for i := c.from; i < c.to; i++ {
+				if c.instr.Ops[i].Opcode != gopcode.CPUI_IMARK {
+					fn(b, &c.instr.Ops[i])
+				}
+			}
+		}
+	}
+}
+
+// loc returns the location of a varnode, nil when it is not renamed.
+func (bd *builder) loc(vn *gopcode.VarNode) *location {
+	if vn == nil || !renamed(vn.Space) {
+		return nil
+	}
+	return bd.locs[varKey{vn.Space.Name, vn.Offset, vn.Size}]
+}
+
+// sorted returns the locations of locs matching keep, sorted.
+func (bd *builder) sorted(keep func(l *location) bool) []*location {
+	seen := map[*location]bool{}
+	var locs []*location
+	for _, l := range bd.locs {
+		if keep(l) && !seen[l] {
+			seen[l] = true
+			locs = append(locs, l)
+		}
+	}
+	sort.Slice(locs, func(i, j int) bool {
+		if locs[i].space.Name != locs[j].space.Name {
+			return locs[i].space.Name < locs[j].space.Name
+		}
+		return locs[i].offset < locs[j].offset
+	})
+	return locs
+}
+
+// indirects returns the locations that get an INDIRECT op after a call,
+// the global locations of the register space.
+func (bd *builder) indirects() []*location {
+	return bd.sorted(func(l *location) bool { return l.global && l.space.Name == "register" })
+}
+
+// placePhis inserts the MULTIEQUAL ops of the global locations at the
+// iterated dominance frontier of the blocks defining them.
+func (bd *builder) placePhis() {
+	for _, l := range bd.sorted(func(l *location) bool { return l.global }) {
+		var work []*Block
+		for _, b := range bd.f.Blocks {
+			if l.defs[b] {
+				work = append(work, b)
+			}
+		}
+		placed := map[*Block]bool{}
+		for len(work) != 0 {
+			b := work[len(work)-1]
+			work = work[:len(work)-1]
+			for _, d := range b.Frontier {
+				if placed[d] {
+					continue
+				}
+				placed[d] = true
+
+				phi := &Op{Opcode: gopcode.CPUI_MULTIEQUAL, Block: d, Inserted: true, Inputs: make([]*Value, len(d.Preds))}
+				phi.Output = bd.value(l.space, l.offset, l.size)
+				phi.Output.Def = phi
+				d.Ops = append(d.Ops, phi)
+				bd.phis[phi] = l
+
+				if !l.defs[d] {
+					l.defs[d] = true
+					work = append(work, d)
+				}
+			}
+		}
+	}
+}
+
+// value returns a new Value.
+func (bd *builder) value(space *gopcode.AddrSpace, offset uint64, size int32) *Value {
+	v := &Value{VarNode: gopcode.VarNode{Space: space, Offset: offset, Size: size}, ID: len(bd.f.Values)}
+	bd.f.Values = append(bd.f.Values, v)
+	return v
+}
+
+func (bd *builder) constant(v uint64, size int32) *Value {
+	return bd.value(bd.constSpace, v, size)
+}
+
+// define returns a new Value of a part of l defined by op.
+func (bd *builder) define(l *location, offset uint64, size int32, op *Op) *Value {
+	v := bd.value(l.space, offset, size)
+	l.versions++
+	v.Version = l.versions
+	v.Def = op
+	op.Output = v
+	return v
+}
+
+// insert adds an op of the SSA form to b.
+func (bd *builder) insert(b *Block, instr *gopcode.Instruction, opcode gopcode.OpCode, inputs ...*Value) *Op {
+	op := &Op{Opcode: opcode, Inputs: inputs, Block: b, Instruction: instr, Inserted: true}
+	if bd.pos < 0 {
+		b.Ops = append(b.Ops, op)
+		return op
+	}
+	b.Ops = append(b.Ops, nil)
+	copy(b.Ops[bd.pos+1:], b.Ops[bd.pos:])
+	b.Ops[bd.pos] = op
+	bd.pos++
+	return op
+}
+
+func (bd *builder) push(l *location, s *state) {
+	l.stack = append(l.stack, s)
+	bd.pushed = append(bd.pushed, l)
+}
+
+// top returns the state of l.
+func (bd *builder) top(l *location) *state {
+	if n := len(l.stack); n != 0 {
+		return l.stack[n-1]
+	}
+	return &state{}
+}
+
+// whole returns the Value of the whole location of s, the input of the
+// function when it is not written.
+func (bd *builder) whole(l *location, s *state) *Value {
+	if s.whole != nil {
+		return s.whole
+	}
+	if l.input == nil {
+		l.input = bd.value(l.space, l.offset, l.size)
+		bd.f.Inputs = append(bd.f.Inputs, l.input)
+	}
+	return l.input
+}
+
+// sub returns the part of v at offset, v itself or a SUBPIECE of it.
+func (bd *builder) sub(b *Block, instr *gopcode.Instruction, l *location, v *Value, offset uint64, size int32) *Value {
+	if offset == v.Offset && size == v.Size {
+		return v
+	}
+	k := subKey{v, offset, size}
+	if p, ok := bd.subs[k]; ok {
+		return p
+	}
+	op := bd.insert(b, instr, gopcode.CPUI_SUBPIECE, v, bd.constant(l.lsb(v, offset, size), 4))
+	p := bd.define(l, offset, size, op)
+	bd.cache(k, p)
+	return p
+}
+
+// cache records p as the part of a Value. The entry lasts as long as the
+// stacks pushed with it: parts are only reused in the blocks dominated by
+// the block defining them.
+func (bd *builder) cache(k subKey, p *Value) {
+	bd.subs[k] = p
+	bd.cached = append(bd.cached, k)
+}
+
+// merge merges the parts written into the Value of the whole location l:
+// for each part, whole = PIECE(high, PIECE(part, low)), low and high being
+// SUBPIECEs of the whole location less and more significant than the part.
+func (bd *builder) merge(b *Block, instr *gopcode.Instruction, l *location) *state {
+	s := bd.top(l)
+	if len(s.parts) == 0 {
+		return s
+	}
+
+	whole := bd.whole(l, s)
+	for _, p := range s.parts {
+		lsb := l.lsb(whole, p.Offset, p.Size)
+		v := p
+		if lsb != 0 {
+			low := bd.sub(b, instr, l, whole, l.part(whole, 0, int32(lsb)), int32(lsb))
+			piece := bd.insert(b, instr, gopcode.CPUI_PIECE, v, low)
+			size := v.Size + low.Size
+			v = bd.define(l, l.part(whole, 0, size), size, piece)
+		}
+		if hsb := lsb + uint64(p.Size); hsb < uint64(whole.Size) {
+			size := whole.Size - int32(hsb)
+			high := bd.sub(b, instr, l, whole, l.part(whole, hsb, size), size)
+			piece := bd.insert(b, instr, gopcode.CPUI_PIECE, high, v)
+			v = bd.define(l, l.offset, l.size, piece)
+		}
+		bd.cache(subKey{v, p.Offset, p.Size}, p)
+		whole = v
+	}
+
+	s = &state{whole: whole}
+	bd.push(l, s)
+	return s
+}
+
+// read returns the Value of a varnode read by an op of b.
+func (bd *builder) read(b *Block, instr *gopcode.Instruction, vn *gopcode.VarNode) *Value {
+	l := bd.loc(vn)
+	if l == nil {
+		return bd.value(vn.Space, vn.Offset, vn.Size)
+	}
+
+	s := bd.top(l)
+	for _, p := range s.parts {
+		if within(vn.Offset, vn.Size, p) {
+			return bd.sub(b, instr, l, p, vn.Offset, vn.Size)
+		}
+		if overlaps(vn.Offset, vn.Size, p) {
+			s = bd.merge(b, instr, l)
+			break
+		}
+	}
+	return bd.sub(b, instr, l, bd.whole(l, s), vn.Offset, vn.Size)
+}
+
+// write defines the Value of the output of op, a part of its location or
+// the whole of it.
+func (bd *builder) write(b *Block, instr *gopcode.Instruction, vn *gopcode.VarNode, op *Op) {
+	l := bd.loc(vn)
+	if l == nil {
+		op.Output = bd.value(vn.Space, vn.Offset, vn.Size)
+		return
+	}
+
+	v := bd.define(l, vn.Offset, vn.Size, op)
+	if vn.Offset == l.offset && vn.Size == l.size {
+		bd.push(l, &state{whole: v})
+		return
+	}
+
+	// the parts v overwrites are dropped, the ones it overwrites partly
+	// are merged first
+	s := bd.top(l)
+	for _, p := range s.parts {
+		if overlaps(p.Offset, p.Size, v) && !within(p.Offset, p.Size, v) {
+			s = bd.merge(b, instr, l)
+			break
+		}
+	}
+	var parts []*Value
+	for _, p := range s.parts {
+		if !within(p.Offset, p.Size, v) {
+			parts = append(parts, p)
+		}
+	}
+	bd.push(l, &state{whole: s.whole, parts: append(parts, v)})
+}
+
+// rename renames the locations of b and of the blocks it dominates.
+func (bd *builder) rename(b *Block) {
+	pushed, cached := len(bd.pushed), len(bd.cached)
+
+	for _, phi := range b.Ops {
+		l := bd.phis[phi]
+		l.versions++
+		phi.Output.Version = l.versions
+		bd.push(l, &state{whole: phi.Output})
+	}
+
+	for _, c := range b.code {
+		instr := c.instr
+		for i := c.from; i < c.to; i++ {
+			pop := &instr.Ops[i]
+			if pop.Opcode == gopcode.CPUI_IMARK {
+				continue
+			}
+
+			op := &Op{Opcode: pop.Opcode, Block: b, Instruction: instr}
+			for _, in := range pop.Inputs {
+				op.Inputs = append(op.Inputs, bd.read(b, instr, in))
+			}
+			if calls(op.Opcode) {
+				for _, l := range bd.indirects() {
+					bd.merge(b, instr, l)
+				}
+			}
+			b.Ops = append(b.Ops, op)
+			if pop.Output != nil {
+				bd.write(b, instr, pop.Output, op)
+			}
+
+			if calls(op.Opcode) {
+				for _, l := range bd.indirects() {
+					ind := bd.insert(b, instr, gopcode.CPUI_INDIRECT, bd.whole(l, bd.top(l)))
+					ind.Call = op
+					bd.push(l, &state{whole: bd.define(l, l.offset, l.size, ind)})
+				}
+			}
+		}
+	}
+
+	// the MULTIEQUAL ops of the successors take whole locations, merged
+	// before the branch ending b
+	if n := len(b.Ops); n != 0 && branches(b.Ops[n-1].Opcode) {
+		bd.pos = n - 1
+	}
+	last := b.last()
+	for _, s := range b.Succs {
+		for _, phi := range s.Ops {
+			if phi.Opcode != gopcode.CPUI_MULTIEQUAL || phi.Instruction != nil {
+				break
+			}
+			bd.merge(b, last, bd.phis[phi])
+		}
+	}
+	bd.pos = -1
+	for _, s := range b.Succs {
+		for i, p := range s.Preds {
+			if p != b {
+				continue
+			}
+			for _, phi := range s.Ops {
+				if phi.Opcode != gopcode.CPUI_MULTIEQUAL || phi.Instruction != nil {
+					break
+				}
+				l := bd.phis[phi]
+				phi.Inputs[i] = bd.whole(l, bd.top(l))
+			}
+		}
+	}
+
+	for _, d := range b.Dominated {
+		bd.rename(d)
+	}
+	for _, l := range bd.pushed[pushed:] {
+		l.stack = l.stack[:len(l.stack)-1]
+	}
+	bd.pushed = bd.pushed[:pushed]
+	for _, k := range bd.cached[cached:] {
+		delete(bd.subs, k)
+	}
+	bd.cached = bd.cached[:cached]
+}
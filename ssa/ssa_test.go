@@ -0,0 +1,457 @@
+package ssa_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dzonerzy/gopcode"
+	"github.com/dzonerzy/gopcode/cfg"
+	_ "github.com/dzonerzy/gopcode/processors/x86"
+	"github.com/dzonerzy/gopcode/ssa"
+)
+
+var code = cfg.Buffer{Base: 0x1000, Data: []byte{
+	0x48, 0xc7, 0xc0, 0x01, 0x00, 0x00, 0x00, // 0x1000: mov rax, 1
+	0xb0, 0x05, // 0x1007: mov al, 5
+	0x85, 0xff, // 0x1009: test edi, edi
+	0x74, 0x04, // 0x100b: je 0x1011
+	0x48, 0x83, 0xc0, 0x02, // 0x100d: add rax, 2
+	0x48, 0x89, 0xc3, // 0x1011: mov rbx, rax
+	0xc3,             // 0x1014: ret
+	0x48, 0x89, 0xf8, // 0x1015: mov rax, rdi
+	0xe8, 0x05, 0x00, 0x00, 0x00, // 0x1018: call 0x1022
+	0x01, 0xf8, // 0x101d: add eax, edi
+	0xc3,       // 0x101f: ret
+	0xcc, 0xcc, // 0x1020: int3
+	0xc3,       // 0x1022: ret
+	0x31, 0xc0, // 0x1023: xor eax, eax
+	0xff, 0xc0, // 0x1025: inc eax
+	0x39, 0xf8, // 0x1027: cmp eax, edi
+	0x75, 0xfa, // 0x1029: jne 0x1025
+	0xc3,       // 0x102b: ret
+	0x31, 0xc0, // 0x102c: xor eax, eax
+	0xb9, 0x05, 0x00, 0x00, 0x00, // 0x102e: mov ecx, 5
+	0x85, 0xff, // 0x1033: test edi, edi
+	0x0f, 0x44, 0xc1, // 0x1035: cmovz eax, ecx
+	0x89, 0xc3, // 0x1038: mov ebx, eax
+	0xc3,                         // 0x103a: ret
+	0xb9, 0x04, 0x00, 0x00, 0x00, // 0x103b: mov ecx, 4
+	0xf3, 0xaa, // 0x1040: rep stosb
+	0xc3,             // 0x1042: ret
+	0x48, 0x89, 0xf8, // 0x1043: mov rax, rdi
+	0x85, 0xf6, // 0x1046: test esi, esi
+	0x74, 0x03, // 0x1048: je 0x104d
+	0x89, 0xc1, // 0x104a: mov ecx, eax
+	0xc3,       // 0x104c: ret
+	0x89, 0xc2, // 0x104d: mov edx, eax
+	0xc3, // 0x104f: ret
+}}
+
+func build(t *testing.T, entry uint64) *ssa.Function {
+	ctx, err := gopcode.NewContext("x86:LE:64:default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ctx.Destroy)
+
+	b := &cfg.Builder{Context: ctx, Source: code, SkipCalls: true}
+	g, err := b.Build(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ssa.Build(g, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// find returns the first op of the instruction at addr with the opcode.
+func find(t *testing.T, f *ssa.Function, addr uint64, opcode gopcode.OpCode) *ssa.Op {
+	for _, b := range f.Blocks {
+		for _, op := range b.Ops {
+			if op.Instruction != nil && op.Instruction.Address == addr && op.Opcode == opcode && !op.Inserted {
+				return op
+			}
+		}
+	}
+	t.Fatalf("no %s op at 0x%x", opcode, addr)
+	return nil
+}
+
+func TestBuild(t *testing.T) {
+	f := build(t, 0x1000)
+
+	if len(f.Blocks) != 3 || f.Entry.Start != 0x1000 {
+		t.Fatalf("blocks %v", f.Blocks)
+	}
+	join, _ := f.Block(0x1011)
+	add, _ := f.Block(0x100d)
+	if join.Idom != f.Entry || add.Idom != f.Entry || !f.Entry.Dominates(join) || add.Dominates(join) {
+		t.Errorf("dominators of 0x1011 %v, 0x100d %v", join.Idom, add.Idom)
+	}
+	if len(add.Frontier) != 1 || add.Frontier[0] != join {
+		t.Errorf("frontier of 0x100d %v", add.Frontier)
+	}
+
+	// mov al, 5 defines AL, merged into RAX
+	al := find(t, f, 0x1007, gopcode.CPUI_COPY).Output
+	if al.String() != "AL_2" || len(al.Uses) != 1 || al.Uses[0].Opcode != gopcode.CPUI_PIECE {
+		t.Fatalf("AL %v used by %v", al, al.Uses)
+	}
+	rax := find(t, f, 0x100d, gopcode.CPUI_INT_ADD).Inputs[0]
+	if rax.Size != 8 || rax.Def == nil || rax.Def.Opcode != gopcode.CPUI_PIECE || !rax.Def.Inserted {
+		t.Fatalf("add reads %v defined by %v", rax, rax.Def)
+	}
+
+	var phi *ssa.Op
+	for _, op := range join.Ops {
+		if op.Opcode == gopcode.CPUI_MULTIEQUAL && op.Output.Offset == rax.Offset && op.Output.Size == 8 {
+			phi = op
+		}
+	}
+	if phi == nil {
+		t.Fatalf("no MULTIEQUAL of RAX in %v", join.Ops)
+	}
+	sum := find(t, f, 0x100d, gopcode.CPUI_INT_ADD).Output
+	for i, p := range join.Preds {
+		want := rax
+		if p == add {
+			want = sum
+		}
+		if phi.Inputs[i] != want {
+			t.Errorf("MULTIEQUAL input from 0x%x is %v, want %v", p.Start, phi.Inputs[i], want)
+		}
+	}
+	if mov := find(t, f, 0x1011, gopcode.CPUI_COPY); mov.Inputs[0] != phi.Output {
+		t.Errorf("mov rbx, rax reads %v", mov.Inputs[0])
+	}
+
+	// RAX is written before it is read, the unique temporaries too
+	var inputs []string
+	for _, v := range f.Inputs {
+		inputs = append(inputs, v.String())
+	}
+	if strings.Join(inputs, " ") != "EDI RSP" {
+		t.Errorf("inputs %v", inputs)
+	}
+
+	verify(t, f)
+}
+
+// verify checks that every value is defined once, that its uses read it and
+// that its definition dominates them: the MULTIEQUAL inputs at the end of
+// the matching predecessor, the other inputs before the op reading them.
+func verify(t *testing.T, f *ssa.Function) {
+	for _, b := range f.Blocks {
+		for i, op := range b.Ops {
+			for j, in := range op.Inputs {
+				if in == nil || in.Def == nil {
+					continue
+				}
+				def := in.Def.Block
+				switch {
+				case op.Opcode == gopcode.CPUI_MULTIEQUAL && op.Instruction == nil:
+					if !def.Dominates(b.Preds[j]) {
+						t.Errorf("%v reads %v from block %d, defined in block %d", op, in, b.Preds[j].Index, def.Index)
+					}
+				case def != b:
+					if !def.Dominates(b) {
+						t.Errorf("%v in block %d reads %v defined in block %d", op, b.Index, in, def.Index)
+					}
+				case index(b, in.Def) >= i:
+					t.Errorf("%v reads %v before it is defined", op, in)
+				}
+			}
+		}
+	}
+
+	for _, v := range f.Values {
+		for _, op := range v.Uses {
+			found := false
+			for _, in := range op.Inputs {
+				found = found || in == v
+			}
+			if !found {
+				t.Errorf("%v does not read %v", op, v)
+			}
+		}
+		if v.Def != nil && v.Def.Output != v {
+			t.Errorf("%v is not the output of %v", v, v.Def)
+		}
+	}
+}
+
+func TestBuildCall(t *testing.T) {
+	f := build(t, 0x1015)
+
+	call := find(t, f, 0x1018, gopcode.CPUI_CALL)
+	add := find(t, f, 0x101d, gopcode.CPUI_INT_ADD)
+
+	// add eax, edi reads parts of the values the callee may have changed
+	var ind []*ssa.Op
+	for _, in := range add.Inputs {
+		if in.Def == nil || in.Def.Opcode != gopcode.CPUI_SUBPIECE {
+			t.Fatalf("%v defined by %v", in, in.Def)
+		}
+		whole := in.Def.Inputs[0]
+		if whole.Size != 8 || whole.Def == nil || whole.Def.Opcode != gopcode.CPUI_INDIRECT || whole.Def.Call != call {
+			t.Fatalf("%v defined by %v", whole, whole.Def)
+		}
+		ind = append(ind, whole.Def)
+	}
+
+	mov := find(t, f, 0x1015, gopcode.CPUI_COPY)
+	if ind[0].Inputs[0] != mov.Output {
+		t.Errorf("INDIRECT of RAX reads %v, want %v", ind[0].Inputs[0], mov.Output)
+	}
+	if rdi := ind[1].Inputs[0]; rdi != mov.Inputs[0] || rdi.Def != nil {
+		t.Errorf("INDIRECT of RDI reads %v, want the input %v", rdi, mov.Inputs[0])
+	}
+}
+
+func TestBuildLoop(t *testing.T) {
+	f := build(t, 0x1023)
+
+	loop, _ := f.Block(0x1025)
+	if len(loop.Preds) != 2 || !containsFrontier(loop, loop) {
+		t.Fatalf("loop preds %v frontier %v", loop.Preds, loop.Frontier)
+	}
+
+	// inc eax reads EAX of the MULTIEQUAL merging RAX from the entry and
+	// from the previous iteration
+	eax := find(t, f, 0x1025, gopcode.CPUI_INT_ADD).Inputs[0]
+	if eax.Def == nil || eax.Def.Opcode != gopcode.CPUI_SUBPIECE {
+		t.Fatalf("%v defined by %v", eax, eax.Def)
+	}
+	phi := eax.Def.Inputs[0].Def
+	if phi == nil || phi.Opcode != gopcode.CPUI_MULTIEQUAL || phi.Block != loop {
+		t.Fatalf("%v defined by %v", eax.Def.Inputs[0], phi)
+	}
+	for i, p := range loop.Preds {
+		in := phi.Inputs[i]
+		if in.Def == nil || in.Def.Opcode != gopcode.CPUI_INT_ZEXT || in.Def.Block != p {
+			t.Errorf("MULTIEQUAL input from 0x%x is %v defined by %v", p.Start, in, in.Def)
+		}
+	}
+}
+
+func TestBuildConditionalMove(t *testing.T) {
+	f := build(t, 0x102c)
+
+	// cmovz eax, ecx splits the block around its move
+	move := find(t, f, 0x1035, gopcode.CPUI_COPY)
+	join, _ := f.Block(0x1038)
+	if len(f.Blocks) != 3 || move.Block.Start != 0x102c || move.Block == f.Entry || move.Block.Idom != f.Entry {
+		t.Fatalf("move in block %d of %v", move.Block.Index, f.Blocks)
+	}
+	if len(join.Preds) != 2 || join.Idom != f.Entry {
+		t.Fatalf("join preds %v", join.Preds)
+	}
+
+	// mov ebx, eax reads EAX of the MULTIEQUAL merging RAX with and
+	// without the move
+	eax := find(t, f, 0x1038, gopcode.CPUI_COPY).Inputs[0]
+	if eax.Def == nil || eax.Def.Opcode != gopcode.CPUI_SUBPIECE {
+		t.Fatalf("%v defined by %v", eax, eax.Def)
+	}
+	phi := eax.Def.Inputs[0].Def
+	if phi == nil || phi.Opcode != gopcode.CPUI_MULTIEQUAL || phi.Block != join {
+		t.Fatalf("%v defined by %v", eax.Def.Inputs[0], phi)
+	}
+	zext := find(t, f, 0x1035, gopcode.CPUI_INT_ZEXT).Output
+	for i, p := range join.Preds {
+		in := phi.Inputs[i]
+		if p == move.Block && (in.Def == nil || in.Def.Opcode != gopcode.CPUI_PIECE || in.Def.Inputs[1] != move.Output) {
+			t.Errorf("MULTIEQUAL input with the move is %v defined by %v", in, in.Def)
+		}
+		if p != move.Block && in != zext {
+			t.Errorf("MULTIEQUAL input without the move is %v, want %v", in, zext)
+		}
+	}
+	verify(t, f)
+}
+
+func index(b *ssa.Block, op *ssa.Op) int {
+	for i, o := range b.Ops {
+		if o == op {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestBuildBranches(t *testing.T) {
+	f := build(t, 0x1043)
+
+	// both branches read EAX, each from a SUBPIECE of its own block
+	for _, addr := range []uint64{0x104a, 0x104d} {
+		b, _ := f.Block(addr)
+		eax := find(t, f, addr, gopcode.CPUI_COPY).Inputs[0]
+		if eax.Def == nil || eax.Def.Opcode != gopcode.CPUI_SUBPIECE || eax.Def.Block != b {
+			t.Errorf("EAX at 0x%x is %v defined by %v", addr, eax, eax.Def)
+		}
+	}
+	verify(t, f)
+}
+
+func TestBuildRepeat(t *testing.T) {
+	f := build(t, 0x103b)
+
+	// rep stosb loops on the part decrementing RCX, and leaves the loop
+	// from the part testing it
+	loop, _ := f.Block(0x1040)
+	ret, _ := f.Block(0x1042)
+	test := find(t, f, 0x1040, gopcode.CPUI_INT_EQUAL)
+	dec := find(t, f, 0x1040, gopcode.CPUI_INT_SUB)
+	if test.Block != loop || dec.Block == loop || dec.Block.Start != 0x1040 {
+		t.Fatalf("test in block %d, decrement in block %d", test.Block.Index, dec.Block.Index)
+	}
+	if len(ret.Preds) != 1 || ret.Preds[0] != loop || len(loop.Preds) != 2 {
+		t.Fatalf("ret preds %v, loop preds %v", ret.Preds, loop.Preds)
+	}
+
+	rcx := test.Inputs[0]
+	if rcx.Def == nil || rcx.Def.Opcode != gopcode.CPUI_MULTIEQUAL || rcx.Def.Block != loop {
+		t.Fatalf("%v defined by %v", rcx, rcx.Def)
+	}
+	mov := find(t, f, 0x103b, gopcode.CPUI_COPY)
+	for i, p := range loop.Preds {
+		in := rcx.Def.Inputs[i]
+		if p == dec.Block && in != dec.Output || p != dec.Block && in != mov.Output {
+			t.Errorf("MULTIEQUAL input from block %d is %v defined by %v", p.Index, in, in.Def)
+		}
+	}
+	verify(t, f)
+}
+
+func containsFrontier(b, d *ssa.Block) bool {
+	for _, o := range b.Frontier {
+		if o == d {
+			return true
+		}
+	}
+	return false
+}
+
+var frame = cfg.Buffer{Base: 0x2000, Data: []byte{
+	0x55,             // 0x2000: push rbp
+	0x48, 0x89, 0xe5, // 0x2001: mov rbp, rsp
+	0x48, 0x83, 0xec, 0x20, // 0x2004: sub rsp, 0x20
+	0xc7, 0x45, 0xfc, 0x07, 0x00, 0x00, 0x00, // 0x2008: mov dword [rbp-4], 7
+	0xb8, 0x30, 0x20, 0x00, 0x00, // 0x200f: mov eax, 0x2030
+	0xff, 0xd0, // 0x2014: call rax
+	0xc9,       // 0x2016: leave
+	0xc3,       // 0x2017: ret
+	0x55,       // 0x2018: push rbp
+	0xc3,       // 0x2019: ret
+	0x31, 0xc0, // 0x201a: xor eax, eax
+	0xb9, 0x30, 0x20, 0x00, 0x00, // 0x201c: mov ecx, 0x2030
+	0x85, 0xff, // 0x2021: test edi, edi
+	0x0f, 0x44, 0xc1, // 0x2023: cmovz eax, ecx
+	0xff, 0xd0, // 0x2026: call rax
+	0xc3, // 0x2028: ret
+}}
+
+func propagate(t *testing.T, entry uint64) (*ssa.Constants, *cfg.Builder) {
+	ctx, err := gopcode.NewContext("x86:LE:64:default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ctx.Destroy)
+
+	al, err := gopcode.LookupLanguage("x86:LE:64:default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := al.Load(); err != nil {
+		t.Fatal(err)
+	}
+	var spec *gopcode.CompilerSpec
+	for _, c := range al.Compilers {
+		if c.ID == "gcc" {
+			spec = c.Spec
+		}
+	}
+
+	b := &cfg.Builder{Context: ctx, Source: frame, SkipCalls: true}
+	g, err := b.Build(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ssa.Build(g, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ssa.Propagate(ctx, spec, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, b
+}
+
+func TestPropagate(t *testing.T) {
+	c, b := propagate(t, 0x2000)
+
+	want := map[uint64]int64{
+		0x2000: 0, 0x2001: -8, 0x2004: -8, 0x2008: -0x28, 0x200f: -0x28,
+		0x2014: -0x28, 0x2016: -0x28, 0x2017: 0,
+	}
+	for addr, off := range want {
+		if got, ok := c.StackOffsets[addr]; !ok || got != off {
+			t.Errorf("stack offset at 0x%x = %d, %v, want %d", addr, got, ok, off)
+		}
+	}
+	if c.Returns[0x2017] != 8 || len(c.Imbalanced) != 0 {
+		t.Errorf("returns %v, imbalanced %x", c.Returns, c.Imbalanced)
+	}
+
+	if targets := c.Targets[0x2014]; len(targets) != 1 || targets[0] != 0x2030 {
+		t.Errorf("targets of call rax %x", targets)
+	}
+	var local *ssa.StackAccess
+	for i, a := range c.StackAccesses {
+		if a.Addr == 0x2008 {
+			local = &c.StackAccesses[i]
+		}
+	}
+	if local == nil || local.Offset != -0xc || local.Size != 4 || !local.Store {
+		t.Errorf("stack accesses %+v", c.StackAccesses)
+	}
+
+	// mov dword [rbp-4], 7 stores a constant
+	store := find(t, c.Function, 0x2008, gopcode.CPUI_STORE)
+	if v, ok := c.Value(store.Inputs[2]); !ok || v.Stack || v.Value != 7 {
+		t.Errorf("stored %v %v", v, ok)
+	}
+
+	b.Resolve = c.Resolve
+	g, err := b.Build(0x2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Unresolved) != 0 || g.Indirects[0].Targets[0] != 0x2030 {
+		t.Errorf("unresolved %v", g.Unresolved)
+	}
+}
+
+func TestPropagateImbalance(t *testing.T) {
+	c, _ := propagate(t, 0x2018)
+
+	if c.Returns[0x2019] != 0 || len(c.Imbalanced) != 1 || c.Imbalanced[0] != 0x2019 {
+		t.Errorf("returns %v, imbalanced %x", c.Returns, c.Imbalanced)
+	}
+}
+
+func TestPropagateConditionalMove(t *testing.T) {
+	c, _ := propagate(t, 0x201a)
+
+	// call rax goes to 0 or 0x2030 depending on edi
+	if targets := c.Targets[0x2026]; len(targets) != 0 {
+		t.Errorf("targets of call rax %x", targets)
+	}
+	eax := find(t, c.Function, 0x2023, gopcode.CPUI_COPY)
+	if v, ok := c.Value(eax.Output); !ok || v.Value != 0x2030 {
+		t.Errorf("moved %v %v", v, ok)
+	}
+}
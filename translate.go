@@ -14,12 +14,9 @@ var varNodePool = sync.Pool{
 	New: func() interface{} { return &VarNode{} },
 }
 
-var addrSpacePool = sync.Pool{
-	New: func() interface{} { return &AddrSpace{} },
-}
-
-// sync.Map for caching AddrSpace instances by *C.char name
-var addrSpaceCache = sync.Map{}
+// nativeSpaces maps the native spaces of the live contexts to their cached
+// AddrSpace, for VarNode.GetSpaceFromConst which has no context.
+var nativeSpaces sync.Map
 
 type PcodeOp struct {
 	Output *VarNode
@@ -29,62 +26,217 @@ type PcodeOp struct {
 
 type PcodeTranslation struct {
 	_formatter prettyPrinter
-	_trans     *C.PcodeTranslationC
+	_trans     []*C.PcodeTranslationC
 	Ops        []PcodeOp
 }
 
-// getOrCreateAddrSpace retrieves an AddrSpace from cache or creates a new one if it doesn't exist
-func getOrCreateAddrSpace(space *C.AddrSpaceC) *AddrSpace {
-	// Use the space name pointer as the unique key for caching
-	namePtr := space.name
-
-	// Try to load AddrSpace from the cache
-	if cached, ok := addrSpaceCache.Load(namePtr); ok {
-		return cached.(*AddrSpace)
+// getOrCreateAddrSpace retrieves an AddrSpace from the context cache or creates a new one if it doesn't exist
+func (c *Context) getOrCreateAddrSpace(space *C.AddrSpaceC) *AddrSpace {
+	// The native space pointer is stable for the lifetime of the context,
+	// unlike the name which is allocated for every varnode
+	if cached, ok := c._spaces[space.n_space]; ok {
+		return cached
 	}
 
-	// If not found in cache, get a new AddrSpace from the pool
-	addrSpace := addrSpacePool.Get().(*AddrSpace)
-
-	// Initialize the AddrSpace fields only once for this unique name
-	addrSpace.Name = C.GoString(namePtr)
-	addrSpace.Index = uint32(space.index)
-	addrSpace.AddressSize = uint32(space.address_size)
-	addrSpace.WordSize = uint32(space.word_size)
-	addrSpace.Flags = AddrSpaceFlags(space.flags)
-	addrSpace.Highest = uint64(space.highest)
-	addrSpace.PointerLowerBound = uint64(space.pointer_lower_bound)
-	addrSpace.PointerUpperBound = uint64(space.pointer_upper_bound)
-	addrSpace.NativeAddrSpacePtr = space.n_space
+	addrSpace := &AddrSpace{
+		Name:               C.GoString(space.name),
+		Index:              uint32(space.index),
+		AddressSize:        uint32(space.address_size),
+		WordSize:           uint32(space.word_size),
+		Highest:            uint64(space.highest),
+		PointerLowerBound:  uint64(space.pointer_lower_bound),
+		PointerUpperBound:  uint64(space.pointer_upper_bound),
+		NativeAddrSpacePtr: space.n_space,
+	}
+	addrSpace.Flags = c.spaceFlags(AddrSpaceFlags(space.flags), addrSpace.Name)
 
 	// Store in cache for future reuse
-	addrSpaceCache.Store(namePtr, addrSpace)
+	c._spaces[space.n_space] = addrSpace
+	nativeSpaces.Store(uintptr(unsafe.Pointer(space.n_space)), addrSpace)
 
 	return addrSpace
 }
 
-func (p *PcodeTranslation) Destroy() {
-	for _, op := range p.Ops {
+// spaceFlags cleans up the flags of a native space. The native library does
+// not clear the space info it allocates before setting the flags, so stray bits
+// may be set: the unknown ones are dropped and the byte order is taken from the
+// language.
+func (c *Context) spaceFlags(flags AddrSpaceFlags, name string) AddrSpaceFlags {
+	flags &= HasNearPointers<<1 - 1
+	flags &^= BigEndian
+	if name != "const" && c._lang != nil && c._lang.IsBigEndian() {
+		flags |= BigEndian
+	}
+	return flags
+}
+
+// releaseSpaces forgets the spaces of the context before it is destroyed.
+func (c *Context) releaseSpaces() {
+	for n := range c._spaces {
+		nativeSpaces.Delete(uintptr(unsafe.Pointer(n)))
+	}
+}
+
+// DefaultCodeSpace returns the space instructions are fetched from, which is
+// the space of the IMARK ops. It is found by translating a run of zero bytes,
+// which most languages decode, and is a ram space otherwise, e.g. for eBPF.
+func (c *Context) DefaultCodeSpace() *AddrSpace {
+	trans, err := c.Translate(make([]byte, 16), 0, 1, 0)
+	if trans != nil {
+		defer trans.Destroy()
+	}
+	if err == nil && len(trans.Ops) != 0 && trans.Ops[0].Opcode == CPUI_IMARK {
+		return trans.Ops[0].Inputs[0].Space
+	}
+	return &AddrSpace{Name: "ram", Flags: c.spaceFlags(0, "ram")}
+}
+
+func releaseOps(ops []PcodeOp) {
+	for _, op := range ops {
 		if op.Output != nil {
-			addrSpacePool.Put(op.Output.Space) // Return AddrSpace to pool
-			varNodePool.Put(op.Output)         // Return VarNode to pool
+			varNodePool.Put(op.Output) // Return VarNode to pool
 		}
 		for _, input := range op.Inputs {
-			addrSpacePool.Put(input.Space) // Return AddrSpace to pool
-			varNodePool.Put(input)         // Return VarNode to pool
+			varNodePool.Put(input) // Return VarNode to pool
 		}
 	}
+}
+
+func (p *PcodeTranslation) Destroy() {
+	releaseOps(p.Ops)
 	p.Ops = nil // Clear Ops slice
 
-	C.pcode_translation_free(p._trans) // Free C-side resources if applicable
+	for _, trans := range p._trans {
+		C.pcode_translation_free(trans) // Free C-side resources if applicable
+	}
+	p._trans = nil
 }
 
 func (p *PcodeTranslation) Format(pco PcodeOp) string {
 	return p._formatter.formatPcodeOp(pco)
 }
 
-// PcodeContext *ctx, const char *bytes, unsigned int num_bytes, uint64_t base_address, unsigned int max_instructions, uint32_t flags)
+// instructionEnd returns the address following the instruction an IMARK op
+// marks. Instructions in delay slots are covered by the same IMARK.
+func instructionEnd(imark PcodeOp) uint64 {
+	var end uint64
+	for _, in := range imark.Inputs {
+		if e := in.Offset + uint64(in.Size); e > end {
+			end = e
+		}
+	}
+	return end
+}
+
 func pcode_translate(ctx *Context, dat []byte, baseAddress uint64, maxInstructions uint32, flags TranslateFlags) (*PcodeTranslation, error) {
+	if !ctx.hasContextRanges() {
+		return pcode_translate_checked(ctx, dat, baseAddress, maxInstructions, flags, baseAddress+uint64(len(dat)))
+	}
+
+	result := &PcodeTranslation{_formatter: ctx.formatter()}
+
+	err := ctx.walkContextSegments(baseAddress, len(dat), maxInstructions, func(addr, segEnd uint64, max uint32) (uint64, uint32, bool, error) {
+		trans, err := pcode_translate_checked(ctx, segmentBytes(dat, baseAddress, addr, segEnd), addr, max, flags, segEnd)
+		if trans == nil {
+			return 0, 0, true, err
+		}
+		result._trans = append(result._trans, trans._trans...)
+
+		// keep the instructions starting inside the segment
+		next, count, kept := addr, uint32(0), len(trans.Ops)
+		for i, op := range trans.Ops {
+			if op.Opcode == CPUI_IMARK {
+				if op.Inputs[0].Offset >= segEnd {
+					kept = i
+					break
+				}
+				next = instructionEnd(op)
+				count++
+			}
+		}
+
+		result.Ops = append(result.Ops, trans.Ops[:kept]...)
+		releaseOps(trans.Ops[kept:])
+
+		// the translation stopped on its own before reaching the next segment
+		return next, count, err != nil || kept == len(trans.Ops), err
+	})
+	if err != nil {
+		if _, ok := err.(*DecodeError); ok {
+			return result, err
+		}
+		result.Destroy()
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// pcode_translate_checked translates dat and reports a *DecodeError, along
+// with the ops decoded so far, when the translation stops before limit for
+// another reason than maxInstructions or BbTerminating. The native decoder
+// stops silently on undecodable bytes and reads zeros past the end of the
+// input, so both cases are detected here.
+func pcode_translate_checked(ctx *Context, dat []byte, baseAddress uint64, maxInstructions uint32, flags TranslateFlags, limit uint64) (*PcodeTranslation, error) {
+	if len(dat) == 0 {
+		return &PcodeTranslation{_formatter: ctx.formatter()}, newDecodeError(dat, baseAddress, DecodeTruncated)
+	}
+
+	trans, err := pcode_translate_segment(ctx, dat, baseAddress, maxInstructions, flags)
+	if err != nil {
+		return &PcodeTranslation{_formatter: ctx.formatter()}, ctx.translateError(dat, baseAddress)
+	}
+
+	end := baseAddress + uint64(len(dat))
+	next, count, last := baseAddress, uint32(0), 0
+	for i, op := range trans.Ops {
+		if op.Opcode == CPUI_IMARK {
+			next = instructionEnd(op)
+			count++
+			last = i
+		}
+	}
+
+	if next > end {
+		start := trans.Ops[last].Inputs[0].Offset
+		releaseOps(trans.Ops[last:])
+		trans.Ops = trans.Ops[:last]
+		if start >= limit {
+			// the caller only decodes up to limit
+			return trans, nil
+		}
+		return trans, newDecodeError(dat[start-baseAddress:], start, DecodeTruncated)
+	}
+
+	if next >= limit || (maxInstructions != 0 && count >= maxInstructions) {
+		return trans, nil
+	}
+
+	if flags&BbTerminating != 0 && count != 0 && endsBlock(trans.Ops[last:]) {
+		return trans, nil
+	}
+
+	return trans, ctx.translateError(dat[next-baseAddress:], next)
+}
+
+// commitContext translates dat without keeping the result, for the context
+// changes the instructions make (SLEIGH globalset). The native library only
+// applies them while translating, so disassembling alone would decode e.g. the
+// target of an ARM blx as ARM code rather than Thumb.
+func commitContext(ctx *Context, dat []byte, baseAddress uint64, maxInstructions uint32) {
+	if !ctx.commitsContext() {
+		return
+	}
+
+	data := unsafe.Pointer(&dat[0])
+	trans := C.pcode_translate(ctx._ctx, (*C.char)(data), C.uint(len(dat)), C.ulonglong(baseAddress), C.uint(maxInstructions), 0)
+	if trans != nil {
+		C.pcode_translation_free(trans)
+	}
+}
+
+// PcodeContext *ctx, const char *bytes, unsigned int num_bytes, uint64_t base_address, unsigned int max_instructions, uint32_t flags)
+func pcode_translate_segment(ctx *Context, dat []byte, baseAddress uint64, maxInstructions uint32, flags TranslateFlags) (*PcodeTranslation, error) {
 	data := unsafe.Pointer(&dat[0])
 	var trans *C.PcodeTranslationC = C.pcode_translate(ctx._ctx, (*C.char)(data), C.uint(len(dat)), C.ulonglong(baseAddress), C.uint(maxInstructions), C.uint(flags))
 
@@ -93,8 +245,8 @@ func pcode_translate(ctx *Context, dat []byte, baseAddress uint64, maxInstructio
 	}
 
 	pcodetrans := &PcodeTranslation{
-		_formatter: DefaultPcodeFormatter,
-		_trans:     trans,
+		_formatter: ctx.formatter(),
+		_trans:     []*C.PcodeTranslationC{trans},
 		Ops:        make([]PcodeOp, 0, int(trans.num_ops)), // Pre-allocate Ops slice based on num_ops
 	}
 
@@ -112,7 +264,7 @@ func pcode_translate(ctx *Context, dat []byte, baseAddress uint64, maxInstructio
 			varNode := varNodePool.Get().(*VarNode)
 
 			// Retrieve AddrSpace from cache or create a new one
-			varNode.Space = getOrCreateAddrSpace(op.output.space)
+			varNode.Space = ctx.getOrCreateAddrSpace(op.output.space)
 			varNode.Offset = uint64(op.output.offset)
 			varNode.Size = int32(op.output.size)
 			pcodeop.Output = varNode
@@ -125,7 +277,7 @@ func pcode_translate(ctx *Context, dat []byte, baseAddress uint64, maxInstructio
 			inputNode := varNodePool.Get().(*VarNode)
 
 			// Retrieve AddrSpace from cache or create a new one
-			inputNode.Space = getOrCreateAddrSpace(inp.space)
+			inputNode.Space = ctx.getOrCreateAddrSpace(inp.space)
 			inputNode.Offset = uint64(inp.offset)
 			inputNode.Size = int32(inp.size)
 			pcodeop.Inputs = append(pcodeop.Inputs, inputNode)